@@ -9,7 +9,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"os"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -48,6 +51,73 @@ const (
 
 var LoadBalancingStrategies = []string{LOAD_BALANCE_RR, LOAD_BALANCE_LC}
 
+// Formats the config can be written for the driver in
+const (
+	JSONOutput string = "json"
+	YAMLOutput string = "yaml"
+)
+
+// What happens to a route whose path is deeper than max_path_depth
+const (
+	RejectDeepPath   string = "reject"
+	TruncateDeepPath string = "truncate"
+)
+
+// What happens to a route with a path but no host
+const (
+	RejectPathOnly   string = "reject"
+	CatchAllPathOnly string = "catch-all"
+)
+
+// What happens to the pool and rules of a route whose virtual is removed
+const (
+	WarnVirtualRemoval    string = "warn"
+	CascadeVirtualRemoval string = "cascade"
+)
+
+// How the policy rules match the path of a route
+const (
+	SegmentPathMatch string = "segment"
+	PrefixPathMatch  string = "prefix"
+	ExactPathMatch   string = "exact"
+)
+
+// Where the monitor definitions of the plans are written
+const (
+	ReferencedMonitors string = "referenced"
+	InlineMonitors     string = "inline"
+)
+
+// What happens to an endpoint registered without a port
+const (
+	RejectPortless      string = "reject"
+	DefaultPortPortless string = "default-port"
+)
+
+// The address family of the pool members, members of the other family are
+// dropped
+const (
+	AnyAddressFamily  string = "any"
+	IPv4AddressFamily string = "ipv4"
+	IPv6AddressFamily string = "ipv6"
+)
+
+// The auto last hop of the frontend virtuals, DefaultAutoLastHop leaves it to
+// the BIG-IP's global setting
+const (
+	DefaultAutoLastHop  string = "default"
+	EnabledAutoLastHop  string = "enabled"
+	DisabledAutoLastHop string = "disabled"
+)
+
+// What happens to a member registered for foo.cf.com when it registers for
+// *.foo.cf.com, or the other way around. KeepWildcardFlips keeps it in both
+// routes, ReplaceWildcardFlips removes it from the route it was in before
+const (
+	KeepWildcardFlips    string = "keep"
+	ReplaceWildcardFlips string = "replace"
+)
+
 // ServiceBrokerConfig configuration parameters
 type ServiceBrokerConfig struct {
 	ID               string
@@ -85,19 +155,101 @@ var DefaultTier2IPRange = "172.0.0.0/24"
 
 // BigIPConfig configuration parameters for bigip integration
 type BigIPConfig struct {
-	URL               string   `yaml:"url" json:"url"`
-	User              string   `yaml:"user" json:"username"`
-	Pass              string   `yaml:"pass" json:"password"`
-	Partitions        []string `yaml:"partition" json:"partitions"`
-	LoadBalancingMode string   `yaml:"load_balancing_mode" json:"-"`
-	VerifyInterval    int      `yaml:"verify_interval" json:"-"`
-	ExternalAddr      string   `yaml:"external_addr" json:"-"`
-	SSLProfiles       []string `yaml:"ssl_profiles" json:"-"`
-	Policies          []string `yaml:"policies" json:"-"`
-	Profiles          []string `yaml:"profiles" json:"-"`
-	HealthMonitors    []string `yaml:"health_monitors" json:"-"`
-	DriverCmd         string   `yaml:"driver_path" json:"-"`
-	Tier2IPRange      string   `yaml:"tier2_ip_range" json:"-"`
+	URL                   string   `yaml:"url" json:"url"`
+	User                  string   `yaml:"user" json:"username"`
+	Pass                  string   `yaml:"pass" json:"password"`
+	Partitions            []string `yaml:"partition" json:"partitions"`
+	LoadBalancingMode     string   `yaml:"load_balancing_mode" json:"-"`
+	VerifyInterval        int      `yaml:"verify_interval" json:"-"`
+	ExternalAddr          string   `yaml:"external_addr" json:"-"`
+	HTTPExternalAddr      string   `yaml:"http_external_addr" json:"-"`
+	HTTPSExternalAddr     string   `yaml:"https_external_addr" json:"-"`
+	SSLProfiles           []string `yaml:"ssl_profiles" json:"-"`
+	Policies              []string `yaml:"policies" json:"-"`
+	Profiles              []string `yaml:"profiles" json:"-"`
+	HTTPProfiles          []string `yaml:"http_profiles" json:"-"`
+	HTTPSProfiles         []string `yaml:"https_profiles" json:"-"`
+	HealthMonitors        []string `yaml:"health_monitors" json:"-"`
+	DriverCmd             string   `yaml:"driver_path" json:"-"`
+	Tier2IPRange          string   `yaml:"tier2_ip_range" json:"-"`
+	PoolGracePeriod       int      `yaml:"pool_grace_period" json:"-"`
+	SplitRoutingPolicies  bool     `yaml:"split_routing_policies" json:"-"`
+	RateLimit             int      `yaml:"rate_limit" json:"-"`
+	ClientCertHeaders     bool     `yaml:"client_cert_headers" json:"-"`
+	DrainPeriod           int      `yaml:"drain_period" json:"-"`
+	FailOnUnhealthyWriter bool     `yaml:"fail_on_unhealthy_writer" json:"-"`
+	SSLOnHTTPVirtual      bool     `yaml:"ssl_on_http_virtual" json:"-"`
+	RedirectTrailingSlash bool     `yaml:"redirect_trailing_slash" json:"-"`
+	MaxWriteFailures      int      `yaml:"max_write_failures" json:"-"`
+	TrafficGroup          string   `yaml:"traffic_group" json:"-"`
+	InstanceID            string   `yaml:"instance_id" json:"-"`
+	LeaderElection        bool     `yaml:"leader_election" json:"-"`
+	LeaderLockFile        string   `yaml:"leader_lock_file" json:"-"`
+	LeaderCheckInterval   int      `yaml:"leader_check_interval" json:"-"`
+	OutputFormat          string   `yaml:"output_format" json:"-"`
+	DoSProfile            string   `yaml:"dos_profile" json:"-"`
+	AnalyticsProfile      string   `yaml:"analytics_profile" json:"-"`
+	OneConnectProfile     string   `yaml:"oneconnect_profile" json:"-"`
+	MaxStaleness          int      `yaml:"max_staleness" json:"-"`
+	Namespace             string   `yaml:"namespace" json:"-"`
+	HSTS                  bool     `yaml:"hsts" json:"-"`
+	HSTSMaxAge            int      `yaml:"hsts_max_age" json:"-"`
+	RuleLogging           bool     `yaml:"rule_logging" json:"-"`
+	RuleLogFacility       string   `yaml:"rule_log_facility" json:"-"`
+	HealthPort            int      `yaml:"health_port" json:"-"`
+	ReadyOnHealthyWriter  bool     `yaml:"ready_on_healthy_writer" json:"-"`
+	DisableWildcards      bool     `yaml:"disable_wildcards" json:"-"`
+	MaxPathDepth          int      `yaml:"max_path_depth" json:"-"`
+	DeepPathAction        string   `yaml:"deep_path_action" json:"-"`
+	ConfigCopies          []string `yaml:"config_copies" json:"-"`
+	VLANs                 []string `yaml:"vlans" json:"-"`
+	HTTPVLANs             []string `yaml:"http_vlans" json:"-"`
+	HTTPSVLANs            []string `yaml:"https_vlans" json:"-"`
+	AllDownPool           string   `yaml:"all_down_pool" json:"-"`
+	AllDownStatus         int      `yaml:"all_down_status" json:"-"`
+	InsertXFF             bool     `yaml:"insert_xff" json:"-"`
+	PrettyPrint           bool     `yaml:"pretty_print" json:"-"`
+	CaseInsensitivePaths  bool     `yaml:"case_insensitive_paths" json:"-"`
+	FQDNMembers           bool     `yaml:"fqdn_members" json:"-"`
+	FQDNInterval          int      `yaml:"fqdn_interval" json:"-"`
+	SlowItemWarning       int      `yaml:"slow_item_warning" json:"-"`
+	MinActiveMembers      int      `yaml:"min_active_members" json:"-"`
+	PathOnlyRoutes        string   `yaml:"path_only_routes" json:"-"`
+	DefaultMemberPort     int      `yaml:"default_member_port" json:"-"`
+	ConnectionMirroring   bool     `yaml:"connection_mirroring" json:"-"`
+	// VirtualModes overrides the ip protocol of a type of virtual, the keys
+	// are http, https, tier2, dedicated and tcp
+	VirtualModes        map[string]string `yaml:"virtual_modes" json:"-"`
+	VirtualRemoval      string            `yaml:"virtual_removal" json:"-"`
+	ReadableRuleNames   bool              `yaml:"readable_rule_names" json:"-"`
+	RouteHeader         string            `yaml:"route_header" json:"-"`
+	PathMatch           string            `yaml:"path_match" json:"-"`
+	MaxHostnameLength   int               `yaml:"max_hostname_length" json:"-"`
+	MonitorMode         string            `yaml:"monitor_mode" json:"-"`
+	MaxItemRetries      int               `yaml:"max_item_retries" json:"-"`
+	PortlessMembers     string            `yaml:"portless_members" json:"-"`
+	PortlessMemberPort  int               `yaml:"portless_member_port" json:"-"`
+	MemberAddressFamily string            `yaml:"member_address_family" json:"-"`
+	SnapshotFile        string            `yaml:"snapshot_file" json:"-"`
+	SnapshotGracePeriod int               `yaml:"snapshot_grace_period" json:"-"`
+	VirtualAddressRef   string            `yaml:"virtual_address_ref" json:"-"`
+	MaxPolicyRules      int               `yaml:"max_policy_rules" json:"-"`
+	MemberTTL           int               `yaml:"member_ttl" json:"-"`
+	PolicyStrategy      string            `yaml:"policy_strategy" json:"-"`
+	PolicyControls      []string          `yaml:"policy_controls" json:"-"`
+	PolicyRequires      []string          `yaml:"policy_requires" json:"-"`
+	AutoLastHop         string            `yaml:"auto_last_hop" json:"-"`
+	WildcardFlips       string            `yaml:"wildcard_flips" json:"-"`
+	CleanupOnShutdown   bool              `yaml:"cleanup_on_shutdown" json:"-"`
+	CleanupWait         int               `yaml:"cleanup_wait" json:"-"`
+	RequestTimeout      int               `yaml:"request_timeout" json:"-"`
+	ResponseTimeout     int               `yaml:"response_timeout" json:"-"`
+	// PassthroughPort is the port of the virtual routing TLS connections by
+	// their SNI server name without decrypting them, 0 leaves it out
+	PassthroughPort int `yaml:"passthrough_port" json:"-"`
+	// PartitionSSLProfiles replaces ssl_profiles for the HTTPS virtual of a
+	// partition
+	PartitionSSLProfiles map[string][]string `yaml:"partition_ssl_profiles" json:"-"`
 }
 
 var defaultBigIPConfig = BigIPConfig{
@@ -113,6 +265,22 @@ var defaultBigIPConfig = BigIPConfig{
 	Profiles:          []string{},
 	DriverCmd:         "",
 	Tier2IPRange:      DefaultTier2IPRange,
+	OutputFormat:      JSONOutput,
+	HSTSMaxAge:        31536000,
+	RuleLogFacility:   "local0",
+	DeepPathAction:    RejectDeepPath,
+	PathOnlyRoutes:    RejectPathOnly,
+	VirtualRemoval:    WarnVirtualRemoval,
+	PathMatch:         SegmentPathMatch,
+	MaxHostnameLength: 253,
+	MonitorMode:       ReferencedMonitors,
+	PortlessMembers:   RejectPortless,
+
+	LeaderCheckInterval: 5,
+	MemberAddressFamily: AnyAddressFamily,
+	AutoLastHop:         DefaultAutoLastHop,
+	WildcardFlips:       KeepWildcardFlips,
+	CleanupWait:         10,
 }
 
 var defaultStatusConfig = StatusConfig{
@@ -453,6 +621,104 @@ func (c *Config) Initialize(configYAML []byte) error {
 	return yaml.Unmarshal(configYAML, &c)
 }
 
+// BigIPEnvPrefix starts the name of the environment variables overriding the
+// bigip section, the rest is the upper cased YAML key: BIGIP_EXTERNAL_ADDR
+// overrides external_addr
+const BigIPEnvPrefix = "BIGIP_"
+
+// ApplyBigIPEnv overrides the bigip section with the environment variables
+// lookup finds, an override takes precedence over the config file. Lists are
+// comma separated and maps are comma separated key=value pairs, a map of lists
+// takes the values following a key=value pair as more values of the key
+func (c *Config) ApplyBigIPEnv(lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(&c.BigIP).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if "" == key || "-" == key {
+			continue
+		}
+		name := BigIPEnvPrefix + strings.ToUpper(key)
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		err := setFromEnv(v.Field(i), strings.TrimSpace(value))
+		if nil != err {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setFromEnv(field reflect.Value, value string) error {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); "" != item {
+			items = append(items, item)
+		}
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if nil != err {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if nil != err {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if reflect.String != field.Type().Elem().Kind() {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		field.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		if reflect.String != field.Type().Key().Kind() {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		switch elem := field.Type().Elem(); {
+		case reflect.String == elem.Kind():
+			m := make(map[string]string)
+			for _, item := range items {
+				kv := strings.SplitN(item, "=", 2)
+				if 2 != len(kv) {
+					return fmt.Errorf("%q is not key=value", item)
+				}
+				m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+			field.Set(reflect.ValueOf(m))
+		case reflect.Slice == elem.Kind() && reflect.String == elem.Elem().Kind():
+			// the items without a key add to the list of the key before
+			// them, e.g. cf=/Common/a,/Common/b,other=/Common/c
+			m := make(map[string][]string)
+			key := ""
+			for _, item := range items {
+				kv := strings.SplitN(item, "=", 2)
+				if 2 == len(kv) {
+					key = strings.TrimSpace(kv[0])
+					item = strings.TrimSpace(kv[1])
+				} else if "" == key {
+					return fmt.Errorf("%q is not key=value", item)
+				}
+				m[key] = append(m[key], item)
+			}
+			field.Set(reflect.ValueOf(m))
+		default:
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
 func InitConfigFromFile(path string) *Config {
 	var c *Config = DefaultConfig()
 	var e error
@@ -467,6 +733,11 @@ func InitConfigFromFile(path string) *Config {
 		panic(e.Error())
 	}
 
+	e = c.ApplyBigIPEnv(os.LookupEnv)
+	if e != nil {
+		panic(e.Error())
+	}
+
 	c.Process()
 
 	return c
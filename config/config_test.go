@@ -6,6 +6,8 @@ package config_test
 
 import (
 	"crypto/tls"
+	"reflect"
+	"strings"
 	"time"
 
 	. "github.com/F5Networks/cf-bigip-ctlr/config"
@@ -120,6 +122,79 @@ nats:
 			Expect(config.Nats[0].Pass).To(Equal("pass"))
 		})
 
+		Context("bigip environment overrides", func() {
+			var env map[string]string
+			lookup := func(name string) (string, bool) {
+				value, ok := env[name]
+				return value, ok
+			}
+
+			It("overrides the bigip section from the environment", func() {
+				var b = []byte(`
+bigip:
+  external_addr: 10.0.0.1
+  load_balancing_mode: round-robin
+  ssl_profiles: [/Common/clientssl]
+  verify_interval: 30
+`)
+				Expect(config.Initialize(b)).To(Succeed())
+
+				env = map[string]string{
+					"BIGIP_EXTERNAL_ADDR":       "10.0.0.2",
+					"BIGIP_SSL_PROFILES":        "/Common/a, /Common/b,",
+					"BIGIP_LOAD_BALANCING_MODE": "least-connections-member",
+					"BIGIP_HSTS":                "true",
+					"BIGIP_VIRTUAL_MODES":       "tcp=udp",
+					"EXTERNAL_ADDR":             "10.0.0.3",
+				}
+				Expect(config.ApplyBigIPEnv(lookup)).To(Succeed())
+				Expect(config.BigIP.ExternalAddr).To(Equal("10.0.0.2"))
+				Expect(config.BigIP.SSLProfiles).To(Equal([]string{"/Common/a", "/Common/b"}))
+				Expect(config.BigIP.LoadBalancingMode).To(Equal("least-connections-member"))
+				Expect(config.BigIP.HSTS).To(BeTrue())
+				Expect(config.BigIP.VirtualModes).To(Equal(map[string]string{"tcp": "udp"}))
+				Expect(config.BigIP.VerifyInterval).To(Equal(30))
+			})
+
+			It("rejects overrides that don't parse", func() {
+				env = map[string]string{"BIGIP_VERIFY_INTERVAL": "often"}
+				Expect(config.ApplyBigIPEnv(lookup)).To(MatchError(
+					`invalid BIGIP_VERIFY_INTERVAL: strconv.Atoi: parsing "often": invalid syntax`))
+
+				env = map[string]string{"BIGIP_VIRTUAL_MODES": "tcp"}
+				Expect(config.ApplyBigIPEnv(lookup)).To(MatchError(
+					`invalid BIGIP_VIRTUAL_MODES: "tcp" is not key=value`))
+
+				env = map[string]string{"BIGIP_PARTITION_SSL_PROFILES": "/Common/a,cf=/Common/b"}
+				Expect(config.ApplyBigIPEnv(lookup)).To(MatchError(
+					`invalid BIGIP_PARTITION_SSL_PROFILES: "/Common/a" is not key=value`))
+			})
+
+			It("overrides every map field", func() {
+				env = map[string]string{}
+				t := reflect.TypeOf(config.BigIP)
+				for i := 0; i < t.NumField(); i++ {
+					if reflect.Map == t.Field(i).Type.Kind() {
+						key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+						env["BIGIP_"+strings.ToUpper(key)] = "cf=a"
+					}
+				}
+				Expect(env).To(HaveLen(2))
+				Expect(config.ApplyBigIPEnv(lookup)).To(Succeed())
+				Expect(config.BigIP.VirtualModes).To(Equal(map[string]string{"cf": "a"}))
+				Expect(config.BigIP.PartitionSSLProfiles).To(Equal(map[string][]string{"cf": {"a"}}))
+
+				env = map[string]string{
+					"BIGIP_PARTITION_SSL_PROFILES": "cf=/Common/a, /Common/b,other=/Common/c",
+				}
+				Expect(config.ApplyBigIPEnv(lookup)).To(Succeed())
+				Expect(config.BigIP.PartitionSSLProfiles).To(Equal(map[string][]string{
+					"cf":    {"/Common/a", "/Common/b"},
+					"other": {"/Common/c"},
+				}))
+			})
+		})
+
 		Context("Suspend Pruning option", func() {
 			It("sets default suspend_pruning_if_nats_unavailable", func() {
 				Expect(config.SuspendPruningIfNatsUnavailable).To(BeFalse())
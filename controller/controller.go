@@ -28,6 +28,7 @@ import (
 	"github.com/F5Networks/cf-bigip-ctlr/common"
 	"github.com/F5Networks/cf-bigip-ctlr/common/health"
 	"github.com/F5Networks/cf-bigip-ctlr/config"
+	"github.com/F5Networks/cf-bigip-ctlr/f5router"
 	"github.com/F5Networks/cf-bigip-ctlr/handlers"
 	"github.com/F5Networks/cf-bigip-ctlr/logger"
 	"github.com/F5Networks/cf-bigip-ctlr/registry"
@@ -57,6 +58,7 @@ func NewController(
 	r *registry.RouteRegistry,
 	routingTable *routingtable.RoutingTable,
 	v varz.Varz,
+	f5Router json.Marshaler,
 	brokerHandler http.Handler,
 ) (*Controller, error) {
 	var host string
@@ -92,6 +94,9 @@ func NewController(
 
 	var heartbeatOK int32
 	health := handlers.NewHealthcheck(&heartbeatOK, logger)
+	if hc, ok := f5Router.(f5router.HealthChecker); ok {
+		health = handlers.NewCheckedHealthcheck(&heartbeatOK, hc.Healthy, logger)
+	}
 	component := &common.VcapComponent{
 		Config: cfg,
 		Varz:   varz,
@@ -101,6 +106,9 @@ func NewController(
 		},
 		Logger: logger,
 	}
+	if nil != f5Router {
+		component.InfoRoutes["/f5router"] = f5Router
+	}
 
 	if err := component.Start(brokerHandler); err != nil {
 		return nil, err
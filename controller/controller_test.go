@@ -81,7 +81,7 @@ var _ = Describe("Controller", func() {
 		varz = vvarz.NewVarz(registry)
 
 		var err error
-		controller, err = NewController(logger, config, mbusClient, registry, routingTable, varz, handler)
+		controller, err = NewController(logger, config, mbusClient, registry, routingTable, varz, nil, handler)
 
 		Expect(err).ToNot(HaveOccurred())
 
@@ -0,0 +1,42 @@
+/*-
+ * Copyright (c) 2017,2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigipResources
+
+const (
+	// AllDownFallbackiRuleName on BIG-IP
+	AllDownFallbackiRuleName = "all-down-fallback"
+
+	// AllDownFallbackiRule sends requests for a tier2 virtual whose pool has
+	// no active members to the fallback pool or answers them with the fallback
+	// status, the route rules set the fallback. It runs ahead of the
+	// forward-to-vip iRule and clears target_vip so that one skips the request
+	AllDownFallbackiRule = `
+when HTTP_REQUEST {
+  if {[info exists target_vip] && [string length $target_vip] != 0} {
+    if { [catch { set active [active_members $target_vip] } ] || $active > 0 } {
+      return
+    }
+    if {[info exists all_down_pool] && [string length $all_down_pool] != 0} {
+      unset target_vip
+      pool $all_down_pool
+    } elseif {[info exists all_down_status] && [string length $all_down_status] != 0} {
+      unset target_vip
+      HTTP::respond $all_down_status
+    }
+  }
+}`
+)
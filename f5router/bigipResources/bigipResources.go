@@ -30,6 +30,7 @@ type (
 	GlobalConfig struct {
 		LogLevel       string `json:"log-level"`
 		VerifyInterval int    `json:"verify-interval"`
+		InstanceID     string `json:"instance-id,omitempty"`
 	}
 
 	// VirtualAddress is frontend bindaddr and port
@@ -56,12 +57,21 @@ type (
 
 	// Resources is what gets written to and dumped out for the python side
 	Resources struct {
-		Virtuals           []*Virtual           `json:"virtualServers,omitempty"`
-		Pools              []*Pool              `json:"pools,omitempty"`
-		Monitors           []*Monitor           `json:"monitors,omitempty"`
-		Policies           []*Policy            `json:"l7Policies,omitempty"`
-		IRules             []*IRule             `json:"iRules,omitempty"`
-		InternalDataGroups []*InternalDataGroup `json:"internalDataGroups,omitempty"`
+		Virtuals           []*Virtual              `json:"virtualServers,omitempty"`
+		Pools              []*Pool                 `json:"pools,omitempty"`
+		Monitors           []*Monitor              `json:"monitors,omitempty"`
+		Policies           []*Policy               `json:"l7Policies,omitempty"`
+		IRules             []*IRule                `json:"iRules,omitempty"`
+		InternalDataGroups []*InternalDataGroup    `json:"internalDataGroups,omitempty"`
+		VirtualAddresses   []*VirtualAddressConfig `json:"virtualAddresses,omitempty"`
+	}
+
+	// VirtualAddressConfig is the BIG-IP virtual address object behind a
+	// virtual's destination, the traffic group moves it between devices
+	VirtualAddressConfig struct {
+		Name         string `json:"name"`
+		Address      string `json:"address"`
+		TrafficGroup string `json:"trafficGroup,omitempty"`
 	}
 
 	// Virtual server frontend
@@ -76,6 +86,11 @@ type (
 		Profiles              []*ProfileRef         `json:"profiles,omitempty"`
 		IRules                []string              `json:"rules,omitempty"`
 		SourceAddrTranslation SourceAddrTranslation `json:"sourceAddressTranslation,omitempty"`
+		RateLimit             int                   `json:"rateLimit,omitempty"`
+		Vlans                 []string              `json:"vlans,omitempty"`
+		VlansEnabled          bool                  `json:"vlansEnabled,omitempty"`
+		Mirror                string                `json:"mirror,omitempty"`
+		AutoLastHop           string                `json:"autoLasthop,omitempty"`
 	}
 
 	// Pool Member
@@ -83,15 +98,31 @@ type (
 		Address string `json:"address"`
 		Port    uint16 `json:"port"`
 		Session string `json:"session,omitempty"`
+		Ratio   int    `json:"ratio,omitempty"`
+		FQDN    *FQDN  `json:"fqdn,omitempty"`
+		// Monitor overrides the monitors of the pool for the member
+		Monitor string `json:"monitor,omitempty"`
+	}
+
+	// FQDN has the BIG-IP resolve a member by name, creating an ephemeral
+	// member for each address the name resolves to
+	FQDN struct {
+		Name         string `json:"tmName"`
+		AutoPopulate string `json:"autopopulate"`
+		Interval     string `json:"interval,omitempty"`
 	}
 
 	// Pool backend
 	Pool struct {
-		Name         string   `json:"name"`
-		Balance      string   `json:"loadBalancingMode"`
-		Members      []Member `json:"members"`
-		MonitorNames []string `json:"monitors"`
-		Description  string   `json:"description"`
+		Name             string   `json:"name"`
+		Balance          string   `json:"loadBalancingMode"`
+		Members          []Member `json:"members"`
+		MonitorNames     []string `json:"monitors"`
+		Description      string   `json:"description"`
+		MinActiveMembers int      `json:"minActiveMembers,omitempty"`
+		// HealthMonitors holds the definitions of the pool's monitors when
+		// they are written inline instead of in the monitors section
+		HealthMonitors []*Monitor `json:"healthMonitors,omitempty"`
 	}
 
 	// backend health monitor
@@ -106,34 +137,63 @@ type (
 
 	// Action for a rule
 	Action struct {
-		Forward     bool   `json:"forward,omitempty"`
-		Name        string `json:"name"`
-		Pool        string `json:"pool,omitempty"`
-		Request     bool   `json:"request"`
-		Expression  string `json:"expression,omitempty"`
-		TmName      string `json:"tmName,omitempty"`
-		Tcl         bool   `json:"tcl,omitempty"`
-		SetVariable bool   `json:"setVariable,omitempty"`
+		Forward        bool   `json:"forward,omitempty"`
+		Name           string `json:"name"`
+		Pool           string `json:"pool,omitempty"`
+		Request        bool   `json:"request"`
+		Expression     string `json:"expression,omitempty"`
+		TmName         string `json:"tmName,omitempty"`
+		Tcl            bool   `json:"tcl,omitempty"`
+		SetVariable    bool   `json:"setVariable,omitempty"`
+		HTTPReply      bool   `json:"httpReply,omitempty"`
+		Redirect       bool   `json:"redirect,omitempty"`
+		Location       string `json:"location,omitempty"`
+		SSLClientHello bool   `json:"sslClientHello,omitempty"`
+		HTTPHeader     bool   `json:"httpHeader,omitempty"`
+		Insert         bool   `json:"insert,omitempty"`
+		Response       bool   `json:"response,omitempty"`
+		Value          string `json:"value,omitempty"`
+		Log            bool   `json:"log,omitempty"`
+		Write          bool   `json:"write,omitempty"`
+		Facility       string `json:"facility,omitempty"`
+		Message        string `json:"message,omitempty"`
 	}
 
 	// Condition for a rule
 	Condition struct {
-		Equals      bool     `json:"equals,omitempty"`
-		StartsWith  bool     `json:"startsWith,omitempty"`
-		EndsWith    bool     `json:"endsWith,omitempty"`
-		Host        bool     `json:"host,omitempty"`
-		HTTPHost    bool     `json:"httpHost,omitempty"`
-		HTTPURI     bool     `json:"httpUri,omitempty"`
-		PathSegment bool     `json:"pathSegment,omitempty"`
-		Name        string   `json:"name"`
-		Index       int      `json:"index"`
-		Request     bool     `json:"request"`
-		Values      []string `json:"values"`
+		Equals          bool     `json:"equals,omitempty"`
+		StartsWith      bool     `json:"startsWith,omitempty"`
+		EndsWith        bool     `json:"endsWith,omitempty"`
+		Contains        bool     `json:"contains,omitempty"`
+		Host            bool     `json:"host,omitempty"`
+		HTTPHost        bool     `json:"httpHost,omitempty"`
+		Port            bool     `json:"port,omitempty"`
+		HTTPURI         bool     `json:"httpUri,omitempty"`
+		HTTPHeader      bool     `json:"httpHeader,omitempty"`
+		HTTPCookie      bool     `json:"httpCookie,omitempty"`
+		TCP             bool     `json:"tcp,omitempty"`
+		Address         bool     `json:"address,omitempty"`
+		Matches         bool     `json:"matches,omitempty"`
+		TmName          string   `json:"tmName,omitempty"`
+		PathSegment     bool     `json:"pathSegment,omitempty"`
+		Path            bool     `json:"path,omitempty"`
+		SSLExtension    bool     `json:"sslExtension,omitempty"`
+		ServerName      bool     `json:"serverName,omitempty"`
+		SSLClientHello  bool     `json:"sslClientHello,omitempty"`
+		CaseSensitive   bool     `json:"caseSensitive,omitempty"`
+		CaseInsensitive bool     `json:"caseInsensitive,omitempty"`
+		Negate          bool     `json:"not,omitempty"`
+		Name            string   `json:"name"`
+		Index           int      `json:"index"`
+		Request         bool     `json:"request"`
+		Values          []string `json:"values"`
 	}
 
 	// Rule builds up a Policy
 	Rule struct {
 		FullURI     string       `json:"-"`
+		Priority    int          `json:"-"`
+		Pool        string       `json:"-"`
 		Actions     []*Action    `json:"actions"`
 		Conditions  []*Condition `json:"conditions"`
 		Name        string       `json:"name"`
@@ -0,0 +1,36 @@
+/*-
+ * Copyright (c) 2017,2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigipResources
+
+const (
+	// ClientCertiRuleName on BIG-IP
+	ClientCertiRuleName = "client-cert-headers"
+
+	// ClientCertiRule inserts the client certificate subject and SAN headers,
+	// any values sent by the client are removed first
+	ClientCertiRule = `
+when HTTP_REQUEST {
+  HTTP::header remove X-Client-Cert-Subject
+  HTTP::header remove X-Client-Cert-SAN
+  if { [SSL::cert count] > 0 } {
+    HTTP::header insert X-Client-Cert-Subject [X509::subject [SSL::cert 0]]
+    if { [regexp {Subject Alternative Name:\s*([^\n]*)} [X509::extensions [SSL::cert 0]] -> san] } {
+      HTTP::header insert X-Client-Cert-SAN $san
+    }
+  }
+}`
+)
@@ -0,0 +1,79 @@
+/*-
+ * Copyright (c) 2017,2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigipResources
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RouteTimeoutsiRulePrefix starts the names of the iRules cutting off slow
+// routes, the name ends in the request and response timeouts in seconds
+const RouteTimeoutsiRulePrefix = "route-timeouts"
+
+// RouteTimeoutsiRuleName is the name of the iRule for the timeouts
+func RouteTimeoutsiRuleName(request, response int) string {
+	return fmt.Sprintf("%s-%d-%d", RouteTimeoutsiRulePrefix, request, response)
+}
+
+// ParseRouteTimeoutsiRuleName returns the timeouts of a route timeouts iRule
+// name, false for the names of other iRules
+func ParseRouteTimeoutsiRuleName(name string) (request int, response int, ok bool) {
+	if !strings.HasPrefix(name, RouteTimeoutsiRulePrefix+"-") {
+		return 0, 0, false
+	}
+	n, _ := fmt.Sscanf(name, RouteTimeoutsiRulePrefix+"-%d-%d", &request, &response)
+	if 2 != n || request < 0 || response < 0 || name != RouteTimeoutsiRuleName(request, response) {
+		return 0, 0, false
+	}
+	return request, response, true
+}
+
+// RouteTimeoutsiRule resets the connection of a request without a response
+// within the request timeout of arriving or the response timeout of being
+// sent to the app, a timeout of 0 is off
+func RouteTimeoutsiRule(request, response int) string {
+	var code []string
+	if request > 0 {
+		code = append(code, fmt.Sprintf(`
+when HTTP_REQUEST {
+  if {[info exists request_timer]} {
+    after cancel $request_timer
+  }
+  set request_timer [after %d { reject }]
+}`, request*1000))
+	}
+	if response > 0 {
+		code = append(code, fmt.Sprintf(`
+when HTTP_REQUEST_SEND {
+  if {[info exists response_timer]} {
+    after cancel $response_timer
+  }
+  set response_timer [after %d { reject }]
+}`, response*1000))
+	}
+	code = append(code, `
+when HTTP_RESPONSE {
+  foreach timer {request_timer response_timer} {
+    if {[info exists $timer]} {
+      after cancel [set $timer]
+      unset $timer
+    }
+  }
+}`)
+	return strings.Join(code, "")
+}
@@ -17,6 +17,7 @@
 package f5router
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -34,10 +35,17 @@ type Writer interface {
 	Write(input []byte) (n int, err error)
 }
 
+// HealthChecker is implemented by writers which can verify their target
+// without writing to it
+type HealthChecker interface {
+	Healthy() error
+}
+
 // ConfigWriter Writer instance to output configuration
 type ConfigWriter struct {
 	configFile string
 	logger     logger.Logger
+	tempDir    bool
 }
 
 // Without a File interface unit testing becomes difficult,
@@ -62,6 +70,7 @@ func NewConfigWriter(logger logger.Logger) (*ConfigWriter, error) {
 	cw := &ConfigWriter{
 		configFile: tmpfn,
 		logger:     logger,
+		tempDir:    true,
 	}
 
 	logger.Info("f5router-configwriter-started",
@@ -70,9 +79,26 @@ func NewConfigWriter(logger logger.Logger) (*ConfigWriter, error) {
 	return cw, nil
 }
 
+// NewFileConfigWriter creates a config writer for a file the caller chose,
+// the file is left in place when the writer is closed
+func NewFileConfigWriter(logger logger.Logger, path string) *ConfigWriter {
+	cw := &ConfigWriter{
+		configFile: path,
+		logger:     logger,
+	}
+
+	logger.Info("f5router-configwriter-started",
+		zap.String("configwriter", fmt.Sprintf("%p", cw)),
+		zap.String("file", path))
+
+	return cw
+}
+
 // Close close file and delete temp file
 func (cw *ConfigWriter) Close() {
-	os.RemoveAll(filepath.Dir(cw.configFile))
+	if cw.tempDir {
+		os.RemoveAll(filepath.Dir(cw.configFile))
+	}
 
 	cw.logger.Info("f5router-configwriter-file-closed")
 }
@@ -82,6 +108,23 @@ func (cw *ConfigWriter) GetOutputFilename() string {
 	return cw.configFile
 }
 
+// Healthy verifies the config file can be opened for writing, the contents
+// of the file are left untouched
+func (cw *ConfigWriter) Healthy() error {
+	f, err := os.OpenFile(cw.configFile, os.O_WRONLY, 0644)
+	if os.IsNotExist(err) {
+		// nothing has been written yet so make sure the directory takes files
+		f, err = ioutil.TempFile(filepath.Dir(cw.configFile), "healthcheck")
+		if nil == err {
+			defer os.Remove(f.Name())
+		}
+	}
+	if nil != err {
+		return fmt.Errorf("config writer target not writable: %v", err)
+	}
+	return f.Close()
+}
+
 // Write creates file lock and outputs byte slice
 func (cw *ConfigWriter) Write(input []byte) (n int, err error) {
 	f, err := os.OpenFile(cw.configFile, os.O_WRONLY|os.O_CREATE, 0644)
@@ -137,3 +180,54 @@ func (cw *ConfigWriter) _write(
 
 	return n, err
 }
+
+// MultiWriter writes the config to several writers. The first writer is the
+// one the driver reads, the others get a best effort copy so a failed copy is
+// logged but never fails the write
+type MultiWriter struct {
+	logger  logger.Logger
+	primary Writer
+	copies  []Writer
+}
+
+// NewMultiWriter creates a MultiWriter copying what is written to primary to
+// each of the copies
+func NewMultiWriter(logger logger.Logger, primary Writer, copies ...Writer) *MultiWriter {
+	return &MultiWriter{
+		logger:  logger,
+		primary: primary,
+		copies:  copies,
+	}
+}
+
+// GetOutputFilename returns the file of the primary writer
+func (mw *MultiWriter) GetOutputFilename() string {
+	return mw.primary.GetOutputFilename()
+}
+
+// Healthy checks the primary writer, copies are not needed by the driver
+func (mw *MultiWriter) Healthy() error {
+	if hc, ok := mw.primary.(HealthChecker); ok {
+		return hc.Healthy()
+	}
+	return nil
+}
+
+// Write outputs the input to every writer, the result is the primary's
+func (mw *MultiWriter) Write(input []byte) (n int, err error) {
+	n, err = mw.primary.Write(input)
+
+	for _, w := range mw.copies {
+		cn, cerr := w.Write(input)
+		if nil == cerr && len(input) != cn {
+			cerr = errors.New("short write")
+		}
+		if nil != cerr {
+			mw.logger.Warn("f5router-config-copy-failed",
+				zap.String("file", w.GetOutputFilename()),
+				zap.Error(cerr),
+			)
+		}
+	}
+	return n, err
+}
@@ -27,6 +27,7 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 var _ = Describe("Configwriter", func() {
@@ -66,6 +67,20 @@ var _ = Describe("Configwriter", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 
+		It("should report a writable target as healthy", func() {
+			Expect(cw.Healthy()).To(Succeed())
+
+			_, err = cw.Write([]byte("{}"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cw.Healthy()).To(Succeed())
+			written, err := ioutil.ReadFile(cw.GetOutputFilename())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(written).To(Equal([]byte("{}")))
+
+			os.RemoveAll(filepath.Dir(cw.GetOutputFilename()))
+			Expect(cw.Healthy()).To(MatchError(HavePrefix("config writer target not writable")))
+		})
+
 		It("should write a simple config", func() {
 			var d []byte
 			var e []byte
@@ -288,6 +303,76 @@ var _ = Describe("Configwriter", func() {
 			})
 		})
 	})
+	Describe("MultiWriter", func() {
+		var (
+			logger  *test_util.TestZapLogger
+			primary *ConfigWriter
+			dir     string
+		)
+
+		BeforeEach(func() {
+			var err error
+			logger = test_util.NewTestZapLogger("multiwriter-test")
+			primary, err = NewConfigWriter(logger)
+			Expect(err).NotTo(HaveOccurred())
+			dir, err = ioutil.TempDir("", "multiwriter")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			primary.Close()
+			os.RemoveAll(dir)
+			logger.Close()
+		})
+
+		It("should write the config to every writer", func() {
+			audit := NewFileConfigWriter(logger, filepath.Join(dir, "audit.json"))
+			mw := NewMultiWriter(logger, primary, audit)
+			Expect(mw.GetOutputFilename()).To(Equal(primary.GetOutputFilename()))
+
+			n, err := mw.Write([]byte("{}"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(2))
+			for _, f := range []string{primary.GetOutputFilename(), audit.GetOutputFilename()} {
+				written, err := ioutil.ReadFile(f)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(written).To(Equal([]byte("{}")))
+			}
+
+			// a file writer leaves the file it was given in place
+			audit.Close()
+			testFile(audit.GetOutputFilename(), true)
+		})
+
+		It("should not fail the write when a copy fails", func() {
+			broken := NewFileConfigWriter(logger, filepath.Join(dir, "missing", "audit.json"))
+			audit := NewFileConfigWriter(logger, filepath.Join(dir, "audit.json"))
+			mw := NewMultiWriter(logger, primary, broken, audit)
+
+			n, err := mw.Write([]byte("{}"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(2))
+			Expect(logger).To(gbytes.Say("f5router-config-copy-failed"))
+			written, err := ioutil.ReadFile(audit.GetOutputFilename())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(written).To(Equal([]byte("{}")))
+			Expect(mw.Healthy()).To(Succeed())
+		})
+
+		It("should fail when the primary fails", func() {
+			audit := NewFileConfigWriter(logger, filepath.Join(dir, "audit.json"))
+			mw := NewMultiWriter(logger, primary, audit)
+			os.RemoveAll(filepath.Dir(primary.GetOutputFilename()))
+
+			_, err := mw.Write([]byte("{}"))
+			Expect(err).To(HaveOccurred())
+			Expect(mw.Healthy()).To(MatchError(HavePrefix("config writer target not writable")))
+			// the copy is still written
+			written, err := ioutil.ReadFile(audit.GetOutputFilename())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(written).To(Equal([]byte("{}")))
+		})
+	})
 })
 
 const (
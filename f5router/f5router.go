@@ -25,6 +25,8 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -36,9 +38,11 @@ import (
 	"github.com/F5Networks/cf-bigip-ctlr/f5router/bigipResources"
 	"github.com/F5Networks/cf-bigip-ctlr/f5router/routeUpdate"
 	"github.com/F5Networks/cf-bigip-ctlr/logger"
+	"github.com/F5Networks/cf-bigip-ctlr/metrics"
 	"github.com/F5Networks/cf-bigip-ctlr/route"
 	"github.com/F5Networks/cf-bigip-ctlr/servicebroker/planResources"
 	"github.com/uber-go/zap"
+	"gopkg.in/yaml.v2"
 	"k8s.io/client-go/util/workqueue"
 )
 
@@ -47,8 +51,26 @@ const (
 	HTTPRouterName = "routing-vip-http"
 	// HTTPSRouterName HTTPS virtual server name
 	HTTPSRouterName = "routing-vip-https"
+	// PassthroughRouterName virtual server name for TLS passthrough
+	PassthroughRouterName = "routing-vip-passthrough"
 	// CFRoutingPolicyName Policy name for CF routing
 	CFRoutingPolicyName = "cf-routing-policy"
+	// CFWildcardRoutingPolicyName Policy name for CF wildcard routing when
+	// exact and wildcard routes are split into separate policies
+	CFWildcardRoutingPolicyName = "cf-wildcard-routing-policy"
+	// CFHSTSPolicyName Policy name for the HSTS header on the HTTPS virtual
+	CFHSTSPolicyName = "cf-hsts-policy"
+	// CFPassthroughPolicyName Policy name for routing by SNI server name on the
+	// passthrough virtual
+	CFPassthroughPolicyName = "cf-passthrough-policy"
+	// maxObjectNameLength is the longest name the BIG-IP accepts for an object
+	maxObjectNameLength = 255
+	// maxHostnameLength is the longest host name the BIG-IP matches
+	maxHostnameLength = 253
+	// minVerifyInterval and maxVerifyInterval bound in seconds how often the
+	// driver verifies the BIG-IP config
+	minVerifyInterval = 5
+	maxVerifyInterval = 3600
 	// InternalDataGroupName on BIG-IP
 	InternalDataGroupName = "cf-ctlr-data-group"
 	// BrokerDataGroupName on BIG-IP
@@ -61,6 +83,13 @@ type mutexPlansMap struct {
 	plans map[string]planResources.Plan
 }
 
+// concurrent safe map of the member sets waiting to replace the members of a
+// route's pool, only the latest set for a URI is applied
+type mutexMemberSetsMap struct {
+	lock sync.Mutex
+	data map[route.Uri][]*route.Endpoint
+}
+
 // concurrent safe map of routeURIs and PlanIDs
 type mutexBindIDRouteURIPlanNameMap struct {
 	lock sync.Mutex
@@ -94,10 +123,17 @@ type Router interface {
 
 // F5Router controller of BigIP configuration objects
 type F5Router struct {
+	// lock guards the resource maps which are mutated by the worker and read
+	// by the status methods
+	lock sync.Mutex
+	// writeLock serializes the writes to the writer, whichever path
+	// triggers them
+	writeLock                 sync.Mutex
 	c                         *config.Config
 	logger                    logger.Logger
 	r                         bigipResources.RuleMap
 	wildcards                 bigipResources.RuleMap
+	redirects                 bigipResources.RuleMap
 	queue                     workqueue.RateLimitingInterface
 	writer                    Writer
 	routeVSHTTP               *bigipResources.Virtual
@@ -112,7 +148,209 @@ type F5Router struct {
 	unmappedResourcesMap      map[string]bigipResources.Resources
 	plansMap                  mutexPlansMap
 	bindIDRouteURIPlanNameMap mutexBindIDRouteURIPlanNameMap
+	memberSets                mutexMemberSetsMap
+	dedicatedVirtuals         map[string]bigipResources.VirtualAddress
 	bigIPClient               bigipclient.Client
+	pendingPoolDeletes        map[string]time.Time
+	drainingMembers           map[string]time.Time
+	primedMembers             map[string]primedMember
+	memberSeen                map[string]time.Time
+	disabledPools             map[string]bool
+	names                     NameGenerator
+	reporter                  metrics.RouterReporter
+	onError                   func(item interface{}, err error)
+	onUnsupported             func(item interface{}, err error)
+	poolDecorator             func(pool *bigipResources.Pool)
+	writeFailures             int
+	writes                    int
+	failedWrites              int
+	evictedMembers            int
+	fatal                     chan error
+	leader                    Leader
+	leading                   bool
+	writeStatus               WriteStatus
+	pendingSince              time.Time
+	initialConfigWritten      bool
+	workerRunning             bool
+}
+
+// NameGenerator creates the name shared by the pool, rule and tier2 virtual of
+// an HTTP route
+type NameGenerator interface {
+	ObjectName(uri, partition string) string
+}
+
+// defaultNameGenerator names objects by the route's host, wildcard routes keep
+// their domain and exact routes get a hash suffix
+type defaultNameGenerator struct{}
+
+func (defaultNameGenerator) ObjectName(uri, partition string) string {
+	return makeObjectName(uri)
+}
+
+// poolExpiry is queued when an emptied pool is retained for the grace period,
+// the deadline identifies the most recent scheduling for the pool
+type poolExpiry struct {
+	ru       routeUpdate.RouteUpdate
+	deadline time.Time
+}
+
+// configRetry is queued to write the config again after a failed write
+type configRetry struct{}
+
+// memberSweep is queued periodically when member_ttl is set, it evicts the
+// members which have not been registered within the TTL
+type memberSweep struct{}
+
+// poolForceRemove is queued to delete a pool and everything routing to it no
+// matter which members it still has
+type poolForceRemove struct {
+	name string
+}
+
+// virtualRemove is queued to delete the virtual of a route, virtual_removal
+// decides what happens to its pool and rules
+type virtualRemove struct {
+	name string
+}
+
+// poolEndpointRemove is queued to remove a member from a pool found by name
+type poolEndpointRemove struct {
+	name    string
+	address string
+	port    uint16
+}
+
+// wildcardsClear is queued to remove every wildcard route at once
+type wildcardsClear struct{}
+
+// poolState is queued to disable or enable all members of a pool
+type poolState struct {
+	name     string
+	disabled bool
+}
+
+// poolMembersSet is queued to replace the members of a route's pool with the
+// set stored for the URI in memberSets
+type poolMembersSet struct {
+	uri route.Uri
+}
+
+// dedicatedVirtual is queued to give the route's pool its own virtual on the
+// address, an empty address removes it
+type dedicatedVirtual struct {
+	name string
+	va   bigipResources.VirtualAddress
+}
+
+// dedicatedSuffix is appended to the pool name to name a dedicated virtual
+const dedicatedSuffix = "-dedicated"
+
+// The types of virtual the router creates
+const (
+	httpVirtualType      = "http"
+	httpsVirtualType     = "https"
+	tier2VirtualType     = "tier2"
+	dedicatedVirtualType = "dedicated"
+	tcpVirtualType       = "tcp"
+)
+
+// defaultVirtualModes is the ip protocol of each type of virtual unless
+// virtual_modes overrides it
+var defaultVirtualModes = map[string]string{
+	httpVirtualType:      "tcp",
+	httpsVirtualType:     "tcp",
+	tier2VirtualType:     "tcp",
+	dedicatedVirtualType: "tcp",
+	tcpVirtualType:       "tcp",
+}
+
+// validVirtualModes are the ip protocols virtual_modes accepts
+var validVirtualModes = map[string]bool{"tcp": true, "udp": true, "sctp": true, "any": true}
+
+// virtualMode is the ip protocol for a type of virtual
+func virtualMode(c *config.Config, vsType string) string {
+	if mode, ok := c.BigIP.VirtualModes[vsType]; ok {
+		return mode
+	}
+	return defaultVirtualModes[vsType]
+}
+
+// externalAddr is the address the HTTP or HTTPS virtual binds to,
+// http_external_addr and https_external_addr override external_addr
+func externalAddr(c *config.Config, vsType string) string {
+	addr := c.BigIP.HTTPExternalAddr
+	if httpsVirtualType == vsType {
+		addr = c.BigIP.HTTPSExternalAddr
+	}
+	if 0 == len(addr) {
+		return c.BigIP.ExternalAddr
+	}
+	return addr
+}
+
+// setAutoLastHop applies auto_last_hop to a virtual clients connect to, the
+// tier2 virtuals only see traffic from the routing virtuals. The default is
+// left out so the BIG-IP's global setting applies
+func setAutoLastHop(vs *bigipResources.Virtual, c *config.Config) {
+	switch c.BigIP.AutoLastHop {
+	case config.EnabledAutoLastHop, config.DisabledAutoLastHop:
+		vs.AutoLastHop = c.BigIP.AutoLastHop
+	}
+}
+
+// virtualDestination is the destination of the HTTP or HTTPS virtual, it
+// references the virtual address object of virtual_address_ref when set and
+// binds to the external address otherwise
+func (r *F5Router) virtualDestination(vsType string, port int32, partition string) (string, error) {
+	if ref := r.c.BigIP.VirtualAddressRef; 0 != len(ref) {
+		return fmt.Sprintf("%s:%d", ref, port), nil
+	}
+	va := &bigipResources.VirtualAddress{
+		BindAddr: externalAddr(r.c, vsType),
+		Port:     port,
+	}
+	return verifyDestAddress(va, partition)
+}
+
+// verifyVirtualAddressRef checks virtual_address_ref is the /partition/name
+// path of a virtual address object, an empty reference is valid
+func verifyVirtualAddressRef(ref string) error {
+	if 0 == len(ref) {
+		return nil
+	}
+	if !validBigipPath(ref) {
+		return fmt.Errorf("virtual_address_ref must be a /partition/name path, got: %s", ref)
+	}
+	return nil
+}
+
+// validBigipPath is true for the /partition/name path of a BIG-IP object
+func validBigipPath(path string) bool {
+	parts := strings.Split(path, "/")
+	return 3 == len(parts) && 0 == len(parts[0]) && 0 != len(parts[1]) && 0 != len(parts[2]) &&
+		!strings.ContainsAny(path, " %:")
+}
+
+// leaderCheck is queued periodically so a follower notices when it becomes the
+// leader without waiting for a route update
+type leaderCheck struct{}
+
+// memberSweepSteps is how many sweeps run per member_ttl, a stale member is
+// evicted at most a step after its TTL has passed
+const memberSweepSteps = 4
+
+// drainRatio is the ratio members start at when draining is enabled, a removed
+// member steps down from it to 1 over the drain period before it is deleted
+const drainRatio = 10
+
+// memberDrain is queued for each step of a member drain, started identifies
+// the drain so a re-added member cancels it
+type memberDrain struct {
+	ru      routeUpdate.RouteUpdate
+	pool    string
+	member  bigipResources.Member
+	started time.Time
 }
 
 func verifyRouteURI(ru updateHTTP) error {
@@ -125,19 +363,50 @@ func verifyRouteURI(ru updateHTTP) error {
 
 func makeObjectName(uri string) string {
 	var name string
-	if strings.HasPrefix(uri, "*.") {
-		name = "cf-" + strings.TrimPrefix(uri, "*.")
-	} else if strings.Contains(uri, "*") {
-		name = "cf-" + strings.Replace(uri, "*", "_", -1)
+	host, path := uri, ""
+	if i := strings.Index(uri, "/"); -1 != i {
+		host, path = uri[:i], uri[i:]
+	}
+	if strings.Contains(host, "*") {
+		if strings.HasPrefix(host, "*.") {
+			name = "cf-" + strings.TrimPrefix(host, "*.")
+		} else {
+			name = "cf-" + strings.Replace(host, "*", "_", -1)
+		}
+		// keep a wildcard bound to a port apart from the bare wildcard
+		name = strings.Replace(name, ":", "-", -1)
+		if 0 != len(path) {
+			// a path can't be part of the name, hash it so the exception stays
+			// distinct from the bare wildcard
+			sum := sha256.Sum256([]byte(uri))
+			name = fmt.Sprintf("%s-%x", name, sum[:8])
+		}
 	} else {
 		sum := sha256.Sum256([]byte(uri))
-		index := strings.Index(uri, ".")
-
-		name = fmt.Sprintf("cf-%s-%x", uri[:index], sum[:8])
+		label := host
+		if index := strings.Index(host, "."); -1 != index {
+			label = host[:index]
+		}
+		if 0 == len(label) {
+			// a path-only route has no host to name it by
+			name = fmt.Sprintf("cf-%x", sum[:8])
+		} else {
+			name = fmt.Sprintf("cf-%s-%x", label, sum[:8])
+		}
 	}
 	return name
 }
 
+// variantName keeps the pool of a route restricted to some requests for its
+// URI apart from the pool of the route taking the others
+func variantName(name, variant string) string {
+	if 0 == len(variant) {
+		return name
+	}
+	sum := sha256.Sum256([]byte(variant))
+	return fmt.Sprintf("%s-%x", name, sum[:4])
+}
+
 // Helper to add a leading slash to bigip paths
 func fixupNames(names []string) []string {
 	var fixed []string
@@ -174,13 +443,24 @@ func generateProfileList(names []string, context string) ([]*bigipResources.Prof
 	return refs, err
 }
 
+// restrictVLANs limits the virtual to the VLANs, a virtual without VLANs
+// listens on all of them
+func restrictVLANs(vs *bigipResources.Virtual, names []string) error {
+	refs, err := generateNameList(names)
+	for _, ref := range refs {
+		vs.Vlans = append(vs.Vlans, "/"+ref.Partition+"/"+ref.Name)
+	}
+	vs.VlansEnabled = 0 != len(vs.Vlans)
+	return err
+}
+
 func generateNameList(names []string) ([]*bigipResources.NameRef, error) {
 	var refs []*bigipResources.NameRef
 	var skipped []string
 	for i := range names {
 		p := strings.TrimPrefix(names[i], "/")
 		parts := strings.Split(p, "/")
-		if 2 == len(parts) {
+		if 2 == len(parts) && "" != parts[0] && "" != parts[1] {
 			refs = append(refs, &bigipResources.NameRef{
 				Name:      parts[1],
 				Partition: parts[0],
@@ -208,6 +488,7 @@ func NewF5Router(
 		logger:                    logger,
 		r:                         make(bigipResources.RuleMap),
 		wildcards:                 make(bigipResources.RuleMap),
+		redirects:                 make(bigipResources.RuleMap),
 		queue:                     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
 		writer:                    writer,
 		virtualResources:          make(map[string]*bigipResources.Virtual),
@@ -217,8 +498,17 @@ func NewF5Router(
 		unmappedResourcesMap:      make(map[string]bigipResources.Resources),
 		plansMap:                  mutexPlansMap{plans: make(map[string]planResources.Plan)},
 		bindIDRouteURIPlanNameMap: mutexBindIDRouteURIPlanNameMap{data: make(map[string]string)},
+		memberSets:                mutexMemberSetsMap{data: make(map[route.Uri][]*route.Endpoint)},
+		dedicatedVirtuals:         make(map[string]bigipResources.VirtualAddress),
 		tier2VSInfo:               tier2VSInfo{usedPorts: make(map[string]*bigipResources.VirtualAddress), holderPort: 10000},
 		bigIPClient:               client,
+		pendingPoolDeletes:        make(map[string]time.Time),
+		drainingMembers:           make(map[string]time.Time),
+		primedMembers:             make(map[string]primedMember),
+		memberSeen:                make(map[string]time.Time),
+		disabledPools:             make(map[string]bool),
+		names:                     defaultNameGenerator{},
+		fatal:                     make(chan error, 1),
 	}
 
 	err := r.validateConfig()
@@ -226,9 +516,15 @@ func NewF5Router(
 		return nil, err
 	}
 
-	err = r.writeInitialConfig()
-	if nil != err {
-		return nil, err
+	if c.BigIP.LeaderElection {
+		r.leader = NewFileLeader(c.BigIP.LeaderLockFile)
+	}
+
+	if leader, _ := r.checkLeader(); leader {
+		err = r.writeInitialConfig()
+		if nil != err {
+			return nil, err
+		}
 	}
 
 	// Create the HTTP virtuals if we are not in TCP only mode
@@ -243,6 +539,86 @@ func NewF5Router(
 	return &r, nil
 }
 
+// SetNameGenerator replaces the naming of HTTP route objects, it must be
+// called before any route updates are sent to the router
+func (r *F5Router) SetNameGenerator(g NameGenerator) {
+	r.names = g
+}
+
+// SetReporter sets where the rule counts and unsupported work items are
+// reported, it must be called before any route updates are sent to the router
+func (r *F5Router) SetReporter(reporter metrics.RouterReporter) {
+	r.reporter = reporter
+}
+
+// OnError registers a callback for work items which fail to process, the
+// failure is logged either way. The callback runs on the router's worker after
+// the router is unlocked, so it may call the router but holds up the next work
+// item until it returns. It must be set before the router is run
+func (r *F5Router) OnError(f func(item interface{}, err error)) {
+	r.onError = f
+}
+
+// OnUnsupported registers a callback for work items of an unknown type or with
+// an unsupported operation, they are also counted and passed to OnError. It
+// must be set before the router is run
+func (r *F5Router) OnUnsupported(f func(item interface{}, err error)) {
+	r.onUnsupported = f
+}
+
+// SetPoolDecorator registers a callback which can fill in a pool, such as its
+// description, monitors or balancing mode, when the router creates it. The
+// callback runs on the router's worker with the router locked, it must not
+// block or call anything on the router other than the methods which only queue
+// an update. It must be set before the router is run
+func (r *F5Router) SetPoolDecorator(f func(pool *bigipResources.Pool)) {
+	r.poolDecorator = f
+}
+
+// SetLeader replaces the leader election of the router, only the leader
+// writes the config. It must be set before the router is run
+func (r *F5Router) SetLeader(l Leader) {
+	r.leader = l
+}
+
+// checkLeader reports whether this instance writes the config and whether it
+// just became the leader
+func (r *F5Router) checkLeader() (leader bool, gained bool) {
+	if nil == r.leader {
+		return true, false
+	}
+
+	leader = r.leader.IsLeader()
+	if leader != r.leading {
+		r.logger.Info("f5router-leadership-changed", zap.Bool("leader", leader))
+		gained = leader
+		r.leading = leader
+	}
+	return leader, gained
+}
+
+// slowItemWarning is how long one work item may take before it is reported as
+// slow, zero when items are not timed
+func (r *F5Router) slowItemWarning() time.Duration {
+	return time.Duration(r.c.BigIP.SlowItemWarning) * time.Second
+}
+
+// releaseLeader gives up leadership, if the leader election supports it, once
+// the router has stopped writing
+func (r *F5Router) releaseLeader() {
+	lr, ok := r.leader.(LeaderReleaser)
+	if !ok {
+		return
+	}
+	if err := lr.Release(); nil != err {
+		r.logger.Warn("f5router-leadership-release-failed", zap.Error(err))
+	}
+}
+
+func (r *F5Router) leaderCheckInterval() time.Duration {
+	return time.Duration(r.c.BigIP.LeaderCheckInterval) * time.Second
+}
+
 // AddPlans adds service broker provided plans to the router
 func (r *F5Router) AddPlans(plans map[string]planResources.Plan) {
 	r.plansMap.lock.Lock()
@@ -290,9 +666,99 @@ func (r *F5Router) GetRouteURIFromBindID(bindID string) string {
 	return strings.Split(r.bindIDRouteURIPlanNameMap.data[bindID], "|")[0]
 }
 
+// PoolMembers describes a pool, the route it serves and its members
+type PoolMembers struct {
+	URI      string   `json:"uri,omitempty"`
+	Rule     string   `json:"rule,omitempty"`
+	Members  []string `json:"members"`
+	Disabled bool     `json:"disabled,omitempty"`
+}
+
+// PoolMembers returns the pools keyed by name along with their member
+// addresses and the URI and rule that route to them
+func (r *F5Router) PoolMembers() map[string]PoolMembers {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	pools := make(map[string]PoolMembers)
+	for name, pool := range r.poolResources {
+		pm := PoolMembers{Members: []string{}, Disabled: r.disabledPools[name]}
+		for _, m := range pool.Members {
+			pm.Members = append(pm.Members, net.JoinHostPort(m.Address, strconv.Itoa(int(m.Port))))
+		}
+		pools[name] = pm
+	}
+	for _, rules := range []bigipResources.RuleMap{r.r, r.wildcards} {
+		for uri, rule := range rules {
+			if pm, ok := pools[rule.Pool]; ok {
+				pm.URI = uri.String()
+				pm.Rule = rule.Name
+				pools[rule.Pool] = pm
+			}
+		}
+	}
+	return pools
+}
+
+// WriteStatus describes the latest attempts to write the config, the times
+// are zero until the first attempt
+type WriteStatus struct {
+	LastWrite   time.Time `json:"lastWrite"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// WriteStatus returns when the config was last written and whether the latest
+// attempt failed
+func (r *F5Router) WriteStatus() WriteStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.writeStatus
+}
+
+// MetricsSnapshot returns the current value of the router's counters and
+// gauges by their metric name, for pushing them to a metrics backend. The age
+// of the last write is only there once the config has been written.
+func (r *F5Router) MetricsSnapshot() map[string]float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	members := 0
+	for _, pool := range r.poolResources {
+		members += len(pool.Members)
+	}
+	snapshot := map[string]float64{
+		"f5router_pools":                 float64(len(r.poolResources)),
+		"f5router_pool_members":          float64(members),
+		"f5router_virtuals":              float64(len(r.virtualResources)),
+		"f5router_exact_rules":           float64(len(r.r)),
+		"f5router_wildcard_rules":        float64(len(r.wildcards)),
+		"f5router_config_writes":         float64(r.writes),
+		"f5router_config_write_failures": float64(r.failedWrites),
+		"f5router_evicted_members":       float64(r.evictedMembers),
+		"f5router_queue_length":          float64(r.queue.Len()),
+	}
+	if !r.writeStatus.LastWrite.IsZero() {
+		snapshot["f5router_last_write_age_seconds"] = time.Since(r.writeStatus.LastWrite).Seconds()
+	}
+	return snapshot
+}
+
+// MarshalJSON reports the router status for the status endpoint
+func (r *F5Router) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Pools map[string]PoolMembers `json:"pools"`
+		Write WriteStatus            `json:"write"`
+	}{
+		Pools: r.PoolMembers(),
+		Write: r.WriteStatus(),
+	})
+}
+
 // Run start the F5Router controller
 func (r *F5Router) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
 	r.logger.Info("f5router-starting")
+	defer r.releaseLeader()
 
 	// See if there is an existing data group on the BIG-IP, this is used to store
 	// our tier2 vip ip:port information so the controller doesn't end up in a bad
@@ -327,16 +793,65 @@ func (r *F5Router) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
 		}
 	}
 
+	// the snapshot is written straight away so the BIG-IP keeps its routes
+	// while they register again
+	if err = r.loadSnapshot(); nil != err {
+		r.logger.Warn("f5router-ignoring-snapshot", zap.Error(err))
+	} else if 0 != len(r.primedMembers) {
+		r.queue.Add(configRetry{})
+		r.queue.AddAfter(snapshotExpiry{}, r.snapshotGracePeriod())
+	}
+
+	err = r.Healthy()
+	if nil != err {
+		if r.c.BigIP.FailOnUnhealthyWriter {
+			return err
+		}
+		r.logger.Warn("f5router-writer-unhealthy", zap.Error(err))
+	}
+
+	if 0 != r.c.BigIP.HealthPort {
+		server, err := r.startHealthServer()
+		if nil != err {
+			return err
+		}
+		defer server.Close()
+	}
+
 	done := make(chan struct{})
 	go r.runWorker(done)
 
+	if nil != r.leader {
+		r.queue.Add(leaderCheck{})
+	}
+	if 0 != r.c.BigIP.MemberTTL {
+		r.queue.AddAfter(memberSweep{}, r.memberSweepInterval())
+	}
+
 	close(ready)
 
 	r.logger.Info("f5router-started")
-	<-signals
+	select {
+	case <-signals:
+		err = nil
+	case err = <-r.fatal:
+		r.logger.Error("f5router-stopping-on-write-failures", zap.Error(err))
+	}
 	r.queue.ShutDown()
 	<-done
+	if nil == err && r.c.BigIP.CleanupOnShutdown {
+		r.cleanup(signals)
+	}
 	r.logger.Info("f5router-exited")
+	return err
+}
+
+// Healthy reports whether the config writer can reach its target, writers
+// without a health check are assumed to be healthy
+func (r *F5Router) Healthy() error {
+	if hc, ok := r.writer.(HealthChecker); ok {
+		return hc.Healthy()
+	}
 	return nil
 }
 
@@ -406,10 +921,27 @@ func (r *F5Router) validateConfig() error {
 		BindAddr: r.c.BigIP.ExternalAddr,
 		Port:     int32(80),
 	}
+	for i := range r.c.BigIP.Partitions {
+		if _, err := resolvePartition(r.c, i); nil != err {
+			return err
+		}
+	}
 	_, err := verifyDestAddress(va, r.c.BigIP.Partitions[0])
 	if nil != err {
 		return err
 	}
+	for _, addr := range []string{r.c.BigIP.HTTPExternalAddr, r.c.BigIP.HTTPSExternalAddr} {
+		if 0 == len(addr) {
+			continue
+		}
+		va := &bigipResources.VirtualAddress{BindAddr: addr, Port: int32(80)}
+		if _, err := verifyDestAddress(va, r.c.BigIP.Partitions[0]); nil != err {
+			return err
+		}
+	}
+	if err := verifyVirtualAddressRef(r.c.BigIP.VirtualAddressRef); nil != err {
+		return err
+	}
 
 	if len(r.c.BigIP.Tier2IPRange) == 0 {
 		r.c.BigIP.Tier2IPRange = config.DefaultTier2IPRange
@@ -425,1134 +957,3958 @@ func (r *F5Router) validateConfig() error {
 	r.tier2VSInfo.holderIP = ipAddr
 	r.tier2VSInfo.ipNet = ipNet
 
-	if 0 == len(r.c.BigIP.HealthMonitors) {
-		r.c.BigIP.HealthMonitors = []string{"/Common/tcp_half_open"}
+	if r.c.BigIP.RateLimit < 0 {
+		return fmt.Errorf("rate_limit must not be negative: %d", r.c.BigIP.RateLimit)
 	}
 
-	if 0 == len(r.c.BigIP.Profiles) {
-		r.c.BigIP.Profiles = []string{"/Common/http", "/Common/tcp"}
-	} else {
-		exist := checkForString(r.c.BigIP.Profiles, "/Common/tcp")
-		if !exist {
-			r.c.BigIP.Profiles = append(r.c.BigIP.Profiles, "/Common/tcp")
+	if r.c.BigIP.LeaderElection {
+		if 0 == len(r.c.BigIP.LeaderLockFile) {
+			return errors.New("leader_election requires leader_lock_file")
+		}
+		if r.c.BigIP.LeaderCheckInterval <= 0 {
+			return fmt.Errorf("leader_check_interval must be positive: %d",
+				r.c.BigIP.LeaderCheckInterval)
 		}
 	}
 
-	return nil
-}
+	for _, path := range r.c.BigIP.ConfigCopies {
+		if 0 == len(path) {
+			return errors.New("config_copies entries must not be empty")
+		}
+	}
 
-func (r *F5Router) initiRule(name string, code string) {
-	iRule := bigipResources.IRule{
-		Name: name,
-		Code: code,
+	switch {
+	case 0 == r.c.BigIP.MaxHostnameLength:
+		r.c.BigIP.MaxHostnameLength = maxHostnameLength
+	case r.c.BigIP.MaxHostnameLength < 0 || r.c.BigIP.MaxHostnameLength > maxHostnameLength:
+		return fmt.Errorf("max_hostname_length must be between 1 and %d, got: %d",
+			maxHostnameLength, r.c.BigIP.MaxHostnameLength)
 	}
-	r.ruleResources[name] = &iRule
-}
 
-func (r *F5Router) createHTTPVirtuals() error {
-	plcs, err := generateNameList(r.c.BigIP.Policies)
-	if err != nil {
-		r.logger.Warn("f5router-skipping-policy-names", zap.Error(err))
+	if r.c.BigIP.SnapshotGracePeriod < 0 {
+		return fmt.Errorf("snapshot_grace_period must not be negative: %d", r.c.BigIP.SnapshotGracePeriod)
 	}
-	plcs = append(plcs, &bigipResources.NameRef{
-		Name:      CFRoutingPolicyName,
-		Partition: r.c.BigIP.Partitions[0], // FIXME handle multiple partitions
-	})
-	prfls, err := generateProfileList(r.c.BigIP.Profiles, "all")
-	if err != nil {
-		r.logger.Warn("f5router-skipping-profile-names", zap.Error(err))
+	if 0 == r.c.BigIP.SnapshotGracePeriod {
+		r.c.BigIP.SnapshotGracePeriod = defaultSnapshotGracePeriod
 	}
-	iRulePath, err := joinBigipPath(r.c.BigIP.Partitions[0], bigipResources.HTTPForwardingiRuleName)
-	if nil != err {
-		return err
+
+	if r.c.BigIP.MaxItemRetries < 0 {
+		return fmt.Errorf("max_item_retries must not be negative: %d", r.c.BigIP.MaxItemRetries)
 	}
-	iRule := []string{iRulePath}
 
-	if r.c.SessionPersistence {
-		r.initiRule(bigipResources.JsessionidIRuleName, bigipResources.JsessionidIRule)
+	if r.c.BigIP.MaxPolicyRules < 0 {
+		return fmt.Errorf("max_policy_rules must not be negative: %d", r.c.BigIP.MaxPolicyRules)
 	}
 
-	srcAddrTrans := bigipResources.SourceAddrTranslation{Type: "automap"}
+	if r.c.BigIP.MemberTTL < 0 {
+		return fmt.Errorf("member_ttl must not be negative: %d", r.c.BigIP.MemberTTL)
+	}
 
-	va := &bigipResources.VirtualAddress{
-		BindAddr: r.c.BigIP.ExternalAddr,
-		Port:     80,
+	if r.c.BigIP.RequestTimeout < 0 {
+		return fmt.Errorf("request_timeout must not be negative: %d", r.c.BigIP.RequestTimeout)
+	}
+
+	if r.c.BigIP.ResponseTimeout < 0 {
+		return fmt.Errorf("response_timeout must not be negative: %d", r.c.BigIP.ResponseTimeout)
+	}
+
+	if r.c.BigIP.CleanupWait < 0 {
+		return fmt.Errorf("cleanup_wait must not be negative: %d", r.c.BigIP.CleanupWait)
 	}
-	dest, err := verifyDestAddress(va, r.c.BigIP.Partitions[0])
+
+	err = r.verifyPolicySettings()
 	if nil != err {
 		return err
 	}
 
-	r.virtualResources[HTTPRouterName] = &bigipResources.Virtual{
-		VirtualServerName:     HTTPRouterName,
-		Mode:                  "tcp",
-		Enabled:               true,
-		Destination:           dest,
-		Policies:              plcs,
-		Profiles:              prfls,
-		IRules:                iRule,
-		SourceAddrTranslation: srcAddrTrans,
+	if r.c.BigIP.MaxPathDepth < 0 {
+		return fmt.Errorf("max_path_depth must not be negative: %d", r.c.BigIP.MaxPathDepth)
 	}
 
-	if 0 != len(r.c.BigIP.SSLProfiles) {
-		sslProfiles, err := generateProfileList(r.c.BigIP.SSLProfiles, "clientside")
-		if err != nil {
-			r.logger.Warn("f5router-skipping-sslProfile-names", zap.Error(err))
-		}
-		prfls = append(prfls, sslProfiles...)
+	switch r.c.BigIP.DeepPathAction {
+	case "":
+		r.c.BigIP.DeepPathAction = config.RejectDeepPath
+	case config.RejectDeepPath, config.TruncateDeepPath:
+	default:
+		return fmt.Errorf("deep_path_action must be %s or %s, got: %s",
+			config.RejectDeepPath, config.TruncateDeepPath, r.c.BigIP.DeepPathAction)
+	}
 
-		va := &bigipResources.VirtualAddress{
-			BindAddr: r.c.BigIP.ExternalAddr,
-			Port:     443,
-		}
-		dest, err := verifyDestAddress(va, r.c.BigIP.Partitions[0])
-		if nil != err {
-			return err
-		}
+	switch r.c.BigIP.WildcardFlips {
+	case "":
+		r.c.BigIP.WildcardFlips = config.KeepWildcardFlips
+	case config.KeepWildcardFlips, config.ReplaceWildcardFlips:
+	default:
+		return fmt.Errorf("wildcard_flips must be %s or %s, got: %s",
+			config.KeepWildcardFlips, config.ReplaceWildcardFlips, r.c.BigIP.WildcardFlips)
+	}
 
-		r.virtualResources[HTTPSRouterName] = &bigipResources.Virtual{
-			VirtualServerName:     HTTPSRouterName,
-			Mode:                  "tcp",
-			Enabled:               true,
-			Destination:           dest,
-			Policies:              plcs,
-			Profiles:              prfls,
-			IRules:                iRule,
-			SourceAddrTranslation: srcAddrTrans,
-		}
+	switch r.c.BigIP.AutoLastHop {
+	case "":
+		r.c.BigIP.AutoLastHop = config.DefaultAutoLastHop
+	case config.DefaultAutoLastHop, config.EnabledAutoLastHop, config.DisabledAutoLastHop:
+	default:
+		return fmt.Errorf("auto_last_hop must be %s, %s or %s, got: %s", config.DefaultAutoLastHop,
+			config.EnabledAutoLastHop, config.DisabledAutoLastHop, r.c.BigIP.AutoLastHop)
 	}
-	return nil
-}
 
-func (r *F5Router) writeInitialConfig() error {
-	sections := make(map[string]interface{})
-	sections["global"] = bigipResources.GlobalConfig{
-		LogLevel:       r.c.Logging.Level,
-		VerifyInterval: r.c.BigIP.VerifyInterval,
+	switch r.c.BigIP.MonitorMode {
+	case "":
+		r.c.BigIP.MonitorMode = config.ReferencedMonitors
+	case config.ReferencedMonitors, config.InlineMonitors:
+	default:
+		return fmt.Errorf("monitor_mode must be %s or %s, got: %s",
+			config.ReferencedMonitors, config.InlineMonitors, r.c.BigIP.MonitorMode)
 	}
-	sections["bigip"] = r.c.BigIP
 
-	output, err := json.Marshal(sections)
-	if nil != err {
-		return fmt.Errorf("failed marshaling initial config: %v", err)
+	switch r.c.BigIP.PathMatch {
+	case "":
+		r.c.BigIP.PathMatch = config.SegmentPathMatch
+	case config.SegmentPathMatch, config.PrefixPathMatch, config.ExactPathMatch:
+	default:
+		return fmt.Errorf("path_match must be %s, %s or %s, got: %s", config.SegmentPathMatch,
+			config.PrefixPathMatch, config.ExactPathMatch, r.c.BigIP.PathMatch)
 	}
-	n, err := r.writer.Write(output)
-	if nil != err {
-		return fmt.Errorf("failed writing initial config: %v", err)
-	} else if len(output) != n {
-		return fmt.Errorf("short write from initial config")
+
+	switch r.c.BigIP.VirtualRemoval {
+	case "":
+		r.c.BigIP.VirtualRemoval = config.WarnVirtualRemoval
+	case config.WarnVirtualRemoval, config.CascadeVirtualRemoval:
+	default:
+		return fmt.Errorf("virtual_removal must be %s or %s, got: %s",
+			config.WarnVirtualRemoval, config.CascadeVirtualRemoval, r.c.BigIP.VirtualRemoval)
 	}
 
-	return nil
-}
+	switch r.c.BigIP.PathOnlyRoutes {
+	case "":
+		r.c.BigIP.PathOnlyRoutes = config.RejectPathOnly
+	case config.RejectPathOnly, config.CatchAllPathOnly:
+	default:
+		return fmt.Errorf("path_only_routes must be %s or %s, got: %s",
+			config.RejectPathOnly, config.CatchAllPathOnly, r.c.BigIP.PathOnlyRoutes)
+	}
 
-func (r *F5Router) runWorker(done chan<- struct{}) {
-	r.logger.Debug("f5router-starting-worker")
-	for r.process() {
+	switch r.c.BigIP.OutputFormat {
+	case "":
+		r.c.BigIP.OutputFormat = config.JSONOutput
+	case config.JSONOutput, config.YAMLOutput:
+	default:
+		return fmt.Errorf("output_format must be %s or %s, got: %s",
+			config.JSONOutput, config.YAMLOutput, r.c.BigIP.OutputFormat)
 	}
-	r.logger.Debug("f5router-stopping-worker")
-	close(done)
-}
 
-func (r *F5Router) createPolicies(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	if len(r.wildcards) != 0 || len(r.r) != 0 {
-		pm[partition].Policies = bigipResources.Policies{
-			r.makeRoutePolicy(CFRoutingPolicyName),
+	if 0 != len(r.c.BigIP.Namespace) {
+		if !namespacePattern.MatchString(r.c.BigIP.Namespace) {
+			return fmt.Errorf("namespace must start with a letter and contain only "+
+				"letters, digits, '.', '_' or '-', got: %s", r.c.BigIP.Namespace)
+		}
+		if len(r.namespaced(CFWildcardRoutingPolicyName)) > maxObjectNameLength {
+			return fmt.Errorf("namespace %s makes policy names longer than %d characters",
+				r.c.BigIP.Namespace, maxObjectNameLength)
 		}
 	}
-}
-
-func (r *F5Router) createVirtuals(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
-	defer wg.Done()
 
-	for _, virtual := range r.virtualResources {
-		pm[partition].Virtuals = append(pm[partition].Virtuals, virtual)
+	if r.c.BigIP.VerifyInterval <= 0 || r.c.BigIP.VerifyInterval > maxVerifyInterval {
+		return fmt.Errorf("verify_interval must be between 1 and %d seconds, got: %d",
+			maxVerifyInterval, r.c.BigIP.VerifyInterval)
+	}
+	// verifying too often loads the BIG-IP for little gain
+	if r.c.BigIP.VerifyInterval < minVerifyInterval {
+		r.logger.Warn("f5router-verify-interval-clamped",
+			zap.Int("verify-interval", r.c.BigIP.VerifyInterval),
+			zap.Int("minimum", minVerifyInterval),
+		)
+		r.c.BigIP.VerifyInterval = minVerifyInterval
 	}
-}
 
-func (r *F5Router) createPools(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
-	defer wg.Done()
+	if r.c.BigIP.MinActiveMembers < 0 {
+		return fmt.Errorf("min_active_members must not be negative: %d", r.c.BigIP.MinActiveMembers)
+	}
 
-	for _, pool := range r.poolResources {
-		pm[partition].Pools = append(pm[partition].Pools, pool)
+	if r.c.BigIP.SlowItemWarning < 0 {
+		return fmt.Errorf("slow_item_warning must not be negative: %d", r.c.BigIP.SlowItemWarning)
 	}
-}
 
-func (r *F5Router) createiRules(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
-	defer wg.Done()
+	if r.c.BigIP.FQDNInterval < 0 {
+		return fmt.Errorf("fqdn_interval must not be negative: %d", r.c.BigIP.FQDNInterval)
+	}
 
-	for _, rule := range r.ruleResources {
-		pm[partition].IRules = append(pm[partition].IRules, rule)
+	// only the TCP route virtuals are mirrored, the HTTP virtuals proxy
+	// requests that clients retry on a new connection
+	if r.c.BigIP.ConnectionMirroring && !r.c.RoutingApiEnabled() {
+		return errors.New("connection_mirroring needs the routing_api for TCP routes")
+	}
+	if r.c.BigIP.DefaultMemberPort < 0 || r.c.BigIP.DefaultMemberPort > 65535 {
+		return fmt.Errorf("invalid default_member_port: %d", r.c.BigIP.DefaultMemberPort)
 	}
-}
 
-func (r *F5Router) createMonitors(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
-	defer wg.Done()
+	switch r.c.BigIP.MemberAddressFamily {
+	case "":
+		r.c.BigIP.MemberAddressFamily = config.AnyAddressFamily
+	case config.AnyAddressFamily, config.IPv4AddressFamily, config.IPv6AddressFamily:
+	default:
+		return fmt.Errorf("member_address_family must be %s, %s or %s, got: %s",
+			config.AnyAddressFamily, config.IPv4AddressFamily, config.IPv6AddressFamily,
+			r.c.BigIP.MemberAddressFamily)
+	}
 
-	for _, monitors := range r.monitorResources {
-		for _, monitor := range monitors {
-			var found bool
-			for _, addedMonitor := range pm[partition].Monitors {
-				if addedMonitor.Name == monitor.Name {
-					found = true
-					break
-				}
-			}
-			if !found {
-				pm[partition].Monitors = append(pm[partition].Monitors, monitor)
-			}
+	switch r.c.BigIP.PortlessMembers {
+	case "":
+		r.c.BigIP.PortlessMembers = config.RejectPortless
+	case config.RejectPortless:
+	case config.DefaultPortPortless:
+		if r.c.BigIP.PortlessMemberPort <= 0 || r.c.BigIP.PortlessMemberPort > 65535 {
+			return fmt.Errorf("invalid portless_member_port: %d", r.c.BigIP.PortlessMemberPort)
 		}
+	default:
+		return fmt.Errorf("portless_members must be %s or %s, got: %s",
+			config.RejectPortless, config.DefaultPortPortless, r.c.BigIP.PortlessMembers)
+	}
+	if r.c.BigIP.HealthPort < 0 || r.c.BigIP.HealthPort > 65535 {
+		return fmt.Errorf("invalid health_port: %d", r.c.BigIP.HealthPort)
+	}
+	if r.c.BigIP.PassthroughPort < 0 || r.c.BigIP.PassthroughPort > 65535 {
+		return fmt.Errorf("invalid passthrough_port: %d", r.c.BigIP.PassthroughPort)
 	}
-}
 
-func (r *F5Router) createInternalDataGroups(
-	dataGroups map[string]map[string]*bigipResources.InternalDataGroupRecord,
-	pm bigipResources.PartitionMap,
-	partition string, wg *sync.WaitGroup,
-) {
-	defer wg.Done()
+	if r.c.BigIP.MaxStaleness < 0 {
+		return fmt.Errorf("max_staleness must not be negative: %d", r.c.BigIP.MaxStaleness)
+	}
 
-	for name, dataGroup := range dataGroups {
-		internalDataGroup := bigipResources.NewInternalDataGroup(name)
-		for _, record := range dataGroup {
-			internalDataGroup.Records = append(internalDataGroup.Records, record)
-		}
-		pm[partition].InternalDataGroups = append(pm[partition].InternalDataGroups, internalDataGroup)
+	if r.c.BigIP.MaxWriteFailures < 0 {
+		return fmt.Errorf("max_write_failures must not be negative: %d", r.c.BigIP.MaxWriteFailures)
 	}
-}
 
-// Create a partition entry in the map if it doesn't exist
-func initPartitionData(pm bigipResources.PartitionMap, partition string) {
-	if _, ok := pm[partition]; !ok {
-		pm[partition] = &bigipResources.Resources{}
+	if r.c.BigIP.DrainPeriod < 0 {
+		return fmt.Errorf("drain_period must not be negative: %d", r.c.BigIP.DrainPeriod)
+	}
+	// Member ratios are only honored by the ratio load balancing modes
+	if r.c.BigIP.DrainPeriod > 0 && !strings.HasPrefix(r.c.BigIP.LoadBalancingMode, "ratio-") {
+		return fmt.Errorf("drain_period requires a ratio load_balancing_mode, got: %s",
+			r.c.BigIP.LoadBalancingMode)
 	}
-}
 
-// Populates a data group from the mutexBindIDRouteURIPlanNameMap
-func populateBrokerDataGroup(brokerData *mutexBindIDRouteURIPlanNameMap) map[string]*bigipResources.InternalDataGroupRecord {
-	dg := make(map[string]*bigipResources.InternalDataGroupRecord)
+	if 0 != len(r.c.BigIP.RouteHeader) && !headerNamePattern.MatchString(r.c.BigIP.RouteHeader) {
+		return fmt.Errorf("invalid route_header: %q", r.c.BigIP.RouteHeader)
+	}
 
-	brokerData.lock.Lock()
-	defer brokerData.lock.Unlock()
+	if r.c.BigIP.RuleLogging && !ruleLogFacility.MatchString(r.c.BigIP.RuleLogFacility) {
+		return fmt.Errorf("rule_log_facility must be one of local0 - local7, got: %s",
+			r.c.BigIP.RuleLogFacility)
+	}
 
-	for k, v := range brokerData.data {
-		record := &bigipResources.InternalDataGroupRecord{
-			Name: k,
-			Data: v,
+	if r.c.BigIP.HSTS {
+		if 0 == len(r.httpsSSLProfiles()) {
+			return errors.New("hsts requires ssl_profiles")
+		}
+		if r.c.BigIP.HSTSMaxAge <= 0 {
+			return fmt.Errorf("hsts_max_age must be positive: %d", r.c.BigIP.HSTSMaxAge)
 		}
-		dg[k] = record
 	}
-	return dg
-}
-
-func (r *F5Router) createResources() bigipResources.PartitionMap {
-	// Organize the data as a map of arrays of resources (per partition)
-	pm := bigipResources.PartitionMap{}
-
-	//FIXME need to handle multiple partitions
-	partition := r.c.BigIP.Partitions[0]
-	initPartitionData(pm, partition)
 
-	var wg sync.WaitGroup
+	if r.c.BigIP.SSLOnHTTPVirtual && 0 == len(r.httpsSSLProfiles()) {
+		return errors.New("ssl_on_http_virtual requires ssl_profiles")
+	}
 
-	wg.Add(1)
-	go r.createPolicies(pm, partition, &wg)
+	// The client certificate is only available on the HTTPS virtual, the
+	// ssl profiles are expected to request it
+	if r.c.BigIP.ClientCertHeaders && 0 == len(r.httpsSSLProfiles()) {
+		return errors.New("client_cert_headers requires ssl_profiles that request client certificates")
+	}
 
-	wg.Add(1)
-	go r.createVirtuals(pm, partition, &wg)
+	sslPartitions := make([]string, 0, len(r.c.BigIP.PartitionSSLProfiles))
+	for partition := range r.c.BigIP.PartitionSSLProfiles {
+		sslPartitions = append(sslPartitions, partition)
+	}
+	sort.Strings(sslPartitions)
+	for _, partition := range sslPartitions {
+		configured := false
+		for _, p := range r.c.BigIP.Partitions {
+			configured = configured || p == partition
+		}
+		if !configured {
+			return fmt.Errorf("partition_ssl_profiles has an unconfigured partition: %s", partition)
+		}
+		_, err := generateNameList(r.c.BigIP.PartitionSSLProfiles[partition])
+		if nil != err {
+			return fmt.Errorf("invalid partition_ssl_profiles for %s: %v", partition, err)
+		}
+	}
 
-	wg.Add(1)
-	go r.createPools(pm, partition, &wg)
+	modeTypes := make([]string, 0, len(r.c.BigIP.VirtualModes))
+	for vsType := range r.c.BigIP.VirtualModes {
+		modeTypes = append(modeTypes, vsType)
+	}
+	sort.Strings(modeTypes)
+	for _, vsType := range modeTypes {
+		if _, ok := defaultVirtualModes[vsType]; !ok {
+			return fmt.Errorf("virtual_modes has an unknown virtual type: %s", vsType)
+		}
+		if mode := r.c.BigIP.VirtualModes[vsType]; !validVirtualModes[mode] {
+			return fmt.Errorf("virtual_modes %s must be tcp, udp, sctp or any, got: %s", vsType, mode)
+		}
+	}
 
-	wg.Add(1)
-	go r.createiRules(pm, partition, &wg)
+	// Catch malformed object references before the agent rejects them
+	refs := []struct {
+		param string
+		names []string
+	}{
+		{"ssl_profiles", r.c.BigIP.SSLProfiles},
+		{"profiles", r.c.BigIP.Profiles},
+		{"http_profiles", r.c.BigIP.HTTPProfiles},
+		{"https_profiles", r.c.BigIP.HTTPSProfiles},
+		{"policies", r.c.BigIP.Policies},
+		{"vlans", r.c.BigIP.VLANs},
+		{"http_vlans", r.c.BigIP.HTTPVLANs},
+		{"https_vlans", r.c.BigIP.HTTPSVLANs},
+		{"health_monitors", r.c.BigIP.HealthMonitors},
+	}
+	for _, ref := range refs {
+		if _, err := generateNameList(ref.names); nil != err {
+			return fmt.Errorf("invalid %s: %v", ref.param, err)
+		}
+	}
+	if 0 != len(r.c.BigIP.TrafficGroup) {
+		_, err := generateNameList([]string{r.c.BigIP.TrafficGroup})
+		if nil != err {
+			return fmt.Errorf("invalid traffic_group: %v", err)
+		}
+	}
+	if 0 != len(r.c.BigIP.OneConnectProfile) && NoOneConnect != r.c.BigIP.OneConnectProfile {
+		_, err := generateNameList([]string{r.c.BigIP.OneConnectProfile})
+		if nil != err {
+			return fmt.Errorf("invalid oneconnect_profile: %v", err)
+		}
+	}
+	if 0 != len(r.c.BigIP.DoSProfile) {
+		_, err := generateNameList([]string{r.c.BigIP.DoSProfile})
+		if nil != err {
+			return fmt.Errorf("invalid dos_profile: %v", err)
+		}
+	}
+	if 0 != len(r.c.BigIP.AnalyticsProfile) {
+		_, err := generateNameList([]string{r.c.BigIP.AnalyticsProfile})
+		if nil != err {
+			return fmt.Errorf("invalid analytics_profile: %v", err)
+		}
+	}
 
-	wg.Add(1)
-	go r.createMonitors(pm, partition, &wg)
+	if 0 != len(r.c.BigIP.AllDownPool) {
+		if 0 != r.c.BigIP.AllDownStatus {
+			return errors.New("all_down_pool and all_down_status are mutually exclusive")
+		}
+		_, err := generateNameList([]string{r.c.BigIP.AllDownPool})
+		if nil != err {
+			return fmt.Errorf("invalid all_down_pool: %v", err)
+		}
+	}
+	if 0 != r.c.BigIP.AllDownStatus && !validStatus(r.c.BigIP.AllDownStatus) {
+		return fmt.Errorf("invalid all_down_status: %d", r.c.BigIP.AllDownStatus)
+	}
 
-	dataGroups := make(map[string]map[string]*bigipResources.InternalDataGroupRecord)
-	if r.c.BrokerMode {
-		brokerInternalDataGroup := populateBrokerDataGroup(&r.bindIDRouteURIPlanNameMap)
-		dataGroups[BrokerDataGroupName] = brokerInternalDataGroup
+	if 0 == len(r.c.BigIP.HealthMonitors) {
+		r.c.BigIP.HealthMonitors = []string{"/Common/tcp_half_open"}
 	}
-	dataGroups[InternalDataGroupName] = r.internalDataGroup
 
-	wg.Add(1)
-	go r.createInternalDataGroups(dataGroups, pm, partition, &wg)
+	if 0 == len(r.c.BigIP.InstanceID) {
+		hostname, err := os.Hostname()
+		if nil != err {
+			r.logger.Warn("f5router-instance-id-error", zap.Error(err))
+		} else {
+			r.c.BigIP.InstanceID = hostname
+		}
+	}
 
-	wg.Wait()
+	if 0 == len(r.c.BigIP.Profiles) {
+		r.c.BigIP.Profiles = []string{"/Common/http", "/Common/tcp"}
+	} else {
+		exist := checkForString(r.c.BigIP.Profiles, "/Common/tcp")
+		if !exist {
+			r.c.BigIP.Profiles = append(r.c.BigIP.Profiles, "/Common/tcp")
+		}
+	}
+	// the routing virtuals are tcp virtuals whichever profiles they get
+	for _, profiles := range []*[]string{&r.c.BigIP.HTTPProfiles, &r.c.BigIP.HTTPSProfiles} {
+		if 0 != len(*profiles) && !checkForString(*profiles, "/Common/tcp") {
+			*profiles = append(*profiles, "/Common/tcp")
+		}
+	}
 
-	return pm
+	return nil
 }
 
-func (r *F5Router) process() bool {
-	item, quit := r.queue.Get()
-	if quit {
-		r.logger.Debug("f5router-quit-signal-received")
-		return false
+func (r *F5Router) initiRule(name string, code string) {
+	iRule := bigipResources.IRule{
+		Name: name,
+		Code: code,
 	}
+	r.ruleResources[name] = &iRule
+}
 
-	defer r.queue.Done(item)
+// httpsSSLProfiles are the ssl profiles of the HTTPS virtual, the partition it
+// is written to can replace ssl_profiles with its own
+func (r *F5Router) httpsSSLProfiles() []string {
+	partition, err := resolvePartition(r.c, 0)
+	if nil == err {
+		if names := r.c.BigIP.PartitionSSLProfiles[partition]; 0 != len(names) {
+			return names
+		}
+	}
+	return r.c.BigIP.SSLProfiles
+}
 
-	var err error
-	r.logger.Debug("f5router-received-update-request")
-	switch ru := item.(type) {
-	case updateHTTP:
-		if ru.Op() == routeUpdate.Add {
-			r.processRouteAdd(ru)
-		} else if ru.Op() == routeUpdate.Remove {
-			r.processRouteRemove(ru)
-		} else if ru.Op() == routeUpdate.Bind {
-			r.processRouteBind(ru)
-		} else if ru.Op() == routeUpdate.Unbind {
-			r.processRouteUnbind(ru)
+func (r *F5Router) createHTTPVirtuals() error {
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return err
+	}
+	plcs, err := generateNameList(r.c.BigIP.Policies)
+	if err != nil {
+		r.logger.Warn("f5router-skipping-policy-names", zap.Error(err))
+	}
+	for _, name := range r.routingPolicyNames() {
+		plcs = append(plcs, &bigipResources.NameRef{
+			Name:      name,
+			Partition: partition, // FIXME handle multiple partitions
+		})
+	}
+	// The BIG-IP attaches DoS protection as a profile of the virtual, it covers
+	// every route behind the shared virtuals
+	var shared []*bigipResources.ProfileRef
+	if 0 != len(r.c.BigIP.DoSProfile) {
+		shared, err = generateProfileList([]string{r.c.BigIP.DoSProfile}, "all")
+		if err != nil {
+			r.logger.Warn("f5router-skipping-dos-profile-name", zap.Error(err))
 		}
-	case updateTCP:
-		if ru.Op() == routeUpdate.Add {
-			r.processTCPRouteAdd(ru)
-		} else if ru.Op() == routeUpdate.Remove {
-			r.processTCPRouteRemove(ru)
+	}
+	// AVR collects the analytics of the HTTP traffic the same way
+	if 0 != len(r.c.BigIP.AnalyticsProfile) {
+		avr, err := generateProfileList([]string{r.c.BigIP.AnalyticsProfile}, "all")
+		if err != nil {
+			r.logger.Warn("f5router-skipping-analytics-profile-name", zap.Error(err))
 		}
-	default:
-		r.logger.Warn("f5router-unknown-workitem",
-			zap.Error(errors.New("workqueue delivered unsupported work type")))
+		shared = append(shared, avr...)
 	}
-
+	// Each virtual takes its own profiles when they are set, otherwise the
+	// shared ones
+	virtualProfiles := func(names []string) []*bigipResources.ProfileRef {
+		if 0 == len(names) {
+			names = r.c.BigIP.Profiles
+		}
+		prfls, err := generateProfileList(names, "all")
+		if err != nil {
+			r.logger.Warn("f5router-skipping-profile-names", zap.Error(err))
+		}
+		return append(prfls, shared...)
+	}
+	sslProfiles, err := generateProfileList(r.httpsSSLProfiles(), "clientside")
+	if err != nil {
+		r.logger.Warn("f5router-skipping-sslProfile-names", zap.Error(err))
+	}
+	// The HTTP virtual only carries the ssl profiles when opportunistic
+	// upgrades are enabled, the HTTPS virtual always does
+	httpProfiles := virtualProfiles(r.c.BigIP.HTTPProfiles)
+	if r.c.BigIP.SSLOnHTTPVirtual {
+		httpProfiles = append(httpProfiles, sslProfiles...)
+	}
+	iRulePath, err := joinBigipPath(partition, bigipResources.HTTPForwardingiRuleName)
 	if nil != err {
-		r.logger.Warn("f5router-process-error", zap.Error(err))
-	} else {
-		l := r.queue.Len()
-		if 0 == l {
-			if !r.firstSyncDone {
-				r.truncateInternalDataGroup()
-				r.firstSyncDone = true
-			}
-			sections := make(map[string]interface{})
+		return err
+	}
+	iRule := []string{iRulePath}
+	// the fallback has to run first, it keeps forward-to-vip from sending the
+	// request to a tier2 virtual without active members
+	if r.allDownFallback() {
+		fallbackPath, err := joinBigipPath(partition, bigipResources.AllDownFallbackiRuleName)
+		if nil != err {
+			return err
+		}
+		r.initiRule(bigipResources.AllDownFallbackiRuleName, bigipResources.AllDownFallbackiRule)
+		iRule = []string{fallbackPath, iRulePath}
+	}
 
-			sections["global"] = bigipResources.GlobalConfig{
-				LogLevel:       r.c.Logging.Level,
-				VerifyInterval: r.c.BigIP.VerifyInterval,
-			}
+	if r.c.SessionPersistence {
+		r.initiRule(bigipResources.JsessionidIRuleName, bigipResources.JsessionidIRule)
+	}
+
+	srcAddrTrans := bigipResources.SourceAddrTranslation{Type: "automap"}
+
+	if 0 != r.c.BigIP.RateLimit {
+		r.logger.Info("f5router-rate-limit-configured",
+			zap.Int("connections-per-second", r.c.BigIP.RateLimit))
+	}
 
-			sections["bigip"] = r.c.BigIP
+	dest, err := r.virtualDestination(httpVirtualType, 80, partition)
+	if nil != err {
+		return err
+	}
 
-			sections["resources"] = r.createResources()
+	r.virtualResources[HTTPRouterName] = &bigipResources.Virtual{
+		VirtualServerName:     HTTPRouterName,
+		Mode:                  virtualMode(r.c, httpVirtualType),
+		Enabled:               true,
+		Destination:           dest,
+		Policies:              plcs,
+		Profiles:              httpProfiles,
+		IRules:                iRule,
+		SourceAddrTranslation: srcAddrTrans,
+		RateLimit:             r.c.BigIP.RateLimit,
+	}
+	// Each virtual takes its own VLANs when they are set, otherwise the
+	// shared ones
+	virtualVLANs := func(vs *bigipResources.Virtual, names []string) {
+		if 0 == len(names) {
+			names = r.c.BigIP.VLANs
+		}
+		if err := restrictVLANs(vs, names); nil != err {
+			r.logger.Warn("f5router-skipping-vlan-names", zap.Error(err))
+		}
+	}
+	virtualVLANs(r.virtualResources[HTTPRouterName], r.c.BigIP.HTTPVLANs)
+	setAutoLastHop(r.virtualResources[HTTPRouterName], r.c)
+
+	if 0 != len(r.httpsSSLProfiles()) {
+		// without a clientside ssl profile the HTTPS virtual cannot
+		// terminate TLS, fail instead of writing a broken virtual
+		if 0 == len(sslProfiles) {
+			return errors.New("no usable ssl_profiles for the HTTPS virtual")
+		}
+		httpsProfiles := append(virtualProfiles(r.c.BigIP.HTTPSProfiles), sslProfiles...)
 
-			r.logger.Debug("f5router-drain", zap.Object("writing", sections))
+		dest, err := r.virtualDestination(httpsVirtualType, 443, partition)
+		if nil != err {
+			return err
+		}
 
-			output, err := json.Marshal(sections)
+		httpsiRules := iRule
+		if r.c.BigIP.ClientCertHeaders {
+			certPath, err := joinBigipPath(partition, bigipResources.ClientCertiRuleName)
 			if nil != err {
-				r.logger.Warn("f5router-config-marshal-error", zap.Error(err))
-			} else {
-				n, err := r.writer.Write(output)
-				if nil != err {
-					r.logger.Warn("f5router-config-write-error", zap.Error(err))
-				} else if len(output) != n {
-					r.logger.Warn("f5router-config-short-write", zap.Error(err))
-				}
+				return err
 			}
-		} else {
-			r.logger.Debug("f5router-write-not-ready",
-				zap.Int("length", l),
-			)
+			r.initiRule(bigipResources.ClientCertiRuleName, bigipResources.ClientCertiRule)
+			httpsiRules = append([]string{certPath}, iRule...)
 		}
-	}
-	return true
-}
 
-// makePool create Pool-Only configuration item
-func makePool(
-	name string,
-	descrip string,
-	members []bigipResources.Member,
-	balanceMode string,
-	hmNames []string,
-) *bigipResources.Pool {
+		httpsPolicies := plcs
+		if r.c.BigIP.HSTS {
+			httpsPolicies = append(append([]*bigipResources.NameRef{}, plcs...), &bigipResources.NameRef{
+				Name:      r.namespaced(CFHSTSPolicyName),
+				Partition: partition,
+			})
+		}
 
-	return &bigipResources.Pool{
-		Name:         name,
-		Balance:      balanceMode,
-		Members:      members,
-		MonitorNames: hmNames,
-		Description:  descrip,
+		r.virtualResources[HTTPSRouterName] = &bigipResources.Virtual{
+			VirtualServerName:     HTTPSRouterName,
+			Mode:                  virtualMode(r.c, httpsVirtualType),
+			Enabled:               true,
+			Destination:           dest,
+			Policies:              httpsPolicies,
+			Profiles:              httpsProfiles,
+			IRules:                httpsiRules,
+			SourceAddrTranslation: srcAddrTrans,
+			RateLimit:             r.c.BigIP.RateLimit,
+		}
+		virtualVLANs(r.virtualResources[HTTPSRouterName], r.c.BigIP.HTTPSVLANs)
+		setAutoLastHop(r.virtualResources[HTTPSRouterName], r.c)
 	}
-}
 
-func verifyDestAddress(va *bigipResources.VirtualAddress, partition string) (string, error) {
-	ip, rd := splitIPWithRouteDomain(va.BindAddr)
-	if len(rd) > 0 {
-		rd = "%" + rd
-	}
-	addr := net.ParseIP(va.BindAddr)
-	if nil != addr {
-		var format string
-		if nil != addr.To4() {
-			format = "/%s/%s%s:%d"
-		} else {
-			format = "/%s/%s%s.%d"
+	if 0 != r.c.BigIP.PassthroughPort {
+		// the passthrough virtual leaves TLS to the apps, it only takes the
+		// SNI server name from the client hello to pick the pool
+		dest, err := r.virtualDestination(httpsVirtualType, int32(r.c.BigIP.PassthroughPort), partition)
+		if nil != err {
+			return err
 		}
-		destination := fmt.Sprintf(
-			format,
-			partition,
-			ip,
-			rd,
-			va.Port)
-		return destination, nil
+		tcp, _ := generateProfileList([]string{"/Common/tcp"}, "all")
+		r.virtualResources[PassthroughRouterName] = &bigipResources.Virtual{
+			VirtualServerName: PassthroughRouterName,
+			Mode:              virtualMode(r.c, httpsVirtualType),
+			Enabled:           true,
+			Destination:       dest,
+			Policies: []*bigipResources.NameRef{{
+				Name:      r.namespaced(CFPassthroughPolicyName),
+				Partition: partition,
+			}},
+			Profiles:              tcp,
+			SourceAddrTranslation: srcAddrTrans,
+			RateLimit:             r.c.BigIP.RateLimit,
+		}
+		virtualVLANs(r.virtualResources[PassthroughRouterName], r.c.BigIP.HTTPSVLANs)
+		setAutoLastHop(r.virtualResources[PassthroughRouterName], r.c)
 	}
-	return "", fmt.Errorf("invalid address: %s", va.BindAddr)
+	return nil
 }
 
-// checkForString loops over a slice to see if a string exists in it
-func checkForString(list []string, text string) bool {
-	for _, val := range list {
-		if val == text {
-			return true
-		}
+// allDownFallback is true when requests for a pool without active members
+// fall back to another pool or a status
+func (r *F5Router) allDownFallback() bool {
+	return 0 != len(r.c.BigIP.AllDownPool) || 0 != r.c.BigIP.AllDownStatus
+}
+
+// globalConfig is the global section, tagged with the instance writing it
+func (r *F5Router) globalConfig() bigipResources.GlobalConfig {
+	return bigipResources.GlobalConfig{
+		LogLevel:       r.c.Logging.Level,
+		VerifyInterval: r.c.BigIP.VerifyInterval,
+		InstanceID:     r.c.BigIP.InstanceID,
 	}
-	return false
 }
 
-func joinBigipPath(partition, objName string) (string, error) {
-	if objName == "" {
-		return "", errors.New("object name is blank")
+// marshalConfig serializes the sections in the configured output format, YAML
+// is converted from the JSON so both formats share the same field names. JSON
+// is indented when pretty_print is set, the driver parses either
+func (r *F5Router) marshalConfig(sections map[string]interface{}) ([]byte, error) {
+	if r.c.BigIP.OutputFormat != config.YAMLOutput && r.c.BigIP.PrettyPrint {
+		return json.MarshalIndent(sections, "", "  ")
 	}
-	if partition == "" {
-		return objName, nil
+	output, err := json.Marshal(sections)
+	if nil != err || r.c.BigIP.OutputFormat != config.YAMLOutput {
+		return output, err
 	}
-	return fmt.Sprintf("/%s/%s", partition, objName), nil
-}
 
-type returns struct {
-	data []byte
-	err  error
+	var generic interface{}
+	err = json.Unmarshal(output, &generic)
+	if nil != err {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
 }
 
-func (r *F5Router) fetchExistingDataGroup(c *config.Config, name string) (*bigipResources.InternalDataGroup, error) {
-	url := fmt.Sprintf(
-		"%s/mgmt/tm/ltm/data-group/internal/~%s~%s",
-		r.c.BigIP.URL,
-		r.c.BigIP.Partitions[0],
-		name,
-	)
-	data, err := r.bigIPClient.Get(url, r.c.BigIP.User, r.c.BigIP.Pass)
+func (r *F5Router) writeInitialConfig() error {
+	sections := make(map[string]interface{})
+	sections["global"] = r.globalConfig()
+	sections["bigip"] = r.c.BigIP
+
+	output, err := r.marshalConfig(sections)
 	if nil != err {
-		// Encountered a timeout or temporary connection error so enter retry backoff
-		if err, ok := err.(net.Error); ok && (err.Timeout() || err.Temporary()) {
-			r.logger.Warn("bigip-client-get-recoverable-error", zap.Error(err))
-			done := make(chan returns)
+		return fmt.Errorf("failed marshaling initial config: %v", err)
+	}
+	n, err := r.write(output)
+	if nil != err {
+		return fmt.Errorf("failed writing initial config: %v", err)
+	} else if len(output) != n {
+		return fmt.Errorf("short write from initial config")
+	}
+	r.initialConfigWritten = true
 
-			go func() {
-				interval := 1
-				rvs := returns{}
+	return nil
+}
 
-				for {
-					// Log and set timer for backoff
-					r.logger.Warn("retry-backoff", zap.String("backoff-interval", fmt.Sprintf("Retrying in %d seconds", interval)))
-					timer := time.NewTimer(time.Second * time.Duration(interval))
-					<-timer.C
+// writeCleanupConfig writes the config without any resources so the driver
+// removes every object the controller created in its partition. The snapshot
+// goes with them so a restarted router starts empty
+func (r *F5Router) writeCleanupConfig() error {
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return err
+	}
+	pm := bigipResources.PartitionMap{}
+	initPartitionData(pm, partition)
 
-					// Attempt to connect to the BIG-IP signal channel if there is not a temporary or timeout error
-					rvs.data, rvs.err = r.bigIPClient.Get(url, r.c.BigIP.User, r.c.BigIP.Pass)
-					if doErr, ok := rvs.err.(net.Error); ok && !(doErr.Timeout() || doErr.Temporary()) {
-						rvs.data = nil
-						done <- rvs
-						break
-					}
+	sections := make(map[string]interface{})
+	sections["global"] = r.globalConfig()
+	sections["bigip"] = r.c.BigIP
+	sections["resources"] = pm
 
-					// Successfully connected to BIG-IP signal channel with the response
-					if rvs.err == nil {
-						done <- rvs
-						break
-					}
-					interval *= 2
-					r.logger.Warn("retry-backoff-encountered-error-retrying", zap.Error(rvs.err))
-				}
-			}()
+	output, err := r.marshalConfig(sections)
+	if nil != err {
+		return fmt.Errorf("failed marshaling cleanup config: %v", err)
+	}
+	n, err := r.write(output)
+	if nil != err {
+		return fmt.Errorf("failed writing cleanup config: %v", err)
+	} else if len(output) != n {
+		return fmt.Errorf("short write from cleanup config")
+	}
 
-			retVals := <-done
-			close(done)
-			if retVals.err != nil {
-				return nil, retVals.err
-			}
-			data = retVals.data
-		} else {
-			return nil, err
+	if path := r.c.BigIP.SnapshotFile; 0 != len(path) {
+		if err := os.Remove(path); nil != err && !os.IsNotExist(err) {
+			return fmt.Errorf("failed removing snapshot: %v", err)
 		}
 	}
+	return nil
+}
 
-	if strings.Contains(string(data), "was not found") {
-		return nil, fmt.Errorf("data group %s not found on the BIG-IP", InternalDataGroupName)
+// cleanup writes the cleanup config when the router stops on a signal with
+// cleanup_on_shutdown set, then gives the driver cleanup_wait seconds to apply
+// it. A follower leaves the objects to the leader and another signal cuts the
+// wait short
+func (r *F5Router) cleanup(signals <-chan os.Signal) {
+	if leader, _ := r.checkLeader(); !leader {
+		r.logger.Info("f5router-follower-skipping-cleanup")
+		return
+	}
+	if err := r.writeCleanupConfig(); nil != err {
+		r.logger.Error("f5router-cleanup-failed", zap.Error(err))
+		return
 	}
+	r.logger.Info("f5router-cleanup-written",
+		zap.Int("cleanup-wait", r.c.BigIP.CleanupWait))
 
-	var idg *bigipResources.InternalDataGroup
-	err = json.Unmarshal(data, &idg)
-	if nil != err {
-		return nil, err
+	select {
+	case <-time.After(time.Duration(r.c.BigIP.CleanupWait) * time.Second):
+	case <-signals:
 	}
+}
 
-	return idg, nil
+func (r *F5Router) runWorker(done chan<- struct{}) {
+	r.logger.Debug("f5router-starting-worker")
+	r.setWorkerRunning(true)
+	for r.process() {
+	}
+	r.setWorkerRunning(false)
+	r.logger.Debug("f5router-stopping-worker")
+	close(done)
 }
 
-// assignVSPort creates the holder BindAddr and Port the vs will use, these
-// virtuals are being routed to through an iRule using the virtual command
-func (r *F5Router) assignVSPort(vs *bigipResources.Virtual) error {
-	var va *bigipResources.VirtualAddress
-	var err error
-	key := vs.VirtualServerName
+func (r *F5Router) setWorkerRunning(running bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.workerRunning = running
+}
 
-	existingVS, exist := r.virtualResources[key]
-	// vs doesn't exist yet so we need to create the ip:port to use as the dest
-	if !exist {
-		// check if the info exists in the internalDataGroup
-		dgr, exist := r.internalDataGroup[key]
-		// the mapping doesn't exist yet so assign it
-		if !exist {
-			va, err = r.getAvailableVirtualAddress()
-			if nil != err {
-				return err
-			}
+// The strategy, controls and requires of the CF routing policies unless
+// policy_strategy, policy_controls or policy_requires replace them
+const defaultPolicyStrategy = "/Common/first-match"
 
-			data, errEncode := va.Encode()
-			if nil != errEncode {
-				return errEncode
-			}
-			r.internalDataGroup[key] = &bigipResources.InternalDataGroupRecord{
-				Name: key,
-				Data: data,
-			}
+var (
+	defaultPolicyControls = []string{"forwarding"}
+	defaultPolicyRequires = []string{"http"}
+)
 
-		} else {
-			va, err = dgr.ReturnTier2VirtualAddress()
-			if nil != err {
-				return err
+// verifyPolicySettings defaults and checks the strategy, controls and requires
+// of the CF routing policies. The routing rules forward HTTP requests, so the
+// controls must keep forwarding and the requires must keep http
+func (r *F5Router) verifyPolicySettings() error {
+	if 0 == len(r.c.BigIP.PolicyStrategy) {
+		r.c.BigIP.PolicyStrategy = defaultPolicyStrategy
+	} else if !validBigipPath(r.c.BigIP.PolicyStrategy) {
+		return fmt.Errorf("policy_strategy must be a /partition/name path, got: %s",
+			r.c.BigIP.PolicyStrategy)
+	}
+
+	for _, setting := range []struct {
+		name     string
+		values   *[]string
+		defaults []string
+		needed   string
+	}{
+		{"policy_controls", &r.c.BigIP.PolicyControls, defaultPolicyControls, "forwarding"},
+		{"policy_requires", &r.c.BigIP.PolicyRequires, defaultPolicyRequires, "http"},
+	} {
+		if 0 == len(*setting.values) {
+			*setting.values = append([]string{}, setting.defaults...)
+			continue
+		}
+		for _, v := range *setting.values {
+			if !policyKeywordPattern.MatchString(v) {
+				return fmt.Errorf("invalid %s entry: %q", setting.name, v)
 			}
 		}
-
-		dest, err := verifyDestAddress(va, r.c.BigIP.Partitions[0])
-		if err != nil {
-			return err
+		if !checkForString(*setting.values, setting.needed) {
+			return fmt.Errorf("%s must include %s, got: %v", setting.name, setting.needed, *setting.values)
 		}
-		vs.Destination = dest
-
-		return nil
 	}
-	// if the vs does exist set the destination on our route update to the current dest
-	vs.Destination = existingVS.Destination
 	return nil
 }
 
-func (r *F5Router) getAvailableVirtualAddress() (*bigipResources.VirtualAddress, error) {
-	var va *bigipResources.VirtualAddress
-	// Use a reaped va if we have one
-	if len(r.tier2VSInfo.reapedPorts) != 0 {
-		va = r.tier2VSInfo.reapedPorts[0]
-		// delete from a slice https://github.com/golang/go/wiki/SliceTricks
-		r.tier2VSInfo.reapedPorts[0] = r.tier2VSInfo.reapedPorts[len(r.tier2VSInfo.reapedPorts)-1]
-		r.tier2VSInfo.reapedPorts[len(r.tier2VSInfo.reapedPorts)-1] = nil
-		r.tier2VSInfo.reapedPorts = r.tier2VSInfo.reapedPorts[:len(r.tier2VSInfo.reapedPorts)-1]
-		return va, nil
+// routingPolicy is a CF routing policy and the rule maps it is made of
+type routingPolicy struct {
+	name     string
+	ruleMaps []bigipResources.RuleMap
+}
+
+// routingPolicies returns the CF routing policies in the order they are
+// attached to the HTTP virtuals
+func (r *F5Router) routingPolicies() []routingPolicy {
+	exact, wildcards := r.httpRules(r.r), r.httpRules(r.wildcards)
+	if r.c.BigIP.SplitRoutingPolicies {
+		return []routingPolicy{
+			{r.namespaced(CFRoutingPolicyName), []bigipResources.RuleMap{r.redirects, exact}},
+			{r.namespaced(CFWildcardRoutingPolicyName), []bigipResources.RuleMap{wildcards}},
+		}
 	}
-	// No reaped va so check for the next available one
-	va = &bigipResources.VirtualAddress{
-		BindAddr: r.tier2VSInfo.holderIP.String(),
-		Port:     r.tier2VSInfo.holderPort,
+	// trailing slash redirects go first so they aren't forwarded by the
+	// path segment match of their route
+	return []routingPolicy{
+		{r.namespaced(CFRoutingPolicyName), []bigipResources.RuleMap{r.redirects, exact, wildcards}},
 	}
-	_, found := r.tier2VSInfo.usedPorts[va.String()]
-	for found {
-		// check if we are at the last address valid for a va
-		if r.tier2VSInfo.holderPort == 65535 {
-			// increement the holderip to the next address
-			err := r.incrementHolderIP()
-			if nil != err {
-				return nil, err
-			}
-			// reset our ports back to our starting point
-			r.tier2VSInfo.holderPort = 10000
-		} else {
-			r.tier2VSInfo.holderPort = r.tier2VSInfo.holderPort + 1
-			va = &bigipResources.VirtualAddress{
-				BindAddr: r.tier2VSInfo.holderIP.String(),
-				Port:     r.tier2VSInfo.holderPort,
-			}
-			_, found = r.tier2VSInfo.usedPorts[va.String()]
+}
+
+// httpRules leaves the passthrough rules out of a rule map, they are matched
+// on the client hello by the passthrough virtual instead
+func (r *F5Router) httpRules(rm bigipResources.RuleMap) bigipResources.RuleMap {
+	if 0 == r.c.BigIP.PassthroughPort {
+		return rm
+	}
+	rules := make(bigipResources.RuleMap)
+	for uri, rule := range rm {
+		if !passthroughRule(rule) {
+			rules[uri] = rule
 		}
 	}
-	r.tier2VSInfo.usedPorts[va.String()] = va
-	return va, nil
+	return rules
 }
 
-func (r *F5Router) incrementHolderIP() error {
-	ipCopy := make(net.IP, len(r.tier2VSInfo.holderIP))
-	copy(ipCopy, r.tier2VSInfo.holderIP)
-	// https://groups.google.com/d/msg/golang-nuts/zlcYA4qk-94/TWRFHeXJCcYJ
-	for i := len(ipCopy) - 1; i >= 0; i-- {
-		ipCopy[i]++
-		if ipCopy[i] > 0 {
-			break
+// passthroughRules returns the exact and wildcard rules of the passthrough
+// routes
+func (r *F5Router) passthroughRules() bigipResources.RuleMap {
+	rules := make(bigipResources.RuleMap)
+	for _, rm := range []bigipResources.RuleMap{r.r, r.wildcards} {
+		for uri, rule := range rm {
+			if passthroughRule(rule) {
+				rules[uri] = rule
+			}
 		}
 	}
-	// verify the ip is in the range provided
-	contains := r.tier2VSInfo.ipNet.Contains(ipCopy)
-	if !contains {
-		return errors.New("Ran out of available IP addresses. Restart the controller with a larger address space")
-	}
-	r.tier2VSInfo.holderIP = ipCopy
-	return nil
+	return rules
 }
 
-// processBrokerDataGroup uses the cached broker data group off the BIG-IP to populate
-// the bindIDRouteURIPlanNameMap and create orphaned resources for those routes
-func (r *F5Router) processBrokerDataGroup(dg *bigipResources.InternalDataGroup) {
-	newbindIDRouteURIPlanNameMap := make(map[string]string)
-	planNamePlanIDMap := make(map[string]string)
+// passthroughRule is true for a rule matching the SNI server name, a
+// passthrough rule always has a host condition
+func passthroughRule(rule *bigipResources.Rule) bool {
+	return 0 != len(rule.Conditions) && rule.Conditions[0].SSLExtension
+}
 
-	r.plansMap.lock.Lock()
-	for _, plan := range r.plansMap.plans {
-		planNamePlanIDMap[plan.Name] = plan.ID
+// routingPolicyNames returns the names of the CF routing policies in the order
+// they are attached to the HTTP virtuals
+func (r *F5Router) routingPolicyNames() []string {
+	var names []string
+	for _, p := range r.routingPolicies() {
+		names = append(names, p.name)
 	}
-	r.plansMap.lock.Unlock()
+	return names
+}
 
-	for _, record := range dg.Records {
-		newbindIDRouteURIPlanNameMap[record.Name] = record.Data
+// policyShardNames returns the names of the policies the rules of a policy
+// are sharded into, a policy within max_policy_rules keeps its name and the
+// shards of a larger one are numbered from 1
+func (r *F5Router) policyShardNames(name string, rules int) []string {
+	max := r.c.BigIP.MaxPolicyRules
+	if 0 == max || rules <= max {
+		return []string{name}
+	}
+	names := make([]string, (rules+max-1)/max)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s-%d", name, i+1)
+	}
+	return names
+}
 
-		routeURI, planName, err := record.ReturnRouteURIAndPlanName()
-		if err != nil {
-			r.logger.Warn("process-broker-data-group-get-routeURI-planName-error", zap.Error(err))
-			continue
+// shardPolicy splits a policy into policies of at most max_policy_rules rules
+// each, keeping the order of the rules across the shards
+func (r *F5Router) shardPolicy(plcy *bigipResources.Policy) bigipResources.Policies {
+	names := r.policyShardNames(plcy.Name, len(plcy.Rules))
+	if 1 == len(names) {
+		return bigipResources.Policies{plcy}
+	}
+	max := r.c.BigIP.MaxPolicyRules
+	var shards bigipResources.Policies
+	for i, name := range names {
+		shard := *plcy
+		shard.Name = name
+		end := (i + 1) * max
+		if end > len(plcy.Rules) {
+			end = len(plcy.Rules)
 		}
+		shard.Rules = plcy.Rules[i*max : end]
+		for j, rule := range shard.Rules {
+			rule.Ordinal = j
+		}
+		shards = append(shards, &shard)
+	}
+	r.logger.Debug("f5router-policy-sharded",
+		zap.String("policy", plcy.Name),
+		zap.Int("number-rules", len(plcy.Rules)),
+		zap.Int("number-shards", len(shards)),
+	)
+	return shards
+}
 
-		// Plan was not found so foundPlan is unitialized
-		foundPlanID := planNamePlanIDMap[planName]
-		if foundPlanID == "" {
-			r.logger.Warn(
-				"process-broker-data-group-find-plan-error",
-				zap.String("plan-not-found-skipping", fmt.Sprintf("Plan %s not found for route %s", planName, routeURI)),
-			)
+// attachPolicyShards replaces the routing policies of a routing virtual with
+// the shards they are currently split into
+func (r *F5Router) attachPolicyShards(vs *bigipResources.Virtual) *bigipResources.Virtual {
+	if 0 == r.c.BigIP.MaxPolicyRules {
+		return vs
+	}
+	shards := make(map[string][]string)
+	for _, p := range r.routingPolicies() {
+		rules := 0
+		for _, rm := range p.ruleMaps {
+			rules += len(rm)
+		}
+		shards[p.name] = r.policyShardNames(p.name, rules)
+	}
+	attached := *vs
+	attached.Policies = nil
+	for _, ref := range vs.Policies {
+		names, ok := shards[ref.Name]
+		if !ok {
+			attached.Policies = append(attached.Policies, ref)
 			continue
 		}
+		for _, name := range names {
+			attached.Policies = append(attached.Policies, &bigipResources.NameRef{
+				Name:      name,
+				Partition: ref.Partition,
+			})
+		}
+	}
+	return &attached
+}
 
-		ru, err := NewUpdate(r.logger, routeUpdate.Bind, route.Uri(routeURI), nil, foundPlanID)
-		if err != nil {
-			r.logger.Warn("process-broker-data-group-new-update-error", zap.Error(err))
+// namespaced prefixes the names of the policies and rules with the configured
+// namespace so controllers sharing a partition don't overwrite each other
+func (r *F5Router) namespaced(name string) string {
+	if 0 == len(r.c.BigIP.Namespace) {
+		return name
+	}
+	return r.c.BigIP.Namespace + "-" + name
+}
+
+func (r *F5Router) createPolicies(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for _, p := range r.routingPolicies() {
+		rules := 0
+		for _, rm := range p.ruleMaps {
+			rules += len(rm)
+		}
+		if 0 == rules {
 			continue
 		}
-		r.UpdateRoute(ru)
+		pm[partition].Policies = append(pm[partition].Policies,
+			r.shardPolicy(r.makeRoutePolicy(p.name, p.ruleMaps...))...)
+	}
+	// the HTTPS virtual always references the HSTS policy, even without routes
+	if r.c.BigIP.HSTS && r.c.RoutingMode != config.TCP {
+		pm[partition].Policies = append(pm[partition].Policies, r.makeHSTSPolicy())
+	}
+	if 0 != r.c.BigIP.PassthroughPort {
+		if rules := r.passthroughRules(); 0 != len(rules) {
+			pm[partition].Policies = append(pm[partition].Policies, r.makePassthroughPolicy(rules))
+		}
 	}
+}
 
-	r.logger.Debug(
-		"process-broker-data-group-processed-data-group",
-		zap.Object("data-group", newbindIDRouteURIPlanNameMap),
-	)
+// makePassthroughPolicy forwards the connections of the passthrough virtual to
+// the pool of the route their SNI server name matches. Without a clientssl
+// profile the client hello is only parsed for a policy requiring
+// ssl-persistence
+func (r *F5Router) makePassthroughPolicy(rules bigipResources.RuleMap) *bigipResources.Policy {
+	plcy := r.makeRoutePolicy(r.namespaced(CFPassthroughPolicyName), rules)
+	plcy.Controls = []string{"forwarding"}
+	plcy.Requires = []string{"ssl-persistence"}
+	return plcy
+}
 
-	r.bindIDRouteURIPlanNameMap.lock.Lock()
-	defer r.bindIDRouteURIPlanNameMap.lock.Unlock()
-	r.bindIDRouteURIPlanNameMap.data = newbindIDRouteURIPlanNameMap
+// makeHSTSPolicy inserts the Strict-Transport-Security header into every
+// response of the HTTPS virtual
+func (r *F5Router) makeHSTSPolicy() *bigipResources.Policy {
+	return &bigipResources.Policy{
+		Controls: []string{},
+		Legacy:   true,
+		Name:     r.namespaced(CFHSTSPolicyName),
+		Requires: []string{"http"},
+		Rules: []*bigipResources.Rule{{
+			Name: "hsts",
+			Actions: []*bigipResources.Action{{
+				Name:       "0",
+				HTTPHeader: true,
+				Insert:     true,
+				Response:   true,
+				TmName:     "Strict-Transport-Security",
+				Value:      fmt.Sprintf("max-age=%d", r.c.BigIP.HSTSMaxAge),
+			}},
+			Conditions: []*bigipResources.Condition{},
+		}},
+		Strategy: "/Common/first-match",
+	}
 }
 
-// processCachedDataGroup uses the cached data group off the BIG-IP to populate
-// our map of used ports and populate the internalDataGroup
-func (r *F5Router) processCachedDataGroup(dg *bigipResources.InternalDataGroup) {
-	newDataGroup := make(map[string]*bigipResources.InternalDataGroupRecord)
-	for _, record := range dg.Records {
-		// Decode the record from the bigip to a virtual address
-		va, err := record.ReturnTier2VirtualAddress()
+func (r *F5Router) createVirtuals(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for name, virtual := range r.virtualResources {
+		if HTTPRouterName == name || HTTPSRouterName == name {
+			virtual = r.attachPolicyShards(virtual)
+		}
+		pm[partition].Virtuals = append(pm[partition].Virtuals, virtual)
+	}
+
+	// Put the external addresses of the routing virtuals in the traffic
+	// group so they fail over with the device group, a referenced virtual
+	// address keeps the settings it was created with
+	if 0 != len(r.c.BigIP.TrafficGroup) && r.c.RoutingMode != config.TCP &&
+		0 == len(r.c.BigIP.VirtualAddressRef) {
+		httpAddr := externalAddr(r.c, httpVirtualType)
+		addrs := []string{httpAddr}
+		if httpsAddr := externalAddr(r.c, httpsVirtualType); httpsAddr != httpAddr {
+			addrs = append(addrs, httpsAddr)
+		}
+		for _, addr := range addrs {
+			pm[partition].VirtualAddresses = append(pm[partition].VirtualAddresses,
+				&bigipResources.VirtualAddressConfig{
+					Name:         addr,
+					Address:      addr,
+					TrafficGroup: r.c.BigIP.TrafficGroup,
+				})
+		}
+	}
+
+	// A dedicated virtual only exists while its route has a pool
+	for name, va := range r.dedicatedVirtuals {
+		if _, ok := r.poolResources[name]; !ok {
+			continue
+		}
+		vs, err := r.makeDedicatedVirtual(name, va)
 		if nil != err {
-			r.logger.Warn("process-cached-data-group-error", zap.Error(err), zap.Object("record", record))
+			r.logger.Warn("f5router-dedicated-virtual-error", zap.String("pool", name), zap.Error(err))
 			continue
 		}
+		pm[partition].Virtuals = append(pm[partition].Virtuals, vs)
+	}
+}
 
-		vaIP := net.ParseIP(va.BindAddr)
-		// Only keep the record and va if the IP and port is in the accepted range
-		if (nil != vaIP) && (r.tier2VSInfo.ipNet.Contains(vaIP) && (va.Port <= 65535)) {
-			_, ok := r.tier2VSInfo.usedPorts[va.String()]
-			if !ok {
-				r.tier2VSInfo.usedPorts[va.String()] = va
-				newDataGroup[record.Name] = record
+// makeDedicatedVirtual creates a virtual that sends everything it receives to
+// the route's pool without going through the routing policy
+func (r *F5Router) makeDedicatedVirtual(
+	name string,
+	va bigipResources.VirtualAddress,
+) (*bigipResources.Virtual, error) {
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return nil, err
+	}
+	dest, err := verifyDestAddress(&va, partition)
+	if nil != err {
+		return nil, err
+	}
+	poolRef := poolPath(partition, name)
+	if "" == poolRef {
+		return nil, fmt.Errorf("invalid pool path for %s", name)
+	}
+	prfls, err := generateProfileList(r.c.BigIP.Profiles, "all")
+	if nil != err {
+		r.logger.Warn("f5router-skipping-profile-names", zap.Error(err))
+	}
+	vs := &bigipResources.Virtual{
+		VirtualServerName:     name + dedicatedSuffix,
+		PoolName:              poolRef,
+		Mode:                  virtualMode(r.c, dedicatedVirtualType),
+		Enabled:               true,
+		Destination:           dest,
+		Profiles:              prfls,
+		SourceAddrTranslation: bigipResources.SourceAddrTranslation{Type: "automap"},
+	}
+	setAutoLastHop(vs, r.c)
+	if err := restrictVLANs(vs, r.c.BigIP.VLANs); nil != err {
+		r.logger.Warn("f5router-skipping-vlan-names", zap.Error(err))
+	}
+	return vs, nil
+}
+
+func (r *F5Router) createPools(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	// members are kept in the order they were added, write them sorted so the
+	// same members always give the same config
+	for _, pool := range r.poolResources {
+		sorted := *pool
+		sorted.Members = sortMembers(pool.Members)
+		if r.disabledPools[pool.Name] {
+			for i := range sorted.Members {
+				sorted.Members[i].Session = "user-disabled"
 			}
 		}
+		sorted.MinActiveMembers = r.minActiveMembers(len(pool.Members))
+		if config.InlineMonitors == r.c.BigIP.MonitorMode {
+			inlineMonitors(&sorted, partition, r.monitorResources[pool.Name])
+		}
+		pm[partition].Pools = append(pm[partition].Pools, &sorted)
 	}
-	r.logger.Debug("add-ports-to-used-ports", zap.Object("used-ports", r.tier2VSInfo.usedPorts))
-	r.internalDataGroup = newDataGroup
+	sort.Slice(pm[partition].Pools, func(i, j int) bool {
+		return pm[partition].Pools[i].Name < pm[partition].Pools[j].Name
+	})
 }
 
-// truncateInternalDataGroup cleans up after our first drain of the queue
-// Create a new data group and list of used ports then compare the old list
-// of used ports to the new, anything not in the new list is added to
-// reapedPorts for reuse
-func (r *F5Router) truncateInternalDataGroup() {
-	newDataGroup := make(map[string]*bigipResources.InternalDataGroupRecord)
-	newUsedPorts := make(map[string]*bigipResources.VirtualAddress)
+// minActiveMembers is the number of members that must be up for a pool with
+// members to be up, a pool never needs more members than it has
+func (r *F5Router) minActiveMembers(members int) int {
+	if r.c.BigIP.MinActiveMembers > members {
+		return members
+	}
+	return r.c.BigIP.MinActiveMembers
+}
 
-	for vsName := range r.virtualResources {
-		record, exists := r.internalDataGroup[vsName]
-		if exists {
-			va, err := record.ReturnTier2VirtualAddress()
-			if nil != err {
-				r.logger.Warn("truncate-internal-data-group-error", zap.Error(err), zap.Object("record", record))
+// sortMembers returns a copy of the members ordered by address and port, IP
+// addresses compare by value so IPv4 and IPv6 sort apart and numerically, names
+// sort after them
+func sortMembers(members []bigipResources.Member) []bigipResources.Member {
+	sorted := append([]bigipResources.Member(nil), members...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		ipA, ipB := net.ParseIP(a.Address), net.ParseIP(b.Address)
+		switch {
+		case nil != ipA && nil == ipB:
+			return true
+		case nil == ipA && nil != ipB:
+			return false
+		case nil != ipA:
+			if c := bytes.Compare(ipA.To16(), ipB.To16()); 0 != c {
+				return c < 0
+			}
+		case a.Address != b.Address:
+			return a.Address < b.Address
+		}
+		return a.Port < b.Port
+	})
+	return sorted
+}
+
+func (r *F5Router) createiRules(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for _, rule := range r.ruleResources {
+		pm[partition].IRules = append(pm[partition].IRules, rule)
+	}
+
+	// the timeouts iRules are written while a virtual references them
+	timeouts := make(map[string]bool)
+	for _, vs := range r.virtualResources {
+		for _, ref := range vs.IRules {
+			name := path.Base(ref)
+			request, response, ok := bigipResources.ParseRouteTimeoutsiRuleName(name)
+			if !ok || timeouts[name] {
 				continue
 			}
-			newDataGroup[vsName] = record
-			newUsedPorts[va.String()] = va
+			timeouts[name] = true
+			pm[partition].IRules = append(pm[partition].IRules, &bigipResources.IRule{
+				Name: name,
+				Code: bigipResources.RouteTimeoutsiRule(request, response),
+			})
 		}
 	}
-	r.logger.Debug(
-		"truncate-internal-data-group",
-		zap.Object("old-used-ports", r.tier2VSInfo.usedPorts),
-		zap.Object("new-used-ports", newUsedPorts),
-	)
-	for key, value := range r.tier2VSInfo.usedPorts {
-		if _, ok := newUsedPorts[key]; !ok {
-			r.tier2VSInfo.reapedPorts = append(r.tier2VSInfo.reapedPorts, value)
+}
+
+// inlineMonitors moves the definitions of the pool's monitors into the pool,
+// only the monitors that already exist on the BIG-IP stay referenced by name
+func inlineMonitors(pool *bigipResources.Pool, partition string, monitors []*bigipResources.Monitor) {
+	if 0 == len(monitors) {
+		return
+	}
+	defined := make(map[string]bool)
+	for _, monitor := range monitors {
+		defined["/"+partition+"/"+monitor.Name] = true
+	}
+	var names []string
+	for _, name := range pool.MonitorNames {
+		if !defined[name] {
+			names = append(names, name)
+		}
+	}
+	pool.MonitorNames = names
+	pool.HealthMonitors = monitors
+}
+
+// createMonitors writes the monitors section, a definition shared by pools is
+// written once under its name. Inline monitors are written with their pools
+func (r *F5Router) createMonitors(pm bigipResources.PartitionMap, partition string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if config.InlineMonitors == r.c.BigIP.MonitorMode {
+		return
+	}
+	pools := make([]string, 0, len(r.monitorResources))
+	for name := range r.monitorResources {
+		pools = append(pools, name)
+	}
+	sort.Strings(pools)
+
+	added := make(map[string]*bigipResources.Monitor)
+	for _, pool := range pools {
+		for _, monitor := range r.monitorResources[pool] {
+			if addedMonitor, found := added[monitor.Name]; found {
+				if *addedMonitor != *monitor {
+					r.logger.Warn("f5router-conflicting-monitor-definitions",
+						zap.String("monitor", monitor.Name),
+						zap.String("pool", pool),
+					)
+				}
+				continue
+			}
+			added[monitor.Name] = monitor
+			pm[partition].Monitors = append(pm[partition].Monitors, monitor)
+		}
+	}
+	sort.Slice(pm[partition].Monitors, func(i, j int) bool {
+		return pm[partition].Monitors[i].Name < pm[partition].Monitors[j].Name
+	})
+}
+
+func (r *F5Router) createInternalDataGroups(
+	dataGroups map[string]map[string]*bigipResources.InternalDataGroupRecord,
+	pm bigipResources.PartitionMap,
+	partition string, wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	for name, dataGroup := range dataGroups {
+		internalDataGroup := bigipResources.NewInternalDataGroup(name)
+		for _, record := range dataGroup {
+			internalDataGroup.Records = append(internalDataGroup.Records, record)
+		}
+		pm[partition].InternalDataGroups = append(pm[partition].InternalDataGroups, internalDataGroup)
+	}
+}
+
+// Create a partition entry in the map if it doesn't exist
+func initPartitionData(pm bigipResources.PartitionMap, partition string) {
+	if _, ok := pm[partition]; !ok {
+		pm[partition] = &bigipResources.Resources{}
+	}
+}
+
+// Populates a data group from the mutexBindIDRouteURIPlanNameMap
+func populateBrokerDataGroup(brokerData *mutexBindIDRouteURIPlanNameMap) map[string]*bigipResources.InternalDataGroupRecord {
+	dg := make(map[string]*bigipResources.InternalDataGroupRecord)
+
+	brokerData.lock.Lock()
+	defer brokerData.lock.Unlock()
+
+	for k, v := range brokerData.data {
+		record := &bigipResources.InternalDataGroupRecord{
+			Name: k,
+			Data: v,
+		}
+		dg[k] = record
+	}
+	return dg
+}
+
+func (r *F5Router) createResources() (bigipResources.PartitionMap, error) {
+	// Organize the data as a map of arrays of resources (per partition)
+	pm := bigipResources.PartitionMap{}
+
+	//FIXME need to handle multiple partitions
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return nil, err
+	}
+	initPartitionData(pm, partition)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go r.createPolicies(pm, partition, &wg)
+
+	wg.Add(1)
+	go r.createVirtuals(pm, partition, &wg)
+
+	wg.Add(1)
+	go r.createPools(pm, partition, &wg)
+
+	wg.Add(1)
+	go r.createiRules(pm, partition, &wg)
+
+	wg.Add(1)
+	go r.createMonitors(pm, partition, &wg)
+
+	dataGroups := make(map[string]map[string]*bigipResources.InternalDataGroupRecord)
+	if r.c.BrokerMode {
+		brokerInternalDataGroup := populateBrokerDataGroup(&r.bindIDRouteURIPlanNameMap)
+		dataGroups[BrokerDataGroupName] = brokerInternalDataGroup
+	}
+	dataGroups[InternalDataGroupName] = r.internalDataGroup
+
+	wg.Add(1)
+	go r.createInternalDataGroups(dataGroups, pm, partition, &wg)
+
+	wg.Wait()
+
+	return pm, nil
+}
+
+// rejection is the error of a work item the router refuses for what it holds,
+// the item fails the same way however often it is retried
+type rejection struct {
+	error
+}
+
+// reject marks err as a rejection of the work item
+func reject(err error) error {
+	return rejection{err}
+}
+
+// unsupported records a work item the router cannot handle, these point at a
+// bug or a version mismatch between the router and whatever queued the item
+func (r *F5Router) unsupported(item interface{}, err error) error {
+	r.logger.Warn("f5router-unknown-workitem", zap.Error(err))
+	if nil != r.reporter {
+		r.reporter.CaptureUnsupportedWorkItem()
+	}
+	return err
+}
+
+// retryItem requeues a failed work item with the queue's rate limiting until
+// it has been retried max_item_retries times, after which it is dropped. A
+// rejected item is dropped straight away
+func (r *F5Router) retryItem(item interface{}, err error) {
+	if _, ok := err.(rejection); ok {
+		r.queue.Forget(item)
+		return
+	}
+	max := r.c.BigIP.MaxItemRetries
+	if 0 == max {
+		return
+	}
+	retries := r.queue.NumRequeues(item)
+	if retries < max {
+		r.logger.Debug("f5router-retrying-work-item",
+			zap.String("item", fmt.Sprintf("%T", item)),
+			zap.Int("attempt", retries+1),
+		)
+		r.queue.AddRateLimited(item)
+		return
+	}
+	r.queue.Forget(item)
+	r.logger.Warn("f5router-dropping-work-item",
+		zap.String("item", fmt.Sprintf("%T", item)),
+		zap.Int("retries", retries),
+	)
+}
+
+func (r *F5Router) process() bool {
+	item, quit := r.queue.Get()
+	if quit {
+		r.logger.Debug("f5router-quit-signal-received")
+		return false
+	}
+
+	defer r.queue.Done(item)
+
+	var err error
+	// unsupported items fail the same way every time, retrying won't help
+	var unsupported bool
+	// the callbacks run once the router is unlocked, so they can call back
+	// into it
+	defer func() {
+		if unsupported && nil != r.onUnsupported {
+			r.onUnsupported(item, err)
+		}
+		if nil != err && nil != r.onError {
+			r.onError(item, err)
+		}
+	}()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// quiet items leave the resources as they were, there is nothing to write
+	var quiet bool
+	r.logger.Debug("f5router-received-update-request")
+	// an item can't be interrupted half way through changing the resources,
+	// a slow item is only reported while it runs so a stalled worker is visible
+	started := time.Now()
+	var slow *time.Timer
+	if warning := r.slowItemWarning(); 0 != warning {
+		slow = time.AfterFunc(warning, func() {
+			r.logger.Warn("f5router-slow-work-item",
+				zap.String("item", fmt.Sprintf("%T", item)),
+				zap.Duration("after", warning),
+			)
+		})
+	}
+	switch ru := item.(type) {
+	case updateHTTP:
+		if ru.Op() == routeUpdate.Add {
+			err = r.processRouteAdd(ru)
+		} else if ru.Op() == routeUpdate.Remove {
+			err = r.processRouteRemove(ru)
+		} else if ru.Op() == routeUpdate.Bind {
+			r.processRouteBind(ru)
+		} else if ru.Op() == routeUpdate.Unbind {
+			err = r.processRouteUnbind(ru)
+		} else {
+			err = r.unsupported(item, fmt.Errorf(
+				"unsupported operation %s for HTTP route %s", ru.Op(), ru.Route()))
+			unsupported = true
+		}
+	case updateTCP:
+		if ru.Op() == routeUpdate.Add {
+			err = r.processTCPRouteAdd(ru)
+		} else if ru.Op() == routeUpdate.Remove {
+			err = r.processTCPRouteRemove(ru)
+		} else {
+			err = r.unsupported(item, fmt.Errorf(
+				"unsupported operation %s for TCP route %s", ru.Op(), ru.Route()))
+			unsupported = true
+		}
+	case poolExpiry:
+		r.processPoolExpiry(ru)
+	case memberDrain:
+		r.processMemberDrain(ru)
+	case configRetry:
+		// nothing to process, the config is written again below
+	case poolForceRemove:
+		r.processPoolForceRemove(ru)
+	case virtualRemove:
+		r.processVirtualRemove(ru)
+	case poolEndpointRemove:
+		r.processPoolEndpointRemove(ru)
+	case wildcardsClear:
+		r.processWildcardsClear()
+	case poolState:
+		r.processPoolState(ru)
+	case poolMembersSet:
+		err = r.processPoolMembersSet(ru)
+	case dedicatedVirtual:
+		err = r.processDedicatedVirtual(ru)
+	case snapshotExpiry:
+		r.processSnapshotExpiry()
+	case leaderCheck:
+		// leadership is checked before writing below
+		r.queue.AddAfter(ru, r.leaderCheckInterval())
+		quiet = true
+	case memberSweep:
+		// a sweep without evictions has nothing to write
+		quiet = 0 == r.processMemberSweep()
+		r.queue.AddAfter(ru, r.memberSweepInterval())
+	default:
+		err = r.unsupported(item, errors.New("workqueue delivered unsupported work type"))
+		unsupported = true
+	}
+	if nil != slow && !slow.Stop() {
+		r.logger.Warn("f5router-slow-work-item-done",
+			zap.String("item", fmt.Sprintf("%T", item)),
+			zap.Duration("took", time.Since(started)),
+		)
+	}
+
+	// A failed item only affects its own route, the config is still written
+	// for everything else
+	if nil != err {
+		r.logger.Warn("f5router-process-error", zap.Error(err))
+		if !unsupported {
+			r.retryItem(item, err)
+		}
+	} else if _, ok := item.(configRetry); !ok {
+		// configRetry keeps its requeues to back off failed writes
+		r.queue.Forget(item)
+	}
+
+	l := r.queue.Len()
+	overdue := r.writeOverdue()
+	if 0 == l || overdue {
+		if 0 == l && !r.firstSyncDone {
+			r.truncateInternalDataGroup()
+			r.firstSyncDone = true
+		}
+		if 0 != l {
+			r.logger.Info("f5router-forcing-stale-write", zap.Int("length", l))
+		}
+		r.pendingSince = time.Time{}
+		leader, gained := r.checkLeader()
+		if !leader {
+			r.logger.Debug("f5router-follower-skipping-write")
+		} else if gained || !quiet {
+			// a new leader writes everything it has tracked as a follower
+			r.checkWrite(r.writeConfig())
+		}
+	} else {
+		if r.pendingSince.IsZero() {
+			r.pendingSince = time.Now()
+		}
+		r.logger.Debug("f5router-write-not-ready",
+			zap.Int("length", l),
+		)
+	}
+	return true
+}
+
+// writeOverdue reports whether changes have waited on a busy queue for longer
+// than the configured max staleness
+func (r *F5Router) writeOverdue() bool {
+	if r.c.BigIP.MaxStaleness <= 0 || r.pendingSince.IsZero() {
+		return false
+	}
+	max := time.Duration(r.c.BigIP.MaxStaleness) * time.Second
+	return time.Since(r.pendingSince) >= max
+}
+
+// write hands the output to the writer one write at a time, so writes from
+// different paths never interleave
+func (r *F5Router) write(output []byte) (int, error) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	return r.writer.Write(output)
+}
+
+// writeConfig outputs the current resources for the driver
+func (r *F5Router) writeConfig() error {
+	sections := make(map[string]interface{})
+
+	sections["global"] = r.globalConfig()
+
+	sections["bigip"] = r.c.BigIP
+
+	resources, err := r.createResources()
+	if nil != err {
+		return fmt.Errorf("failed creating resources: %v", err)
+	}
+	sections["resources"] = resources
+
+	r.logger.Debug("f5router-drain", zap.Object("writing", sections))
+
+	output, err := r.marshalConfig(sections)
+	if nil != err {
+		return fmt.Errorf("failed marshaling config: %v", err)
+	}
+	n, err := r.write(output)
+	if nil != err {
+		return fmt.Errorf("failed writing config: %v", err)
+	} else if len(output) != n {
+		return fmt.Errorf("short write from config")
+	}
+
+	if err := r.saveSnapshot(); nil != err {
+		r.logger.Warn("f5router-snapshot-error", zap.Error(err))
+	}
+
+	members := 0
+	for _, pool := range r.poolResources {
+		members += len(pool.Members)
+	}
+	r.logger.Debug("f5router-config-written",
+		zap.Int("number-services", len(r.virtualResources)),
+		zap.Int("number-pools", len(r.poolResources)),
+		zap.Int("number-pool-members", members),
+		zap.Int("number-exact-rules", len(r.r)),
+		zap.Int("number-wildcard-rules", len(r.wildcards)),
+	)
+	return nil
+}
+
+// checkWrite retries failed config writes when max_write_failures is set and
+// stops the router once that many writes in a row have failed
+func (r *F5Router) checkWrite(err error) {
+	r.writeStatus.LastAttempt = time.Now()
+	if nil == err {
+		r.writes++
+		r.writeStatus.LastWrite = r.writeStatus.LastAttempt
+		r.writeStatus.LastError = ""
+		r.writeFailures = 0
+		r.queue.Forget(configRetry{})
+		return
+	}
+
+	r.writeStatus.LastError = err.Error()
+	r.failedWrites++
+	r.writeFailures++
+	r.logger.Warn("f5router-config-write-error",
+		zap.Error(err),
+		zap.Int("consecutive-failures", r.writeFailures),
+	)
+
+	max := r.c.BigIP.MaxWriteFailures
+	if 0 == max {
+		return
+	}
+	if r.writeFailures >= max {
+		select {
+		case r.fatal <- fmt.Errorf("config write failed %d consecutive times: %v", r.writeFailures, err):
+		default:
+		}
+		return
+	}
+	r.queue.AddRateLimited(configRetry{})
+}
+
+// makePool create Pool-Only configuration item
+func makePool(
+	name string,
+	descrip string,
+	members []bigipResources.Member,
+	balanceMode string,
+	hmNames []string,
+) *bigipResources.Pool {
+
+	return &bigipResources.Pool{
+		Name:         name,
+		Balance:      balanceMode,
+		Members:      members,
+		MonitorNames: hmNames,
+		Description:  descrip,
+	}
+}
+
+func verifyDestAddress(va *bigipResources.VirtualAddress, partition string) (string, error) {
+	ip, rd := splitIPWithRouteDomain(va.BindAddr)
+	if len(rd) > 0 {
+		rd = "%" + rd
+	}
+	addr := net.ParseIP(va.BindAddr)
+	if nil != addr {
+		var format string
+		if nil != addr.To4() {
+			format = "/%s/%s%s:%d"
+		} else {
+			format = "/%s/%s%s.%d"
+		}
+		destination := fmt.Sprintf(
+			format,
+			partition,
+			ip,
+			rd,
+			va.Port)
+		return destination, nil
+	}
+	return "", fmt.Errorf("invalid address: %s", va.BindAddr)
+}
+
+// checkForString loops over a slice to see if a string exists in it
+func checkForString(list []string, text string) bool {
+	for _, val := range list {
+		if val == text {
+			return true
+		}
+	}
+	return false
+}
+
+// validStatus is true for the status codes BIG-IP can respond with
+func validStatus(status int) bool {
+	return status >= 100 && status <= 599
+}
+
+// resolvePartition returns the configured partition at index, the partitions
+// are validated at startup but an error beats a panic if they change later
+func resolvePartition(c *config.Config, index int) (string, error) {
+	if index < 0 || index >= len(c.BigIP.Partitions) {
+		return "", fmt.Errorf("partition index %d out of range, %d partitions configured",
+			index, len(c.BigIP.Partitions))
+	}
+	partition := c.BigIP.Partitions[index]
+	if 0 == len(partition) || strings.ContainsAny(partition, "/ ") {
+		return "", fmt.Errorf("invalid partition %d: %q", index, partition)
+	}
+	return partition, nil
+}
+
+// poolPath is the path every reference to a pool uses, it is empty when the
+// partition or name cannot be part of a BIG-IP path
+func poolPath(partition, name string) string {
+	if 0 == len(partition) || 0 == len(name) ||
+		strings.ContainsAny(partition, "/ ") || strings.ContainsAny(name, "/ ") {
+		return ""
+	}
+	return "/" + partition + "/" + name
+}
+
+func joinBigipPath(partition, objName string) (string, error) {
+	if objName == "" {
+		return "", errors.New("object name is blank")
+	}
+	if partition == "" {
+		return objName, nil
+	}
+	return fmt.Sprintf("/%s/%s", partition, objName), nil
+}
+
+type returns struct {
+	data []byte
+	err  error
+}
+
+func (r *F5Router) fetchExistingDataGroup(c *config.Config, name string) (*bigipResources.InternalDataGroup, error) {
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return nil, err
+	}
+	url := fmt.Sprintf(
+		"%s/mgmt/tm/ltm/data-group/internal/~%s~%s",
+		r.c.BigIP.URL,
+		partition,
+		name,
+	)
+	data, err := r.bigIPClient.Get(url, r.c.BigIP.User, r.c.BigIP.Pass)
+	if nil != err {
+		// Encountered a timeout or temporary connection error so enter retry backoff
+		if err, ok := err.(net.Error); ok && (err.Timeout() || err.Temporary()) {
+			r.logger.Warn("bigip-client-get-recoverable-error", zap.Error(err))
+			done := make(chan returns)
+
+			go func() {
+				interval := 1
+				rvs := returns{}
+
+				for {
+					// Log and set timer for backoff
+					r.logger.Warn("retry-backoff", zap.String("backoff-interval", fmt.Sprintf("Retrying in %d seconds", interval)))
+					timer := time.NewTimer(time.Second * time.Duration(interval))
+					<-timer.C
+
+					// Attempt to connect to the BIG-IP signal channel if there is not a temporary or timeout error
+					rvs.data, rvs.err = r.bigIPClient.Get(url, r.c.BigIP.User, r.c.BigIP.Pass)
+					if doErr, ok := rvs.err.(net.Error); ok && !(doErr.Timeout() || doErr.Temporary()) {
+						rvs.data = nil
+						done <- rvs
+						break
+					}
+
+					// Successfully connected to BIG-IP signal channel with the response
+					if rvs.err == nil {
+						done <- rvs
+						break
+					}
+					interval *= 2
+					r.logger.Warn("retry-backoff-encountered-error-retrying", zap.Error(rvs.err))
+				}
+			}()
+
+			retVals := <-done
+			close(done)
+			if retVals.err != nil {
+				return nil, retVals.err
+			}
+			data = retVals.data
+		} else {
+			return nil, err
+		}
+	}
+
+	if strings.Contains(string(data), "was not found") {
+		return nil, fmt.Errorf("data group %s not found on the BIG-IP", InternalDataGroupName)
+	}
+
+	var idg *bigipResources.InternalDataGroup
+	err = json.Unmarshal(data, &idg)
+	if nil != err {
+		return nil, err
+	}
+
+	return idg, nil
+}
+
+// assignVSPort creates the holder BindAddr and Port the vs will use, these
+// virtuals are being routed to through an iRule using the virtual command
+func (r *F5Router) assignVSPort(vs *bigipResources.Virtual) error {
+	var va *bigipResources.VirtualAddress
+	var err error
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return err
+	}
+	key := vs.VirtualServerName
+
+	existingVS, exist := r.virtualResources[key]
+	// vs doesn't exist yet so we need to create the ip:port to use as the dest
+	if !exist {
+		// check if the info exists in the internalDataGroup
+		dgr, exist := r.internalDataGroup[key]
+		// the mapping doesn't exist yet so assign it
+		if !exist {
+			va, err = r.getAvailableVirtualAddress()
+			if nil != err {
+				return err
+			}
+
+			data, errEncode := va.Encode()
+			if nil != errEncode {
+				return errEncode
+			}
+			r.internalDataGroup[key] = &bigipResources.InternalDataGroupRecord{
+				Name: key,
+				Data: data,
+			}
+
+		} else {
+			va, err = dgr.ReturnTier2VirtualAddress()
+			if nil != err {
+				return err
+			}
+		}
+
+		dest, err := verifyDestAddress(va, partition)
+		if err != nil {
+			return err
+		}
+		vs.Destination = dest
+
+		return nil
+	}
+	// if the vs does exist set the destination on our route update to the current dest
+	vs.Destination = existingVS.Destination
+	return nil
+}
+
+func (r *F5Router) getAvailableVirtualAddress() (*bigipResources.VirtualAddress, error) {
+	var va *bigipResources.VirtualAddress
+	// Use a reaped va if we have one
+	if len(r.tier2VSInfo.reapedPorts) != 0 {
+		va = r.tier2VSInfo.reapedPorts[0]
+		// delete from a slice https://github.com/golang/go/wiki/SliceTricks
+		r.tier2VSInfo.reapedPorts[0] = r.tier2VSInfo.reapedPorts[len(r.tier2VSInfo.reapedPorts)-1]
+		r.tier2VSInfo.reapedPorts[len(r.tier2VSInfo.reapedPorts)-1] = nil
+		r.tier2VSInfo.reapedPorts = r.tier2VSInfo.reapedPorts[:len(r.tier2VSInfo.reapedPorts)-1]
+		return va, nil
+	}
+	// No reaped va so check for the next available one
+	va = &bigipResources.VirtualAddress{
+		BindAddr: r.tier2VSInfo.holderIP.String(),
+		Port:     r.tier2VSInfo.holderPort,
+	}
+	_, found := r.tier2VSInfo.usedPorts[va.String()]
+	for found {
+		// check if we are at the last address valid for a va
+		if r.tier2VSInfo.holderPort == 65535 {
+			// increement the holderip to the next address
+			err := r.incrementHolderIP()
+			if nil != err {
+				return nil, err
+			}
+			// reset our ports back to our starting point
+			r.tier2VSInfo.holderPort = 10000
+		} else {
+			r.tier2VSInfo.holderPort = r.tier2VSInfo.holderPort + 1
+			va = &bigipResources.VirtualAddress{
+				BindAddr: r.tier2VSInfo.holderIP.String(),
+				Port:     r.tier2VSInfo.holderPort,
+			}
+			_, found = r.tier2VSInfo.usedPorts[va.String()]
+		}
+	}
+	r.tier2VSInfo.usedPorts[va.String()] = va
+	return va, nil
+}
+
+func (r *F5Router) incrementHolderIP() error {
+	ipCopy := make(net.IP, len(r.tier2VSInfo.holderIP))
+	copy(ipCopy, r.tier2VSInfo.holderIP)
+	// https://groups.google.com/d/msg/golang-nuts/zlcYA4qk-94/TWRFHeXJCcYJ
+	for i := len(ipCopy) - 1; i >= 0; i-- {
+		ipCopy[i]++
+		if ipCopy[i] > 0 {
+			break
+		}
+	}
+	// verify the ip is in the range provided
+	contains := r.tier2VSInfo.ipNet.Contains(ipCopy)
+	if !contains {
+		return errors.New("Ran out of available IP addresses. Restart the controller with a larger address space")
+	}
+	r.tier2VSInfo.holderIP = ipCopy
+	return nil
+}
+
+// processBrokerDataGroup uses the cached broker data group off the BIG-IP to populate
+// the bindIDRouteURIPlanNameMap and create orphaned resources for those routes
+func (r *F5Router) processBrokerDataGroup(dg *bigipResources.InternalDataGroup) {
+	newbindIDRouteURIPlanNameMap := make(map[string]string)
+	planNamePlanIDMap := make(map[string]string)
+
+	r.plansMap.lock.Lock()
+	for _, plan := range r.plansMap.plans {
+		planNamePlanIDMap[plan.Name] = plan.ID
+	}
+	r.plansMap.lock.Unlock()
+
+	for _, record := range dg.Records {
+		newbindIDRouteURIPlanNameMap[record.Name] = record.Data
+
+		routeURI, planName, err := record.ReturnRouteURIAndPlanName()
+		if err != nil {
+			r.logger.Warn("process-broker-data-group-get-routeURI-planName-error", zap.Error(err))
+			continue
+		}
+
+		// Plan was not found so foundPlan is unitialized
+		foundPlanID := planNamePlanIDMap[planName]
+		if foundPlanID == "" {
+			r.logger.Warn(
+				"process-broker-data-group-find-plan-error",
+				zap.String("plan-not-found-skipping", fmt.Sprintf("Plan %s not found for route %s", planName, routeURI)),
+			)
+			continue
+		}
+
+		ru, err := NewUpdate(r.logger, routeUpdate.Bind, route.Uri(routeURI), nil, foundPlanID)
+		if err != nil {
+			r.logger.Warn("process-broker-data-group-new-update-error", zap.Error(err))
+			continue
+		}
+		r.UpdateRoute(ru)
+	}
+
+	r.logger.Debug(
+		"process-broker-data-group-processed-data-group",
+		zap.Object("data-group", newbindIDRouteURIPlanNameMap),
+	)
+
+	r.bindIDRouteURIPlanNameMap.lock.Lock()
+	defer r.bindIDRouteURIPlanNameMap.lock.Unlock()
+	r.bindIDRouteURIPlanNameMap.data = newbindIDRouteURIPlanNameMap
+}
+
+// processCachedDataGroup uses the cached data group off the BIG-IP to populate
+// our map of used ports and populate the internalDataGroup
+func (r *F5Router) processCachedDataGroup(dg *bigipResources.InternalDataGroup) {
+	newDataGroup := make(map[string]*bigipResources.InternalDataGroupRecord)
+	for _, record := range dg.Records {
+		// Decode the record from the bigip to a virtual address
+		va, err := record.ReturnTier2VirtualAddress()
+		if nil != err {
+			r.logger.Warn("process-cached-data-group-error", zap.Error(err), zap.Object("record", record))
+			continue
+		}
+
+		vaIP := net.ParseIP(va.BindAddr)
+		// Only keep the record and va if the IP and port is in the accepted range
+		if (nil != vaIP) && (r.tier2VSInfo.ipNet.Contains(vaIP) && (va.Port <= 65535)) {
+			_, ok := r.tier2VSInfo.usedPorts[va.String()]
+			if !ok {
+				r.tier2VSInfo.usedPorts[va.String()] = va
+				newDataGroup[record.Name] = record
+			}
+		}
+	}
+	r.logger.Debug("add-ports-to-used-ports", zap.Object("used-ports", r.tier2VSInfo.usedPorts))
+	r.internalDataGroup = newDataGroup
+}
+
+// truncateInternalDataGroup cleans up after our first drain of the queue
+// Create a new data group and list of used ports then compare the old list
+// of used ports to the new, anything not in the new list is added to
+// reapedPorts for reuse
+func (r *F5Router) truncateInternalDataGroup() {
+	newDataGroup := make(map[string]*bigipResources.InternalDataGroupRecord)
+	newUsedPorts := make(map[string]*bigipResources.VirtualAddress)
+
+	for vsName := range r.virtualResources {
+		record, exists := r.internalDataGroup[vsName]
+		if exists {
+			va, err := record.ReturnTier2VirtualAddress()
+			if nil != err {
+				r.logger.Warn("truncate-internal-data-group-error", zap.Error(err), zap.Object("record", record))
+				continue
+			}
+			newDataGroup[vsName] = record
+			newUsedPorts[va.String()] = va
+		}
+	}
+	r.logger.Debug(
+		"truncate-internal-data-group",
+		zap.Object("old-used-ports", r.tier2VSInfo.usedPorts),
+		zap.Object("new-used-ports", newUsedPorts),
+	)
+	for key, value := range r.tier2VSInfo.usedPorts {
+		if _, ok := newUsedPorts[key]; !ok {
+			r.tier2VSInfo.reapedPorts = append(r.tier2VSInfo.reapedPorts, value)
+		}
+	}
+	r.internalDataGroup = newDataGroup
+	r.tier2VSInfo.usedPorts = newUsedPorts
+
+}
+
+// actionStage orders the actions of a rule, request rewrites run before
+// header changes and forwarding to the tier2 virtual always runs last
+type actionStage int
+
+const (
+	rewriteStage actionStage = iota
+	headerStage
+	logStage
+	forwardStage
+)
+
+type ruleAction struct {
+	stage  actionStage
+	action *bigipResources.Action
+}
+
+// orderActions sorts the actions by stage, keeping the order they were added
+// in within a stage, and names them by their position
+func orderActions(actions []ruleAction) []*bigipResources.Action {
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].stage < actions[j].stage
+	})
+
+	ordered := make([]*bigipResources.Action, len(actions))
+	for i, ra := range actions {
+		ra.action.Name = strconv.Itoa(i)
+		ordered[i] = ra.action
+	}
+	return ordered
+}
+
+func (r *F5Router) makeRouteRule(ru updateHTTP) (*bigipResources.Rule, error) {
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return nil, err
+	}
+	_u := "scheme://" + ru.URI().String()
+	_u = strings.TrimSuffix(_u, "/")
+	u, err := url.Parse(_u)
+	if nil != err {
+		return nil, err
+	}
+
+	// the rule forwards to the tier2 virtual named after the pool
+	//FIXME update to use multiple partitions
+	if "" == poolPath(partition, ru.Name()) {
+		return nil, fmt.Errorf("invalid pool path for route %s: %s", ru.Route(), ru.Name())
+	}
+
+	target := ru.Name()
+	weights, err := ru.wildcardWeights()
+	if nil != err {
+		r.logger.Warn("f5router-ignoring-wildcard-weights",
+			zap.String("route", ru.Route()),
+			zap.Error(err),
+		)
+	} else if 0 != len(weights) {
+		target = r.weightedTarget(partition, ru.Name(), weights)
+	}
+
+	actions := []ruleAction{
+		{stage: forwardStage, action: &bigipResources.Action{
+			Request:     true,
+			Expression:  target,
+			TmName:      "target_vip",
+			Tcl:         true,
+			SetVariable: true,
+		}},
+	}
+
+	uriString := ru.URI().String()
+
+	if r.allDownFallback() {
+		pool, status, err := ru.allDownFallback(r.c)
+		if nil != err {
+			r.logger.Warn("f5router-ignoring-all-down-fallback",
+				zap.String("route", uriString),
+				zap.Error(err),
+			)
+		}
+		if 0 != len(pool) {
+			actions = append(actions, ruleAction{stage: forwardStage, action: &bigipResources.Action{
+				Request:     true,
+				Expression:  pool,
+				TmName:      "all_down_pool",
+				Tcl:         true,
+				SetVariable: true,
+			}})
+		} else if 0 != status {
+			actions = append(actions, ruleAction{stage: forwardStage, action: &bigipResources.Action{
+				Request:     true,
+				Expression:  strconv.Itoa(status),
+				TmName:      "all_down_status",
+				Tcl:         true,
+				SetVariable: true,
+			}})
+		}
+	}
+
+	xff, err := ru.insertXFF(r.c)
+	if nil != err {
+		r.logger.Warn("f5router-ignoring-route-xff",
+			zap.String("route", uriString),
+			zap.Error(err),
+		)
+	}
+	if xff {
+		actions = append(actions, ruleAction{stage: headerStage, action: &bigipResources.Action{
+			HTTPHeader: true,
+			Insert:     true,
+			Request:    true,
+			TmName:     "X-Forwarded-For",
+			Value:      "tcl:[IP::client_addr]",
+		}})
+	}
+
+	// the header names the pool for tracing the request downstream
+	if 0 != len(r.c.BigIP.RouteHeader) {
+		actions = append(actions, ruleAction{stage: headerStage, action: &bigipResources.Action{
+			HTTPHeader: true,
+			Insert:     true,
+			Request:    true,
+			TmName:     r.c.BigIP.RouteHeader,
+			Value:      ru.Name(),
+		}})
+	}
+
+	if r.c.BigIP.RuleLogging {
+		actions = append(actions, ruleAction{stage: logStage, action: &bigipResources.Action{
+			Log:      true,
+			Write:    true,
+			Request:  true,
+			Facility: r.c.BigIP.RuleLogFacility,
+			Message: fmt.Sprintf("tcl:cf-routing rule %s matched [HTTP::host][HTTP::uri]",
+				r.namespaced(ru.Name())),
+		}})
+	}
+
+	path, _, err := r.limitPath(u.EscapedPath())
+	if nil != err {
+		return nil, err
+	}
+
+	header, value := ru.headerMatch()
+	cookie, cookieValue := ru.cookieMatch()
+	// a route restricted to some clients must not open up to all of them
+	sources, err := ru.sourceAddresses()
+	if nil != err {
+		return nil, err
+	}
+	// nor match the opposite of what it asked for
+	negated, err := ru.negatedConditions()
+	if nil != err {
+		return nil, err
+	}
+	pathRegex, err := ru.pathRegex()
+	if nil != err {
+		return nil, err
+	}
+
+	var c []*bigipResources.Condition
+	if strings.Contains(uriString, "*") {
+		host := u.Hostname()
+		splits := strings.Split(host, "*")
+		numSplits := len(splits)
+		ruleIndex := 0
+		if strings.HasPrefix(host, splits[0]) {
+			if splits[0] != "" {
+				c = append(c, &bigipResources.Condition{
+					StartsWith: true,
+					Host:       true,
+					HTTPHost:   true,
+					Name:       strconv.Itoa(ruleIndex),
+					Index:      ruleIndex,
+					Request:    true,
+					Values:     []string{splits[0]},
+				})
+				ruleIndex++
+			}
+			splits = splits[1:]
+			numSplits--
+		}
+		if strings.HasSuffix(host, splits[numSplits-1]) {
+			if splits[numSplits-1] != "" {
+				c = append(c, &bigipResources.Condition{
+					EndsWith: true,
+					Host:     true,
+					HTTPHost: true,
+					Name:     strconv.Itoa(ruleIndex),
+					Index:    ruleIndex,
+					Request:  true,
+					Values:   []string{splits[numSplits-1]},
+				})
+			}
+		}
+		c = appendPortCondition(c, u.Port())
+		c = appendHeaderCondition(c, header, value)
+		c = appendCookieCondition(c, cookie, cookieValue)
+		c = appendSourceCondition(c, sources)
+		// a wildcard with a path is an exception to the bare wildcard, it
+		// sorts ahead of it so the more specific match wins
+		c = r.appendRoutePath(c, path, pathRegex)
+	} else {
+		// a catch-all route matches its path on any host
+		if 0 != len(u.Host) {
+			match, value, err := ru.hostMatch(u.Host)
+			if nil != err {
+				r.logger.Warn("f5router-ignoring-host-match",
+					zap.String("route", uriString),
+					zap.Error(err),
+				)
+			}
+			c = append(c, &bigipResources.Condition{
+				Equals:     EqualsHostMatch == match,
+				StartsWith: StartsWithHostMatch == match,
+				EndsWith:   EndsWithHostMatch == match,
+				Contains:   ContainsHostMatch == match,
+				Matches:    RegexHostMatch == match,
+				Host:       true,
+				HTTPHost:   true,
+				Name:       "0",
+				Index:      0,
+				Request:    true,
+				Values:     []string{value},
+			})
+		}
+
+		c = appendHeaderCondition(c, header, value)
+		c = appendCookieCondition(c, cookie, cookieValue)
+		c = appendSourceCondition(c, sources)
+		c = r.appendRoutePath(c, path, pathRegex)
+	}
+
+	for _, cond := range c {
+		switch {
+		case cond.HTTPHost && !cond.Port:
+			cond.Negate = negated[NegateHost]
+		case cond.HTTPHeader:
+			cond.Negate = negated[NegateHeader]
+		case cond.TCP:
+			cond.Negate = negated[NegateSource]
+		}
+	}
+
+	name := r.namespaced(ru.Name())
+	// leave room for the suffix of the trailing slash redirect
+	if len(name+redirectSuffix) > maxObjectNameLength {
+		return nil, fmt.Errorf("rule name %s is longer than %d characters", name,
+			maxObjectNameLength-len(redirectSuffix))
+	}
+	if r.c.BigIP.ReadableRuleNames {
+		name = readableRuleName(name, u.Host+path)
+	}
+
+	priority, err := ru.priority()
+	if nil != err {
+		r.logger.Warn("f5router-ignoring-route-priority",
+			zap.String("route", uriString),
+			zap.Error(err),
+		)
+	}
+
+	// catch-all routes, routes matching everything but a condition and routes
+	// matching a path regex go behind the routes of the same kind that match
+	// what they ask for
+	if 0 == priority && (pathOnly(ru.URI()) || 0 != len(negated) || 0 != len(pathRegex)) {
+		priority = -1
+	}
+
+	rl := bigipResources.Rule{
+		FullURI:     uriString,
+		Priority:    priority,
+		Pool:        ru.Name(),
+		Actions:     orderActions(actions),
+		Conditions:  c,
+		Name:        name,
+		Description: makeDescription(uriString, ru.AppID()),
+	}
+
+	passthrough, err := ru.passthrough()
+	if nil != err {
+		return nil, err
+	}
+	if passthrough {
+		sni, err := r.makeSNIRule(&rl, partition)
+		if nil != err {
+			return nil, err
+		}
+		r.logger.Debug("f5router-rule-create", zap.Object("rule", sni))
+		return sni, nil
+	}
+
+	r.logger.Debug("f5router-rule-create", zap.Object("rule", rl))
+
+	return &rl, nil
+}
+
+// unreadableRuleChars are replaced in the host and path of a readable rule name
+var unreadableRuleChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// readableRuleName adds the sanitized host and path of the route to the rule
+// name so the rule can be recognized on the BIG-IP, the pool name it starts
+// with keeps it unique. The route is cut short to stay within the name limit
+func readableRuleName(name, route string) string {
+	readable := strings.Trim(unreadableRuleChars.ReplaceAllString(route, "_"), "_")
+	room := maxObjectNameLength - len(redirectSuffix) - len(name) - 1
+	if room <= 0 || 0 == len(readable) {
+		return name
+	}
+	if len(readable) > room {
+		readable = readable[:room]
+	}
+	return name + "-" + readable
+}
+
+// weightedTarget picks the tier2 virtual for each request, the targets take
+// their percent in turn and the rest goes to the route's own virtual
+func (r *F5Router) weightedTarget(partition, name string, targets []weightedTarget) string {
+	// the first comparison draws the random percent the others reuse
+	draw := "[set w [expr {int(rand() * 100)}]]"
+	var expr bytes.Buffer
+	cumulative := 0
+	for _, t := range targets {
+		cumulative += t.weight
+		targetName := r.names.ObjectName(t.uri.String(), partition)
+		fmt.Fprintf(&expr, `%s < %d ? "%s" : `, draw, cumulative, targetName)
+		draw = "$w"
+	}
+	fmt.Fprintf(&expr, `"%s"`, name)
+	return fmt.Sprintf("[expr {%s}]", expr.String())
+}
+
+// appendRoutePath adds the path conditions of a route, a route with a path
+// regex matches the whole path against it instead
+func (r *F5Router) appendRoutePath(
+	c []*bigipResources.Condition,
+	path string,
+	regex string,
+) []*bigipResources.Condition {
+	if 0 == len(regex) {
+		return appendPathConditions(c, path, !r.c.BigIP.CaseInsensitivePaths, r.c.BigIP.PathMatch)
+	}
+	return append(c, &bigipResources.Condition{
+		Matches: true,
+		HTTPURI: true,
+		Path:    true,
+		Name:    strconv.Itoa(len(c)),
+		Request: true,
+		Values:  []string{regex},
+	})
+}
+
+// appendPortCondition matches the port of a route bound to a non-standard
+// port, the host conditions only see the host name
+func appendPortCondition(c []*bigipResources.Condition, port string) []*bigipResources.Condition {
+	if 0 == len(port) {
+		return c
+	}
+	return append(c, &bigipResources.Condition{
+		Equals:   true,
+		HTTPHost: true,
+		Port:     true,
+		Name:     strconv.Itoa(len(c)),
+		Index:    0,
+		Request:  true,
+		Values:   []string{port},
+	})
+}
+
+// appendHeaderCondition matches the value of a request header, nothing is
+// added when the name is empty
+func appendHeaderCondition(c []*bigipResources.Condition, name, value string) []*bigipResources.Condition {
+	if 0 == len(name) {
+		return c
+	}
+	return append(c, &bigipResources.Condition{
+		Equals:     true,
+		HTTPHeader: true,
+		TmName:     name,
+		Name:       strconv.Itoa(len(c)),
+		Index:      0,
+		Request:    true,
+		Values:     []string{value},
+	})
+}
+
+// appendCookieCondition matches the value of the named cookie, nothing is
+// added without a cookie
+func appendCookieCondition(c []*bigipResources.Condition, name, value string) []*bigipResources.Condition {
+	if 0 == len(name) {
+		return c
+	}
+	return append(c, &bigipResources.Condition{
+		Equals:     true,
+		HTTPCookie: true,
+		TmName:     name,
+		Name:       strconv.Itoa(len(c)),
+		Index:      0,
+		Request:    true,
+		Values:     []string{value},
+	})
+}
+
+// appendSourceCondition matches the client address against the networks,
+// nothing is added when there are none
+func appendSourceCondition(c []*bigipResources.Condition, networks []string) []*bigipResources.Condition {
+	if 0 == len(networks) {
+		return c
+	}
+	return append(c, &bigipResources.Condition{
+		Matches: true,
+		TCP:     true,
+		Address: true,
+		Name:    strconv.Itoa(len(c)),
+		Index:   0,
+		Request: true,
+		Values:  networks,
+	})
+}
+
+// limitPath applies max_path_depth to the path of a route, a deeper path is
+// either cut down to its leading segments so the rule becomes a prefix match
+// or rejected
+func (r *F5Router) limitPath(path string) (string, bool, error) {
+	max := r.c.BigIP.MaxPathDepth
+	if 0 == max || 0 == len(path) {
+		return path, false, nil
+	}
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(segments) <= max {
+		return path, false, nil
+	}
+	if r.c.BigIP.DeepPathAction != config.TruncateDeepPath {
+		return "", false, fmt.Errorf("path %s has %d segments, max_path_depth is %d",
+			path, len(segments), max)
+	}
+	return "/" + strings.Join(segments[:max], "/"), true, nil
+}
+
+// appendPathConditions matches each segment of the path, condition names
+// carry on from the conditions already in the rule. The BIG-IP numbers path
+// segments from 1 so the index is the segment's position, not the name. The
+// case of the match is always set, CF paths are case-sensitive. The prefix
+// and exact path_match modes match the whole path with one condition instead
+func appendPathConditions(
+	c []*bigipResources.Condition,
+	path string,
+	caseSensitive bool,
+	match string,
+) []*bigipResources.Condition {
+	if 0 == len(path) {
+		return c
+	}
+
+	if config.PrefixPathMatch == match || config.ExactPathMatch == match {
+		return append(c, &bigipResources.Condition{
+			Equals:          config.ExactPathMatch == match,
+			StartsWith:      config.PrefixPathMatch == match,
+			HTTPURI:         true,
+			Path:            true,
+			CaseSensitive:   caseSensitive,
+			CaseInsensitive: !caseSensitive,
+			Name:            strconv.Itoa(len(c)),
+			Request:         true,
+			Values:          []string{path},
+		})
+	}
+
+	base := len(c)
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, v := range segments {
+		c = append(c, &bigipResources.Condition{
+			Equals:          true,
+			HTTPURI:         true,
+			PathSegment:     true,
+			CaseSensitive:   caseSensitive,
+			CaseInsensitive: !caseSensitive,
+			Name:            strconv.Itoa(base + i),
+			Index:           i + 1,
+			Request:         true,
+			Values:          []string{v},
+		})
+	}
+	return c
+}
+
+// wildcardSuffixKey is the host suffix a wildcard rule ends with, reversed, and
+// empty for the other rules. The key of *.bar.foo.com starts with the key of
+// *.foo.com so the more specific wildcard sorts after it
+func wildcardSuffixKey(rule *bigipResources.Rule) string {
+	host := strings.SplitN(rule.FullURI, "/", 2)[0]
+	if i := strings.LastIndex(host, ":"); -1 != i {
+		host = host[:i]
+	}
+	i := strings.LastIndex(host, "*")
+	if -1 == i {
+		return ""
+	}
+	suffix := []byte(host[i+1:])
+	for l, r := 0, len(suffix)-1; l < r; l, r = l+1, r-1 {
+		suffix[l], suffix[r] = suffix[r], suffix[l]
+	}
+	return string(suffix)
+}
+
+// makeRoutePolicy builds a policy from the rule maps, rules are sorted within
+// each map and the maps are given ordinals in the order they are passed
+func (r *F5Router) makeRoutePolicy(policyName string, ruleMaps ...bigipResources.RuleMap) *bigipResources.Policy {
+	plcy := bigipResources.Policy{
+		Controls: r.c.BigIP.PolicyControls,
+		Legacy:   true,
+		Name:     policyName,
+		Requires: r.c.BigIP.PolicyRequires,
+		Rules:    []*bigipResources.Rule{},
+		Strategy: r.c.BigIP.PolicyStrategy,
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(ruleMaps))
+	sortRules := func(r bigipResources.RuleMap, rls *bigipResources.Rules, ordinal int) {
+		for _, v := range r {
+			*rls = append(*rls, v)
+		}
+
+		sort.Sort(sort.Reverse(*rls))
+		// prioritized rules go first, then the wildcards with the longer host
+		// suffix so *.bar.foo.com wins over *.foo.com, the rest keep the URI
+		// order
+		sort.SliceStable(*rls, func(i, j int) bool {
+			a, b := (*rls)[i], (*rls)[j]
+			if a.Priority != b.Priority {
+				return a.Priority > b.Priority
+			}
+			if ka, kb := wildcardSuffixKey(a), wildcardSuffixKey(b); ka != kb {
+				return ka > kb
+			}
+			if a.FullURI != b.FullURI {
+				return a.FullURI > b.FullURI
+			}
+			// a route restricted by header or cookie goes ahead of the route
+			// taking the other requests for the URI
+			if len(a.Conditions) != len(b.Conditions) {
+				return len(a.Conditions) > len(b.Conditions)
+			}
+			return a.Name < b.Name
+		})
+
+		for _, v := range *rls {
+			v.Ordinal = ordinal
+			ordinal++
+		}
+		wg.Done()
+	}
+
+	sorted := make([]bigipResources.Rules, len(ruleMaps))
+	ordinal := 0
+	for i, rm := range ruleMaps {
+		sorted[i] = bigipResources.Rules{}
+		go sortRules(rm, &sorted[i], ordinal)
+		ordinal += len(rm)
+	}
+
+	wg.Wait()
+
+	rls := bigipResources.Rules{}
+	for _, s := range sorted {
+		rls = append(rls, s...)
+	}
+
+	plcy.Rules = rls
+
+	r.logger.Debug("f5router-policy-create", zap.Object("policy", plcy))
+	return &plcy
+}
+
+func (r *F5Router) processRouteAdd(ru updateHTTP) error {
+	r.logger.Debug("process-HTTP-route-add", zap.String("name", ru.Name()), zap.String("route", ru.Route()))
+
+	err := verifyRouteURI(ru)
+	if nil != err {
+		return reject(err)
+	}
+	err = r.verifyPathDepth(ru)
+	if nil != err {
+		return reject(err)
+	}
+	err = r.verifyRouteHost(ru)
+	if nil != err {
+		return reject(err)
+	}
+	if _, err = ru.pathRegex(); nil != err {
+		return reject(fmt.Errorf("rejecting route %s: %v", ru.Route(), err))
+	}
+	if _, err = ru.sourceAddresses(); nil != err {
+		return reject(fmt.Errorf("rejecting route %s: %v", ru.Route(), err))
+	}
+
+	// Create default resources and update them if resource updates exist for this route
+	rs, err := ru.CreateResources(r.c)
+	if nil != err {
+		return fmt.Errorf("failed creating resources for route %s: %v", ru.Route(), err)
+	}
+	if resources, ok := r.unmappedResourcesMap[ru.Name()]; ok {
+		rs = ru.UpdateResources(rs, resources)
+	}
+
+	err = r.assignVSPort(rs.Virtuals[0])
+	if nil != err {
+		return fmt.Errorf("failed assigning a tier2 port for route %s: %v", ru.Route(), err)
+	}
+	r.removeFlippedMember(ru, rs.Pools[0])
+
+	if len(rs.Monitors) != 0 {
+		r.addMonitors(rs.Pools[0].Name, rs.Monitors)
+	}
+	r.addPool(rs.Pools[0])
+	r.addVirtual(rs.Virtuals[0])
+	r.addRule(ru)
+	return nil
+}
+
+// flippedURI returns the route a URI flips from, *.foo.cf.com for foo.cf.com
+// and foo.cf.com for *.foo.cf.com. Other wildcards have none
+func flippedURI(uri route.Uri) (route.Uri, bool) {
+	s := uri.String()
+	if strings.HasPrefix(s, "*.") {
+		flipped := strings.TrimPrefix(s, "*.")
+		return route.Uri(flipped), !strings.Contains(flipped, "*")
+	}
+	if strings.Contains(s, "*") {
+		return "", false
+	}
+	return route.Uri("*." + s), true
+}
+
+// removeFlippedMember removes the member of a route from the route it flipped
+// from when wildcard_flips is replace, so a member moving between an exact and
+// a wildcard route does not stay behind in both. The route it flipped from
+// goes with its last member
+func (r *F5Router) removeFlippedMember(ru updateHTTP, pool *bigipResources.Pool) {
+	if config.ReplaceWildcardFlips != r.c.BigIP.WildcardFlips || 0 == len(pool.Members) {
+		return
+	}
+	uri, ok := flippedURI(ru.URI())
+	if !ok {
+		return
+	}
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return
+	}
+	name := r.names.ObjectName(uri.String(), partition)
+	m := pool.Members[0]
+	if name == pool.Name || nil == r.findMember(name, m) {
+		return
+	}
+	r.logger.Info("f5router-route-flipped",
+		zap.String("from", uri.String()),
+		zap.String("to", ru.URI().String()),
+		zap.String("member", net.JoinHostPort(m.Address, strconv.Itoa(int(m.Port)))),
+	)
+	r.processPoolEndpointRemove(poolEndpointRemove{name: name, address: m.Address, port: m.Port})
+}
+
+// verifyPathDepth rejects a route before any of its resources are created when
+// its path is too deep, a truncated path is only warned about
+func (r *F5Router) verifyPathDepth(ru updateHTTP) error {
+	u, err := url.Parse("scheme://" + strings.TrimSuffix(ru.URI().String(), "/"))
+	if nil != err {
+		return err
+	}
+	path, truncated, err := r.limitPath(u.EscapedPath())
+	if nil != err {
+		return fmt.Errorf("rejecting route %s: %v", ru.Route(), err)
+	}
+	if truncated {
+		r.logger.Warn("f5router-path-truncated",
+			zap.String("route", ru.Route()),
+			zap.String("path", path),
+		)
+	}
+	return nil
+}
+
+// verifyRouteHost rejects routes without a host unless path_only_routes
+// makes them catch-all routes, a rule without a host condition matches the
+// path on every host
+func (r *F5Router) verifyRouteHost(ru updateHTTP) error {
+	if !pathOnly(ru.URI()) || r.c.BigIP.PathOnlyRoutes == config.CatchAllPathOnly {
+		return nil
+	}
+	return fmt.Errorf("rejecting route %s: route has no host, path_only_routes is %s",
+		ru.Route(), r.c.BigIP.PathOnlyRoutes)
+}
+
+// pathOnly is true for a route URI without a host
+func pathOnly(uri route.Uri) bool {
+	return strings.HasPrefix(uri.String(), "/")
+}
+
+func (r *F5Router) processRouteBind(ru updateHTTP) {
+	name := ru.Name()
+	planID := ru.PlanID()
+	existingPool := r.poolResources[name]
+	existingVirtual := r.virtualResources[name]
+	r.plansMap.lock.Lock()
+	defer r.plansMap.lock.Unlock()
+
+	// There is a mapped route (with an endpoint) that will be updated
+	if (existingPool != nil) && (existingVirtual != nil) {
+		var rs bigipResources.Resources
+
+		// Get copy of members before they are removed
+		members := make([]bigipResources.Member, len(existingPool.Members))
+		copy(members, existingPool.Members)
+		r.removePool(existingPool)
+		r.removeVirtual(name)
+
+		// Bind updates to this mapped route
+		rs = bigipResources.Resources{
+			Virtuals: []*bigipResources.Virtual{existingVirtual},
+			Pools:    []*bigipResources.Pool{existingPool},
+		}
+
+		if plan, ok := r.plansMap.plans[planID]; ok {
+			if len(plan.Pool.HealthMonitors) != 0 {
+				r.removeMonitors(existingPool.Name)
+			}
+			planResources := ru.CreatePlanResources(r.c, plan)
+			rs = ru.UpdateResources(rs, planResources)
+			// later adds for the route rebuild its virtual from the plan
+			r.unmappedResourcesMap[name] = planResources
+		} else {
+			r.logger.Warn("process-HTTP-route-update-bind-error",
+				zap.String("Update-Mapped-Route-Error",
+					fmt.Sprintf("could not find plan %s for route %s keeping defaults", planID, ru.Route())))
+		}
+
+		// Members are not updated and should be added back
+		rs.Pools[0].Members = members
+		if len(rs.Monitors) != 0 {
+			r.addMonitors(rs.Pools[0].Name, rs.Monitors)
+		}
+		r.addPool(rs.Pools[0])
+		r.addVirtual(rs.Virtuals[0])
+	} else {
+		// Bind updates to this unmapped route
+		if plan, ok := r.plansMap.plans[planID]; ok {
+			planResources := ru.CreatePlanResources(r.c, plan)
+			r.unmappedResourcesMap[name] = planResources
+		} else {
+			r.logger.Warn("process-HTTP-route-update-bind-error",
+				zap.String("Update-Unmapped-Route-Error",
+					fmt.Sprintf("could not find plan %s for unmapped route noop", planID)))
+		}
+	}
+}
+
+func (r *F5Router) processRouteUnbind(ru updateHTTP) error {
+	name := ru.Name()
+	existingPool := r.poolResources[name]
+	existingVirtual := r.virtualResources[name]
+
+	// There is a mapped route (with an endpoint) that will be updated, a pool
+	// retained for its grace period has no members left and counts as unmapped
+	if (existingPool != nil) && (existingVirtual != nil) && 0 != len(existingPool.Members) {
+		var rs bigipResources.Resources
+		var err error
+
+		// Get copy of members before they are removed
+		members := make([]bigipResources.Member, len(existingPool.Members))
+		copy(members, existingPool.Members)
+		r.removePool(existingPool)
+		r.removeVirtual(name)
+
+		// Unbind updates to this mapped route
+		r.removeMonitors(existingPool.Name)
+		rs, err = ru.CreateBrokerDefaultResources(
+			r.c,
+			existingPool.Description,
+			existingVirtual.Destination,
+			members[0].Address,
+			members[0].Port,
+		)
+		if nil != err {
+			return fmt.Errorf("failed unbinding route %s: %v", ru.Route(), err)
+		}
+
+		// Members are not updated and should be added back
+		rs.Pools[0].Members = members
+		r.addPool(rs.Pools[0])
+		r.addVirtual(rs.Virtuals[0])
+	}
+	delete(r.unmappedResourcesMap, name)
+	return nil
+}
+
+func (r *F5Router) processRouteRemove(ru updateHTTP) error {
+	r.logger.Debug("process-HTTP-route-remove", zap.String("name", ru.Name()), zap.String("route", ru.Route()))
+
+	err := verifyRouteURI(ru)
+	if nil != err {
+		return reject(err)
+	}
+
+	rs, err := ru.CreateResources(r.c)
+	if nil != err {
+		return fmt.Errorf("failed creating resources for route %s: %v", ru.Route(), err)
+	}
+	if r.drainMember(ru, rs.Pools[0]) {
+		return nil
+	}
+	r.removeRouteMember(ru, rs.Pools[0])
+	return nil
+}
+
+func (r *F5Router) removeRouteMember(ru updateHTTP, pool *bigipResources.Pool) {
+	if r.retainPool(ru, pool) {
+		return
+	}
+	poolRemoved := r.removePool(pool)
+	if poolRemoved {
+		delete(r.disabledPools, pool.Name)
+		r.removeRouteResources(ru)
+	}
+}
+
+// removeRouteResources deletes everything hanging off of a deleted HTTP pool
+func (r *F5Router) removeRouteResources(ru updateHTTP) {
+	// delete the health monitors associated with this pool
+	r.removeMonitors(ru.Name())
+	// delete the rule for the vip
+	r.removeRule(ru)
+	// delete the tier2 vip
+	r.removeVirtual(ru.Name())
+	r.releaseTier2Address(ru.Name())
+}
+
+// releaseTier2Address returns the address of a deleted tier2 virtual for reuse
+func (r *F5Router) releaseTier2Address(vsName string) {
+	// delete the mapping of the vs name to the destination
+	delete(r.tier2VSInfo.usedPorts, vsName)
+	// the tier2 vip is deleted, remove the internal data group entry for it
+	record, exist := r.internalDataGroup[vsName]
+	if exist {
+		va, err := record.ReturnTier2VirtualAddress()
+		if nil != err {
+			r.logger.Warn("process-HTTP-route-remove-error", zap.Object("record", record), zap.Error(err))
+		} else {
+			// Add the virtual address to reaped ports for reuse
+			r.tier2VSInfo.reapedPorts = append(r.tier2VSInfo.reapedPorts, va)
+		}
+		delete(r.internalDataGroup, vsName)
+	}
+}
+
+func (r *F5Router) processTCPRouteAdd(ru updateTCP) error {
+	r.logger.Debug("process-TCP-route-add", zap.String("name", ru.Name()), zap.String("route", ru.Route()))
+
+	rs, err := ru.CreateResources(r.c)
+	if nil != err {
+		return fmt.Errorf("failed creating resources for tcp route %s: %v", ru.Route(), err)
+	}
+	r.addPool(rs.Pools[0])
+	r.addVirtual(rs.Virtuals[0])
+	return nil
+}
+
+func (r *F5Router) processTCPRouteRemove(ru updateTCP) error {
+	r.logger.Debug("process-TCP-route-remove", zap.String("name", ru.Name()), zap.String("route", ru.Route()))
+
+	rs, err := ru.CreateResources(r.c)
+	if nil != err {
+		return fmt.Errorf("failed creating resources for tcp route %s: %v", ru.Route(), err)
+	}
+	if r.drainMember(ru, rs.Pools[0]) {
+		return nil
+	}
+	r.removeTCPMember(ru, rs.Pools[0])
+	return nil
+}
+
+func (r *F5Router) removeTCPMember(ru updateTCP, pool *bigipResources.Pool) {
+	if r.retainPool(ru, pool) {
+		return
+	}
+	poolRemoved := r.removePool(pool)
+	if poolRemoved {
+		delete(r.disabledPools, pool.Name)
+		r.removeVirtual(ru.Name())
+	}
+}
+
+// sameMember compares members by their address, ignoring the ratio and the
+// FQDN settings
+func sameMember(a, b bigipResources.Member) bool {
+	a.Ratio, b.Ratio = 0, 0
+	a.FQDN, b.FQDN = nil, nil
+	a.Monitor, b.Monitor = "", ""
+	return a == b
+}
+
+func memberKey(pool string, m bigipResources.Member) string {
+	return pool + "|" + net.JoinHostPort(m.Address, strconv.Itoa(int(m.Port)))
+}
+
+func (r *F5Router) findMember(pool string, m bigipResources.Member) *bigipResources.Member {
+	p, exists := r.poolResources[pool]
+	if !exists {
+		return nil
+	}
+	for i := range p.Members {
+		if sameMember(p.Members[i], m) {
+			return &p.Members[i]
+		}
+	}
+	return nil
+}
+
+func (r *F5Router) drainInterval() time.Duration {
+	return time.Duration(r.c.BigIP.DrainPeriod) * time.Second / drainRatio
+}
+
+// drainMember defers the removal of a member while its ratio is lowered over
+// the drain period, returns true when the removal was deferred
+func (r *F5Router) drainMember(ru routeUpdate.RouteUpdate, pool *bigipResources.Pool) bool {
+	if r.c.BigIP.DrainPeriod <= 0 {
+		return false
+	}
+
+	m := r.findMember(pool.Name, pool.Members[0])
+	if nil == m {
+		return false
+	}
+	key := memberKey(pool.Name, *m)
+	if _, draining := r.drainingMembers[key]; draining {
+		return true
+	}
+
+	started := time.Now()
+	r.drainingMembers[key] = started
+	r.queue.AddAfter(memberDrain{
+		ru:      ru,
+		pool:    pool.Name,
+		member:  pool.Members[0],
+		started: started,
+	}, r.drainInterval())
+
+	r.logger.Debug("f5router-member-draining",
+		zap.String("pool", pool.Name),
+		zap.String("member", key),
+		zap.Int("drain-period", r.c.BigIP.DrainPeriod),
+	)
+	return true
+}
+
+// processMemberDrain lowers the ratio of a draining member by one step and
+// removes the member once it has reached the bottom of the schedule
+func (r *F5Router) processMemberDrain(md memberDrain) {
+	key := memberKey(md.pool, md.member)
+	started, draining := r.drainingMembers[key]
+	if !draining || !started.Equal(md.started) {
+		// the member was re-added
+		return
+	}
+
+	m := r.findMember(md.pool, md.member)
+	if nil == m {
+		delete(r.drainingMembers, key)
+		return
+	}
+	if m.Ratio > 1 {
+		m.Ratio--
+		r.queue.AddAfter(md, r.drainInterval())
+		return
+	}
+	delete(r.drainingMembers, key)
+	r.logger.Debug("f5router-member-drained", zap.String("member", key))
+
+	pool := &bigipResources.Pool{
+		Name:    md.pool,
+		Members: []bigipResources.Member{md.member},
+	}
+	switch ru := md.ru.(type) {
+	case updateHTTP:
+		r.removeRouteMember(ru, pool)
+	case updateTCP:
+		r.removeTCPMember(ru, pool)
+	}
+}
+
+// retainPool removes the last member of a pool but keeps the empty pool for the
+// configured grace period so a quickly returning member can reuse it, returns
+// true when the pool was retained
+func (r *F5Router) retainPool(ru routeUpdate.RouteUpdate, pool *bigipResources.Pool) bool {
+	if r.c.BigIP.PoolGracePeriod <= 0 {
+		return false
+	}
+
+	p, exists := r.poolResources[pool.Name]
+	if !exists {
+		return false
+	}
+	if _, pending := r.pendingPoolDeletes[pool.Name]; pending && len(p.Members) == 0 {
+		// already retained, the scheduled expiry will clean it up
+		return true
+	}
+	if len(p.Members) != 1 || !sameMember(p.Members[0], pool.Members[0]) {
+		return false
+	}
+	p.Members = []bigipResources.Member{}
+
+	grace := time.Duration(r.c.BigIP.PoolGracePeriod) * time.Second
+	deadline := time.Now().Add(grace)
+	r.pendingPoolDeletes[pool.Name] = deadline
+	r.queue.AddAfter(poolExpiry{ru: ru, deadline: deadline}, grace)
+
+	r.logger.Debug("f5router-pool-retained",
+		zap.String("name", pool.Name),
+		zap.Int("grace-period", r.c.BigIP.PoolGracePeriod),
+	)
+	return true
+}
+
+// processPoolExpiry deletes a retained pool once its grace period has passed
+// without a member returning
+func (r *F5Router) processPoolExpiry(pe poolExpiry) {
+	name := pe.ru.Name()
+	deadline, pending := r.pendingPoolDeletes[name]
+	if !pending || !deadline.Equal(pe.deadline) {
+		// the deletion was cancelled or rescheduled
+		return
+	}
+	delete(r.pendingPoolDeletes, name)
+
+	p, exists := r.poolResources[name]
+	if !exists || len(p.Members) != 0 {
+		return
+	}
+	delete(r.poolResources, name)
+	delete(r.disabledPools, name)
+	r.logger.Debug("f5router-pool-grace-period-expired", zap.String("name", name))
+
+	switch ru := pe.ru.(type) {
+	case updateHTTP:
+		r.removeRouteResources(ru)
+	case updateTCP:
+		r.removeVirtual(ru.Name())
+	}
+}
+
+func (r *F5Router) memberSweepInterval() time.Duration {
+	return time.Duration(r.c.BigIP.MemberTTL) * time.Second / memberSweepSteps
+}
+
+// seeMember refreshes the time a member was last registered, it is only
+// tracked when member_ttl is set
+func (r *F5Router) seeMember(pool string, m bigipResources.Member) {
+	if 0 != r.c.BigIP.MemberTTL {
+		r.memberSeen[memberKey(pool, m)] = time.Now()
+	}
+}
+
+// processMemberSweep evicts the members not registered within member_ttl, as
+// if their removal had been received, and returns how many were evicted. A
+// member the sweep finds without a registration time, such as one loaded from
+// a snapshot, starts its TTL then.
+func (r *F5Router) processMemberSweep() int {
+	now := time.Now()
+	ttl := time.Duration(r.c.BigIP.MemberTTL) * time.Second
+	live := make(map[string]bool)
+	var stale []poolEndpointRemove
+	for name, pool := range r.poolResources {
+		for _, m := range pool.Members {
+			key := memberKey(name, m)
+			live[key] = true
+			seen, ok := r.memberSeen[key]
+			if !ok {
+				r.memberSeen[key] = now
+			} else if now.Sub(seen) > ttl {
+				stale = append(stale, poolEndpointRemove{name: name, address: m.Address, port: m.Port})
+			}
+		}
+	}
+	for key := range r.memberSeen {
+		if !live[key] {
+			delete(r.memberSeen, key)
 		}
 	}
-	r.internalDataGroup = newDataGroup
-	r.tier2VSInfo.usedPorts = newUsedPorts
 
+	for _, per := range stale {
+		r.logger.Warn("f5router-evicting-stale-member",
+			zap.String("pool", per.name),
+			zap.String("address", net.JoinHostPort(per.address, strconv.Itoa(int(per.port)))),
+			zap.Int("member-ttl", r.c.BigIP.MemberTTL),
+		)
+		r.processPoolEndpointRemove(per)
+		delete(r.memberSeen, memberKey(per.name, bigipResources.Member{Address: per.address, Port: per.port}))
+	}
+	r.evictedMembers += len(stale)
+	return len(stale)
 }
 
-func (r *F5Router) makeRouteRule(ru updateHTTP) (*bigipResources.Rule, error) {
-	_u := "scheme://" + ru.URI().String()
-	_u = strings.TrimSuffix(_u, "/")
-	u, err := url.Parse(_u)
-	if nil != err {
-		return nil, err
-	}
+func (r *F5Router) addMonitors(poolName string, monitors []*bigipResources.Monitor) {
+	r.monitorResources[poolName] = monitors
+}
 
-	var b bytes.Buffer
-	b.WriteRune('/')
-	b.WriteString(r.c.BigIP.Partitions[0]) //FIXME update to use multiple partitions
-	b.WriteRune('/')
-	b.WriteString(ru.Name())
+func (r *F5Router) removeMonitors(poolName string) {
+	delete(r.monitorResources, poolName)
+}
 
-	a := bigipResources.Action{
-		Name:        "0",
-		Request:     true,
-		Expression:  ru.Name(),
-		TmName:      "target_vip",
-		Tcl:         true,
-		SetVariable: true,
+func (r *F5Router) addPool(pool *bigipResources.Pool) {
+	key := pool.Name
+	for _, m := range pool.Members {
+		delete(r.primedMembers, memberKey(key, m))
+		r.seeMember(key, m)
 	}
 
-	uriString := ru.URI().String()
+	p, exists := r.poolResources[key]
 
-	var c []*bigipResources.Condition
-	if strings.Contains(uriString, "*") {
-		splits := strings.Split(u.Host, "*")
-		numSplits := len(splits)
-		ruleIndex := 0
-		if strings.HasPrefix(u.Host, splits[0]) {
-			if splits[0] != "" {
-				c = append(c, &bigipResources.Condition{
-					StartsWith: true,
-					Host:       true,
-					HTTPHost:   true,
-					Name:       strconv.Itoa(ruleIndex),
-					Index:      ruleIndex,
-					Request:    true,
-					Values:     []string{splits[0]},
-				})
-				ruleIndex++
-			}
-			splits = splits[1:]
-			numSplits--
+	// the BIG-IP rejects a member without an address, keep it out of the pool
+	valid := make([]bigipResources.Member, 0, len(pool.Members))
+	for _, m := range pool.Members {
+		if 0 == len(m.Address) {
+			r.logger.Warn("f5router-skipping-empty-member", zap.String("pool", key))
+			continue
 		}
-		if strings.HasSuffix(u.Host, splits[numSplits-1]) {
-			if splits[numSplits-1] != "" {
-				c = append(c, &bigipResources.Condition{
-					EndsWith: true,
-					Host:     true,
-					HTTPHost: true,
-					Name:     strconv.Itoa(ruleIndex),
-					Index:    ruleIndex,
-					Request:  true,
-					Values:   []string{splits[numSplits-1]},
-				})
-			}
+		valid = append(valid, m)
+	}
+	if len(valid) != len(pool.Members) {
+		if 0 == len(valid) {
+			return
 		}
-	} else {
-		c = append(c, &bigipResources.Condition{
-			Equals:   true,
-			Host:     true,
-			HTTPHost: true,
-			Name:     "0",
-			Index:    0,
-			Request:  true,
-			Values:   []string{u.Host},
-		})
-
-		if 0 != len(u.EscapedPath()) {
-			path := strings.TrimPrefix(u.EscapedPath(), "/")
-			segments := strings.Split(path, "/")
+		pool.Members = valid
+	}
 
-			for i, v := range segments {
-				c = append(c, &bigipResources.Condition{
-					Equals:      true,
-					HTTPURI:     true,
-					PathSegment: true,
-					Name:        strconv.Itoa(i + 1),
-					Index:       i + 1,
-					Request:     true,
-					Values:      []string{v},
-				})
-			}
+	// a bind rebuilding a pool retained for its grace period brings no
+	// members, the retained pool is kept as it is
+	if 0 == len(pool.Members) {
+		if !exists {
+			r.storePool(pool)
 		}
+		return
 	}
 
-	rl := bigipResources.Rule{
-		FullURI:     uriString,
-		Actions:     []*bigipResources.Action{&a},
-		Conditions:  c,
-		Name:        ru.Name(),
-		Description: makeDescription(uriString, ru.AppID()),
+	if r.c.BigIP.DrainPeriod > 0 {
+		pool.Members[0].Ratio = drainRatio
 	}
 
-	r.logger.Debug("f5router-rule-create", zap.Object("rule", rl))
+	if exists {
+		// a member returned so cancel any pending deletion of the pool
+		delete(r.pendingPoolDeletes, key)
+		for i, addr := range p.Members {
+			// Currently only a single update comes through at a time so we always
+			// know to look at the first addr
+			if sameMember(addr, pool.Members[0]) {
+				// cancel a drain in progress and restore the ratio
+				delete(r.drainingMembers, memberKey(key, addr))
+				p.Members[i].Ratio = pool.Members[0].Ratio
+				p.Members[i].Monitor = pool.Members[0].Monitor
+				return
+			}
+		}
+		p.Members = append(p.Members, pool.Members...)
+	} else {
+		r.storePool(pool)
+	}
 
-	return &rl, nil
 }
 
-func (r *F5Router) makeRoutePolicy(policyName string) *bigipResources.Policy {
-	plcy := bigipResources.Policy{
-		Controls: []string{"forwarding"},
-		Legacy:   true,
-		Name:     policyName,
-		Requires: []string{"http"},
-		Rules:    []*bigipResources.Rule{},
-		Strategy: "/Common/first-match",
+// storePool adds a new pool, decorated first when a decorator is set
+func (r *F5Router) storePool(pool *bigipResources.Pool) {
+	if nil != r.poolDecorator {
+		r.poolDecorator(pool)
 	}
+	r.poolResources[pool.Name] = pool
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	sortRules := func(r bigipResources.RuleMap, rls *bigipResources.Rules, ordinal int) {
-		for _, v := range r {
-			*rls = append(*rls, v)
-		}
-
-		sort.Sort(sort.Reverse(*rls))
+// removePool returns true when the pool is deleted else false
+func (r *F5Router) removePool(pool *bigipResources.Pool) bool {
+	key := pool.Name
 
-		for _, v := range *rls {
-			v.Ordinal = ordinal
-			ordinal++
+	p, exists := r.poolResources[key]
+	if exists {
+		for i, addr := range p.Members {
+			// Currently only a single update comes through at a time so we always
+			// know to look at the first addr
+			if sameMember(addr, pool.Members[0]) {
+				p.Members[i] = p.Members[len(p.Members)-1]
+				p.Members[len(p.Members)-1] = bigipResources.Member{Address: "", Port: 0, Session: ""}
+				p.Members = p.Members[:len(p.Members)-1]
+			}
+		}
+		// delete the pool and virtual if there are no members
+		if len(p.Members) == 0 {
+			delete(r.poolResources, key)
+			return true
 		}
-		wg.Done()
 	}
 
-	rls := bigipResources.Rules{}
-	go sortRules(r.r, &rls, 0)
-
-	w := bigipResources.Rules{}
-	go sortRules(r.wildcards, &w, len(r.r))
-
-	wg.Wait()
-
-	rls = append(rls, w...)
+	return false
+}
 
-	plcy.Rules = rls
+// addVirtual adds or replaces a virtual, each add for a route rebuilds its
+// virtual so the profiles and iRules its tags select follow the tags. The
+// policies and profiles of a bound plan are reapplied from unmappedResourcesMap
+func (r *F5Router) addVirtual(vs *bigipResources.Virtual) {
+	r.virtualResources[vs.VirtualServerName] = vs
+}
 
-	r.logger.Debug("f5router-policy-create", zap.Object("policy", plcy))
-	return &plcy
+func (r *F5Router) removeVirtual(key string) {
+	delete(r.virtualResources, key)
 }
 
-func (r *F5Router) processRouteAdd(ru updateHTTP) {
-	r.logger.Debug("process-HTTP-route-add", zap.String("name", ru.Name()), zap.String("route", ru.Route()))
+// ForceRemovePool deletes a pool along with its monitors, rules and virtual
+// even if members are still registered, for cleaning up orphaned pools
+func (r *F5Router) ForceRemovePool(name string) {
+	r.logger.Info("f5router-force-removing-pool", zap.String("name", name))
+	r.queue.Add(poolForceRemove{name: name})
+}
 
-	err := verifyRouteURI(ru)
-	if nil != err {
-		r.logger.Error("f5router-URI-error", zap.Error(err))
+func (r *F5Router) processPoolForceRemove(pr poolForceRemove) {
+	name := pr.name
+	if HTTPRouterName == name || HTTPSRouterName == name || PassthroughRouterName == name {
+		r.logger.Warn("f5router-force-remove-routing-virtual", zap.String("name", name))
 		return
 	}
 
-	// Create default resources and update them if resource updates exist for this route
-	rs, err := ru.CreateResources(r.c)
-	if nil != err {
-		r.logger.Error("process-HTTP-route-add-error-create-resources", zap.Error(err))
-		return
+	pool, poolExists := r.poolResources[name]
+	members := 0
+	if poolExists {
+		members = len(pool.Members)
 	}
-	if resources, ok := r.unmappedResourcesMap[ru.Name()]; ok {
-		rs = ru.UpdateResources(rs, resources)
+	delete(r.poolResources, name)
+	delete(r.pendingPoolDeletes, name)
+	delete(r.disabledPools, name)
+	for key := range r.drainingMembers {
+		if strings.HasPrefix(key, name+"|") {
+			delete(r.drainingMembers, key)
+		}
 	}
+	r.removeMonitors(name)
+	delete(r.dedicatedVirtuals, name)
 
-	err = r.assignVSPort(rs.Virtuals[0])
-	if nil != err {
-		r.logger.Error(
-			"process-HTTP-route-add-error-assign-vs-port",
-			zap.String("Route", ru.Route()),
-			zap.Error(err))
+	rules := r.removePoolRules(name)
+
+	_, virtualExists := r.virtualResources[name]
+	r.removeVirtual(name)
+	r.releaseTier2Address(name)
+
+	if !poolExists && !virtualExists && 0 == len(rules) {
+		r.logger.Info("f5router-force-remove-unknown-pool", zap.String("name", name))
 		return
 	}
+	r.logger.Info("f5router-pool-force-removed",
+		zap.String("name", name),
+		zap.Bool("pool", poolExists),
+		zap.Int("members", members),
+		zap.Bool("virtual", virtualExists),
+		zap.Object("rules", rules),
+	)
+}
 
-	if len(rs.Monitors) != 0 {
-		r.addMonitors(rs.Pools[0].Name, rs.Monitors)
+// RemoveVirtualServer deletes the virtual of a route, the rules forwarding to
+// it and its pool are removed with it or left behind with a warning
+// depending on virtual_removal
+func (r *F5Router) RemoveVirtualServer(uri route.Uri) {
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		r.logger.Warn("f5router-partition-error", zap.Error(err))
+		return
 	}
-	r.addPool(rs.Pools[0])
-	r.addVirtual(rs.Virtuals[0])
-	r.addRule(ru)
+	name := r.names.ObjectName(uri.String(), partition)
+	r.logger.Info("f5router-removing-virtual", zap.String("route", uri.String()))
+	r.queue.Add(virtualRemove{name: name})
 }
 
-func (r *F5Router) processRouteBind(ru updateHTTP) {
-	name := ru.Name()
-	planID := ru.PlanID()
-	existingPool := r.poolResources[name]
-	existingVirtual := r.virtualResources[name]
-	r.plansMap.lock.Lock()
-	defer r.plansMap.lock.Unlock()
-
-	// There is a mapped route (with an endpoint) that will be updated
-	if (existingPool != nil) && (existingVirtual != nil) {
-		var rs bigipResources.Resources
-
-		// Get copy of members before they are removed
-		members := make([]bigipResources.Member, len(existingPool.Members))
-		copy(members, existingPool.Members)
-		r.removePool(existingPool)
-		r.removeVirtual(name)
+func (r *F5Router) processVirtualRemove(vr virtualRemove) {
+	name := vr.name
+	if HTTPRouterName == name || HTTPSRouterName == name || PassthroughRouterName == name {
+		r.logger.Warn("f5router-remove-routing-virtual", zap.String("name", name))
+		return
+	}
+	if _, ok := r.virtualResources[name]; !ok {
+		r.logger.Info("f5router-remove-unknown-virtual", zap.String("name", name))
+		return
+	}
+	if config.CascadeVirtualRemoval == r.c.BigIP.VirtualRemoval {
+		r.processPoolForceRemove(poolForceRemove{name: name})
+		return
+	}
 
-		// Bind updates to this mapped route
-		rs = bigipResources.Resources{
-			Virtuals: []*bigipResources.Virtual{existingVirtual},
-			Pools:    []*bigipResources.Pool{existingPool},
-		}
+	r.removeVirtual(name)
+	r.releaseTier2Address(name)
 
-		if plan, ok := r.plansMap.plans[planID]; ok {
-			if len(plan.Pool.HealthMonitors) != 0 {
-				r.removeMonitors(existingPool.Name)
+	var rules []string
+	for _, rm := range []bigipResources.RuleMap{r.r, r.wildcards} {
+		for uri, rule := range rm {
+			if rule.Pool == name {
+				rules = append(rules, uri.String())
 			}
-			planResources := ru.CreatePlanResources(r.c, plan)
-			rs = ru.UpdateResources(rs, planResources)
-		} else {
-			r.logger.Warn("process-HTTP-route-update-bind-error",
-				zap.String("Update-Mapped-Route-Error",
-					fmt.Sprintf("could not find plan %s for route %s keeping defaults", planID, ru.Route())))
 		}
+	}
+	sort.Strings(rules)
+	_, poolExists := r.poolResources[name]
+	if !poolExists && 0 == len(rules) {
+		r.logger.Info("f5router-virtual-removed", zap.String("name", name))
+		return
+	}
+	r.logger.Warn("f5router-virtual-removed-orphans-remain",
+		zap.String("name", name),
+		zap.Bool("pool", poolExists),
+		zap.Object("rules", rules),
+	)
+}
 
-		// Members are not updated and should be added back
-		rs.Pools[0].Members = members
-		if len(rs.Monitors) != 0 {
-			r.addMonitors(rs.Pools[0].Name, rs.Monitors)
-		}
-		r.addPool(rs.Pools[0])
-		r.addVirtual(rs.Virtuals[0])
-	} else {
-		// Bind updates to this unmapped route
-		if plan, ok := r.plansMap.plans[planID]; ok {
-			planResources := ru.CreatePlanResources(r.c, plan)
-			r.unmappedResourcesMap[name] = planResources
-		} else {
-			r.logger.Warn("process-HTTP-route-update-bind-error",
-				zap.String("Update-Unmapped-Route-Error",
-					fmt.Sprintf("could not find plan %s for unmapped route noop", planID)))
+// removePoolRules deletes the rules forwarding to the pool, returning their URIs
+func (r *F5Router) removePoolRules(name string) []string {
+	var rules []string
+	for _, rm := range []bigipResources.RuleMap{r.r, r.wildcards} {
+		for uri, rule := range rm {
+			if rule.Pool == name {
+				delete(rm, uri)
+				delete(r.redirects, uri)
+				rules = append(rules, uri.String())
+			}
 		}
 	}
+	sort.Strings(rules)
+	r.reportRuleStats()
+	return rules
 }
 
-func (r *F5Router) processRouteUnbind(ru updateHTTP) {
-	name := ru.Name()
-	existingPool := r.poolResources[name]
-	existingVirtual := r.virtualResources[name]
-
-	// There is a mapped route (with an endpoint) that will be updated
-	if (existingPool != nil) && (existingVirtual != nil) {
-		var rs bigipResources.Resources
-		var err error
-
-		// Get copy of members before they are removed
-		members := make([]bigipResources.Member, len(existingPool.Members))
-		copy(members, existingPool.Members)
-		r.removePool(existingPool)
-		r.removeVirtual(name)
-
-		// Unbind updates to this mapped route
-		r.removeMonitors(existingPool.Name)
-		rs, err = ru.CreateBrokerDefaultResources(
-			r.c,
-			existingPool.Description,
-			existingVirtual.Destination,
-			members[0].Address,
-			members[0].Port,
+// RemovePoolEndpointByName removes the member at addr, host:port, from the
+// pool without the route's URI, for cleanup tooling that only knows the pool
+// from the BIG-IP. The member is removed at once, without draining, and an
+// emptied pool takes its rules and virtual with it
+func (r *F5Router) RemovePoolEndpointByName(poolName, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	var p uint64
+	if nil == err {
+		p, err = strconv.ParseUint(port, 10, 16)
+	}
+	if nil != err {
+		r.logger.Warn("f5router-invalid-endpoint-address",
+			zap.String("pool", poolName),
+			zap.String("address", addr),
+			zap.Error(err),
 		)
-		if nil != err {
-			r.logger.Error("process-HTTP-route-update-unbind-error", zap.Error(err))
-			return
-		}
+		return
+	}
+	r.logger.Info("f5router-removing-pool-endpoint",
+		zap.String("pool", poolName),
+		zap.String("address", addr),
+	)
+	r.queue.Add(poolEndpointRemove{name: poolName, address: host, port: uint16(p)})
+}
 
-		// Members are not updated and should be added back
-		rs.Pools[0].Members = members
-		r.addPool(rs.Pools[0])
-		r.addVirtual(rs.Virtuals[0])
-	} else {
-		// Unbind updates to this unmapped route
-		delete(r.unmappedResourcesMap, name)
+func (r *F5Router) processPoolEndpointRemove(per poolEndpointRemove) {
+	name := per.name
+	m := bigipResources.Member{Address: per.address, Port: per.port}
+	pool, ok := r.poolResources[name]
+	found := false
+	if ok {
+		for i := range pool.Members {
+			if pool.Members[i].Address == m.Address && pool.Members[i].Port == m.Port {
+				pool.Members = append(pool.Members[:i], pool.Members[i+1:]...)
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		r.logger.Info("f5router-remove-unknown-pool-endpoint",
+			zap.String("pool", name),
+			zap.String("address", net.JoinHostPort(m.Address, strconv.Itoa(int(m.Port)))),
+		)
+		return
+	}
+	delete(r.drainingMembers, memberKey(name, m))
+
+	var rules []string
+	if 0 == len(pool.Members) {
+		delete(r.poolResources, name)
+		delete(r.pendingPoolDeletes, name)
+		delete(r.disabledPools, name)
+		r.removeMonitors(name)
+		rules = r.removePoolRules(name)
+		r.removeVirtual(name)
+		r.releaseTier2Address(name)
 	}
+	r.logger.Info("f5router-pool-endpoint-removed",
+		zap.String("pool", name),
+		zap.String("address", net.JoinHostPort(m.Address, strconv.Itoa(int(m.Port)))),
+		zap.Int("members", len(pool.Members)),
+		zap.Object("rules", rules),
+	)
 }
 
-func (r *F5Router) processRouteRemove(ru updateHTTP) {
-	r.logger.Debug("process-HTTP-route-remove", zap.String("name", ru.Name()), zap.String("route", ru.Route()))
+// ClearWildcards removes all wildcard routes along with the pools no exact
+// route uses, the routes come back when they register again
+func (r *F5Router) ClearWildcards() {
+	r.logger.Info("f5router-clearing-wildcards")
+	r.queue.Add(wildcardsClear{})
+}
 
-	err := verifyRouteURI(ru)
-	if nil != err {
-		r.logger.Error("f5router-URI-error", zap.Error(err))
+func (r *F5Router) processWildcardsClear() {
+	if 0 == len(r.wildcards) {
+		r.logger.Info("f5router-no-wildcards-to-clear")
 		return
 	}
 
-	rs, err := ru.CreateResources(r.c)
-	if nil != err {
-		r.logger.Error("process-HTTP-route-remove-error", zap.Error(err))
-		return
+	exact := make(map[string]bool)
+	for _, rule := range r.r {
+		exact[rule.Pool] = true
 	}
-	poolRemoved := r.removePool(rs.Pools[0])
-	if poolRemoved {
-		// delete the health monitors associated with this pool
-		r.removeMonitors(rs.Pools[0].Name)
-		// delete the rule for the vip
-		r.removeRule(ru)
-		// delete the tier2 vip
-		vsName := rs.Virtuals[0].VirtualServerName
-		r.removeVirtual(vsName)
-		// delete the mapping of the vs name to the destination
-		delete(r.tier2VSInfo.usedPorts, vsName)
-		// the tier2 vip is deleted, remove the internal data group entry for it
-		record, exist := r.internalDataGroup[vsName]
-		if exist {
-			va, err := record.ReturnTier2VirtualAddress()
-			if nil != err {
-				r.logger.Warn("process-HTTP-route-remove-error", zap.Object("record", record), zap.Error(err))
-			} else {
-				// Add the virtual address to reaped ports for reuse
-				r.tier2VSInfo.reapedPorts = append(r.tier2VSInfo.reapedPorts, va)
-			}
-			delete(r.internalDataGroup, vsName)
+	var uris, pools []string
+	for uri, rule := range r.wildcards {
+		delete(r.wildcards, uri)
+		delete(r.redirects, uri)
+		uris = append(uris, uri.String())
+		if !exact[rule.Pool] {
+			pools = append(pools, rule.Pool)
 		}
 	}
+	sort.Strings(uris)
+	sort.Strings(pools)
+	for _, name := range pools {
+		r.processPoolForceRemove(poolForceRemove{name: name})
+	}
+	r.reportRuleStats()
+
+	r.logger.Info("f5router-wildcards-cleared",
+		zap.Object("routes", uris),
+		zap.Object("pools", pools),
+	)
 }
 
-func (r *F5Router) processTCPRouteAdd(ru updateTCP) {
-	r.logger.Debug("process-TCP-route-add", zap.String("name", ru.Name()), zap.String("route", ru.Route()))
+// DisablePool takes all members of the route's pool offline for maintenance
+// without removing them, members registering later are disabled as well until
+// EnablePool restores the pool. The state goes with the pool when it is deleted
+func (r *F5Router) DisablePool(uri route.Uri) {
+	r.setPoolState(uri, true)
+}
 
-	rs, err := ru.CreateResources(r.c)
+// EnablePool brings the members of a pool DisablePool took offline back
+func (r *F5Router) EnablePool(uri route.Uri) {
+	r.setPoolState(uri, false)
+}
+
+func (r *F5Router) setPoolState(uri route.Uri, disabled bool) {
+	partition, err := resolvePartition(r.c, 0)
 	if nil != err {
-		r.logger.Error("process-TCP-route-add-error", zap.Error(err))
+		r.logger.Warn("f5router-partition-error", zap.Error(err))
 		return
 	}
-	r.addPool(rs.Pools[0])
-	r.addVirtual(rs.Virtuals[0])
+	name := r.names.ObjectName(uri.String(), partition)
+	r.logger.Info("f5router-setting-pool-state",
+		zap.String("route", uri.String()),
+		zap.Bool("disabled", disabled),
+	)
+	r.queue.Add(poolState{name: name, disabled: disabled})
 }
 
-func (r *F5Router) processTCPRouteRemove(ru updateTCP) {
-	r.logger.Debug("process-TCP-route-remove", zap.String("name", ru.Name()), zap.String("route", ru.Route()))
-
-	rs, err := ru.CreateResources(r.c)
-	if nil != err {
-		r.logger.Error("process-TCP-route-remove-error", zap.Error(err))
+func (r *F5Router) processPoolState(ps poolState) {
+	if !ps.disabled {
+		delete(r.disabledPools, ps.name)
+		r.logger.Info("f5router-pool-enabled", zap.String("name", ps.name))
 		return
 	}
-	poolRemoved := r.removePool(rs.Pools[0])
-	if poolRemoved {
-		r.removeVirtual(rs.Virtuals[0].VirtualServerName)
+	pool, ok := r.poolResources[ps.name]
+	if !ok {
+		r.logger.Info("f5router-disable-unknown-pool", zap.String("name", ps.name))
+		return
 	}
+	r.disabledPools[ps.name] = true
+	r.logger.Info("f5router-pool-disabled",
+		zap.String("name", ps.name),
+		zap.Int("members", len(pool.Members)),
+	)
 }
 
-func (r *F5Router) addMonitors(poolName string, monitors []*bigipResources.Monitor) {
-	r.monitorResources[poolName] = monitors
-}
+// SetPoolMembers replaces the members of the route's pool with endpoints, so
+// members whose address changed without a removal do not linger in the pool.
+// An empty set removes the route.
+func (r *F5Router) SetPoolMembers(uri route.Uri, endpoints []*route.Endpoint) {
+	if r.rejectWildcard(uri) || r.rejectLongHost(uri) {
+		return
+	}
+	r.logger.Debug("f5router-setting-pool-members",
+		zap.String("route", uri.String()),
+		zap.Int("members", len(endpoints)),
+	)
+	set := make([]*route.Endpoint, len(endpoints))
+	copy(set, endpoints)
 
-func (r *F5Router) removeMonitors(poolName string) {
-	delete(r.monitorResources, poolName)
+	r.memberSets.lock.Lock()
+	r.memberSets.data[uri] = set
+	r.memberSets.lock.Unlock()
+	r.queue.Add(poolMembersSet{uri: uri})
 }
 
-func (r *F5Router) addPool(pool *bigipResources.Pool) {
-	key := pool.Name
+func (r *F5Router) processPoolMembersSet(ps poolMembersSet) error {
+	r.memberSets.lock.Lock()
+	endpoints, ok := r.memberSets.data[ps.uri]
+	delete(r.memberSets.data, ps.uri)
+	r.memberSets.lock.Unlock()
+	if !ok {
+		// a queued item for the same URI already applied the latest set
+		return nil
+	}
 
-	p, exists := r.poolResources[key]
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return err
+	}
 
-	if exists {
-		for _, addr := range p.Members {
-			// Currently only a single update comes through at a time so we always
-			// know to look at the first addr
-			if addr == pool.Members[0] {
-				return
-			}
-		}
-		p.Members = append(p.Members, pool.Members...)
-	} else {
-		r.poolResources[key] = pool
+	name := r.names.ObjectName(ps.uri.String(), partition)
+	if 0 == len(endpoints) {
+		r.processPoolForceRemove(poolForceRemove{name: name})
+		return nil
 	}
 
-}
+	var members []bigipResources.Member
+	var first *route.Endpoint
+	seen := make(map[string]bool)
+	for _, ep := range endpoints {
+		err := verifyMemberAddress(updateHTTP{endpoint: ep}, r.c.BigIP.FQDNMembers)
+		if nil != err {
+			r.logger.Warn("f5router-invalid-member-address",
+				zap.String("route", ps.uri.String()),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err := verifyMemberPort(updateHTTP{endpoint: ep}, r.c); nil != err {
+			r.logger.Warn("f5router-portless-member-rejected",
+				zap.String("route", ps.uri.String()),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err := verifyMemberFamily(updateHTTP{endpoint: ep}, r.c); nil != err {
+			r.logger.Info("f5router-member-address-family-filtered",
+				zap.String("route", ps.uri.String()),
+				zap.Error(err),
+			)
+			continue
+		}
+		m := bigipResources.Member{
+			Address: ep.Address,
+			Port:    memberPort(ep.Port, r.c),
+			Session: "user-enabled",
+		}
+		if r.c.BigIP.DrainPeriod > 0 {
+			m.Ratio = drainRatio
+		}
+		makeFQDNMember(&m, r.c)
+		m.Monitor, err = updateHTTP{endpoint: ep}.memberMonitor()
+		if nil != err {
+			r.logger.Warn("f5router-ignoring-member-monitor",
+				zap.String("route", ps.uri.String()),
+				zap.Error(err),
+			)
+		}
+		key := memberKey(name, m)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		r.seeMember(name, m)
+		if nil == first {
+			first = ep
+		}
+		members = append(members, m)
+	}
+	if 0 == len(members) {
+		return fmt.Errorf("no valid members for route %s", ps.uri.String())
+	}
 
-// removePool returns true when the pool is deleted else false
-func (r *F5Router) removePool(pool *bigipResources.Pool) bool {
-	key := pool.Name
+	ru, err := NewUpdate(r.logger, routeUpdate.Add, ps.uri, first, "")
+	if nil != err {
+		return err
+	}
+	ru.name = name
+	err = r.processRouteAdd(ru)
+	if nil != err {
+		return err
+	}
+	pool, exists := r.poolResources[name]
+	if !exists {
+		return fmt.Errorf("failed creating pool for route %s", ps.uri.String())
+	}
 
-	p, exists := r.poolResources[key]
-	if exists {
-		for i, addr := range p.Members {
-			// Currently only a single update comes through at a time so we always
-			// know to look at the first addr
-			if addr == pool.Members[0] {
-				p.Members[i] = p.Members[len(p.Members)-1]
-				p.Members[len(p.Members)-1] = bigipResources.Member{Address: "", Port: 0, Session: ""}
-				p.Members = p.Members[:len(p.Members)-1]
-			}
+	// members not in the set are dropped right away instead of draining
+	for key := range r.drainingMembers {
+		if strings.HasPrefix(key, name+"|") {
+			delete(r.drainingMembers, key)
 		}
-		// delete the pool and virtual if there are no members
-		if len(p.Members) == 0 {
-			delete(r.poolResources, key)
-			return true
+	}
+	for key := range r.primedMembers {
+		if strings.HasPrefix(key, name+"|") {
+			delete(r.primedMembers, key)
 		}
 	}
+	pool.Members = members
 
-	return false
+	r.logger.Debug("f5router-pool-members-set",
+		zap.String("pool", name),
+		zap.Int("members", len(members)),
+	)
+	return nil
 }
 
-func (r *F5Router) addVirtual(vs *bigipResources.Virtual) {
-	key := vs.VirtualServerName
+// SetDedicatedVirtual gives a route a virtual of its own on address and port
+// which forwards straight to the route's pool. The route stays reachable
+// through the shared virtuals as well.
+func (r *F5Router) SetDedicatedVirtual(uri route.Uri, address string, port int32) error {
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		return err
+	}
+	va := bigipResources.VirtualAddress{BindAddr: address, Port: port}
+	if _, err := verifyDestAddress(&va, partition); nil != err {
+		return err
+	}
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port: %d", port)
+	}
+	if (address == externalAddr(r.c, httpVirtualType) && 80 == port) ||
+		(address == externalAddr(r.c, httpsVirtualType) && 443 == port) {
+		return fmt.Errorf("%s:%d is used by the routing virtuals", address, port)
+	}
 
-	_, exist := r.virtualResources[key]
-	if !exist {
-		r.virtualResources[key] = vs
+	name := r.names.ObjectName(uri.String(), partition)
+	r.logger.Info("f5router-setting-dedicated-virtual",
+		zap.String("route", uri.String()),
+		zap.String("address", address),
+		zap.Int("port", int(port)),
+	)
+	r.queue.Add(dedicatedVirtual{name: name, va: va})
+	return nil
+}
+
+// RemoveDedicatedVirtual removes the dedicated virtual of a route, the route
+// itself is kept
+func (r *F5Router) RemoveDedicatedVirtual(uri route.Uri) {
+	partition, err := resolvePartition(r.c, 0)
+	if nil != err {
+		r.logger.Warn("f5router-partition-error", zap.Error(err))
+		return
 	}
+	name := r.names.ObjectName(uri.String(), partition)
+	r.logger.Info("f5router-removing-dedicated-virtual", zap.String("route", uri.String()))
+	r.queue.Add(dedicatedVirtual{name: name})
 }
 
-func (r *F5Router) removeVirtual(key string) {
-	delete(r.virtualResources, key)
+func (r *F5Router) processDedicatedVirtual(dv dedicatedVirtual) error {
+	if 0 == len(dv.va.BindAddr) {
+		delete(r.dedicatedVirtuals, dv.name)
+		return nil
+	}
+	for name, va := range r.dedicatedVirtuals {
+		if name != dv.name && va == dv.va {
+			return fmt.Errorf("%s:%d is already dedicated to %s", va.BindAddr, va.Port, name)
+		}
+	}
+	r.dedicatedVirtuals[dv.name] = dv.va
+	return nil
 }
 
 func (r *F5Router) addRule(ru updateHTTP) {
+	skip, err := ru.skipRoutingPolicy()
+	if nil != err {
+		r.logger.Warn("f5router-ignoring-skip-routing-policy",
+			zap.String("route", ru.URI().String()),
+			zap.Error(err),
+		)
+	}
+	if skip {
+		// the route's pool and virtual stay for the custom policy, a rule the
+		// route had before it was skipped goes
+		r.removeRule(ru)
+		r.logger.Debug("f5router-rule-skipped",
+			zap.String("name", ru.Name()),
+			zap.String("uri", ru.URI().String()),
+		)
+		return
+	}
+
 	rule, err := r.makeRouteRule(ru)
 	if nil != err {
 		r.logger.Warn("f5router-rule-error", zap.Error(err))
+		return
 	}
 
+	key := ru.ruleKey()
 	if strings.Contains(ru.URI().String(), "*") {
-		r.wildcards[ru.URI()] = rule
+		r.wildcards[key] = rule
 		r.logger.Debug("f5router-wildcard-rule-updated",
 			zap.String("name", ru.Name()),
 			zap.String("uri", ru.URI().String()),
 		)
 	} else {
-		r.r[ru.URI()] = rule
+		r.r[key] = rule
 		r.logger.Debug("f5router-app-rule-updated",
 			zap.String("name", ru.Name()),
 			zap.String("uri", ru.URI().String()),
 		)
 	}
+	if r.c.BigIP.RedirectTrailingSlash && nil != rule {
+		if redirect := makeRedirectRule(rule); nil != redirect {
+			r.redirects[key] = redirect
+		}
+	}
+	r.reportRuleStats()
+}
+
+const redirectSuffix = "-redirect"
+
+// makeRedirectRule redirects requests for the trailing slash form of a route's
+// path to the canonical form, rules without a path have nothing to redirect
+func makeRedirectRule(rule *bigipResources.Rule) *bigipResources.Rule {
+	u, err := url.Parse("scheme://" + rule.FullURI)
+	if nil != err || 0 == len(u.EscapedPath()) {
+		return nil
+	}
+	path := u.EscapedPath()
+
+	// the redirect matches the path with the case of the rule's segments
+	caseSensitive := true
+	var c []*bigipResources.Condition
+	for _, cond := range rule.Conditions {
+		// a path regex decides on trailing slashes itself
+		if cond.Path && cond.Matches {
+			return nil
+		}
+		if cond.HTTPHost || cond.HTTPHeader || cond.HTTPCookie || cond.TCP {
+			hc := *cond
+			c = append(c, &hc)
+		}
+		if cond.PathSegment || cond.Path {
+			caseSensitive = !cond.CaseInsensitive
+		}
+	}
+	c = append(c, &bigipResources.Condition{
+		Equals:          true,
+		HTTPURI:         true,
+		Path:            true,
+		CaseSensitive:   caseSensitive,
+		CaseInsensitive: !caseSensitive,
+		Name:            strconv.Itoa(len(c)),
+		Request:         true,
+		Values:          []string{path + "/"},
+	})
+
+	// keep anything after the trailing slash, i.e. the query string
+	a := &bigipResources.Action{
+		HTTPReply: true,
+		Redirect:  true,
+		Request:   true,
+		Location:  fmt.Sprintf("tcl:%s[string range [HTTP::uri] %d end]", path, len(path)+1),
+	}
+
+	return &bigipResources.Rule{
+		FullURI:     rule.FullURI + "/",
+		Priority:    rule.Priority,
+		Pool:        rule.Pool,
+		Actions:     orderActions([]ruleAction{{stage: forwardStage, action: a}}),
+		Conditions:  c,
+		Name:        rule.Name + redirectSuffix,
+		Description: rule.Description,
+	}
+}
+
+// makeSNIRule matches a rule's host on the SNI server name instead of the Host
+// header for a route on the passthrough virtual. The request is still
+// encrypted when the client hello is seen, so only the host can be matched and
+// the connection goes straight to the route's pool
+func (r *F5Router) makeSNIRule(rule *bigipResources.Rule, partition string) (*bigipResources.Rule, error) {
+	if 0 == r.c.BigIP.PassthroughPort {
+		return nil, fmt.Errorf("route %s has %s but passthrough_port is not set",
+			rule.FullURI, PassthroughTag)
+	}
+	var c []*bigipResources.Condition
+	for _, cond := range rule.Conditions {
+		if !cond.HTTPHost {
+			return nil, fmt.Errorf("passthrough route %s can only match its host", rule.FullURI)
+		}
+		if cond.Port {
+			// the port is the virtual's, it can't distinguish the route
+			continue
+		}
+		c = append(c, &bigipResources.Condition{
+			Equals:         cond.Equals,
+			StartsWith:     cond.StartsWith,
+			EndsWith:       cond.EndsWith,
+			Contains:       cond.Contains,
+			Matches:        cond.Matches,
+			SSLExtension:   true,
+			ServerName:     true,
+			SSLClientHello: true,
+			Negate:         cond.Negate,
+			Name:           strconv.Itoa(len(c)),
+			Index:          cond.Index,
+			Values:         cond.Values,
+		})
+	}
+	if 0 == len(c) {
+		return nil, fmt.Errorf("passthrough route %s has no host", rule.FullURI)
+	}
+
+	return &bigipResources.Rule{
+		FullURI:  rule.FullURI,
+		Priority: rule.Priority,
+		Pool:     rule.Pool,
+		Actions: []*bigipResources.Action{{
+			Forward:        true,
+			Name:           "0",
+			Pool:           poolPath(partition, rule.Pool),
+			SSLClientHello: true,
+		}},
+		Conditions:  c,
+		Name:        rule.Name,
+		Description: rule.Description,
+	}, nil
 }
 
 func (r *F5Router) removeRule(ru updateHTTP) {
+	key := ru.ruleKey()
 	if strings.Contains(ru.URI().String(), "*") {
-		delete(r.wildcards, ru.URI())
+		delete(r.wildcards, key)
 		r.logger.Debug("f5router-wildcard-rule-removed",
 			zap.String("name", ru.Name()),
 			zap.String("uri", ru.URI().String()),
 		)
 	} else {
-		delete(r.r, ru.URI())
+		delete(r.r, key)
 		r.logger.Debug("f5router-app-rule-removed",
 			zap.String("name", ru.Name()),
 			zap.String("uri", ru.URI().String()),
 		)
 	}
+	delete(r.redirects, key)
+	r.reportRuleStats()
+}
+
+func (r *F5Router) reportRuleStats() {
+	if nil != r.reporter {
+		r.reporter.CaptureRuleStats(len(r.r), len(r.wildcards))
+	}
+}
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._-]*$`)
+
+var ruleLogFacility = regexp.MustCompile(`^local[0-7]$`)
+
+// policyKeywordPattern matches the controls and requires of a BIG-IP policy
+var policyKeywordPattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// headerNamePattern matches the token characters an HTTP header name allows
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// fqdnPattern matches a DNS name of letters, digits and hyphens
+var fqdnPattern = regexp.MustCompile(
+	`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)+[A-Za-z]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.?$`)
+
+// validFQDN is true for a DNS name the BIG-IP can resolve
+func validFQDN(name string) bool {
+	return len(name) <= 253 && fqdnPattern.MatchString(name)
+}
+
+// makeFQDNMember has the BIG-IP resolve a member whose address is a name,
+// members with an IP address are left as they are
+func makeFQDNMember(m *bigipResources.Member, c *config.Config) {
+	if !c.BigIP.FQDNMembers || nil != net.ParseIP(m.Address) {
+		return
+	}
+	m.FQDN = &bigipResources.FQDN{
+		Name:         m.Address,
+		AutoPopulate: "enabled",
+	}
+	// without an interval the BIG-IP queries again when the record expires
+	if 0 != c.BigIP.FQDNInterval {
+		m.FQDN.Interval = strconv.Itoa(c.BigIP.FQDNInterval)
+	}
+}
+
+// memberPort replaces the port an endpoint registered with when
+// default_member_port is set, or fills it in for an endpoint without one when
+// portless_members is default-port. Adds and removes both go through here so
+// they agree on the member
+func memberPort(port uint16, c *config.Config) uint16 {
+	if 0 != c.BigIP.DefaultMemberPort {
+		return uint16(c.BigIP.DefaultMemberPort)
+	}
+	if 0 == port && config.DefaultPortPortless == c.BigIP.PortlessMembers {
+		return uint16(c.BigIP.PortlessMemberPort)
+	}
+	return port
+}
+
+// verifyMemberPort rejects HTTP updates whose member would end up without a
+// port, the BIG-IP can't tell which service of the address it is
+func verifyMemberPort(ru routeUpdate.RouteUpdate, c *config.Config) error {
+	u, ok := ru.(updateHTTP)
+	if !ok || nil == u.endpoint {
+		return nil
+	}
+	if 0 == memberPort(u.endpoint.Port, c) {
+		return fmt.Errorf("member %s has no port", u.endpoint.Address)
+	}
+	return nil
+}
+
+// memberAddress returns the address of the update's member, false for an
+// update without one
+func memberAddress(ru routeUpdate.RouteUpdate) (string, bool) {
+	switch u := ru.(type) {
+	case updateHTTP:
+		if nil == u.endpoint {
+			return "", false
+		}
+		return u.endpoint.Address, true
+	case updateTCP:
+		return u.member.Address, true
+	}
+	return "", false
+}
+
+// verifyMemberAddress rejects updates whose member the BIG-IP can't address,
+// names are only accepted when fqdn_members is set
+func verifyMemberAddress(ru routeUpdate.RouteUpdate, allowFQDN bool) error {
+	address, ok := memberAddress(ru)
+	if !ok {
+		return nil
+	}
+
+	if 0 == len(address) {
+		return errors.New("empty member address")
+	}
+	if nil == net.ParseIP(address) && !(allowFQDN && validFQDN(address)) {
+		return fmt.Errorf("malformed member address: %s", address)
+	}
+	return nil
+}
+
+// verifyMemberFamily rejects updates whose member is not of the
+// member_address_family, names are left for the BIG-IP to resolve
+func verifyMemberFamily(ru routeUpdate.RouteUpdate, c *config.Config) error {
+	address, ok := memberAddress(ru)
+	if !ok {
+		return nil
+	}
+	ip := net.ParseIP(address)
+	if nil == ip {
+		return nil
+	}
+	switch c.BigIP.MemberAddressFamily {
+	case config.IPv4AddressFamily:
+		if nil == ip.To4() {
+			return fmt.Errorf("member %s is not an IPv4 address", address)
+		}
+	case config.IPv6AddressFamily:
+		if nil != ip.To4() {
+			return fmt.Errorf("member %s is not an IPv6 address", address)
+		}
+	}
+	return nil
+}
+
+// rejectWildcard returns true and warns when the URI is a wildcard route and
+// wildcard routing is disabled
+func (r *F5Router) rejectWildcard(uri route.Uri) bool {
+	if !r.c.BigIP.DisableWildcards || !strings.Contains(uri.String(), "*") {
+		return false
+	}
+	r.logger.Warn("f5router-wildcard-route-rejected", zap.String("route", uri.String()))
+	return true
+}
+
+// rejectLongHost drops routes whose host is longer than max_hostname_length,
+// the BIG-IP would reject the config with their rule
+func (r *F5Router) rejectLongHost(uri route.Uri) bool {
+	host := strings.SplitN(uri.String(), "/", 2)[0]
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+	if len(host) <= r.c.BigIP.MaxHostnameLength {
+		return false
+	}
+	r.logger.Warn("f5router-long-hostname-rejected",
+		zap.String("route", uri.String()),
+		zap.Int("length", len(host)),
+		zap.Int("max-hostname-length", r.c.BigIP.MaxHostnameLength),
+	)
+	return true
 }
 
 // UpdateRoute send update information to processor
@@ -1562,6 +4918,43 @@ func (r *F5Router) UpdateRoute(ru routeUpdate.RouteUpdate) {
 		zap.String("route-type", ru.Protocol()),
 		zap.String("route", ru.Route()),
 	)
+	// Name HTTP routes here so adds and removes share the same generator
+	if hu, ok := ru.(updateHTTP); ok {
+		if r.rejectWildcard(hu.uri) || r.rejectLongHost(hu.uri) {
+			return
+		}
+		partition, err := resolvePartition(r.c, 0)
+		if nil != err {
+			r.logger.Warn("f5router-partition-error",
+				zap.String("route", ru.Route()),
+				zap.Error(err),
+			)
+			return
+		}
+		hu.name = variantName(r.names.ObjectName(hu.uri.String(), partition), hu.variant())
+		ru = hu
+	}
+	if err := verifyMemberAddress(ru, r.c.BigIP.FQDNMembers); nil != err {
+		r.logger.Warn("f5router-invalid-member-address",
+			zap.String("route", ru.Route()),
+			zap.Error(err),
+		)
+		return
+	}
+	if err := verifyMemberPort(ru, r.c); nil != err {
+		r.logger.Warn("f5router-portless-member-rejected",
+			zap.String("route", ru.Route()),
+			zap.Error(err),
+		)
+		return
+	}
+	if err := verifyMemberFamily(ru, r.c); nil != err {
+		r.logger.Info("f5router-member-address-family-filtered",
+			zap.String("route", ru.Route()),
+			zap.Error(err),
+		)
+		return
+	}
 	// WARNING: This only accepts hashable types!
 	r.queue.Add(ru)
 }
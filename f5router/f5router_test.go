@@ -24,13 +24,17 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/F5Networks/cf-bigip-ctlr/bigipclient"
 	fakeClient "github.com/F5Networks/cf-bigip-ctlr/bigipclient/fakes"
 	"github.com/F5Networks/cf-bigip-ctlr/config"
 	"github.com/F5Networks/cf-bigip-ctlr/f5router/bigipResources"
 	"github.com/F5Networks/cf-bigip-ctlr/f5router/routeUpdate"
+	fakeMetrics "github.com/F5Networks/cf-bigip-ctlr/metrics/fakes"
 	"github.com/F5Networks/cf-bigip-ctlr/route"
 	"github.com/F5Networks/cf-bigip-ctlr/servicebroker/planResources"
 	"github.com/F5Networks/cf-bigip-ctlr/test_util"
@@ -41,6 +45,7 @@ import (
 	"github.com/onsi/gomega/format"
 	. "github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/ghttp"
+	"gopkg.in/yaml.v2"
 )
 
 var _ = Describe("F5Router", func() {
@@ -222,1021 +227,5517 @@ var _ = Describe("F5Router", func() {
 			Expect(r).NotTo(BeNil())
 			Expect(err).NotTo(HaveOccurred())
 		})
-	})
-
-	Describe("httpUpdate", func() {
-		var httpUpdate updateHTTP
-		Context("UpdateResources", func() {
-			var oldResources bigipResources.Resources
-			var newResources bigipResources.Resources
+		Context("object references", func() {
+			var c *config.Config
+			var logger *test_util.TestZapLogger
+			var mw *MockWriter
+			var client *bigipclient.BigIPClient
 
 			BeforeEach(func() {
-				httpUpdate = updateHTTP{}
-				policies := []*bigipResources.NameRef{&bigipResources.NameRef{
-					Name:      "test-policy",
-					Partition: "test",
-				}}
-				profiles := []*bigipResources.ProfileRef{&bigipResources.ProfileRef{
-					Name:      "test-profile",
-					Partition: "test",
-					Context:   "all",
-				}}
-				oldResources.Virtuals = []*bigipResources.Virtual{&bigipResources.Virtual{
-					VirtualServerName: "test-route-virtual",
-					PoolName:          "test-route-pool",
-					Profiles:          profiles,
-					Policies:          policies,
-				}}
-				oldResources.Pools = []*bigipResources.Pool{&bigipResources.Pool{
-					Name:         "test-route-pool",
-					Balance:      "round-robin",
-					MonitorNames: []string{"monitor1", "monitor2"},
-				}}
-				oldResources.Monitors = []*bigipResources.Monitor{&bigipResources.Monitor{
-					Name: "test-route-monitor",
-					Type: "http",
-				}}
-				newResources = bigipResources.Resources{}
+				logger = test_util.NewTestZapLogger("router-test")
+				mw = &MockWriter{}
+				c = makeConfig()
+				client = bigipclient.DefaultClient()
 			})
 
-			It("should not update", func() {
-				updatedResources := httpUpdate.UpdateResources(oldResources, newResources)
-				Expect(updatedResources).To(Equal(oldResources))
+			AfterEach(func() {
+				logger.Close()
 			})
 
-			It("should update virtuals profiles and policies only", func() {
-				newPolicies := []*bigipResources.NameRef{&bigipResources.NameRef{
-					Name:      "new-test-policy",
-					Partition: "test",
-				}}
-				newProfiles := []*bigipResources.ProfileRef{&bigipResources.ProfileRef{
-					Name:      "new-test-profile",
-					Partition: "test",
-					Context:   "clientside",
-				}}
-				newResources.Virtuals = []*bigipResources.Virtual{&bigipResources.Virtual{
-					VirtualServerName: "update-route-virtual",
-					PoolName:          "update-route-pool",
-					Profiles:          newProfiles,
-					Policies:          newPolicies,
-				}}
-				updatedResources := httpUpdate.UpdateResources(oldResources, newResources)
+			It("should accept /partition/name references", func() {
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl", "Common/clientssl2"}
+				c.BigIP.Profiles = []string{"/Common/http"}
+				c.BigIP.Policies = []string{"/cf/policy"}
 
-				Expect(len(updatedResources.Virtuals)).To(Equal(1))
-				Expect(updatedResources.Virtuals[0].VirtualServerName).To(Equal(oldResources.Virtuals[0].VirtualServerName))
-				Expect(updatedResources.Virtuals[0].PoolName).To(Equal(oldResources.Virtuals[0].PoolName))
-				Expect(updatedResources.Virtuals[0].Profiles).To(Equal(newProfiles))
-				Expect(updatedResources.Virtuals[0].Policies).To(Equal(newPolicies))
-				Expect(len(updatedResources.Virtuals[0].Profiles)).To(Equal(1))
-				Expect(len(updatedResources.Virtuals[0].Policies)).To(Equal(1))
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).NotTo(BeNil())
+				Expect(err).NotTo(HaveOccurred())
+			})
 
-				Expect(len(updatedResources.Pools)).To(Equal(1))
-				Expect(len(updatedResources.Monitors)).To(Equal(1))
-				Expect(updatedResources.Pools[0]).To(Equal(oldResources.Pools[0]))
-				Expect(updatedResources.Monitors[0]).To(Equal(oldResources.Monitors[0]))
+			It("should reject malformed ssl profiles", func() {
+				c.BigIP.SSLProfiles = []string{"clientssl"}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid ssl_profiles: skipped names: [clientssl] need format /[partition]/[name]"))
+
+				c.BigIP.SSLProfiles = []string{"/Common/ssl/extra", "/Common/"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid ssl_profiles: skipped names: [Common/ssl/extra Common/] need format /[partition]/[name]"))
 			})
 
-			It("should update pools balance and monitor names only", func() {
-				newResources.Pools = []*bigipResources.Pool{&bigipResources.Pool{
-					Name:         "update-route-pool",
-					Balance:      "fastest-node",
-					MonitorNames: []string{"monitor3"},
-				}}
-				updatedResources := httpUpdate.UpdateResources(oldResources, newResources)
+			It("should only create the HTTPS virtual with ssl profiles", func() {
+				for _, profiles := range [][]string{nil, []string{}} {
+					c.BigIP.SSLProfiles = profiles
+					r, err := NewF5Router(logger, c, mw, client)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(r.virtualResources).To(HaveKey(HTTPRouterName))
+					Expect(r.virtualResources).NotTo(HaveKey(HTTPSRouterName))
+				}
 
-				Expect(len(updatedResources.Pools)).To(Equal(1))
-				Expect(updatedResources.Pools[0].Name).To(Equal(oldResources.Pools[0].Name))
-				Expect(updatedResources.Pools[0].Balance).To(Equal(newResources.Pools[0].Balance))
-				Expect(updatedResources.Pools[0].MonitorNames).To(Equal(newResources.Pools[0].MonitorNames))
-				Expect(len(updatedResources.Pools[0].MonitorNames)).To(Equal(1))
+				c.BigIP.SSLProfiles = []string{""}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid ssl_profiles: skipped names: [] need format /[partition]/[name]"))
 
-				Expect(len(updatedResources.Virtuals)).To(Equal(1))
-				Expect(len(updatedResources.Monitors)).To(Equal(1))
-				Expect(updatedResources.Virtuals[0]).To(Equal(oldResources.Virtuals[0]))
-				Expect(updatedResources.Monitors[0]).To(Equal(oldResources.Monitors[0]))
+				// names that get past validation still cannot produce an HTTPS
+				// virtual without a clientside profile
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				r.c.BigIP.SSLProfiles = []string{"clientssl"}
+				delete(r.virtualResources, HTTPSRouterName)
+				Expect(r.createHTTPVirtuals()).To(MatchError(
+					"no usable ssl_profiles for the HTTPS virtual"))
+				Expect(r.virtualResources).NotTo(HaveKey(HTTPSRouterName))
 			})
 
-			It("should update monitors", func() {
-				newResources.Monitors = []*bigipResources.Monitor{&bigipResources.Monitor{
-					Name: "update-route-monitor",
-					Type: "tcp",
-				}}
-				updatedResources := httpUpdate.UpdateResources(oldResources, newResources)
+			It("should set the rate limit on the routing virtuals", func() {
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				c.BigIP.RateLimit = 500
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.virtualResources[HTTPRouterName].RateLimit).To(Equal(500))
+				Expect(r.virtualResources[HTTPSRouterName].RateLimit).To(Equal(500))
+				Eventually(logger).Should(Say("f5router-rate-limit-configured"))
+
+				c.BigIP.RateLimit = -1
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("rate_limit must not be negative: -1"))
+			})
 
-				Expect(len(updatedResources.Virtuals)).To(Equal(1))
-				Expect(len(updatedResources.Pools)).To(Equal(1))
-				Expect(len(updatedResources.Monitors)).To(Equal(1))
-				Expect(updatedResources.Virtuals[0]).To(Equal(oldResources.Virtuals[0]))
-				Expect(updatedResources.Pools[0]).To(Equal(oldResources.Pools[0]))
-				Expect(updatedResources.Monitors[0]).To(Equal(newResources.Monitors[0]))
+			It("should forward client certificates on the HTTPS virtual", func() {
+				c.BigIP.ClientCertHeaders = true
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"client_cert_headers requires ssl_profiles that request client certificates"))
+
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl-auth"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.virtualResources[HTTPSRouterName].IRules).To(Equal([]string{
+					"/cf/" + bigipResources.ClientCertiRuleName,
+					"/cf/" + bigipResources.HTTPForwardingiRuleName,
+				}))
+				Expect(r.virtualResources[HTTPRouterName].IRules).To(Equal([]string{
+					"/cf/" + bigipResources.HTTPForwardingiRuleName,
+				}))
+				Expect(r.ruleResources).To(HaveKey(bigipResources.ClientCertiRuleName))
 			})
-		})
 
-		Context("CreatePlanResources", func() {
-			var plan planResources.Plan
-			var logger *test_util.TestZapLogger
-			var c *config.Config
+			It("should require a ratio load balancing mode to drain members", func() {
+				c.BigIP.DrainPeriod = 30
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"drain_period requires a ratio load_balancing_mode, got: round-robin"))
 
-			BeforeEach(func() {
-				logger := test_util.NewTestZapLogger("create-plan-resources-test")
-				httpUpdate = updateHTTP{logger: logger}
-				plan = planResources.Plan{
-					Name: "test-plan",
-				}
-				c = config.DefaultConfig()
-				c.BigIP.Partitions = []string{"test"}
+				c.BigIP.LoadBalancingMode = "ratio-member"
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+
+				c.BigIP.DrainPeriod = -1
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("drain_period must not be negative: -1"))
 			})
 
-			AfterEach(func() {
-				if nil != logger {
-					logger.Close()
-				}
+			It("should attach the ssl profiles to the HTTP virtual when enabled", func() {
+				c.BigIP.SSLOnHTTPVirtual = true
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("ssl_on_http_virtual requires ssl_profiles"))
+
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				sslRef := &bigipResources.ProfileRef{Name: "clientssl", Partition: "Common", Context: "clientside"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.virtualResources[HTTPRouterName].Profiles).To(ContainElement(sslRef))
+				Expect(r.virtualResources[HTTPSRouterName].Profiles).To(ContainElement(sslRef))
+
+				c.BigIP.SSLOnHTTPVirtual = false
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.virtualResources[HTTPRouterName].Profiles).NotTo(ContainElement(sslRef))
+				Expect(r.virtualResources[HTTPSRouterName].Profiles).To(ContainElement(sslRef))
 			})
 
-			It("should create virtual resources from plan", func() {
-				plan.VirtualServer = planResources.VirtualType{
-					Policies:    []string{"/test/policy"},
-					Profiles:    []string{"/test/profile"},
-					SslProfiles: []string{"/test/sslProfile"},
-				}
-				resources := httpUpdate.CreatePlanResources(c, plan)
+			It("should reject malformed health monitors", func() {
+				c.BigIP.HealthMonitors = []string{"/Common/http", "tcp"}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid health_monitors: skipped names: [tcp] need format /[partition]/[name]"))
+			})
 
-				Expect(len(resources.Pools)).To(Equal(1))
-				Expect(len(resources.Monitors)).To(Equal(0))
-				Expect(len(resources.Virtuals)).To(Equal(1))
-				Expect(len(resources.Virtuals[0].Policies)).To(Equal(1))
-				Expect(len(resources.Virtuals[0].Profiles)).To(Equal(2))
+			It("should attach per protocol profiles to each virtual", func() {
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				c.BigIP.Profiles = []string{"/Common/http"}
+				c.BigIP.HTTPSProfiles = []string{"/Common/http", "/Common/http2"}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
 
-				Expect(resources.Pools[0]).To(Equal(&bigipResources.Pool{}))
-				Expect(resources.Virtuals[0].Policies).To(Equal([]*bigipResources.NameRef{
-					&bigipResources.NameRef{
-						Name:      "policy",
-						Partition: "test",
-					}}))
-				Expect(resources.Virtuals[0].Profiles[0]).To(Equal(&bigipResources.ProfileRef{
-					Name:      "profile",
-					Partition: "test",
-					Context:   "all",
+				Expect(r.virtualResources[HTTPRouterName].Profiles).To(Equal([]*bigipResources.ProfileRef{
+					{Name: "http", Partition: "Common", Context: "all"},
+					{Name: "tcp", Partition: "Common", Context: "all"},
 				}))
-				Expect(resources.Virtuals[0].Profiles[1]).To(Equal(&bigipResources.ProfileRef{
-					Name:      "sslProfile",
-					Partition: "test",
-					Context:   "serverside",
+				Expect(r.virtualResources[HTTPSRouterName].Profiles).To(Equal([]*bigipResources.ProfileRef{
+					{Name: "http", Partition: "Common", Context: "all"},
+					{Name: "http2", Partition: "Common", Context: "all"},
+					{Name: "tcp", Partition: "Common", Context: "all"},
+					{Name: "clientssl", Partition: "Common", Context: "clientside"},
 				}))
 			})
 
-			It("should not create virtual resources", func() {
-				plan.VirtualServer = planResources.VirtualType{}
-				resources := httpUpdate.CreatePlanResources(c, plan)
+			It("should reject malformed per protocol profiles", func() {
+				c.BigIP.HTTPProfiles = []string{"http"}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid http_profiles: skipped names: [http] need format /[partition]/[name]"))
+			})
 
-				Expect(len(resources.Pools)).To(Equal(1))
-				Expect(len(resources.Virtuals)).To(Equal(1))
-				Expect(len(resources.Monitors)).To(Equal(0))
+			It("should restrict the virtuals to the configured VLANs", func() {
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.virtualResources[HTTPRouterName].Vlans).To(BeEmpty())
+				Expect(r.virtualResources[HTTPRouterName].VlansEnabled).To(BeFalse())
 
-				Expect(resources.Pools[0]).To(Equal(&bigipResources.Pool{}))
-				Expect(resources.Virtuals[0]).To(Equal(&bigipResources.Virtual{}))
+				c.BigIP.VLANs = []string{"/Common/external", "Common/dmz"}
+				c.BigIP.HTTPSVLANs = []string{"/Common/secure"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.virtualResources[HTTPRouterName].Vlans).To(Equal(
+					[]string{"/Common/external", "/Common/dmz"}))
+				Expect(r.virtualResources[HTTPRouterName].VlansEnabled).To(BeTrue())
+				Expect(r.virtualResources[HTTPSRouterName].Vlans).To(Equal([]string{"/Common/secure"}))
+				Expect(r.virtualResources[HTTPSRouterName].VlansEnabled).To(BeTrue())
+
+				tu, err := NewTCPUpdate(c, logger, routeUpdate.Add, 6000,
+					bigipResources.Member{Address: "10.0.0.1", Port: 6000})
+				Expect(err).NotTo(HaveOccurred())
+				rs, err := tu.CreateResources(c)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rs.Virtuals[0].Vlans).To(Equal([]string{"/Common/external", "/Common/dmz"}))
 			})
 
-			It("should create pool resources from plan", func() {
-				monitors := []bigipResources.Monitor{
-					bigipResources.Monitor{
-						Name: "monitor1",
-						Type: "http",
-					},
-					bigipResources.Monitor{
-						Name: "monitor2",
-						Type: "tcp",
-					},
-				}
-				plan.Pool = planResources.PoolType{
-					Balance:        "round-robin",
-					HealthMonitors: monitors,
+			It("should mirror the connections of the TCP virtuals when configured", func() {
+				tu, err := NewTCPUpdate(c, logger, routeUpdate.Add, 6000,
+					bigipResources.Member{Address: "10.0.0.1", Port: 6000})
+				Expect(err).NotTo(HaveOccurred())
+				rs, err := tu.CreateResources(c)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rs.Virtuals[0].Mirror).To(BeEmpty())
+
+				c.BigIP.ConnectionMirroring = true
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("connection_mirroring needs the routing_api for TCP routes"))
+
+				c.RoutingApi.Uri = "http://127.0.0.1"
+				c.RoutingApi.Port = 3000
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.virtualResources[HTTPRouterName].Mirror).To(BeEmpty())
+
+				rs, err = tu.CreateResources(c)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rs.Virtuals[0].Mirror).To(Equal("enabled"))
+				data, err := json.Marshal(rs.Virtuals[0])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring(`"mirror":"enabled"`))
+			})
+
+			It("should derive the ip protocol of each type of virtual", func() {
+				modes := func(r *F5Router) []string {
+					tu, err := NewTCPUpdate(c, logger, routeUpdate.Add, 6000,
+						bigipResources.Member{Address: "10.0.0.1", Port: 6000})
+					Expect(err).NotTo(HaveOccurred())
+					tcp, err := tu.CreateResources(c)
+					Expect(err).NotTo(HaveOccurred())
+					hu, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+					Expect(err).NotTo(HaveOccurred())
+					tier2, err := hu.CreateResources(c)
+					Expect(err).NotTo(HaveOccurred())
+					dedicated, err := r.makeDedicatedVirtual("foo",
+						bigipResources.VirtualAddress{BindAddr: "10.0.0.2", Port: 53})
+					Expect(err).NotTo(HaveOccurred())
+					return []string{
+						r.virtualResources[HTTPRouterName].Mode,
+						r.virtualResources[HTTPSRouterName].Mode,
+						tier2.Virtuals[0].Mode,
+						dedicated.Mode,
+						tcp.Virtuals[0].Mode,
+					}
 				}
-				resources := httpUpdate.CreatePlanResources(c, plan)
 
-				Expect(len(resources.Virtuals)).To(Equal(1))
-				Expect(resources.Virtuals[0]).To(Equal(&bigipResources.Virtual{}))
-				Expect(len(resources.Pools)).To(Equal(1))
-				Expect(len(resources.Monitors)).To(Equal(2))
-				Expect(len(resources.Pools[0].MonitorNames)).To(Equal(2))
-				Expect(resources.Pools[0].Balance).To(Equal("round-robin"))
-				Expect(resources.Pools[0].MonitorNames).To(Equal([]string{"/test/monitor1", "/test/monitor2"}))
-				Expect(*resources.Monitors[0]).To(Equal(monitors[0]))
-				Expect(*resources.Monitors[1]).To(Equal(monitors[1]))
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(modes(r)).To(Equal([]string{"tcp", "tcp", "tcp", "tcp", "tcp"}))
+
+				c.BigIP.VirtualModes = map[string]string{"dedicated": "udp", "tcp": "sctp"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(modes(r)).To(Equal([]string{"tcp", "tcp", "tcp", "udp", "sctp"}))
+
+				c.BigIP.VirtualModes = map[string]string{"udp": "udp"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("virtual_modes has an unknown virtual type: udp"))
+
+				c.BigIP.VirtualModes = map[string]string{"http": "icmp"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("virtual_modes http must be tcp, udp, sctp or any, got: icmp"))
 			})
 
-			It("should not create pool resources", func() {
-				plan.Pool = planResources.PoolType{}
-				resources := httpUpdate.CreatePlanResources(c, plan)
+			It("should set the auto last hop of the frontend virtuals", func() {
+				lastHops := func(r *F5Router) []string {
+					tu, err := NewTCPUpdate(c, logger, routeUpdate.Add, 6000,
+						bigipResources.Member{Address: "10.0.0.1", Port: 6000})
+					Expect(err).NotTo(HaveOccurred())
+					tcp, err := tu.CreateResources(c)
+					Expect(err).NotTo(HaveOccurred())
+					hu, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+					Expect(err).NotTo(HaveOccurred())
+					tier2, err := hu.CreateResources(c)
+					Expect(err).NotTo(HaveOccurred())
+					dedicated, err := r.makeDedicatedVirtual("foo",
+						bigipResources.VirtualAddress{BindAddr: "10.0.0.2", Port: 53})
+					Expect(err).NotTo(HaveOccurred())
+					return []string{
+						r.virtualResources[HTTPRouterName].AutoLastHop,
+						r.virtualResources[HTTPSRouterName].AutoLastHop,
+						tier2.Virtuals[0].AutoLastHop,
+						dedicated.AutoLastHop,
+						tcp.Virtuals[0].AutoLastHop,
+					}
+				}
 
-				Expect(len(resources.Virtuals)).To(Equal(1))
-				Expect(len(resources.Pools)).To(Equal(1))
-				Expect(len(resources.Monitors)).To(Equal(0))
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(c.BigIP.AutoLastHop).To(Equal(config.DefaultAutoLastHop))
+				Expect(lastHops(r)).To(Equal([]string{"", "", "", "", ""}))
+				data, err := json.Marshal(r.virtualResources[HTTPRouterName])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).NotTo(ContainSubstring("autoLasthop"))
 
-				Expect(resources.Pools[0]).To(Equal(&bigipResources.Pool{}))
-				Expect(resources.Virtuals[0]).To(Equal(&bigipResources.Virtual{}))
+				c.BigIP.AutoLastHop = config.EnabledAutoLastHop
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				// the tier2 virtuals only take traffic from the routing virtuals
+				Expect(lastHops(r)).To(Equal([]string{"enabled", "enabled", "", "enabled", "enabled"}))
+				data, err = json.Marshal(r.virtualResources[HTTPSRouterName])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring(`"autoLasthop":"enabled"`))
+
+				c.BigIP.AutoLastHop = config.DisabledAutoLastHop
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lastHops(r)).To(Equal([]string{"disabled", "disabled", "", "disabled", "disabled"}))
+
+				c.BigIP.AutoLastHop = "on"
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("auto_last_hop must be default, enabled or disabled, got: on"))
 			})
-		})
-	})
 
-	Describe("running router", func() {
-		var mw *MockWriter
-		var router *F5Router
-		var err error
-		var up updateHTTP
-		var logger *test_util.TestZapLogger
-		var c *config.Config
-		var client *bigipclient.BigIPClient
+			It("should use the ssl profiles of the partition for the HTTPS virtual", func() {
+				profileNames := func(r *F5Router) (names []string) {
+					for _, p := range r.virtualResources[HTTPSRouterName].Profiles {
+						if "clientside" == p.Context {
+							names = append(names, p.Partition+"/"+p.Name)
+						}
+					}
+					return names
+				}
 
-		var (
-			fooEndpoint,
-			barEndpoint,
-			bar2Endpoint,
-			bazEndpoint,
-			baz2Endpoint,
-			bazSegment1Endpoint,
-			baz2Segment1Endpoint,
-			bazSegment3Endpoint,
-			baz2Segment3Endpoint,
-			wildCfEndpoint,
-			wildFooEndpoint,
-			wildEndEndpoint,
-			wildMidEndpoint,
-			wildBeginEndpoint,
-			wild2Endpoint,
-			quxEndpoint *route.Endpoint
+				c.BigIP.Partitions = []string{"tenant-a"}
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				c.BigIP.PartitionSSLProfiles = map[string][]string{
+					"tenant-a": {"/tenant-a/a-clientssl"},
+				}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(profileNames(r)).To(Equal([]string{"tenant-a/a-clientssl"}))
+
+				// a partition without its own falls back to ssl_profiles
+				c.BigIP.Partitions = []string{"tenant-b", "tenant-a"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(profileNames(r)).To(Equal([]string{"Common/clientssl"}))
+
+				// the partition's profiles are enough for the HTTPS virtual
+				c.BigIP.Partitions = []string{"tenant-a"}
+				c.BigIP.SSLProfiles = nil
+				c.BigIP.HSTS = true
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(profileNames(r)).To(Equal([]string{"tenant-a/a-clientssl"}))
+
+				c.BigIP.HSTS = false
+				c.BigIP.PartitionSSLProfiles = map[string][]string{"tenant-c": {"/tenant-c/clientssl"}}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("partition_ssl_profiles has an unconfigured partition: tenant-c"))
+
+				c.BigIP.PartitionSSLProfiles = map[string][]string{"tenant-a": {"clientssl"}}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("invalid partition_ssl_profiles for tenant-a: " +
+					"skipped names: [clientssl] need format /[partition]/[name]"))
+			})
+
+			It("should reject malformed VLAN names", func() {
+				c.BigIP.VLANs = []string{"external"}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid vlans: skipped names: [external] need format /[partition]/[name]"))
+
+				c.BigIP.VLANs = nil
+				c.BigIP.HTTPVLANs = []string{"/Common/vlan/extra"}
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid http_vlans: skipped names: [Common/vlan/extra] need format /[partition]/[name]"))
+			})
+
+			It("should reject empty partitions", func() {
+				c.BigIP.Partitions = []string{"cf", ""}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(`invalid partition 1: ""`))
+
+				_, err = resolvePartition(c, 2)
+				Expect(err).To(MatchError("partition index 2 out of range, 2 partitions configured"))
+				partition, err := resolvePartition(c, 0)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(partition).To(Equal("cf"))
+			})
+
+			It("should fail instead of panicking when the partitions go away", func() {
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				c.BigIP.Partitions = nil
+				missing := "partition index 0 out of range, 0 partitions configured"
+
+				up, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				r.UpdateRoute(up)
+				Expect(logger).To(Say("f5router-partition-error"))
+				Expect(r.queue.Len()).To(Equal(0))
+
+				_, err = r.makeRouteRule(up)
+				Expect(err).To(MatchError(missing))
+				_, err = up.CreateResources(c)
+				Expect(err).To(MatchError(missing))
+				Expect(r.SetDedicatedVirtual("foo.cf.com", "10.0.0.1", 8080)).To(MatchError(missing))
+				Expect(r.createHTTPVirtuals()).To(MatchError(missing))
+				Expect(r.writeConfig()).To(MatchError("failed creating resources: " + missing))
+
+				tu, err := NewTCPUpdate(c, logger, routeUpdate.Add, 6000,
+					bigipResources.Member{Address: "10.0.0.1", Port: 6000})
+				Expect(err).NotTo(HaveOccurred())
+				_, err = tu.CreateResources(c)
+				Expect(err).To(MatchError(missing))
+			})
+
+			It("should reject an invalid all down fallback", func() {
+				c.BigIP.AllDownStatus = 700
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("invalid all_down_status: 700"))
+
+				c.BigIP.AllDownPool = "/Common/sorry"
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("all_down_pool and all_down_status are mutually exclusive"))
+
+				c.BigIP.AllDownStatus = 0
+				c.BigIP.AllDownPool = "sorry"
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid all_down_pool: skipped names: [sorry] need format /[partition]/[name]"))
+			})
+
+			It("should attach the DoS profile to the shared virtuals", func() {
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				c.BigIP.DoSProfile = "/Common/dos"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+
+				dosRef := &bigipResources.ProfileRef{Name: "dos", Partition: "Common", Context: "all"}
+				Expect(r.virtualResources[HTTPRouterName].Profiles).To(ContainElement(dosRef))
+				Expect(r.virtualResources[HTTPSRouterName].Profiles).To(ContainElement(dosRef))
+			})
+
+			It("should attach the analytics profile to the shared virtuals", func() {
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				c.BigIP.AnalyticsProfile = "/Common/analytics"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+
+				avrRef := &bigipResources.ProfileRef{Name: "analytics", Partition: "Common", Context: "all"}
+				Expect(r.virtualResources[HTTPRouterName].Profiles).To(ContainElement(avrRef))
+				Expect(r.virtualResources[HTTPSRouterName].Profiles).To(ContainElement(avrRef))
+
+				c.BigIP.AnalyticsProfile = "analytics"
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid analytics_profile: skipped names: [analytics] need format /[partition]/[name]"))
+			})
+
+			It("should clamp a low verify interval", func() {
+				c.BigIP.VerifyInterval = 1
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r).NotTo(BeNil())
+				Expect(c.BigIP.VerifyInterval).To(Equal(5))
+				Expect(logger).To(Say("f5router-verify-interval-clamped"))
+				Expect(mw.getInput().Global.VerifyInterval).To(Equal(5))
+			})
+
+			It("should reject verify intervals out of range", func() {
+				for _, interval := range []int{0, -30, 3601} {
+					c.BigIP.VerifyInterval = interval
+					r, err := NewF5Router(logger, c, mw, client)
+					Expect(r).To(BeNil())
+					Expect(err).To(MatchError(fmt.Sprintf(
+						"verify_interval must be between 1 and 3600 seconds, got: %d", interval)))
+				}
+			})
+
+			It("should reject an unknown rule log facility", func() {
+				c.BigIP.RuleLogging = true
+				c.BigIP.RuleLogFacility = "daemon"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("rule_log_facility must be one of local0 - local7, got: daemon"))
+			})
+
+			It("should reject a malformed OneConnect profile", func() {
+				c.BigIP.OneConnectProfile = "oneconnect"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid oneconnect_profile: skipped names: [oneconnect] need format /[partition]/[name]"))
+			})
+
+			It("should reject a malformed DoS profile", func() {
+				c.BigIP.DoSProfile = "Common/"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid dos_profile: skipped names: [Common/] need format /[partition]/[name]"))
+			})
+
+			It("should reject a malformed traffic group", func() {
+				c.BigIP.TrafficGroup = "traffic-group-1"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid traffic_group: skipped names: [traffic-group-1] need format /[partition]/[name]"))
+			})
+
+			It("should reject malformed profiles", func() {
+				c.BigIP.Profiles = []string{"/Common/http", "//tcp"}
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid profiles: skipped names: [/tcp] need format /[partition]/[name]"))
+			})
+		})
+	})
+
+	Describe("rule conditions", func() {
+		var (
+			logger *test_util.TestZapLogger
+			router *F5Router
 		)
 
-		registerRoutes := func() {
-			// This should produce 10 tier2 vips, pools and rules
-			rp := []routePair{
-				routePair{"foo.cf.com", fooEndpoint},
-				routePair{"bar.cf.com", barEndpoint},
-				routePair{"bar.cf.com", bar2Endpoint},
-				routePair{"baz.cf.com", bazEndpoint},
-				routePair{"baz.cf.com/segment1", bazSegment1Endpoint},
-				routePair{"baz.cf.com/segment1", baz2Segment1Endpoint},
-				routePair{"baz.cf.com/segment1/segment2/segment3", bazSegment3Endpoint},
-				routePair{"baz.cf.com/segment1/segment2/segment3", baz2Segment3Endpoint},
-				routePair{"*.cf.com", wildCfEndpoint},
-				routePair{"*.foo.cf.com", wildFooEndpoint},
-				routePair{"ser*.cf.com", wildEndEndpoint},
-				routePair{"ser*es.cf.com", wildMidEndpoint},
-				routePair{"*vices.cf.com", wildBeginEndpoint},
-				routePair{"*vic*.cf.com", wild2Endpoint},
+		BeforeEach(func() {
+			var err error
+			logger = test_util.NewTestZapLogger("router-test")
+			router, err = NewF5Router(logger, makeConfig(), &MockWriter{}, bigipclient.DefaultClient())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			logger.Close()
+		})
+
+		routeRule := func(uri route.Uri, tags map[string]string) (*bigipResources.Rule, error) {
+			ep := makeEndpoint("127.0.0.1")
+			ep.Tags = tags
+			ru, err := NewUpdate(logger, routeUpdate.Add, uri, ep, "")
+			Expect(err).NotTo(HaveOccurred())
+			return router.makeRouteRule(ru)
+		}
+
+		ruleFor := func(uri route.Uri, tags map[string]string) *bigipResources.Rule {
+			rule, err := routeRule(uri, tags)
+			Expect(err).NotTo(HaveOccurred())
+			return rule
+		}
+
+		ruleNames := func(plcy *bigipResources.Policy) (uris []string) {
+			for i, rule := range plcy.Rules {
+				Expect(rule.Ordinal).To(Equal(i))
+				uris = append(uris, rule.FullURI)
 			}
-			for _, pair := range rp {
-				up, _ = NewUpdate(logger, routeUpdate.Add, pair.url, pair.ep, "")
-				router.UpdateRoute(up)
+			return uris
+		}
+
+		conditionIndices := func(uri route.Uri) (names []string, indices []int) {
+			for _, c := range ruleFor(uri, nil).Conditions {
+				names = append(names, c.Name)
+				indices = append(indices, c.Index)
 			}
+			return names, indices
 		}
 
-		BeforeEach(func() {
-			logger = test_util.NewTestZapLogger("router-test")
-			c = makeConfig()
-			mw = &MockWriter{}
-			client = bigipclient.DefaultClient()
+		conditionKinds := func(rule *bigipResources.Rule) (kinds []string) {
+			for i, c := range rule.Conditions {
+				Expect(c.Name).To(Equal(strconv.Itoa(i)))
+				switch {
+				case c.Port:
+					kinds = append(kinds, "port")
+				case c.HTTPHost:
+					kinds = append(kinds, "host")
+				case c.HTTPHeader:
+					kinds = append(kinds, "header")
+				case c.HTTPCookie:
+					kinds = append(kinds, "cookie")
+				case c.PathSegment, c.Path:
+					kinds = append(kinds, "path")
+				}
+			}
+			return kinds
+		}
 
-			router, err = NewF5Router(logger, c, mw, client)
+		It("should index path segments from 1 after the host", func() {
+			names, indices := conditionIndices("foo.cf.com/a/b/c")
+			Expect(names).To(Equal([]string{"0", "1", "2", "3"}))
+			Expect(indices).To(Equal([]int{0, 1, 2, 3}))
+		})
 
-			Expect(router).NotTo(BeNil(), "%v", router)
+		It("should keep segment indices when the host takes several conditions", func() {
+			names, indices := conditionIndices("foo*.cf.com/a/b")
+			Expect(names).To(Equal([]string{"0", "1", "2", "3"}))
+			Expect(indices).To(Equal([]int{0, 1, 1, 2}))
+
+			names, indices = conditionIndices("*.cf.com/a/b")
+			Expect(names).To(Equal([]string{"0", "1", "2"}))
+			Expect(indices).To(Equal([]int{0, 1, 2}))
+		})
+
+		It("should log rule matches when enabled", func() {
+			ru, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+			Expect(err).NotTo(HaveOccurred())
+			rule, err := router.makeRouteRule(ru)
 			Expect(err).NotTo(HaveOccurred())
+			Expect(rule.Actions).To(HaveLen(1))
 
-			fooEndpoint = makeEndpoint("127.0.0.1")
-			barEndpoint = makeEndpoint("127.0.1.1")
-			bar2Endpoint = makeEndpoint("127.0.1.2")
-			bazEndpoint = makeEndpoint("127.0.2.1")
-			baz2Endpoint = makeEndpoint("127.0.2.2")
-			bazSegment1Endpoint = makeEndpoint("127.0.3.1")
-			baz2Segment1Endpoint = makeEndpoint("127.0.3.2")
-			bazSegment3Endpoint = makeEndpoint("127.0.4.1")
-			baz2Segment3Endpoint = makeEndpoint("127.0.4.2")
-			wildCfEndpoint = makeEndpoint("127.0.5.1")
-			wildFooEndpoint = makeEndpoint("127.0.6.1")
-			wildEndEndpoint = makeEndpoint("127.0.6.2")
-			wildMidEndpoint = makeEndpoint("127.0.6.3")
-			wildBeginEndpoint = makeEndpoint("127.0.6.4")
-			wild2Endpoint = makeEndpoint("127.0.7.1")
-			quxEndpoint = makeEndpoint("127.0.7.1")
+			router.c.BigIP.RuleLogging = true
+			rule, err = router.makeRouteRule(ru)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rule.Actions).To(HaveLen(2))
+			Expect(rule.Actions[0]).To(Equal(&bigipResources.Action{
+				Name:     "0",
+				Log:      true,
+				Write:    true,
+				Request:  true,
+				Facility: "local0",
+				Message:  "tcl:cf-routing rule " + ru.Name() + " matched [HTTP::host][HTTP::uri]",
+			}))
+			Expect(rule.Actions[1].TmName).To(Equal("target_vip"))
 		})
 
-		AfterEach(func() {
-			if nil != logger {
-				logger.Close()
+		It("should match a request header from the route's tags", func() {
+			tenant := map[string]string{HeaderNameTag: "X-Tenant", HeaderValueTag: "acme"}
+
+			rule := ruleFor("foo.cf.com/a", tenant)
+			Expect(rule.Conditions).To(HaveLen(3))
+			Expect(rule.Conditions[0].HTTPHost).To(BeTrue())
+			Expect(rule.Conditions[1]).To(Equal(&bigipResources.Condition{
+				Equals:     true,
+				HTTPHeader: true,
+				TmName:     "X-Tenant",
+				Name:       "1",
+				Index:      0,
+				Request:    true,
+				Values:     []string{"acme"},
+			}))
+			Expect(rule.Conditions[2].PathSegment).To(BeTrue())
+			Expect(rule.Conditions[2].Name).To(Equal("2"))
+			Expect(rule.Conditions[2].Index).To(Equal(1))
+
+			// host and port come first on wildcards
+			rule = ruleFor("*.cf.com:8443/a", tenant)
+			Expect(conditionKinds(rule)).To(Equal([]string{"host", "port", "header", "path"}))
+
+			// the trailing slash redirect is only for the same header or cookie
+			redirect := makeRedirectRule(ruleFor("foo.cf.com/a", tenant))
+			Expect(conditionKinds(redirect)).To(Equal([]string{"host", "header", "path"}))
+			redirect = makeRedirectRule(ruleFor("foo.cf.com/a", map[string]string{
+				CookieNameTag: "ab-variant", CookieValueTag: "b"}))
+			Expect(conditionKinds(redirect)).To(Equal([]string{"host", "cookie", "path"}))
+
+			// both tags are needed
+			Expect(ruleFor("foo.cf.com", map[string]string{HeaderNameTag: "X-Tenant"}).Conditions).To(HaveLen(1))
+			Expect(ruleFor("foo.cf.com", map[string]string{CookieNameTag: "ab-variant"}).Conditions).To(HaveLen(1))
+		})
+
+		It("should match a request cookie from the route's tags", func() {
+			variant := map[string]string{CookieNameTag: "ab-variant", CookieValueTag: "b"}
+
+			rule := ruleFor("foo.cf.com/a", variant)
+			Expect(rule.Conditions).To(HaveLen(3))
+			Expect(rule.Conditions[0].HTTPHost).To(BeTrue())
+			Expect(rule.Conditions[1]).To(Equal(&bigipResources.Condition{
+				Equals:     true,
+				HTTPCookie: true,
+				TmName:     "ab-variant",
+				Name:       "1",
+				Index:      0,
+				Request:    true,
+				Values:     []string{"b"},
+			}))
+			Expect(rule.Conditions[2].PathSegment).To(BeTrue())
+			Expect(rule.Conditions[2].Name).To(Equal("2"))
+
+			data, err := json.Marshal(rule.Conditions[1])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal(
+				`{"equals":true,"httpCookie":true,"tmName":"ab-variant","name":"1","index":0,"request":true,"values":["b"]}`))
+
+			// the cookie follows the header on wildcards
+			variant[HeaderNameTag] = "X-Tenant"
+			variant[HeaderValueTag] = "acme"
+			rule = ruleFor("*.cf.com:8443/a", variant)
+			Expect(conditionKinds(rule)).To(Equal([]string{"host", "port", "header", "cookie", "path"}))
+		})
+
+		It("should match the client address from the route's tags", func() {
+			sourceRule := func(uri route.Uri, tag string) (*bigipResources.Rule, error) {
+				return routeRule(uri, map[string]string{SourceAddressTag: tag})
 			}
+
+			rule, err := sourceRule("foo.cf.com/a", "10.1.2.3/8, 192.168.1.0/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rule.Conditions).To(HaveLen(3))
+			Expect(rule.Conditions[0].HTTPHost).To(BeTrue())
+			Expect(rule.Conditions[1]).To(Equal(&bigipResources.Condition{
+				Matches: true,
+				TCP:     true,
+				Address: true,
+				Name:    "1",
+				Index:   0,
+				Request: true,
+				Values:  []string{"10.0.0.0/8", "192.168.1.0/24"},
+			}))
+			Expect(rule.Conditions[2].PathSegment).To(BeTrue())
+			Expect(rule.Conditions[2].Name).To(Equal("2"))
+
+			// the trailing slash redirect is only for the same clients
+			redirect := makeRedirectRule(rule)
+			Expect(redirect.Conditions).To(HaveLen(3))
+			Expect(redirect.Conditions[1].TCP).To(BeTrue())
+
+			rule, err = sourceRule("*.cf.com", "2001:db8::/32")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rule.Conditions).To(HaveLen(2))
+			Expect(rule.Conditions[1].TCP).To(BeTrue())
+			Expect(rule.Conditions[1].Name).To(Equal("1"))
+			Expect(rule.Conditions[1].Values).To(Equal([]string{"2001:db8::/32"}))
+
+			_, err = sourceRule("foo.cf.com", "10.0.0.1")
+			Expect(err).To(MatchError("invalid f5-source-address: invalid CIDR address: 10.0.0.1"))
+			_, err = sourceRule("foo.cf.com", " , ")
+			Expect(err).To(MatchError("f5-source-address has no networks"))
 		})
 
-		It("should run", func() {
-			done := make(chan struct{})
-			os := make(chan os.Signal)
-			ready := make(chan struct{})
+		It("should match the host as the route's tags select", func() {
+			hostCondition := func(uri route.Uri, tags map[string]string) *bigipResources.Condition {
+				rule := ruleFor(uri, tags)
+				Expect(rule.Conditions[0].HTTPHost).To(BeTrue())
+				return rule.Conditions[0]
+			}
+			hostMatch := func(cond bigipResources.Condition) *bigipResources.Condition {
+				cond.Host = true
+				cond.HTTPHost = true
+				cond.Name = "0"
+				cond.Request = true
+				return &cond
+			}
 
-			go func() {
-				defer GinkgoRecover()
-				Expect(func() {
-					err = router.Run(os, ready)
-					Expect(err).NotTo(HaveOccurred())
-					close(done)
-				}).NotTo(Panic())
-			}()
-			// wait for the router to be ready
-			Eventually(ready).Should(BeClosed(), "timed out waiting for ready")
-			// send a kill signal to the router
-			os <- MockSignal(123)
-			//wait for the router to stop
-			Eventually(done).Should(BeClosed(), "timed out waiting for Run to complete")
+			Expect(hostCondition("foo.cf.com", nil)).To(Equal(hostMatch(bigipResources.Condition{
+				Equals: true,
+				Values: []string{"foo.cf.com"},
+			})))
+			Expect(hostCondition("foo.cf.com", map[string]string{HostMatchTag: "starts-with"})).To(
+				Equal(hostMatch(bigipResources.Condition{
+					StartsWith: true,
+					Values:     []string{"foo.cf.com"},
+				})))
+			Expect(hostCondition("foo.cf.com", map[string]string{
+				HostMatchTag:   "ends-with",
+				HostPatternTag: ".cf.com",
+			})).To(Equal(hostMatch(bigipResources.Condition{
+				EndsWith: true,
+				Values:   []string{".cf.com"},
+			})))
+			Expect(hostCondition("foo.cf.com", map[string]string{
+				HostMatchTag:   "contains",
+				HostPatternTag: "foo",
+			})).To(Equal(hostMatch(bigipResources.Condition{
+				Contains: true,
+				Values:   []string{"foo"},
+			})))
+			Expect(hostCondition("foo.cf.com", map[string]string{
+				HostMatchTag:   "regex",
+				HostPatternTag: `^foo-[0-9]+\.cf\.com$`,
+			})).To(Equal(hostMatch(bigipResources.Condition{
+				Matches: true,
+				Values:  []string{`^foo-[0-9]+\.cf\.com$`},
+			})))
+
+			// tags that do not parse keep the equals match of the host
+			equals := hostMatch(bigipResources.Condition{
+				Equals: true,
+				Values: []string{"foo.cf.com"},
+			})
+			Expect(hostCondition("foo.cf.com", map[string]string{
+				HostMatchTag:   "regex",
+				HostPatternTag: "foo-[0-9",
+			})).To(Equal(equals))
+			Expect(logger).To(Say("f5router-ignoring-host-match.*invalid f5-host-pattern"))
+			Expect(hostCondition("foo.cf.com", map[string]string{HostMatchTag: "like"})).To(Equal(equals))
+			Expect(logger).To(Say("f5router-ignoring-host-match.*f5-host-match must be"))
+
+			// wildcards keep their own host conditions
+			cond := hostCondition("*.cf.com", map[string]string{HostMatchTag: "contains"})
+			Expect(cond.EndsWith).To(BeTrue())
+			Expect(cond.Contains).To(BeFalse())
 		})
 
-		It("should update routes", func() {
-			done := make(chan struct{})
-			os := make(chan os.Signal)
-			ready := make(chan struct{})
-			update := 0
+		It("should negate the conditions the route's tags list", func() {
+			negations := func(rule *bigipResources.Rule) (negate []bool) {
+				for _, c := range rule.Conditions {
+					negate = append(negate, c.Negate)
+				}
+				return negate
+			}
 
-			go func() {
-				defer GinkgoRecover()
-				Expect(func() {
-					err = router.Run(os, ready)
-					Expect(err).NotTo(HaveOccurred())
-					close(done)
-				}).NotTo(Panic())
-			}()
+			rule, err := routeRule("foo.cf.com/a", map[string]string{NegateTag: "host"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(negations(rule)).To(Equal([]bool{true, false}))
+			Expect(rule.Priority).To(Equal(-1))
+			data, err := json.Marshal(rule.Conditions[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"not":true`))
+			data, err = json.Marshal(rule.Conditions[1])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).NotTo(ContainSubstring(`"not"`))
 
-			registerRoutes()
-			// config0
-			matchConfig(mw, expectedConfigs[update], false)
-			update++
+			rule, err = routeRule("foo.cf.com/a", map[string]string{
+				HeaderNameTag:    "X-Tenant",
+				HeaderValueTag:   "acme",
+				SourceAddressTag: "10.0.0.0/8",
+				NegateTag:        " header, source ",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(negations(rule)).To(Equal([]bool{false, true, true, false}))
+			Expect(rule.Conditions[1].HTTPHeader).To(BeTrue())
+			Expect(rule.Conditions[2].TCP).To(BeTrue())
+			// the trailing slash redirect negates the same conditions
+			Expect(negations(makeRedirectRule(rule))).To(Equal([]bool{false, true, true, false}))
+
+			// wildcards can negate everything but their host
+			rule, err = routeRule("*.cf.com", map[string]string{
+				SourceAddressTag: "10.0.0.0/8",
+				NegateTag:        "source",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(negations(rule)).To(Equal([]bool{false, true}))
+			_, err = routeRule("*.cf.com", map[string]string{NegateTag: "host"})
+			Expect(err).To(MatchError("f5-negate cannot negate the host of wildcard route *.cf.com"))
+			_, err = routeRule("foo.cf.com", map[string]string{NegateTag: "host,path"})
+			Expect(err).To(MatchError("f5-negate must list host, header or source, got: path"))
+
+			// a route without the tag is left as it was
+			rule, err = routeRule("foo.cf.com", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(negations(rule)).To(Equal([]bool{false}))
+			Expect(rule.Priority).To(BeZero())
+		})
 
-			// make some changes and update the verification function
-			up, err = NewUpdate(logger, routeUpdate.Remove, "bar.cf.com", barEndpoint, "")
+		It("should match the path against the route's regex", func() {
+			regexRule := func(uri route.Uri, regex string) (*bigipResources.Rule, error) {
+				return routeRule(uri, map[string]string{PathRegexTag: regex})
+			}
+			pathRegex := &bigipResources.Condition{
+				Matches: true,
+				HTTPURI: true,
+				Path:    true,
+				Name:    "1",
+				Request: true,
+				Values:  []string{`/api/v[0-9]+/.*`},
+			}
+
+			rule, err := regexRule("foo.cf.com/api", `/api/v[0-9]+/.*`)
 			Expect(err).NotTo(HaveOccurred())
-			router.UpdateRoute(up)
+			Expect(rule.Conditions).To(HaveLen(2))
+			Expect(rule.Conditions[0].HTTPHost).To(BeTrue())
+			Expect(rule.Conditions[1]).To(Equal(pathRegex))
+			Expect(rule.Priority).To(Equal(-1))
+			data, err := json.Marshal(rule.Conditions[1])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"matches":true`))
+			// the regex decides on trailing slashes itself
+			Expect(makeRedirectRule(rule)).To(BeNil())
 
-			up, err = NewUpdate(logger, routeUpdate.Remove, "baz.cf.com/segment1", baz2Segment1Endpoint, "")
+			rule, err = regexRule("*.cf.com", `/api/v[0-9]+/.*`)
 			Expect(err).NotTo(HaveOccurred())
-			router.UpdateRoute(up)
+			Expect(rule.Conditions).To(HaveLen(2))
+			Expect(rule.Conditions[0].EndsWith).To(BeTrue())
+			Expect(rule.Conditions[1]).To(Equal(pathRegex))
+
+			_, err = regexRule("foo.cf.com/api", "/api/v[0-9")
+			Expect(err).To(MatchError(HavePrefix("invalid f5-path-regex: error parsing regexp")))
+
+			// a route with a regex that does not compile is rejected before any
+			// of its resources are created
+			ep := makeEndpoint("127.0.0.1")
+			ep.Tags = map[string]string{PathRegexTag: ""}
+			ru, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com/api", ep, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(router.processRouteAdd(ru)).To(MatchError(
+				"rejecting route foo.cf.com/api: f5-path-regex is empty"))
+			Expect(router.poolResources).To(BeEmpty())
+		})
 
-			up, err = NewUpdate(logger, routeUpdate.Add, "baz.cf.com", baz2Endpoint, "")
+		It("should sort regex rules behind the exact path rules", func() {
+			regex := map[string]string{PathRegexTag: `/api/v[0-9]+/.*`}
+
+			// the regex rule would otherwise sort ahead of the shorter paths
+			exact := bigipResources.RuleMap{
+				"foo.cf.com/api/v1": ruleFor("foo.cf.com/api/v1", nil),
+				"foo.cf.com/api/vx": ruleFor("foo.cf.com/api/vx", regex),
+				"foo.cf.com":        ruleFor("foo.cf.com", nil),
+			}
+			wildcards := bigipResources.RuleMap{
+				"*.cf.com": ruleFor("*.cf.com", nil),
+			}
+			Expect(ruleNames(router.makeRoutePolicy("test", exact, wildcards))).To(Equal([]string{
+				"foo.cf.com/api/v1", "foo.cf.com", "foo.cf.com/api/vx", "*.cf.com",
+			}))
+		})
+
+		It("should sort negated rules behind the rules matching what they ask for", func() {
+			notHost := map[string]string{NegateTag: NegateHost}
+
+			exact := bigipResources.RuleMap{
+				"a.cf.com":   ruleFor("a.cf.com", notHost),
+				"b.cf.com":   ruleFor("b.cf.com", nil),
+				"c.cf.com/x": ruleFor("c.cf.com/x", nil),
+			}
+			wildcards := bigipResources.RuleMap{
+				"*.cf.com": ruleFor("*.cf.com", nil),
+			}
+			Expect(ruleNames(router.makeRoutePolicy("test", exact, wildcards))).To(Equal([]string{
+				"c.cf.com/x", "b.cf.com", "a.cf.com", "*.cf.com",
+			}))
+
+			// a priority puts the negated rule back in front
+			exact["a.cf.com"] = ruleFor("a.cf.com", map[string]string{
+				NegateTag:   NegateHost,
+				PriorityTag: "1",
+			})
+			Expect(ruleNames(router.makeRoutePolicy("test", exact, wildcards))).To(Equal([]string{
+				"a.cf.com", "c.cf.com/x", "b.cf.com", "*.cf.com",
+			}))
+		})
+
+		It("should set the case of the path conditions", func() {
+			pathCase := func(rule *bigipResources.Rule) (sensitive []bool) {
+				for _, c := range rule.Conditions {
+					if c.PathSegment || c.Path {
+						Expect(c.CaseSensitive).NotTo(Equal(c.CaseInsensitive))
+						sensitive = append(sensitive, c.CaseSensitive)
+					} else {
+						Expect(c.CaseSensitive || c.CaseInsensitive).To(BeFalse())
+					}
+				}
+				return sensitive
+			}
+
+			Expect(pathCase(ruleFor("foo.cf.com/App/v1", nil))).To(Equal([]bool{true, true}))
+			Expect(pathCase(ruleFor("*.cf.com/App", nil))).To(Equal([]bool{true}))
+			Expect(pathCase(makeRedirectRule(ruleFor("foo.cf.com/App", nil)))).To(Equal([]bool{true}))
+
+			router.c.BigIP.CaseInsensitivePaths = true
+			Expect(pathCase(ruleFor("foo.cf.com/App/v1", nil))).To(Equal([]bool{false, false}))
+			Expect(pathCase(makeRedirectRule(ruleFor("foo.cf.com/App", nil)))).To(Equal([]bool{false}))
+		})
+
+		It("should sort prioritized rules ahead of the default order", func() {
+			priority := func(p string) map[string]string {
+				return map[string]string{PriorityTag: p}
+			}
+
+			exact := bigipResources.RuleMap{
+				"a.cf.com":   ruleFor("a.cf.com", nil),
+				"b.cf.com":   ruleFor("b.cf.com", nil),
+				"c.cf.com":   ruleFor("c.cf.com", nil),
+				"c.cf.com/x": ruleFor("c.cf.com/x", nil),
+			}
+			wildcards := bigipResources.RuleMap{
+				"*.cf.com":     ruleFor("*.cf.com", nil),
+				"*.foo.cf.com": ruleFor("*.foo.cf.com", nil),
+			}
+			Expect(ruleNames(router.makeRoutePolicy("test", exact, wildcards))).To(Equal([]string{
+				"c.cf.com/x", "c.cf.com", "b.cf.com", "a.cf.com", "*.foo.cf.com", "*.cf.com",
+			}))
+
+			exact["a.cf.com"] = ruleFor("a.cf.com", priority("5"))
+			exact["c.cf.com"] = ruleFor("c.cf.com", priority("10"))
+			wildcards["*.cf.com"] = ruleFor("*.cf.com", priority("1"))
+			// priorities only reorder the rules of their own rule map
+			Expect(ruleNames(router.makeRoutePolicy("test", exact, wildcards))).To(Equal([]string{
+				"c.cf.com", "a.cf.com", "c.cf.com/x", "b.cf.com", "*.cf.com", "*.foo.cf.com",
+			}))
+
+			Expect(ruleFor("b.cf.com", priority("high")).Priority).To(BeZero())
+			Expect(ruleFor("b.cf.com", priority("-3")).Priority).To(BeZero())
+			Expect(logger).To(Say("f5router-ignoring-route-priority"))
+		})
+
+		It("should limit the path depth when configured", func() {
+			deep := route.Uri("foo.cf.com/a/b/c/d/e/f/g/h")
+			names, _ := conditionIndices(deep)
+			Expect(names).To(HaveLen(9))
+
+			router.c.BigIP.MaxPathDepth = 3
+			ru, err := NewUpdate(logger, routeUpdate.Add, deep, makeEndpoint("127.0.0.1"), "")
 			Expect(err).NotTo(HaveOccurred())
-			router.UpdateRoute(up)
+			_, err = router.makeRouteRule(ru)
+			Expect(err).To(MatchError("path /a/b/c/d/e/f/g/h has 8 segments, max_path_depth is 3"))
+			Expect(router.processRouteAdd(ru)).To(MatchError(
+				"rejecting route foo.cf.com/a/b/c/d/e/f/g/h: " +
+					"path /a/b/c/d/e/f/g/h has 8 segments, max_path_depth is 3"))
+			Expect(router.poolResources).To(BeEmpty())
+
+			names, _ = conditionIndices("foo.cf.com/a/b/c")
+			Expect(names).To(HaveLen(4))
+
+			router.c.BigIP.DeepPathAction = config.TruncateDeepPath
+			rule, err := router.makeRouteRule(ru)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rule.Conditions).To(HaveLen(4))
+			var segments []string
+			for _, c := range rule.Conditions[1:] {
+				segments = append(segments, c.Values[0])
+			}
+			Expect(segments).To(Equal([]string{"a", "b", "c"}))
+			Expect(rule.FullURI).To(Equal(deep.String()))
+			Expect(firstMatch([]*bigipResources.Rule{rule}, "foo.cf.com", "/a/b/c/x")).To(Equal(rule))
 
-			up, err = NewUpdate(logger, routeUpdate.Remove, "*.foo.cf.com", wildFooEndpoint, "")
+			Expect(router.verifyPathDepth(ru)).To(Succeed())
+			Expect(logger).To(Say("f5router-path-truncated"))
+		})
+
+		It("should only take path-only routes as catch-all routes when configured", func() {
+			ru, err := NewUpdate(logger, routeUpdate.Add, "/foo", makeEndpoint("127.0.0.1"), "")
 			Expect(err).NotTo(HaveOccurred())
-			router.UpdateRoute(up)
+			Expect(router.processRouteAdd(ru)).To(MatchError(
+				"rejecting route /foo: route has no host, path_only_routes is reject"))
+			Expect(router.poolResources).To(BeEmpty())
 
-			up, err = NewUpdate(logger, routeUpdate.Remove, "ser*.cf.com", wildEndEndpoint, "")
+			router.c.BigIP.PathOnlyRoutes = config.CatchAllPathOnly
+			rule, err := router.makeRouteRule(ru)
 			Expect(err).NotTo(HaveOccurred())
-			router.UpdateRoute(up)
+			Expect(rule.Priority).To(Equal(-1))
+			for _, c := range rule.Conditions {
+				Expect(c.Host).To(BeFalse())
+			}
+			Expect(rule.Name).To(HavePrefix("cf-"))
+
+			exact := bigipResources.RuleMap{"foo.cf.com": ruleFor("foo.cf.com", nil)}
+			wildcards := bigipResources.RuleMap{"*.cf.com": ruleFor("*.cf.com", nil), "/foo": rule}
+			rules := router.makeRoutePolicy("test", exact, wildcards).Rules
+			Expect(rules[len(rules)-1]).To(Equal(rule))
+			Expect(firstMatch(rules, "bar.cf.com", "/foo")).NotTo(Equal(rule))
+			Expect(firstMatch(rules, "bar.example.com", "/foo/x")).To(Equal(rule))
+			Expect(firstMatch(rules, "bar.example.com", "/bar")).To(BeNil())
+		})
 
-			up, err = NewUpdate(logger, routeUpdate.Remove, "ser*es.cf.com", wildMidEndpoint, "")
+		It("should add the host and path to the rule names when configured", func() {
+			Expect(ruleFor("foo.cf.com/bar", nil).Name).To(Equal(makeObjectName("foo.cf.com/bar")))
+
+			router.c.BigIP.ReadableRuleNames = true
+			rule := ruleFor("foo.cf.com/bar", nil)
+			Expect(rule.Name).To(Equal(makeObjectName("foo.cf.com/bar") + "-foo.cf.com_bar"))
+			// the pool keeps its own name
+			Expect(rule.Pool).To(Equal(makeObjectName("foo.cf.com/bar")))
+			Expect(ruleFor("*.cf.com", nil).Name).To(Equal(makeObjectName("*.cf.com") + "-.cf.com"))
+			Expect(ruleFor("foo.cf.com/a%20b", nil).Name).To(Equal(
+				makeObjectName("foo.cf.com/a%20b") + "-foo.cf.com_a_20b"))
+
+			long := route.Uri("foo.cf.com/" + strings.Repeat("a", 300))
+			rule = ruleFor(long, nil)
+			Expect(rule.Name).To(HavePrefix(makeObjectName(long.String()) + "-foo.cf.com_aaa"))
+			Expect(len(rule.Name + redirectSuffix)).To(Equal(maxObjectNameLength))
+			Expect(makeRedirectRule(rule).Name).To(HaveLen(maxObjectNameLength))
+		})
+
+		It("should match the whole path in the prefix and exact modes", func() {
+			ru, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com/a/b", makeEndpoint("127.0.0.1"), "")
 			Expect(err).NotTo(HaveOccurred())
-			router.UpdateRoute(up)
+			matchRule := func(match string) *bigipResources.Rule {
+				router.c.BigIP.PathMatch = match
+				rule, err := router.makeRouteRule(ru)
+				Expect(err).NotTo(HaveOccurred())
+				return rule
+			}
 
-			up, err = NewUpdate(logger, routeUpdate.Remove, "*vices.cf.com", wildBeginEndpoint, "")
+			segment := matchRule(config.SegmentPathMatch)
+			Expect(segment.Conditions).To(HaveLen(3))
+			Expect(segment.Conditions[1].PathSegment).To(BeTrue())
+			Expect(segment.Conditions[2].PathSegment).To(BeTrue())
+
+			prefix := matchRule(config.PrefixPathMatch)
+			Expect(prefix.Conditions).To(HaveLen(2))
+			Expect(prefix.Conditions[1]).To(Equal(&bigipResources.Condition{
+				StartsWith: true, HTTPURI: true, Path: true, CaseSensitive: true,
+				Name: "1", Request: true, Values: []string{"/a/b"},
+			}))
+
+			exact := matchRule(config.ExactPathMatch)
+			Expect(exact.Conditions).To(HaveLen(2))
+			Expect(exact.Conditions[1].Equals).To(BeTrue())
+			Expect(exact.Conditions[1].StartsWith).To(BeFalse())
+
+			matches := func(rule *bigipResources.Rule, path string) bool {
+				return nil != firstMatch([]*bigipResources.Rule{rule}, "foo.cf.com", path)
+			}
+			for _, tc := range []struct {
+				path                   string
+				segment, prefix, exact bool
+			}{
+				{"/a/b", true, true, true},
+				{"/a/b/c", true, true, false},
+				{"/a/bc", false, true, false},
+				{"/a", false, false, false},
+			} {
+				Expect(matches(segment, tc.path)).To(Equal(tc.segment), tc.path)
+				Expect(matches(prefix, tc.path)).To(Equal(tc.prefix), tc.path)
+				Expect(matches(exact, tc.path)).To(Equal(tc.exact), tc.path)
+			}
+
+			// the redirect keeps the case of the whole path condition
+			router.c.BigIP.CaseInsensitivePaths = true
+			redirect := makeRedirectRule(matchRule(config.PrefixPathMatch))
+			Expect(redirect.Conditions[1].CaseInsensitive).To(BeTrue())
+		})
+
+		It("should match the host on the SNI server name for passthrough", func() {
+			passthrough := map[string]string{PassthroughTag: "true"}
+
+			_, err := routeRule("foo.cf.com", passthrough)
+			Expect(err).To(MatchError("route foo.cf.com has f5-passthrough but passthrough_port is not set"))
+
+			router.c.BigIP.PassthroughPort = 8443
+			rule, err := routeRule("foo.cf.com", passthrough)
 			Expect(err).NotTo(HaveOccurred())
-			router.UpdateRoute(up)
+			Expect(passthroughRule(rule)).To(BeTrue())
+			Expect(rule.Pool).To(Equal(makeObjectName("foo.cf.com")))
+			Expect(rule.Conditions).To(Equal([]*bigipResources.Condition{
+				{Equals: true, SSLExtension: true, ServerName: true, SSLClientHello: true,
+					Name: "0", Index: 0, Values: []string{"foo.cf.com"}},
+			}))
+			Expect(rule.Actions).To(Equal([]*bigipResources.Action{
+				{Forward: true, Name: "0", Pool: "/cf/" + makeObjectName("foo.cf.com"), SSLClientHello: true},
+			}))
+
+			data, err := json.Marshal(rule.Conditions[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal(
+				`{"equals":true,"sslExtension":true,"serverName":true,"sslClientHello":true,"name":"0","index":0,"request":false,"values":["foo.cf.com"]}`))
 
-			up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", fooEndpoint, "")
+			// the port of a wildcard is the virtual's
+			rule, err = routeRule("*.cf.com:8443", passthrough)
 			Expect(err).NotTo(HaveOccurred())
-			router.UpdateRoute(up)
+			Expect(rule.Conditions).To(Equal([]*bigipResources.Condition{
+				{EndsWith: true, SSLExtension: true, ServerName: true, SSLClientHello: true,
+					Name: "0", Index: 0, Values: []string{".cf.com"}},
+			}))
 
-			// config1
+			// other routes keep the Host header
+			rule, err = routeRule("foo.cf.com", map[string]string{PassthroughTag: "false"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(passthroughRule(rule)).To(BeFalse())
+			Expect(rule.Conditions[0].HTTPHost).To(BeTrue())
+
+			_, err = routeRule("foo.cf.com/a", passthrough)
+			Expect(err).To(MatchError("passthrough route foo.cf.com/a can only match its host"))
+			_, err = routeRule("foo.cf.com", map[string]string{PassthroughTag: "yes"})
+			Expect(err).To(MatchError("f5-passthrough must be true or false, got: yes"))
+		})
+	})
+
+	Describe("rule actions", func() {
+		It("should order actions by stage and name them by position", func() {
+			forward := &bigipResources.Action{TmName: "target_vip"}
+			header1 := &bigipResources.Action{TmName: "header-1"}
+			header2 := &bigipResources.Action{TmName: "header-2"}
+			rewrite := &bigipResources.Action{TmName: "rewrite"}
+
+			actions := orderActions([]ruleAction{
+				{stage: forwardStage, action: forward},
+				{stage: headerStage, action: header1},
+				{stage: rewriteStage, action: rewrite},
+				{stage: headerStage, action: header2},
+			})
+			Expect(actions).To(Equal([]*bigipResources.Action{rewrite, header1, header2, forward}))
+			for i, a := range actions {
+				Expect(a.Name).To(Equal(strconv.Itoa(i)))
+			}
+		})
+		It("should insert the X-Forwarded-For header for the enabled routes", func() {
+			logger := test_util.NewTestZapLogger("router-test")
+			defer logger.Close()
+			c := makeConfig()
+			router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+			Expect(err).NotTo(HaveOccurred())
+
+			xff := func(tags map[string]string) *bigipResources.Action {
+				ep := makeEndpoint("127.0.0.1")
+				ep.Tags = tags
+				ru, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+				Expect(err).NotTo(HaveOccurred())
+				rule, err := router.makeRouteRule(ru)
+				Expect(err).NotTo(HaveOccurred())
+				for _, a := range rule.Actions {
+					if a.HTTPHeader {
+						return a
+					}
+				}
+				return nil
+			}
+
+			Expect(xff(nil)).To(BeNil())
+			action := xff(map[string]string{XFFTag: "true"})
+			Expect(action).NotTo(BeNil())
+			Expect(action.Insert).To(BeTrue())
+			Expect(action.Request).To(BeTrue())
+			Expect(action.TmName).To(Equal("X-Forwarded-For"))
+			Expect(action.Value).To(Equal("tcl:[IP::client_addr]"))
+			// the header goes in before forwarding to the tier2 virtual
+			Expect(action.Name).To(Equal("0"))
+
+			c.BigIP.InsertXFF = true
+			Expect(xff(nil)).NotTo(BeNil())
+			Expect(xff(map[string]string{XFFTag: "false"})).To(BeNil())
+			Expect(xff(map[string]string{XFFTag: "maybe"})).NotTo(BeNil())
+		})
+
+		It("should name the pool in the route header when configured", func() {
+			logger := test_util.NewTestZapLogger("router-test")
+			defer logger.Close()
+			c := makeConfig()
+			router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+			Expect(err).NotTo(HaveOccurred())
+
+			ru, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+			Expect(err).NotTo(HaveOccurred())
+			headers := func() (actions []*bigipResources.Action) {
+				rule, err := router.makeRouteRule(ru)
+				Expect(err).NotTo(HaveOccurred())
+				for _, a := range rule.Actions {
+					if a.HTTPHeader {
+						actions = append(actions, a)
+					}
+				}
+				return actions
+			}
+
+			Expect(headers()).To(BeEmpty())
+
+			c.BigIP.RouteHeader = "X-CF-Route"
+			c.BigIP.InsertXFF = true
+			actions := headers()
+			Expect(actions).To(HaveLen(2))
+			Expect(actions[1]).To(Equal(&bigipResources.Action{
+				HTTPHeader: true,
+				Insert:     true,
+				Request:    true,
+				TmName:     "X-CF-Route",
+				Value:      ru.Name(),
+				Name:       "1",
+			}))
+
+			c.BigIP.RouteHeader = "X CF Route"
+			r, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+			Expect(r).To(BeNil())
+			Expect(err).To(MatchError(`invalid route_header: "X CF Route"`))
+		})
+
+		It("should split wildcard requests by the route weights", func() {
+			logger := test_util.NewTestZapLogger("router-test")
+			defer logger.Close()
+			router, err := NewF5Router(logger, makeConfig(), &MockWriter{}, bigipclient.DefaultClient())
+			Expect(err).NotTo(HaveOccurred())
+
+			target := func(uri route.Uri, weights string) string {
+				ep := makeEndpoint("127.0.0.1")
+				ep.Tags = map[string]string{WildcardWeightsTag: weights}
+				ru, err := NewUpdate(logger, routeUpdate.Add, uri, ep, "")
+				Expect(err).NotTo(HaveOccurred())
+				rule, err := router.makeRouteRule(ru)
+				Expect(err).NotTo(HaveOccurred())
+				return rule.Actions[0].Expression
+			}
+
+			Expect(target("*.cf.com", "a.cf.com=20, B.cf.com=10")).To(Equal(fmt.Sprintf(
+				`[expr {[set w [expr {int(rand() * 100)}]] < 20 ? "%s" : $w < 30 ? "%s" : "cf-cf.com"}]`,
+				makeObjectName("a.cf.com"), makeObjectName("b.cf.com"))))
+
+			// anything but a valid split keeps the route on its own pool
+			Expect(target("foo.cf.com", "a.cf.com=20")).To(Equal(makeObjectName("foo.cf.com")))
+			Expect(target("*.cf.com", "a.cf.com=60,b.cf.com=50")).To(Equal("cf-cf.com"))
+			Expect(target("*.cf.com", "a.cf.com")).To(Equal("cf-cf.com"))
+			Expect(target("*.cf.com", "a.cf.com=0")).To(Equal("cf-cf.com"))
+			Expect(target("*.cf.com", "*.cf.com=10")).To(Equal("cf-cf.com"))
+		})
+
+		It("should set the all down fallback of each route", func() {
+			logger := test_util.NewTestZapLogger("router-test")
+			defer logger.Close()
+			c := makeConfig()
+			c.BigIP.AllDownStatus = 503
+			router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(router.virtualResources[HTTPRouterName].IRules).To(Equal(
+				[]string{"/cf/all-down-fallback", "/cf/forward-to-vip"}))
+			Expect(router.ruleResources).To(HaveKey("all-down-fallback"))
+
+			fallback := func(tags map[string]string) map[string]string {
+				ep := makeEndpoint("127.0.0.1")
+				ep.Tags = tags
+				ru, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+				Expect(err).NotTo(HaveOccurred())
+				rule, err := router.makeRouteRule(ru)
+				Expect(err).NotTo(HaveOccurred())
+				vars := make(map[string]string)
+				for _, a := range rule.Actions {
+					if a.SetVariable {
+						vars[a.TmName] = a.Expression
+					}
+				}
+				return vars
+			}
+
+			Expect(fallback(nil)).To(Equal(map[string]string{
+				"target_vip": makeObjectName("foo.cf.com"), "all_down_status": "503"}))
+			Expect(fallback(map[string]string{AllDownPoolTag: "/Common/sorry"})).To(
+				HaveKeyWithValue("all_down_pool", "/Common/sorry"))
+			Expect(fallback(map[string]string{AllDownStatusTag: "404"})).To(
+				HaveKeyWithValue("all_down_status", "404"))
+			Expect(fallback(map[string]string{AllDownStatusTag: NoAllDownFallback})).To(HaveLen(1))
+			// a bad tag keeps the configured fallback
+			Expect(fallback(map[string]string{AllDownStatusTag: "999"})).To(
+				HaveKeyWithValue("all_down_status", "503"))
+			Expect(fallback(map[string]string{AllDownPoolTag: "sorry"})).To(
+				HaveKeyWithValue("all_down_status", "503"))
+		})
+	})
+
+	Describe("pool paths", func() {
+		It("should join the partition and name", func() {
+			Expect(poolPath("cf", "cf-foo-1234")).To(Equal("/cf/cf-foo-1234"))
+		})
+
+		It("should reject parts that cannot be in a path", func() {
+			Expect(poolPath("", "cf-foo")).To(BeEmpty())
+			Expect(poolPath("cf", "")).To(BeEmpty())
+			Expect(poolPath("cf/common", "cf-foo")).To(BeEmpty())
+			Expect(poolPath("cf", "cf/foo")).To(BeEmpty())
+			Expect(poolPath("cf", "cf foo")).To(BeEmpty())
+		})
+
+		It("should match the pool the route's virtual references", func() {
+			c := makeConfig()
+			logger := test_util.NewTestZapLogger("pool-path-test")
+			defer logger.Close()
+			router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+			Expect(err).NotTo(HaveOccurred())
+
+			ru, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+			Expect(err).NotTo(HaveOccurred())
+			rs, err := ru.CreateResources(c)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rs.Virtuals[0].PoolName).To(Equal(poolPath("cf", rs.Pools[0].Name)))
+			_, err = router.makeRouteRule(ru)
+			Expect(err).NotTo(HaveOccurred())
+
+			ru.name = "cf/foo"
+			_, err = ru.CreateResources(c)
+			Expect(err).To(MatchError("invalid pool path for cf/foo"))
+			_, err = router.makeRouteRule(ru)
+			Expect(err).To(MatchError("invalid pool path for route foo.cf.com: cf/foo"))
+		})
+	})
+
+	Describe("httpUpdate", func() {
+		var httpUpdate updateHTTP
+		Context("UpdateResources", func() {
+			var oldResources bigipResources.Resources
+			var newResources bigipResources.Resources
+
+			BeforeEach(func() {
+				httpUpdate = updateHTTP{}
+				policies := []*bigipResources.NameRef{&bigipResources.NameRef{
+					Name:      "test-policy",
+					Partition: "test",
+				}}
+				profiles := []*bigipResources.ProfileRef{&bigipResources.ProfileRef{
+					Name:      "test-profile",
+					Partition: "test",
+					Context:   "all",
+				}}
+				oldResources.Virtuals = []*bigipResources.Virtual{&bigipResources.Virtual{
+					VirtualServerName: "test-route-virtual",
+					PoolName:          "test-route-pool",
+					Profiles:          profiles,
+					Policies:          policies,
+				}}
+				oldResources.Pools = []*bigipResources.Pool{&bigipResources.Pool{
+					Name:         "test-route-pool",
+					Balance:      "round-robin",
+					MonitorNames: []string{"monitor1", "monitor2"},
+				}}
+				oldResources.Monitors = []*bigipResources.Monitor{&bigipResources.Monitor{
+					Name: "test-route-monitor",
+					Type: "http",
+				}}
+				newResources = bigipResources.Resources{}
+			})
+
+			It("should not update", func() {
+				updatedResources := httpUpdate.UpdateResources(oldResources, newResources)
+				Expect(updatedResources).To(Equal(oldResources))
+			})
+
+			It("should update virtuals profiles and policies only", func() {
+				newPolicies := []*bigipResources.NameRef{&bigipResources.NameRef{
+					Name:      "new-test-policy",
+					Partition: "test",
+				}}
+				newProfiles := []*bigipResources.ProfileRef{&bigipResources.ProfileRef{
+					Name:      "new-test-profile",
+					Partition: "test",
+					Context:   "clientside",
+				}}
+				newResources.Virtuals = []*bigipResources.Virtual{&bigipResources.Virtual{
+					VirtualServerName: "update-route-virtual",
+					PoolName:          "update-route-pool",
+					Profiles:          newProfiles,
+					Policies:          newPolicies,
+				}}
+				updatedResources := httpUpdate.UpdateResources(oldResources, newResources)
+
+				Expect(len(updatedResources.Virtuals)).To(Equal(1))
+				Expect(updatedResources.Virtuals[0].VirtualServerName).To(Equal(oldResources.Virtuals[0].VirtualServerName))
+				Expect(updatedResources.Virtuals[0].PoolName).To(Equal(oldResources.Virtuals[0].PoolName))
+				Expect(updatedResources.Virtuals[0].Profiles).To(Equal(newProfiles))
+				Expect(updatedResources.Virtuals[0].Policies).To(Equal(newPolicies))
+				Expect(len(updatedResources.Virtuals[0].Profiles)).To(Equal(1))
+				Expect(len(updatedResources.Virtuals[0].Policies)).To(Equal(1))
+
+				Expect(len(updatedResources.Pools)).To(Equal(1))
+				Expect(len(updatedResources.Monitors)).To(Equal(1))
+				Expect(updatedResources.Pools[0]).To(Equal(oldResources.Pools[0]))
+				Expect(updatedResources.Monitors[0]).To(Equal(oldResources.Monitors[0]))
+			})
+
+			It("should update pools balance and monitor names only", func() {
+				newResources.Pools = []*bigipResources.Pool{&bigipResources.Pool{
+					Name:         "update-route-pool",
+					Balance:      "fastest-node",
+					MonitorNames: []string{"monitor3"},
+				}}
+				updatedResources := httpUpdate.UpdateResources(oldResources, newResources)
+
+				Expect(len(updatedResources.Pools)).To(Equal(1))
+				Expect(updatedResources.Pools[0].Name).To(Equal(oldResources.Pools[0].Name))
+				Expect(updatedResources.Pools[0].Balance).To(Equal(newResources.Pools[0].Balance))
+				Expect(updatedResources.Pools[0].MonitorNames).To(Equal(newResources.Pools[0].MonitorNames))
+				Expect(len(updatedResources.Pools[0].MonitorNames)).To(Equal(1))
+
+				Expect(len(updatedResources.Virtuals)).To(Equal(1))
+				Expect(len(updatedResources.Monitors)).To(Equal(1))
+				Expect(updatedResources.Virtuals[0]).To(Equal(oldResources.Virtuals[0]))
+				Expect(updatedResources.Monitors[0]).To(Equal(oldResources.Monitors[0]))
+			})
+
+			It("should update monitors", func() {
+				newResources.Monitors = []*bigipResources.Monitor{&bigipResources.Monitor{
+					Name: "update-route-monitor",
+					Type: "tcp",
+				}}
+				updatedResources := httpUpdate.UpdateResources(oldResources, newResources)
+
+				Expect(len(updatedResources.Virtuals)).To(Equal(1))
+				Expect(len(updatedResources.Pools)).To(Equal(1))
+				Expect(len(updatedResources.Monitors)).To(Equal(1))
+				Expect(updatedResources.Virtuals[0]).To(Equal(oldResources.Virtuals[0]))
+				Expect(updatedResources.Pools[0]).To(Equal(oldResources.Pools[0]))
+				Expect(updatedResources.Monitors[0]).To(Equal(newResources.Monitors[0]))
+			})
+		})
+
+		Context("CreateResources", func() {
+			var logger *test_util.TestZapLogger
+			var c *config.Config
+
+			BeforeEach(func() {
+				logger = test_util.NewTestZapLogger("create-resources-test")
+				c = makeConfig()
+			})
+
+			AfterEach(func() {
+				logger.Close()
+			})
+
+			oneConnectRefs := func(tags map[string]string) []*bigipResources.ProfileRef {
+				ep := makeEndpoint("127.0.0.1")
+				for k, v := range tags {
+					ep.Tags[k] = v
+				}
+				ru, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+				Expect(err).NotTo(HaveOccurred())
+				rs, err := ru.CreateResources(c)
+				Expect(err).NotTo(HaveOccurred())
+				return rs.Virtuals[0].Profiles[2:]
+			}
+
+			It("should select the OneConnect profile of the route", func() {
+				Expect(oneConnectRefs(nil)).To(BeEmpty())
+
+				c.BigIP.OneConnectProfile = "/Common/oneconnect"
+				Expect(oneConnectRefs(nil)).To(Equal([]*bigipResources.ProfileRef{
+					{Name: "oneconnect", Partition: "Common", Context: "all"},
+				}))
+				Expect(oneConnectRefs(map[string]string{OneConnectTag: "/cf/app-oneconnect"})).To(Equal(
+					[]*bigipResources.ProfileRef{{Name: "app-oneconnect", Partition: "cf", Context: "all"}}))
+				Expect(oneConnectRefs(map[string]string{OneConnectTag: NoOneConnect})).To(BeEmpty())
+			})
+
+			It("should skip a malformed route profile", func() {
+				Expect(oneConnectRefs(map[string]string{OneConnectTag: "oneconnect"})).To(BeEmpty())
+				Expect(logger).To(Say("skipping-oneconnect-profile-name"))
+			})
+
+			It("should reference the timeouts iRule of the route", func() {
+				c.SessionPersistence = false
+				iRules := func(tags map[string]string) []string {
+					ep := makeEndpoint("127.0.0.1")
+					for k, v := range tags {
+						ep.Tags[k] = v
+					}
+					ru, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+					Expect(err).NotTo(HaveOccurred())
+					rs, err := ru.CreateResources(c)
+					Expect(err).NotTo(HaveOccurred())
+					return rs.Virtuals[0].IRules
+				}
+				Expect(iRules(nil)).To(BeEmpty())
+
+				c.BigIP.ResponseTimeout = 30
+				Expect(iRules(nil)).To(Equal([]string{"/cf/route-timeouts-0-30"}))
+				Expect(iRules(map[string]string{RequestTimeoutTag: "60", ResponseTimeoutTag: "5"})).To(
+					Equal([]string{"/cf/route-timeouts-60-5"}))
+				Expect(iRules(map[string]string{ResponseTimeoutTag: "0"})).To(BeEmpty())
+
+				// a malformed tag keeps the configured timeout
+				Expect(iRules(map[string]string{RequestTimeoutTag: "-1", ResponseTimeoutTag: "5"})).To(
+					Equal([]string{"/cf/route-timeouts-0-5"}))
+				Expect(logger).To(Say("f5router-ignoring-route-timeout.*f5-request-timeout must be a number of seconds, got: -1"))
+			})
+		})
+
+		Context("CreatePlanResources", func() {
+			var plan planResources.Plan
+			var logger *test_util.TestZapLogger
+			var c *config.Config
+
+			BeforeEach(func() {
+				logger := test_util.NewTestZapLogger("create-plan-resources-test")
+				httpUpdate = updateHTTP{logger: logger}
+				plan = planResources.Plan{
+					Name: "test-plan",
+				}
+				c = config.DefaultConfig()
+				c.BigIP.Partitions = []string{"test"}
+			})
+
+			AfterEach(func() {
+				if nil != logger {
+					logger.Close()
+				}
+			})
+
+			It("should create virtual resources from plan", func() {
+				plan.VirtualServer = planResources.VirtualType{
+					Policies:    []string{"/test/policy"},
+					Profiles:    []string{"/test/profile"},
+					SslProfiles: []string{"/test/sslProfile"},
+				}
+				resources := httpUpdate.CreatePlanResources(c, plan)
+
+				Expect(len(resources.Pools)).To(Equal(1))
+				Expect(len(resources.Monitors)).To(Equal(0))
+				Expect(len(resources.Virtuals)).To(Equal(1))
+				Expect(len(resources.Virtuals[0].Policies)).To(Equal(1))
+				Expect(len(resources.Virtuals[0].Profiles)).To(Equal(2))
+
+				Expect(resources.Pools[0]).To(Equal(&bigipResources.Pool{}))
+				Expect(resources.Virtuals[0].Policies).To(Equal([]*bigipResources.NameRef{
+					&bigipResources.NameRef{
+						Name:      "policy",
+						Partition: "test",
+					}}))
+				Expect(resources.Virtuals[0].Profiles[0]).To(Equal(&bigipResources.ProfileRef{
+					Name:      "profile",
+					Partition: "test",
+					Context:   "all",
+				}))
+				Expect(resources.Virtuals[0].Profiles[1]).To(Equal(&bigipResources.ProfileRef{
+					Name:      "sslProfile",
+					Partition: "test",
+					Context:   "serverside",
+				}))
+			})
+
+			It("should not create virtual resources", func() {
+				plan.VirtualServer = planResources.VirtualType{}
+				resources := httpUpdate.CreatePlanResources(c, plan)
+
+				Expect(len(resources.Pools)).To(Equal(1))
+				Expect(len(resources.Virtuals)).To(Equal(1))
+				Expect(len(resources.Monitors)).To(Equal(0))
+
+				Expect(resources.Pools[0]).To(Equal(&bigipResources.Pool{}))
+				Expect(resources.Virtuals[0]).To(Equal(&bigipResources.Virtual{}))
+			})
+
+			It("should create pool resources from plan", func() {
+				monitors := []bigipResources.Monitor{
+					bigipResources.Monitor{
+						Name: "monitor1",
+						Type: "http",
+					},
+					bigipResources.Monitor{
+						Name: "monitor2",
+						Type: "tcp",
+					},
+				}
+				plan.Pool = planResources.PoolType{
+					Balance:        "round-robin",
+					HealthMonitors: monitors,
+				}
+				resources := httpUpdate.CreatePlanResources(c, plan)
+
+				Expect(len(resources.Virtuals)).To(Equal(1))
+				Expect(resources.Virtuals[0]).To(Equal(&bigipResources.Virtual{}))
+				Expect(len(resources.Pools)).To(Equal(1))
+				Expect(len(resources.Monitors)).To(Equal(2))
+				Expect(len(resources.Pools[0].MonitorNames)).To(Equal(2))
+				Expect(resources.Pools[0].Balance).To(Equal("round-robin"))
+				Expect(resources.Pools[0].MonitorNames).To(Equal([]string{"/test/monitor1", "/test/monitor2"}))
+				Expect(*resources.Monitors[0]).To(Equal(monitors[0]))
+				Expect(*resources.Monitors[1]).To(Equal(monitors[1]))
+			})
+
+			It("should reference existing monitors by partition and name", func() {
+				plan.Pool = planResources.PoolType{
+					HealthMonitors: []bigipResources.Monitor{
+						{Name: "/Common/http"},
+						{Name: "Common/tcp"},
+						{Name: "gateway_icmp"},
+					},
+				}
+				resources := httpUpdate.CreatePlanResources(c, plan)
+
+				Expect(resources.Monitors).To(BeEmpty())
+				Expect(resources.Pools[0].MonitorNames).To(Equal([]string{"/Common/http", "/Common/tcp"}))
+			})
+
+			It("should not create pool resources", func() {
+				plan.Pool = planResources.PoolType{}
+				resources := httpUpdate.CreatePlanResources(c, plan)
+
+				Expect(len(resources.Virtuals)).To(Equal(1))
+				Expect(len(resources.Pools)).To(Equal(1))
+				Expect(len(resources.Monitors)).To(Equal(0))
+
+				Expect(resources.Pools[0]).To(Equal(&bigipResources.Pool{}))
+				Expect(resources.Virtuals[0]).To(Equal(&bigipResources.Virtual{}))
+			})
+		})
+	})
+
+	Describe("running router", func() {
+		var mw *MockWriter
+		var router *F5Router
+		var err error
+		var up updateHTTP
+		var logger *test_util.TestZapLogger
+		var c *config.Config
+		var client *bigipclient.BigIPClient
+
+		var (
+			fooEndpoint,
+			barEndpoint,
+			bar2Endpoint,
+			bazEndpoint,
+			baz2Endpoint,
+			bazSegment1Endpoint,
+			baz2Segment1Endpoint,
+			bazSegment3Endpoint,
+			baz2Segment3Endpoint,
+			wildCfEndpoint,
+			wildFooEndpoint,
+			wildEndEndpoint,
+			wildMidEndpoint,
+			wildBeginEndpoint,
+			wild2Endpoint,
+			quxEndpoint *route.Endpoint
+		)
+
+		registerRoutes := func() {
+			// This should produce 10 tier2 vips, pools and rules
+			rp := []routePair{
+				routePair{"foo.cf.com", fooEndpoint},
+				routePair{"bar.cf.com", barEndpoint},
+				routePair{"bar.cf.com", bar2Endpoint},
+				routePair{"baz.cf.com", bazEndpoint},
+				routePair{"baz.cf.com/segment1", bazSegment1Endpoint},
+				routePair{"baz.cf.com/segment1", baz2Segment1Endpoint},
+				routePair{"baz.cf.com/segment1/segment2/segment3", bazSegment3Endpoint},
+				routePair{"baz.cf.com/segment1/segment2/segment3", baz2Segment3Endpoint},
+				routePair{"*.cf.com", wildCfEndpoint},
+				routePair{"*.foo.cf.com", wildFooEndpoint},
+				routePair{"ser*.cf.com", wildEndEndpoint},
+				routePair{"ser*es.cf.com", wildMidEndpoint},
+				routePair{"*vices.cf.com", wildBeginEndpoint},
+				routePair{"*vic*.cf.com", wild2Endpoint},
+			}
+			for _, pair := range rp {
+				up, _ = NewUpdate(logger, routeUpdate.Add, pair.url, pair.ep, "")
+				router.UpdateRoute(up)
+			}
+		}
+
+		BeforeEach(func() {
+			logger = test_util.NewTestZapLogger("router-test")
+			c = makeConfig()
+			mw = &MockWriter{}
+			client = bigipclient.DefaultClient()
+
+			router, err = NewF5Router(logger, c, mw, client)
+
+			Expect(router).NotTo(BeNil(), "%v", router)
+			Expect(err).NotTo(HaveOccurred())
+
+			fooEndpoint = makeEndpoint("127.0.0.1")
+			barEndpoint = makeEndpoint("127.0.1.1")
+			bar2Endpoint = makeEndpoint("127.0.1.2")
+			bazEndpoint = makeEndpoint("127.0.2.1")
+			baz2Endpoint = makeEndpoint("127.0.2.2")
+			bazSegment1Endpoint = makeEndpoint("127.0.3.1")
+			baz2Segment1Endpoint = makeEndpoint("127.0.3.2")
+			bazSegment3Endpoint = makeEndpoint("127.0.4.1")
+			baz2Segment3Endpoint = makeEndpoint("127.0.4.2")
+			wildCfEndpoint = makeEndpoint("127.0.5.1")
+			wildFooEndpoint = makeEndpoint("127.0.6.1")
+			wildEndEndpoint = makeEndpoint("127.0.6.2")
+			wildMidEndpoint = makeEndpoint("127.0.6.3")
+			wildBeginEndpoint = makeEndpoint("127.0.6.4")
+			wild2Endpoint = makeEndpoint("127.0.7.1")
+			quxEndpoint = makeEndpoint("127.0.7.1")
+		})
+
+		AfterEach(func() {
+			if nil != logger {
+				logger.Close()
+			}
+		})
+
+		It("should run", func() {
+			done := make(chan struct{})
+			os := make(chan os.Signal)
+			ready := make(chan struct{})
+
+			go func() {
+				defer GinkgoRecover()
+				Expect(func() {
+					err = router.Run(os, ready)
+					Expect(err).NotTo(HaveOccurred())
+					close(done)
+				}).NotTo(Panic())
+			}()
+			// wait for the router to be ready
+			Eventually(ready).Should(BeClosed(), "timed out waiting for ready")
+			// send a kill signal to the router
+			os <- MockSignal(123)
+			//wait for the router to stop
+			Eventually(done).Should(BeClosed(), "timed out waiting for Run to complete")
+		})
+
+		It("should update routes", func() {
+			done := make(chan struct{})
+			os := make(chan os.Signal)
+			ready := make(chan struct{})
+			update := 0
+
+			go func() {
+				defer GinkgoRecover()
+				Expect(func() {
+					err = router.Run(os, ready)
+					Expect(err).NotTo(HaveOccurred())
+					close(done)
+				}).NotTo(Panic())
+			}()
+
+			registerRoutes()
+			// config0
+			matchConfig(mw, expectedConfigs[update], false)
+			update++
+
+			// make some changes and update the verification function
+			up, err = NewUpdate(logger, routeUpdate.Remove, "bar.cf.com", barEndpoint, "")
+			Expect(err).NotTo(HaveOccurred())
+			router.UpdateRoute(up)
+
+			up, err = NewUpdate(logger, routeUpdate.Remove, "baz.cf.com/segment1", baz2Segment1Endpoint, "")
+			Expect(err).NotTo(HaveOccurred())
+			router.UpdateRoute(up)
+
+			up, err = NewUpdate(logger, routeUpdate.Add, "baz.cf.com", baz2Endpoint, "")
+			Expect(err).NotTo(HaveOccurred())
+			router.UpdateRoute(up)
+
+			up, err = NewUpdate(logger, routeUpdate.Remove, "*.foo.cf.com", wildFooEndpoint, "")
+			Expect(err).NotTo(HaveOccurred())
+			router.UpdateRoute(up)
+
+			up, err = NewUpdate(logger, routeUpdate.Remove, "ser*.cf.com", wildEndEndpoint, "")
+			Expect(err).NotTo(HaveOccurred())
+			router.UpdateRoute(up)
+
+			up, err = NewUpdate(logger, routeUpdate.Remove, "ser*es.cf.com", wildMidEndpoint, "")
+			Expect(err).NotTo(HaveOccurred())
+			router.UpdateRoute(up)
+
+			up, err = NewUpdate(logger, routeUpdate.Remove, "*vices.cf.com", wildBeginEndpoint, "")
+			Expect(err).NotTo(HaveOccurred())
+			router.UpdateRoute(up)
+
+			up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", fooEndpoint, "")
+			Expect(err).NotTo(HaveOccurred())
+			router.UpdateRoute(up)
+
+			// config1
 			matchConfig(mw, expectedConfigs[update], false)
 			update++
 
-			up, err = NewUpdate(logger, routeUpdate.Add, "qux.cf.com", quxEndpoint, "")
-			Expect(err).NotTo(HaveOccurred())
-			router.UpdateRoute(up)
+			up, err = NewUpdate(logger, routeUpdate.Add, "qux.cf.com", quxEndpoint, "")
+			Expect(err).NotTo(HaveOccurred())
+			router.UpdateRoute(up)
+
+			// config2
+			matchConfig(mw, expectedConfigs[update], false)
+
+			os <- MockSignal(123)
+			Eventually(done).Should(BeClosed(), "timed out waiting for Run to complete")
+		})
+
+		It("should handle policies, profiles, session persistence, and health monitors", func() {
+			done := make(chan struct{})
+			os := make(chan os.Signal)
+			ready := make(chan struct{})
+
+			c.BigIP.HealthMonitors = []string{"Common/potato"}
+			c.BigIP.SSLProfiles = []string{"Common/clientssl"}
+			c.BigIP.Profiles = []string{"Common/http", "/Common/fakeprofile"}
+			c.BigIP.Policies = []string{"Common/fakepolicy", "/cf/anotherpolicy"}
+			c.BigIP.LoadBalancingMode = "least-connections-member"
+			c.SessionPersistence = false
+
+			router, err = NewF5Router(logger, c, mw, client)
+
+			go func() {
+				defer GinkgoRecover()
+				Expect(func() {
+					err = router.Run(os, ready)
+					Expect(err).NotTo(HaveOccurred())
+					close(done)
+				}).NotTo(Panic())
+			}()
+			Eventually(ready).Should(BeClosed())
+
+			registerRoutes()
+
+			//config3
+			matchConfig(mw, expectedConfigs[3], false)
+		})
+		Context("service broker route updates", func() {
+			var (
+				regularEndpoint1,
+				regularEndpoint2,
+				brokerEndpoint1,
+				brokerEndpoint2 *route.Endpoint
+			)
+
+			BeforeEach(func() {
+				regularEndpoint1 = makeEndpoint("127.0.0.1")
+				regularEndpoint2 = makeEndpoint("127.0.0.2")
+				brokerEndpoint1 = makeEndpoint("127.0.1.1")
+				brokerEndpoint2 = makeEndpoint("127.0.1.2")
+
+				// Add broker plans to router
+				plans := make(map[string]planResources.Plan)
+
+				// Updates to virtual and pool but no health monitors
+				plans["plan1"] = planResources.Plan{
+					ID: "plan1",
+					Pool: planResources.PoolType{
+						Balance: "ratio-member",
+						HealthMonitors: []bigipResources.Monitor{
+							bigipResources.Monitor{
+								Name: "/Common/existing-bigip-monitor",
+							},
+							bigipResources.Monitor{
+								Name: "plan1-monitor1",
+								Type: "http",
+							},
+						},
+					},
+					VirtualServer: planResources.VirtualType{
+						Policies:    []string{"/test/plan1-policy"},
+						Profiles:    []string{"/test/plan1-profile"},
+						SslProfiles: []string{"/test/plan1-ssl-profile"},
+					},
+				}
+
+				// Updates to pool health monitors only
+				plans["plan2"] = planResources.Plan{
+					ID: "plan2",
+					Pool: planResources.PoolType{
+						HealthMonitors: []bigipResources.Monitor{
+							bigipResources.Monitor{
+								Name: "plan2-monitor1",
+								Type: "http",
+							},
+							bigipResources.Monitor{
+								Name: "plan2-monitor2",
+								Type: "tcp",
+							},
+						},
+					},
+				}
+
+				router.AddPlans(plans)
+
+				err = router.VerifyPlanExists("plan1")
+				Expect(err).NotTo(HaveOccurred())
+				err = router.VerifyPlanExists("plan2")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should handle service broker updates", func() {
+				done := make(chan struct{})
+				os := make(chan os.Signal)
+				ready := make(chan struct{})
+
+				go func() {
+					defer GinkgoRecover()
+					Expect(func() {
+						err = router.Run(os, ready)
+						Expect(err).NotTo(HaveOccurred())
+						close(done)
+					}).NotTo(Panic())
+				}()
+
+				// Add regular route to router
+				up, err := NewUpdate(logger, routeUpdate.Add, "regular.cf.com/1", regularEndpoint1, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				matchConfig(mw, expectedConfigs[7], false)
+
+				// Add a regular route that will have broker updates bound to it
+				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/1", brokerEndpoint1, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Remove a regular route that was added before the test
+				up, err = NewUpdate(logger, routeUpdate.Remove, "regular.cf.com/1", regularEndpoint1, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Add broker defined updates to a route without endpoint this should not yet create bigip objects
+				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/2", nil, "plan1")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Same as above except this route will never get an endpoint so these bigip objects will never be created
+				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/3", nil, "plan1")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Add a regular route that will have broker updates bound to it
+				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/4", brokerEndpoint1, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Add a regular route that will have broker updates bound to it
+				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/5", brokerEndpoint1, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Add a regular route that will have broker updates bound to it
+				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/6", brokerEndpoint1, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				matchConfig(mw, expectedConfigs[8], false)
+
+				// Add a regular route
+				up, err = NewUpdate(logger, routeUpdate.Add, "regular.cf.com/2", regularEndpoint2, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Add broker update to route with existing endpoint
+				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/1", nil, "plan2")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Add broker update to route with existing endpoint
+				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/4", nil, "plan1")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Add broker update to route with existing endpoint
+				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/5", nil, "plan2")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Add broker update to route with existing endpoint
+				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/6", nil, "plan2")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Double bind update to route with existing endpoint make sure objects are not duplicated
+				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/4", nil, "plan1")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Double bind update to route with existing endpoint make sure objects are not duplicated
+				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/5", nil, "plan2")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Add route with endpoint to a broker updated route
+				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/2", brokerEndpoint2, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				matchConfig(mw, expectedConfigs[9], false)
+
+				// Remove a regular route
+				up, err = NewUpdate(logger, routeUpdate.Remove, "regular.cf.com/2", regularEndpoint2, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Remove a broker updated route
+				up, err = NewUpdate(logger, routeUpdate.Remove, "broker.cf.com/2", brokerEndpoint2, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Unbind a broker updated route (reset to config defaults)
+				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/1", nil, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Unbind a broker updated route (reset to config defaults)
+				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/4", nil, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Unbind a broker updated route (reset to config defaults)
+				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/5", nil, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Double unbind update to route with existing endpoint make sure objects are not duplicated
+				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/4", nil, "plan1")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Double unbind update to route with existing endpoint make sure objects are not duplicated
+				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/5", nil, "plan2")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				// Unbind a broker updated route without an endpoint (noop since its bigip objects are never created)
+				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/3", nil, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				matchConfig(mw, expectedConfigs[10], false)
+
+				os <- MockSignal(123)
+				Eventually(done).Should(BeClosed(), "timed out waiting for Run to complete")
+			})
+		})
+
+		Context("writer health", func() {
+			It("should fail to start on an unhealthy writer when configured", func() {
+				uw := &unhealthyWriter{}
+				router, err = NewF5Router(logger, c, uw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(router.Healthy()).To(MatchError("mock writer unhealthy"))
+
+				c.BigIP.FailOnUnhealthyWriter = true
+				ready := make(chan struct{})
+				err = router.Run(make(chan os.Signal), ready)
+				Expect(err).To(MatchError("mock writer unhealthy"))
+				Expect(ready).NotTo(BeClosed())
+			})
+
+			It("should only warn about an unhealthy writer by default", func() {
+				router, err = NewF5Router(logger, c, &unhealthyWriter{}, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+				Eventually(logger).Should(Say("f5router-writer-unhealthy"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("write failures", func() {
+			It("should stop the router once writes keep failing", func() {
+				c.BigIP.MaxWriteFailures = 3
+				fw := &failingWriter{}
+				router, err = NewF5Router(logger, c, fw, client)
+				Expect(err).NotTo(HaveOccurred())
+				fw.setFailing(true)
+
+				runErr := make(chan error, 1)
+				ready := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					runErr <- router.Run(make(chan os.Signal), ready)
+				}()
+				Eventually(ready).Should(BeClosed())
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				Eventually(runErr).Should(Receive(MatchError(
+					"config write failed 3 consecutive times: failed writing config: mock write failure")))
+				Expect(logger).To(Say("f5router-config-write-error"))
+			})
+
+			It("should recover when a retried write succeeds", func() {
+				// retries back off exponentially from 5ms, leave room to recover
+				c.BigIP.MaxWriteFailures = 10
+				fw := &failingWriter{}
+				router, err = NewF5Router(logger, c, fw, client)
+				Expect(err).NotTo(HaveOccurred())
+				fw.setFailing(true)
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(logger).Should(Say("f5router-config-write-error"))
+				Eventually(func() string {
+					return router.WriteStatus().LastError
+				}).Should(Equal("failed writing config: mock write failure"))
+				fw.setFailing(false)
+
+				Eventually(func() *bigipResources.Pool {
+					return findPool(&fw.MockWriter, up.Name())
+				}).ShouldNot(BeNil())
+				Eventually(func() string {
+					return router.WriteStatus().LastError
+				}).Should(BeEmpty())
+				status := router.WriteStatus()
+				Expect(status.LastWrite).To(Equal(status.LastAttempt))
+				Expect(status.LastWrite).NotTo(BeZero())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("metrics snapshot", func() {
+			It("should report the router's counters and gauges", func() {
+				fw := &failingWriter{}
+				router, err = NewF5Router(logger, c, fw, client)
+				Expect(err).NotTo(HaveOccurred())
+				snapshot := router.MetricsSnapshot()
+				Expect(snapshot).NotTo(HaveKey("f5router_last_write_age_seconds"))
+				Expect(snapshot).To(HaveKeyWithValue("f5router_pools", 0.0))
+				Expect(snapshot).To(HaveKeyWithValue("f5router_config_writes", 0.0))
+
+				sigs, done := runRouter(router)
+				for _, uri := range []string{"foo.cf.com", "*.cf.com"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, route.Uri(uri), makeEndpoint("127.0.0.1"), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				Eventually(func() float64 {
+					return router.MetricsSnapshot()["f5router_wildcard_rules"]
+				}).Should(Equal(1.0))
+				snapshot = router.MetricsSnapshot()
+				Expect(snapshot).To(HaveKeyWithValue("f5router_pools", 2.0))
+				Expect(snapshot).To(HaveKeyWithValue("f5router_pool_members", 2.0))
+				Expect(snapshot).To(HaveKeyWithValue("f5router_exact_rules", 1.0))
+				Expect(snapshot["f5router_virtuals"]).To(BeNumerically(">=", 3))
+				Expect(snapshot).To(HaveKeyWithValue("f5router_config_write_failures", 0.0))
+				Expect(snapshot["f5router_last_write_age_seconds"]).To(BeNumerically(">=", 0))
+				writes := snapshot["f5router_config_writes"]
+				Expect(writes).To(BeNumerically(">", 0))
+
+				fw.setFailing(true)
+				router.queue.Add(configRetry{})
+				Eventually(func() float64 {
+					return router.MetricsSnapshot()["f5router_config_write_failures"]
+				}).Should(BeNumerically(">", 0))
+				Expect(router.MetricsSnapshot()["f5router_config_writes"]).To(Equal(writes))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("skipped routing policy", func() {
+			It("should create the pool of a skipped route without a CF rule", func() {
+				sigs, done := runRouter(router)
+
+				skipped := func(uri route.Uri, addr, tag string) updateHTTP {
+					ep := makeEndpoint(addr)
+					if 0 != len(tag) {
+						ep.Tags = map[string]string{SkipPolicyTag: tag}
+					}
+					up, err := NewUpdate(logger, routeUpdate.Add, uri, ep, "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+					return up
+				}
+				rules := func() []string {
+					var names []string
+					if res, ok := mw.getInput().Resources["cf"]; ok {
+						for _, plcy := range res.Policies {
+							for _, rl := range plcy.Rules {
+								names = append(names, rl.Name)
+							}
+						}
+					}
+					return names
+				}
+
+				foo := skipped("foo.cf.com", "127.0.0.1", "true")
+				wild := skipped("*.cf.com", "127.0.0.2", "true")
+				bar := skipped("bar.cf.com", "127.0.0.3", "")
+				Eventually(rules).Should(Equal([]string{bar.Name()}))
+				Expect(findPool(mw, foo.Name())).NotTo(BeNil())
+				Expect(findPool(mw, wild.Name())).NotTo(BeNil())
+				router.lock.Lock()
+				Expect(router.r).NotTo(HaveKey(foo.URI()))
+				Expect(router.wildcards).To(BeEmpty())
+				Expect(router.virtualResources).To(HaveKey(foo.Name()))
+				router.lock.Unlock()
+
+				// the latest registration decides, a skipped route loses the
+				// rule it had
+				skipped("bar.cf.com", "127.0.0.3", "true")
+				Eventually(rules).Should(BeEmpty())
+				Expect(findPool(mw, bar.Name()).Members).To(HaveLen(1))
+				skipped("foo.cf.com", "127.0.0.1", "false")
+				Eventually(rules).Should(Equal([]string{foo.Name()}))
+
+				// a tag that does not parse keeps the rule
+				skipped("*.cf.com", "127.0.0.2", "maybe")
+				Eventually(rules).Should(ConsistOf(foo.Name(), wild.Name()))
+				Expect(logger).To(Say("f5router-ignoring-skip-routing-policy.*" +
+					"f5-skip-routing-policy must be true or false, got: maybe"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("oneconnect profiles", func() {
+			It("should follow a changed tag when the route is registered again", func() {
+				c.BigIP.OneConnectProfile = "/Common/oneconnect"
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				register := func(tags map[string]string) {
+					ep := makeEndpoint("127.0.0.1")
+					ep.Tags = tags
+					up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				virtual := func() *bigipResources.Virtual {
+					if res, ok := mw.getInput().Resources["cf"]; ok {
+						for _, vs := range res.Virtuals {
+							if vs.VirtualServerName == up.Name() {
+								return vs
+							}
+						}
+					}
+					return nil
+				}
+				oneConnectRefs := func() []*bigipResources.ProfileRef {
+					if vs := virtual(); nil != vs {
+						return vs.Profiles[2:]
+					}
+					return nil
+				}
+
+				register(nil)
+				Eventually(oneConnectRefs).Should(Equal([]*bigipResources.ProfileRef{
+					{Name: "oneconnect", Partition: "Common", Context: "all"},
+				}))
+				destination := virtual().Destination
+
+				register(map[string]string{OneConnectTag: "/cf/app-oneconnect"})
+				Eventually(oneConnectRefs).Should(Equal([]*bigipResources.ProfileRef{
+					{Name: "app-oneconnect", Partition: "cf", Context: "all"},
+				}))
+				register(map[string]string{OneConnectTag: NoOneConnect})
+				Eventually(oneConnectRefs).Should(BeEmpty())
+				// the rebuilt virtual keeps its address
+				Expect(virtual().Destination).To(Equal(destination))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("route timeouts", func() {
+			It("should write the timeouts iRules the routes reference", func() {
+				c.BigIP.RequestTimeout = 60
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				ep := makeEndpoint("127.0.0.1")
+				ep.Tags = map[string]string{ResponseTimeoutTag: "5"}
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				up, err = NewUpdate(logger, routeUpdate.Add, "bar.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				iRules := func() map[string]string {
+					code := make(map[string]string)
+					if res, ok := mw.getInput().Resources["cf"]; ok {
+						for _, rule := range res.IRules {
+							if strings.HasPrefix(rule.Name, bigipResources.RouteTimeoutsiRulePrefix) {
+								code[rule.Name] = rule.Code
+							}
+						}
+					}
+					return code
+				}
+				Eventually(iRules).Should(HaveLen(2))
+				written := iRules()
+				Expect(written["route-timeouts-60-5"]).To(ContainSubstring("set request_timer [after 60000 { reject }]"))
+				Expect(written["route-timeouts-60-5"]).To(ContainSubstring("set response_timer [after 5000 { reject }]"))
+				Expect(written["route-timeouts-60-0"]).To(ContainSubstring("set request_timer [after 60000 { reject }]"))
+				Expect(written["route-timeouts-60-0"]).NotTo(ContainSubstring("HTTP_REQUEST_SEND"))
+
+				// the iRule goes with the last route referencing it
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", ep, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(iRules).Should(HaveLen(1))
+				Expect(iRules()).To(HaveKey("route-timeouts-60-0"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should follow a changed tag when the route is registered again", func() {
+				c.BigIP.RequestTimeout = 60
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				register := func(tags map[string]string) {
+					ep := makeEndpoint("127.0.0.1")
+					ep.Tags = tags
+					up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				virtualIRules := func() []string {
+					if res, ok := mw.getInput().Resources["cf"]; ok {
+						for _, vs := range res.Virtuals {
+							if vs.VirtualServerName == up.Name() {
+								return vs.IRules
+							}
+						}
+					}
+					return nil
+				}
+
+				register(nil)
+				Eventually(virtualIRules).Should(ContainElement("/cf/route-timeouts-60-0"))
+				register(map[string]string{RequestTimeoutTag: "30"})
+				Eventually(virtualIRules).Should(ContainElement("/cf/route-timeouts-30-0"))
+				Expect(virtualIRules()).NotTo(ContainElement("/cf/route-timeouts-60-0"))
+				register(map[string]string{RequestTimeoutTag: "0"})
+				Eventually(virtualIRules).ShouldNot(ContainElement("/cf/route-timeouts-30-0"))
+				Expect(virtualIRules()).NotTo(ContainElement(HavePrefix("/cf/route-timeouts-")))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should parse only the names of timeouts iRules", func() {
+				request, response, ok := bigipResources.ParseRouteTimeoutsiRuleName("route-timeouts-60-5")
+				Expect(ok).To(BeTrue())
+				Expect(request).To(Equal(60))
+				Expect(response).To(Equal(5))
+				for _, name := range []string{"forward-to-vip", "route-timeouts-60", "route-timeouts-60-5x", "route-timeouts--1-5"} {
+					_, _, ok = bigipResources.ParseRouteTimeoutsiRuleName(name)
+					Expect(ok).To(BeFalse(), name)
+				}
+			})
+
+			It("should reject negative timeouts", func() {
+				c.BigIP.RequestTimeout = -1
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(router).To(BeNil())
+				Expect(err).To(MatchError("request_timeout must not be negative: -1"))
+
+				c.BigIP.RequestTimeout = 0
+				c.BigIP.ResponseTimeout = -5
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(router).To(BeNil())
+				Expect(err).To(MatchError("response_timeout must not be negative: -5"))
+			})
+		})
+
+		Context("overlapping wildcards", func() {
+			It("should put the wildcard with the longer suffix first", func() {
+				sigs, done := runRouter(router)
+
+				for _, uri := range []route.Uri{"*.foo.com", "*.bar.foo.com", "*.a.bar.foo.com", "foo.com"} {
+					up, err := NewUpdate(logger, routeUpdate.Add, uri, makeEndpoint("127.0.0.1"), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				routes := func() []string {
+					var uris []string
+					if res, ok := mw.getInput().Resources["cf"]; ok {
+						for _, plcy := range res.Policies {
+							for _, rl := range plcy.Rules {
+								uris = append(uris, strings.TrimPrefix(rl.Description, "route: "))
+							}
+						}
+					}
+					return uris
+				}
+				// *.bar.foo.com sorts after *.foo.com by its URI alone
+				Eventually(routes).Should(Equal([]string{
+					"foo.com - App GUID: 1",
+					"*.a.bar.foo.com - App GUID: 1",
+					"*.bar.foo.com - App GUID: 1",
+					"*.foo.com - App GUID: 1",
+				}))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should key the wildcards on their host suffix", func() {
+				key := func(uri string) string {
+					return wildcardSuffixKey(&bigipResources.Rule{FullURI: uri})
+				}
+				Expect(key("foo.com")).To(BeEmpty())
+				Expect(key("*.foo.com")).To(Equal("moc.oof."))
+				Expect(key("ser*es.foo.com:8443/app")).To(Equal("moc.oof.se"))
+				Expect(key("*.bar.foo.com")).To(HavePrefix(key("*.foo.com")))
+			})
+		})
+
+		Context("wildcard flips", func() {
+			register := func(uri route.Uri, addr string) updateHTTP {
+				up, err := NewUpdate(logger, routeUpdate.Add, uri, makeEndpoint(addr), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				return up
+			}
+			routes := func() []string {
+				var uris []string
+				if res, ok := mw.getInput().Resources["cf"]; ok {
+					for _, plcy := range res.Policies {
+						for _, rl := range plcy.Rules {
+							uris = append(uris, strings.TrimPrefix(rl.Description, "route: "))
+						}
+					}
+				}
+				sort.Strings(uris)
+				return uris
+			}
+			members := func(name string) []string {
+				var addrs []string
+				if pool := findPool(mw, name); nil != pool {
+					for _, m := range pool.Members {
+						addrs = append(addrs, m.Address)
+					}
+				}
+				return addrs
+			}
+
+			It("should keep a member in both routes by default", func() {
+				sigs, done := runRouter(router)
+
+				register("foo.cf.com", "127.0.0.1")
+				register("*.foo.cf.com", "127.0.0.1")
+				Eventually(routes).Should(HaveLen(2))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should move a member between the exact and wildcard routes", func() {
+				c.BigIP.WildcardFlips = config.ReplaceWildcardFlips
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				exact := register("foo.cf.com/app", "127.0.0.1")
+				register("foo.cf.com/app", "127.0.0.2")
+				register("bar.cf.com", "127.0.0.1")
+				Eventually(func() []string { return members(exact.Name()) }).Should(HaveLen(2))
+
+				// the exact route keeps its other member
+				wildcard := register("*.foo.cf.com/app", "127.0.0.1")
+				Eventually(func() []string { return members(wildcard.Name()) }).Should(HaveLen(1))
+				Expect(members(exact.Name())).To(Equal([]string{"127.0.0.2"}))
+				Expect(logger).To(Say(`f5router-route-flipped.*"from":"foo.cf.com/app".*"to":"\*.foo.cf.com/app"`))
+
+				// and goes with its last one
+				register("*.foo.cf.com/app", "127.0.0.2")
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, exact.Name())
+				}).Should(BeNil())
+				Expect(members(wildcard.Name())).To(ConsistOf("127.0.0.1", "127.0.0.2"))
+				Expect(routes()).To(HaveLen(2))
+				Expect(routes()[0]).To(HavePrefix("*.foo.cf.com/app"))
+				Expect(routes()[1]).To(HavePrefix("bar.cf.com"))
+				router.lock.Lock()
+				Expect(router.r).NotTo(HaveKey(exact.URI()))
+				Expect(router.virtualResources).NotTo(HaveKey(exact.Name()))
+				router.lock.Unlock()
+
+				// flipping back works the same way
+				register("foo.cf.com/app", "127.0.0.1")
+				register("foo.cf.com/app", "127.0.0.2")
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, wildcard.Name())
+				}).Should(BeNil())
+				Expect(members(exact.Name())).To(ConsistOf("127.0.0.1", "127.0.0.2"))
+				router.lock.Lock()
+				Expect(router.wildcards).To(BeEmpty())
+				router.lock.Unlock()
+
+				// other wildcards are not flips
+				register("ser*.cf.com", "127.0.0.3")
+				register("*.ser.cf.com", "127.0.0.3")
+				Eventually(routes).Should(HaveLen(4))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should reject unknown handling", func() {
+				c.BigIP.WildcardFlips = "merge"
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(router).To(BeNil())
+				Expect(err).To(MatchError("wildcard_flips must be keep or replace, got: merge"))
+			})
+		})
+
+		Context("member ttl", func() {
+			It("should evict the members not registered within the TTL", func() {
+				c.BigIP.MemberTTL = 1
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				register := func(addr string) {
+					up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint(addr), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				members := func() []bigipResources.Member {
+					if pool := findPool(mw, up.Name()); nil != pool {
+						return pool.Members
+					}
+					return nil
+				}
+				register("127.0.0.1")
+				register("127.0.0.2")
+				Eventually(members).Should(HaveLen(2))
+
+				// only the member which keeps registering stays
+				Eventually(func() []bigipResources.Member {
+					register("127.0.0.2")
+					return members()
+				}, "5s", "200ms").Should(Equal([]bigipResources.Member{
+					{Address: "127.0.0.2", Port: 80, Session: "user-enabled"},
+				}))
+				Expect(logger).To(Say(`f5router-evicting-stale-member.*"address":"127.0.0.1:80"`))
+				Expect(router.MetricsSnapshot()).To(HaveKeyWithValue("f5router_evicted_members", 1.0))
+
+				// the route goes with its last member
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}, "5s").Should(BeNil())
+				Expect(router.MetricsSnapshot()).To(HaveKeyWithValue("f5router_evicted_members", 2.0))
+				router.lock.Lock()
+				Expect(router.r).To(BeEmpty())
+				Expect(router.memberSeen).To(BeEmpty())
+				router.lock.Unlock()
+
+				// sweeps without evictions do not write the config
+				writes := router.MetricsSnapshot()["f5router_config_writes"]
+				Consistently(func() float64 {
+					return router.MetricsSnapshot()["f5router_config_writes"]
+				}, "1s").Should(Equal(writes))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should reject a negative TTL", func() {
+				c.BigIP.MemberTTL = -1
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(router).To(BeNil())
+				Expect(err).To(MatchError("member_ttl must not be negative: -1"))
+			})
+		})
+
+		Context("concurrent writes", func() {
+			It("should not interleave writes from different paths", func() {
+				ow := &overlapWriter{}
+				router, err = NewF5Router(logger, c, ow, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				var wg sync.WaitGroup
+				for i := 0; i < 10; i++ {
+					wg.Add(2)
+					go func(i int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						up, err := NewUpdate(logger, routeUpdate.Add, route.Uri(fmt.Sprintf("app%d.cf.com", i)),
+							makeEndpoint("127.0.0.1"), "")
+						Expect(err).NotTo(HaveOccurred())
+						router.UpdateRoute(up)
+					}(i)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						_, err := router.write([]byte("{}"))
+						Expect(err).NotTo(HaveOccurred())
+					}()
+				}
+				wg.Wait()
+				Eventually(func() int {
+					router.lock.Lock()
+					defer router.lock.Unlock()
+					return len(router.poolResources)
+				}).Should(Equal(10))
+				Eventually(router.queue.Len).Should(BeZero())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+				Expect(atomic.LoadInt32(&ow.overlapped)).To(BeZero())
+				// the initial config, the direct writes and at least one from
+				// the worker
+				Expect(ow.writes).To(BeNumerically(">", 11))
+			})
+		})
+
+		Context("error callback", func() {
+			It("should report failed and unknown work items", func() {
+				type failure struct {
+					item interface{}
+					err  error
+				}
+				failures := make(chan failure, 2)
+				router.OnError(func(item interface{}, err error) {
+					failures <- failure{item, err}
+				})
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "*.*.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				var f failure
+				Eventually(failures).Should(Receive(&f))
+				Expect(f.item).To(Equal(up))
+				Expect(f.err).To(MatchError(
+					"Invalid URI: *.*.cf.com multiple wildcards are not supported"))
+
+				router.queue.Add("unsupported")
+				Eventually(failures).Should(Receive(&f))
+				Expect(f.item).To(Equal("unsupported"))
+				Expect(f.err).To(MatchError("workqueue delivered unsupported work type"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should let the callbacks call back into the router", func() {
+				pools := make(chan map[string]PoolMembers, 2)
+				router.OnError(func(item interface{}, err error) {
+					pools <- router.PoolMembers()
+				})
+				router.OnUnsupported(func(item interface{}, err error) {
+					pools <- router.PoolMembers()
+				})
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "*.*.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(pools).Should(Receive())
+
+				router.queue.Add("unsupported")
+				Eventually(pools).Should(Receive())
+				Eventually(pools).Should(Receive())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should retry failed work items until they succeed", func() {
+				router.c.BigIP.MaxItemRetries = 3
+				failures := make(chan error, 4)
+				router.OnError(func(item interface{}, err error) {
+					if 0 == len(failures) {
+						// freeing the address lets the retried item through
+						router.RemoveDedicatedVirtual("foo.cf.com")
+					}
+					failures <- err
+				})
+				sigs, done := runRouter(router)
+
+				Expect(router.SetDedicatedVirtual("foo.cf.com", "10.0.0.1", 8080)).To(Succeed())
+				Expect(router.SetDedicatedVirtual("bar.cf.com", "10.0.0.1", 8080)).To(Succeed())
+
+				name := makeObjectName("bar.cf.com")
+				Eventually(func() bigipResources.VirtualAddress {
+					router.lock.Lock()
+					defer router.lock.Unlock()
+					return router.dedicatedVirtuals[name]
+				}).Should(Equal(bigipResources.VirtualAddress{BindAddr: "10.0.0.1", Port: 8080}))
+				Expect(router.queue.NumRequeues(dedicatedVirtual{
+					name: name,
+					va:   bigipResources.VirtualAddress{BindAddr: "10.0.0.1", Port: 8080},
+				})).To(BeZero())
+				Expect(failures).To(HaveLen(1))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should drop work items once the retries run out", func() {
+				router.c.BigIP.MaxItemRetries = 2
+				failures := make(chan interface{}, 4)
+				router.OnError(func(item interface{}, err error) {
+					failures <- item
+				})
+				sigs, done := runRouter(router)
+
+				Expect(router.SetDedicatedVirtual("foo.cf.com", "10.0.0.1", 8080)).To(Succeed())
+				Expect(router.SetDedicatedVirtual("bar.cf.com", "10.0.0.1", 8080)).To(Succeed())
+				bar := dedicatedVirtual{
+					name: makeObjectName("bar.cf.com"),
+					va:   bigipResources.VirtualAddress{BindAddr: "10.0.0.1", Port: 8080},
+				}
+				for i := 0; i < 3; i++ {
+					Eventually(failures).Should(Receive(Equal(bar)))
+				}
+				Consistently(failures, "100ms").ShouldNot(Receive())
+				Expect(router.queue.NumRequeues(bar)).To(BeZero())
+
+				// unsupported items are never retried
+				router.queue.Add("unsupported")
+				Eventually(failures).Should(Receive(Equal("unsupported")))
+				Consistently(failures, "100ms").ShouldNot(Receive())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should not retry rejected routes", func() {
+				router.c.BigIP.MaxItemRetries = 2
+				failures := make(chan interface{}, 4)
+				router.OnError(func(item interface{}, err error) {
+					failures <- item
+				})
+				sigs, done := runRouter(router)
+
+				wildcards, err := NewUpdate(logger, routeUpdate.Add, "*.*.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(wildcards)
+				ep := makeEndpoint("127.0.0.1")
+				ep.Tags = map[string]string{SourceAddressTag: "10.0.0.1"}
+				source, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(source)
+
+				Eventually(failures).Should(Receive(Equal(wildcards)))
+				Eventually(failures).Should(Receive(Equal(source)))
+				Consistently(failures, "100ms").ShouldNot(Receive())
+				Expect(logger).To(Say("rejecting route foo.cf.com: invalid f5-source-address"))
+				router.lock.Lock()
+				Expect(router.poolResources).NotTo(HaveKey(source.Name()))
+				router.lock.Unlock()
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should count and report unsupported work items", func() {
+				reporter := &fakeMetrics.FakeRouterReporter{}
+				router.SetReporter(reporter)
+				unsupported := make(chan error, 3)
+				router.OnUnsupported(func(item interface{}, err error) {
+					unsupported <- err
+				})
+				sigs, done := runRouter(router)
+
+				// a failure which is not an unsupported item is not counted
+				up, err = NewUpdate(logger, routeUpdate.Add, "*.*.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				router.queue.Add(updateHTTP{
+					op:  routeUpdate.Operation(42),
+					uri: "foo.cf.com",
+				})
+				router.queue.Add(updateTCP{
+					op:        routeUpdate.Bind,
+					routePort: 6000,
+				})
+				router.queue.Add(42)
+
+				var e error
+				Eventually(unsupported).Should(Receive(&e))
+				Expect(e).To(MatchError("unsupported operation Unknown for HTTP route foo.cf.com"))
+				Eventually(unsupported).Should(Receive(&e))
+				Expect(e).To(MatchError("unsupported operation Bind for TCP route 6000"))
+				Eventually(unsupported).Should(Receive(&e))
+				Expect(e).To(MatchError("workqueue delivered unsupported work type"))
+				Expect(reporter.CaptureUnsupportedWorkItemCallCount()).To(Equal(3))
+				Expect(logger).To(Say("f5router-unknown-workitem"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("rule metrics", func() {
+			It("should report the exact and wildcard rule counts", func() {
+				reporter := &fakeMetrics.FakeRouterReporter{}
+				router.SetReporter(reporter)
+				sigs, done := runRouter(router)
+
+				for _, uri := range []string{"foo.cf.com", "bar.cf.com", "*.cf.com"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, route.Uri(uri), makeEndpoint("127.0.0.1"), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				Eventually(reporter.CaptureRuleStatsCallCount).Should(Equal(3))
+				exact, wildcard := reporter.CaptureRuleStatsArgsForCall(2)
+				Expect(exact).To(Equal(2))
+				Expect(wildcard).To(Equal(1))
+
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(reporter.CaptureRuleStatsCallCount).Should(Equal(4))
+				exact, wildcard = reporter.CaptureRuleStatsArgsForCall(3)
+				Expect(exact).To(Equal(1))
+				Expect(wildcard).To(Equal(1))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("output format", func() {
+			It("should write the same structure as yaml and json", func() {
+				sections := map[string]interface{}{
+					"global": router.globalConfig(),
+					"bigip":  c.BigIP,
+					"resources": bigipResources.PartitionMap{
+						"cf": &bigipResources.Resources{
+							Pools: []*bigipResources.Pool{{
+								Name:    "foo",
+								Members: []bigipResources.Member{{Address: "127.0.0.1", Port: 80}},
+							}},
+						},
+					},
+				}
+				jsonOut, err := router.marshalConfig(sections)
+				Expect(err).NotTo(HaveOccurred())
+
+				c.BigIP.OutputFormat = config.YAMLOutput
+				yamlOut, err := router.marshalConfig(sections)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(yamlOut)).To(ContainSubstring("pools:"))
+
+				var generic interface{}
+				Expect(yaml.Unmarshal(yamlOut, &generic)).To(Succeed())
+				converted, err := json.Marshal(yamlToJSON(generic))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(converted).To(MatchJSON(jsonOut))
+			})
+
+			It("should indent the json when pretty printing", func() {
+				sections := map[string]interface{}{
+					"global": router.globalConfig(),
+					"bigip":  c.BigIP,
+				}
+				compact, err := router.marshalConfig(sections)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(compact)).NotTo(ContainSubstring("\n"))
+
+				c.BigIP.PrettyPrint = true
+				pretty, err := router.marshalConfig(sections)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(pretty)).To(ContainSubstring("\n  \"global\": {\n"))
+				Expect(pretty).To(MatchJSON(compact))
+
+				// yaml output is readable already
+				c.BigIP.OutputFormat = config.YAMLOutput
+				yamlOut, err := router.marshalConfig(sections)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(yamlOut)).To(ContainSubstring("global:"))
+			})
+
+			It("should write route updates as yaml", func() {
+				c.BigIP.OutputFormat = config.YAMLOutput
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() []interface{} {
+					mw.Lock()
+					defer mw.Unlock()
+					var out struct {
+						Resources map[string]struct {
+							Pools []interface{} `yaml:"pools"`
+						} `yaml:"resources"`
+					}
+					if nil != yaml.Unmarshal(mw.input, &out) {
+						return nil
+					}
+					return out.Resources["cf"].Pools
+				}).Should(HaveLen(1))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should reject unknown formats", func() {
+				c.BigIP.OutputFormat = "xml"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("output_format must be json or yaml, got: xml"))
+			})
+		})
+
+		Context("leader election", func() {
+			It("should only write the config while leading", func() {
+				c.BigIP.LeaderCheckInterval = 1
+				fl := &fakeLeader{}
+				mw = &MockWriter{}
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				router.SetLeader(fl)
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Consistently(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).Should(BeNil())
+
+				// the follower tracked the route and writes it once it leads
+				fl.setLeader(true)
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}, 3*time.Second).ShouldNot(BeNil())
+
+				fl.setLeader(false)
+				up, err = NewUpdate(logger, routeUpdate.Add, "bar.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Consistently(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).Should(BeNil())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should require a lock file", func() {
+				c.BigIP.LeaderElection = true
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("leader_election requires leader_lock_file"))
+			})
+		})
+
+		Context("instance identity", func() {
+			It("should tag the written config with the instance", func() {
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).ShouldNot(BeNil())
+				Expect(mw.getInput().Global.InstanceID).To(Equal("test-instance"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should default to the hostname", func() {
+				c.BigIP.InstanceID = ""
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r).NotTo(BeNil())
+
+				hostname, err := os.Hostname()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mw.getInput().Global.InstanceID).To(Equal(hostname))
+			})
+		})
+
+		Context("traffic group", func() {
+			It("should put the external address in the traffic group", func() {
+				c.BigIP.TrafficGroup = "/Common/traffic-group-1"
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() []*bigipResources.VirtualAddressConfig {
+					if _, ok := mw.getInput().Resources["cf"]; !ok {
+						return nil
+					}
+					return mw.getInput().Resources["cf"].VirtualAddresses
+				}).Should(Equal([]*bigipResources.VirtualAddressConfig{{
+					Name:         c.BigIP.ExternalAddr,
+					Address:      c.BigIP.ExternalAddr,
+					TrafficGroup: "/Common/traffic-group-1",
+				}}))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("external addresses", func() {
+			It("should bind each routing virtual to its own address", func() {
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				c.BigIP.HTTPExternalAddr = "10.1.1.1"
+				c.BigIP.HTTPSExternalAddr = "10.1.1.2"
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(router.virtualResources[HTTPRouterName].Destination).To(Equal("/cf/10.1.1.1:80"))
+				Expect(router.virtualResources[HTTPSRouterName].Destination).To(Equal("/cf/10.1.1.2:443"))
+				// the routing virtuals only take their own port
+				Expect(router.SetDedicatedVirtual("foo.cf.com", "10.1.1.1", 443)).To(Succeed())
+				Expect(router.SetDedicatedVirtual("foo.cf.com", "10.1.1.2", 443)).To(
+					MatchError("10.1.1.2:443 is used by the routing virtuals"))
+
+				c.BigIP.HTTPSExternalAddr = ""
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(router.virtualResources[HTTPSRouterName].Destination).To(
+					Equal("/cf/" + c.BigIP.ExternalAddr + ":443"))
+			})
+
+			It("should reject addresses which are not IPs", func() {
+				c.BigIP.HTTPSExternalAddr = "bad"
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(router).To(BeNil())
+				Expect(err).To(MatchError("invalid address: bad"))
+			})
+
+			It("should reference a virtual address object when configured", func() {
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				c.BigIP.TrafficGroup = "/Common/traffic-group-1"
+				c.BigIP.VirtualAddressRef = "/Common/rhi-va"
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(router.virtualResources[HTTPRouterName].Destination).To(Equal("/Common/rhi-va:80"))
+				Expect(router.virtualResources[HTTPSRouterName].Destination).To(Equal("/Common/rhi-va:443"))
+				data, err := json.Marshal(router.virtualResources[HTTPRouterName])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring(`"destination":"/Common/rhi-va:80"`))
+
+				// the referenced object keeps its own traffic group
+				sigs, done := runRouter(router)
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).ShouldNot(BeNil())
+				Expect(mw.getInput().Resources["cf"].VirtualAddresses).To(BeEmpty())
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should reject references which are not partition paths", func() {
+				for _, ref := range []string{"rhi-va", "Common/rhi-va", "/Common/", "/Common/a/b",
+					"/Common/10.0.0.1:80", "/Common/rhi va"} {
+					c.BigIP.VirtualAddressRef = ref
+					router, err = NewF5Router(logger, c, mw, client)
+					Expect(router).To(BeNil())
+					Expect(err).To(MatchError("virtual_address_ref must be a /partition/name path, got: " + ref))
+				}
+			})
+		})
+
+		Context("pool decorator", func() {
+			It("should decorate a pool once when it is created", func() {
+				decorated := make(chan string, 2)
+				router.SetPoolDecorator(func(pool *bigipResources.Pool) {
+					pool.Description = "app-guid: 1234"
+					pool.Balance = "least-connections-member"
+					decorated <- pool.Name
+				})
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				up2, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.2"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up2)
+
+				Eventually(func() int {
+					if pool := findPool(mw, up.Name()); nil != pool {
+						return len(pool.Members)
+					}
+					return 0
+				}).Should(Equal(2))
+				pool := findPool(mw, up.Name())
+				Expect(pool.Description).To(Equal("app-guid: 1234"))
+				Expect(pool.Balance).To(Equal("least-connections-member"))
+				Expect(decorated).To(Receive(Equal(up.Name())))
+				Expect(decorated).NotTo(Receive())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("name generator", func() {
+			It("should name add and remove objects with the injected generator", func() {
+				router.SetNameGenerator(testNameGenerator{})
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, "cf-cf-foo.cf.com")
+				}).ShouldNot(BeNil())
+
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, "cf-cf-foo.cf.com")
+				}).Should(BeNil())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("re-adding a bound route", func() {
+			It("should keep the bound policies and profiles on the virtual", func() {
+				plans := map[string]planResources.Plan{
+					"plan1": planResources.Plan{
+						ID: "plan1",
+						VirtualServer: planResources.VirtualType{
+							Policies: []string{"/test/plan1-policy"},
+							Profiles: []string{"/test/plan1-profile"},
+						},
+					},
+				}
+				router.AddPlans(plans)
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com", makeEndpoint("127.0.1.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com", nil, "plan1")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				findVirtual := func() *bigipResources.Virtual {
+					if _, ok := mw.getInput().Resources["cf"]; !ok {
+						return nil
+					}
+					for _, vs := range mw.getInput().Resources["cf"].Virtuals {
+						if vs.VirtualServerName == up.Name() {
+							return vs
+						}
+					}
+					return nil
+				}
+				boundPolicies := []*bigipResources.NameRef{{Name: "plan1-policy", Partition: "test"}}
+				Eventually(func() []*bigipResources.NameRef {
+					if vs := findVirtual(); nil != vs {
+						return vs.Policies
+					}
+					return nil
+				}).Should(Equal(boundPolicies))
+
+				// the config has been drained, add another endpoint for the route
+				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com", makeEndpoint("127.0.1.2"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() int {
+					if p := findPool(mw, up.Name()); nil != p {
+						return len(p.Members)
+					}
+					return 0
+				}).Should(Equal(2))
+
+				vs := findVirtual()
+				Expect(vs.Policies).To(Equal(boundPolicies))
+				Expect(vs.Profiles).To(Equal([]*bigipResources.ProfileRef{
+					{Name: "plan1-profile", Partition: "test", Context: "all"},
+				}))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("retry backoff", func() {
+			var fakeBigIPClient *fakeClient.FakeClient
+
+			BeforeEach(func() {
+				fakeBigIPClient = &fakeClient.FakeClient{}
+			})
+
+			It("handles retry backoff recovery", func() {
+				networkError1 := mockNetworkError{
+					error:   errors.New("mock network error 1"),
+					retTime: false,
+					retTemp: true,
+				}
+				fakeBigIPClient.GetReturnsOnCall(0, nil, networkError1)
+
+				networkError2 := mockNetworkError{
+					error:   errors.New("mock network error 2"),
+					retTime: true,
+					retTemp: false,
+				}
+				fakeBigIPClient.GetReturnsOnCall(1, nil, networkError2)
+
+				fakeBigIPClient.GetReturnsOnCall(2, []byte("was not found"), nil)
+
+				done := make(chan struct{})
+				os := make(chan os.Signal)
+				ready := make(chan struct{})
+
+				router, err = NewF5Router(logger, c, mw, fakeBigIPClient)
+
+				go func() {
+					defer GinkgoRecover()
+					Expect(func() {
+						err = router.Run(os, ready)
+						Expect(err).NotTo(HaveOccurred())
+						close(done)
+					}).NotTo(Panic())
+				}()
+
+				Eventually(logger).Should(Say(`"bigip-client-get-recoverable-error","source":"router-test","data":{"error":"mock network error 1"`))
+				Eventually(logger).Should(Say("Retrying in 1 seconds"))
+				Eventually(logger).Should(Say(`"retry-backoff-encountered-error-retrying","source":"router-test","data":{"error":"mock network error 2"`))
+				Eventually(logger).Should(Say("Retrying in 2 seconds"))
+				Eventually(logger).Should(Say("data group cf-ctlr-data-group not found on the BIG-IP"))
+				Eventually(ready).Should(BeClosed())
+			})
+
+			It("handles retry backoff fatal error", func() {
+				networkError1 := mockNetworkError{
+					error:   errors.New("mock network error 1"),
+					retTime: true,
+					retTemp: true,
+				}
+				fakeBigIPClient.GetReturnsOnCall(0, nil, networkError1)
+
+				networkError2 := mockNetworkError{
+					error:   errors.New("mock network error 2"),
+					retTime: false,
+					retTemp: false,
+				}
+				fakeBigIPClient.GetReturnsOnCall(1, nil, networkError2)
+
+				done := make(chan struct{})
+				os := make(chan os.Signal)
+				ready := make(chan struct{})
+
+				router, err = NewF5Router(logger, c, mw, fakeBigIPClient)
+
+				go func() {
+					defer GinkgoRecover()
+					Expect(func() {
+						err = router.Run(os, ready)
+						Expect(err).NotTo(HaveOccurred())
+						close(done)
+					}).NotTo(Panic())
+				}()
+
+				Eventually(logger).Should(Say(`"bigip-client-get-recoverable-error","source":"router-test","data":{"error":"mock network error 1"`))
+				Eventually(logger).Should(Say("Retrying in 1 seconds"))
+				Eventually(logger).Should(Say("failed-to-fetch-existing-controller-data-group"))
+				Eventually(ready).Should(BeClosed())
+			})
+		})
+
+		Context("fake BIG-IP provides a response", func() {
+			var server *ghttp.Server
+			var fakeDataGroup *bigipResources.InternalDataGroup
+
+			BeforeEach(func() {
+				server = ghttp.NewServer()
+			})
+
+			AfterEach(func() {
+				//shut down the server between tests
+				server.Close()
+			})
+			It("should be able to use a pre-existing datagroup", func() {
+				fakeDataGroup = createFakeDataGroup()
+				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, fakeDataGroup))
+
+				done := make(chan struct{})
+				os := make(chan os.Signal)
+				ready := make(chan struct{})
+
+				// Update the config
+				c.BigIP.URL = server.URL()
+
+				router, err = NewF5Router(logger, c, mw, client)
+
+				go func() {
+					defer GinkgoRecover()
+					Expect(func() {
+						err = router.Run(os, ready)
+						Expect(err).NotTo(HaveOccurred())
+						close(done)
+					}).NotTo(Panic())
+				}()
+				// Verify we got the data back from the "BIG-IP"
+				Eventually(logger).Should(Say("add-ports-to-used-ports.*60000"))
+				Eventually(ready).Should(BeClosed())
+
+				registerRoutes()
+
+				var virtuals []*bigipResources.Virtual
+
+				// Wait for all routes to be registered
+				Eventually(func() int {
+					if _, ok := mw.getInput().Resources["cf"]; ok {
+						virtuals = mw.getInput().Resources["cf"].Virtuals
+						return len(virtuals)
+					}
+					return 0
+				}).Should(Equal(11))
+
+				// Dests we know should exist on two virtuals
+				idDests := []string{"/cf/10.0.0.1:50000", "/cf/10.0.0.1:60000"}
+				var dests []string
+				for _, virtual := range virtuals {
+					if virtual.Destination == idDests[0] || virtual.Destination == idDests[1] {
+						dests = append(dests, virtual.Destination)
+					}
+				}
+				// Marshall the virtuals for ease of printing in the error
+				data, _ := json.Marshal(virtuals)
+				Expect(dests).To(ConsistOf(idDests), "Not all datagroup destinations were assigned, virtuals: %s", data)
+
+				// Verify none of the virtuals ended up with the bunk dest addrs put in the data group
+				badDests := []string{"/cf/10.0.0.1:70000", "/cf/10.1.1.1:10019"}
+				for _, virtual := range virtuals {
+					Expect(virtual.Destination).NotTo(SatisfyAny(
+						Equal(badDests[0]),
+						Equal(badDests[1]),
+					))
+				}
+			})
+			It("should be able to use a pre-existing broker data group", func() {
+				fakeDataGroup = createFakeBrokerDataGroup()
+				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusNotFound, "was not found"))
+				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, fakeDataGroup))
+
+				registerTestRoutes := func() {
+					noPlanEndpoint := makeEndpoint("127.0.0.1")
+					plan1Endpoint := makeEndpoint("127.0.1.1")
+					plan2Endpoint := makeEndpoint("127.0.1.2")
+					bunkPlanEndpoint := makeEndpoint("127.0.1.3")
+
+					pairs := []routePair{
+						routePair{"noPlan.cf.com", noPlanEndpoint},
+						routePair{"plan1.cf.com", plan1Endpoint},
+						routePair{"plan2.cf.com", plan2Endpoint},
+						routePair{"bunkPlan.cf.com", bunkPlanEndpoint},
+					}
+					for _, pair := range pairs {
+						up, _ = NewUpdate(logger, routeUpdate.Add, pair.url, pair.ep, "")
+						router.UpdateRoute(up)
+					}
+				}
+
+				done := make(chan struct{})
+				os := make(chan os.Signal)
+				ready := make(chan struct{})
+
+				// Update the config
+				c.BigIP.URL = server.URL()
+				c.BrokerMode = true
+
+				router, err = NewF5Router(logger, c, mw, client)
+
+				// Add broker plans to router
+				plans := make(map[string]planResources.Plan)
+				plans["plan1-GUID"] = planResources.Plan{
+					ID:   "plan1-GUID",
+					Name: "plan1",
+					VirtualServer: planResources.VirtualType{
+						Policies: []string{"/Common/Policy1", "/Common/Policy2"},
+					},
+					Pool: planResources.PoolType{
+						HealthMonitors: []bigipResources.Monitor{
+							bigipResources.Monitor{
+								Name:     "Monitor1",
+								Type:     "http",
+								Interval: 16,
+								Timeout:  5,
+								Send:     "Hello",
+							},
+						},
+					},
+				}
+				plans["plan2-GUID"] = planResources.Plan{
+					ID:   "plan2-GUID",
+					Name: "plan2",
+					VirtualServer: planResources.VirtualType{
+						Profiles:    []string{"/Common/Profile1", "/Common/Profile2"},
+						SslProfiles: []string{"/Common/SSLProfile1", "/Common/SSLProfile2"},
+					},
+					Pool: planResources.PoolType{
+						Balance: "ratio-node",
+					},
+				}
+				router.AddPlans(plans)
+
+				go func() {
+					defer GinkgoRecover()
+					Expect(func() {
+						err = router.Run(os, ready)
+						Expect(err).NotTo(HaveOccurred())
+						close(done)
+					}).NotTo(Panic())
+				}()
+				Eventually(logger).Should(Say("process-broker-data-group-processed-data-group"))
+				Eventually(ready).Should(BeClosed())
+
+				// Rebuild routes with data group info
+				registerTestRoutes()
+
+				// Skip bigip validation since its URL is determined by the ghttp
+				// server mocking it so it will change
+				matchConfig(mw, expectedConfigs[11], true)
+			})
+		})
+
+		Context("fail cases", func() {
+			It("should error when not passing a URI for route update", func() {
+				_, updateErr := NewUpdate(logger, routeUpdate.Add, "", fooEndpoint, "")
+				Expect(updateErr).To(MatchError("uri length of zero is not allowed"))
+			})
+
+			It("should error when a policy name is not formatted correctly", func() {
+				c.BigIP.Policies = []string{"fakepolicy", "/cf/anotherpolicy"}
+
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(router).To(BeNil())
+				Expect(err).To(MatchError(
+					"invalid policies: skipped names: [fakepolicy] need format /[partition]/[name]"))
+			})
+
+			It("should error when exceeding the ip range", func() {
+				done := make(chan struct{})
+				os := make(chan os.Signal)
+				ready := make(chan struct{})
+
+				router, err = NewF5Router(logger, c, mw, client)
+				// Set the current port to the max
+				router.tier2VSInfo.holderPort = 65535
+
+				go func() {
+					defer GinkgoRecover()
+					Expect(func() {
+						err = router.Run(os, ready)
+						Expect(err).NotTo(HaveOccurred())
+						close(done)
+					}).NotTo(Panic())
+				}()
+				Eventually(ready).Should(BeClosed())
+
+				registerRoutes()
+
+				Eventually(logger).Should(Say("Ran out of available IP addresses."))
+				// Verify the config, we should only see one 2nd tier vip, pool and rule
+				matchConfig(mw, expectedConfigs[6], false)
+
+			})
+
+		})
+		Context("tcp routing", func() {
+			registerTCP := func() {
+				ups := []tcpPair{
+					{port: 6010, member: bigipResources.Member{Address: "10.0.0.1", Port: 5000, Session: "user-enabled"}},
+					{port: 6010, member: bigipResources.Member{Address: "10.0.0.1", Port: 5001, Session: "user-enabled"}},
+					{port: 6010, member: bigipResources.Member{Address: "10.0.0.1", Port: 5002, Session: "user-enabled"}},
+					{port: 6020, member: bigipResources.Member{Address: "10.0.0.1", Port: 6000, Session: "user-enabled"}},
+					{port: 6030, member: bigipResources.Member{Address: "10.0.0.1", Port: 7000, Session: "user-enabled"}},
+					{port: 6040, member: bigipResources.Member{Address: "10.0.0.1", Port: 8000, Session: "user-enabled"}},
+					{port: 6050, member: bigipResources.Member{Address: "10.0.0.1", Port: 9000, Session: "user-enabled"}},
+				}
+				for _, pair := range ups {
+					up, _ := NewTCPUpdate(c, logger, routeUpdate.Add, pair.port, pair.member)
+					router.UpdateRoute(up)
+				}
+			}
+			BeforeEach(func() {
+				c.RoutingMode = config.TCP
+				router, err = NewF5Router(logger, c, mw, client)
+
+				done := make(chan struct{})
+				os := make(chan os.Signal)
+				ready := make(chan struct{})
+
+				go func() {
+					defer GinkgoRecover()
+					Expect(func() {
+						err = router.Run(os, ready)
+						Expect(err).NotTo(HaveOccurred())
+						close(done)
+					}).NotTo(Panic())
+				}()
+
+			})
+
+			It("should register tcp routes", func() {
+				registerTCP()
+				matchConfig(mw, expectedConfigs[4], false)
+			})
+
+			It("should update tcp routes", func() {
+				registerTCP()
+				matchConfig(mw, expectedConfigs[4], false)
+				// add a pool member to existing pool
+				member := bigipResources.Member{Address: "10.0.0.1", Port: 6001, Session: "user-enabled"}
+				ad, _ := NewTCPUpdate(c, logger, routeUpdate.Add, 6020, member)
+				router.UpdateRoute(ad)
+				// add a new pool - new pool and vs created
+				member = bigipResources.Member{Address: "10.0.0.1", Port: 6000, Session: "user-enabled"}
+				ad2, _ := NewTCPUpdate(c, logger, routeUpdate.Add, 6060, member)
+				router.UpdateRoute(ad2)
+				// remove a pool member with other members left
+				member = bigipResources.Member{Address: "10.0.0.1", Port: 5000, Session: "user-enabled"}
+				rmEP, _ := NewTCPUpdate(c, logger, routeUpdate.Remove, 6010, member)
+				router.UpdateRoute(rmEP)
+				// remove a pool member and none are left - pool and vs is deleted
+				member = bigipResources.Member{Address: "10.0.0.1", Port: 9000, Session: "user-enabled"}
+				rmEP2, _ := NewTCPUpdate(c, logger, routeUpdate.Remove, 6050, member)
+				router.UpdateRoute(rmEP2)
+
+				matchConfig(mw, expectedConfigs[5], false)
+			})
+
+			It("should not add the same pool member more than once", func() {
+				registerTCP()
+				matchConfig(mw, expectedConfigs[4], false)
+
+				member := bigipResources.Member{Address: "10.0.0.1", Port: 5000, Session: "user-enabled"}
+				ad, _ := NewTCPUpdate(c, logger, routeUpdate.Add, 6010, member)
+				router.UpdateRoute(ad)
+				router.UpdateRoute(ad)
+				router.UpdateRoute(ad)
+
+				matchConfig(mw, expectedConfigs[4], false)
+
+			})
+
+		})
+
+		Context("trailing slash", func() {
+			var rules []*bigipResources.Rule
+
+			addRoute := func() {
+				sigs, done := runRouter(router)
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com/app", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() int {
+					if _, ok := mw.getInput().Resources["cf"]; !ok {
+						return 0
+					}
+					if 1 != len(mw.getInput().Resources["cf"].Policies) {
+						return 0
+					}
+					rules = mw.getInput().Resources["cf"].Policies[0].Rules
+					return len(rules)
+				}).ShouldNot(BeZero())
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			}
+
+			It("should forward both forms of the path by default", func() {
+				addRoute()
+				Expect(rules).To(HaveLen(1))
+				Expect(firstMatch(rules, "foo.cf.com", "/app")).To(Equal(rules[0]))
+				Expect(firstMatch(rules, "foo.cf.com", "/app/")).To(Equal(rules[0]))
+				Expect(firstMatch(rules, "foo.cf.com", "/application")).To(BeNil())
+			})
+
+			It("should redirect the trailing slash form when configured", func() {
+				c.BigIP.RedirectTrailingSlash = true
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				addRoute()
+				Expect(rules).To(HaveLen(2))
+
+				redirect := firstMatch(rules, "foo.cf.com", "/app/")
+				Expect(redirect).NotTo(BeNil())
+				Expect(redirect.Name).To(Equal(up.Name() + "-redirect"))
+				Expect(redirect.Actions).To(Equal([]*bigipResources.Action{{
+					Name:      "0",
+					HTTPReply: true,
+					Redirect:  true,
+					Request:   true,
+					Location:  "tcl:/app[string range [HTTP::uri] 5 end]",
+				}}))
+
+				forward := firstMatch(rules, "foo.cf.com", "/app")
+				Expect(forward).NotTo(BeNil())
+				Expect(forward.Name).To(Equal(up.Name()))
+				Expect(firstMatch(rules, "foo.cf.com", "/app/static")).To(Equal(forward))
+			})
+		})
+
+		Context("wildcard path exceptions", func() {
+			It("should match the exception ahead of the bare wildcard", func() {
+				sigs, done := runRouter(router)
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "*.foo.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				exception, err := NewUpdate(logger, routeUpdate.Add, "*.foo.com/admin", makeEndpoint("127.0.0.2"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(exception)
+
+				var rules []*bigipResources.Rule
+				Eventually(func() int {
+					if _, ok := mw.getInput().Resources["cf"]; !ok {
+						return 0
+					}
+					if 1 != len(mw.getInput().Resources["cf"].Policies) {
+						return 0
+					}
+					rules = mw.getInput().Resources["cf"].Policies[0].Rules
+					return len(rules)
+				}).Should(Equal(2))
+
+				Expect(exception.Name()).NotTo(Equal(up.Name()))
+				Expect(exception.Name()).NotTo(ContainSubstring("/"))
+				Expect(rules[0].Name).To(Equal(exception.Name()))
+				Expect(rules[0].Ordinal).To(BeNumerically("<", rules[1].Ordinal))
+				Expect(rules[0].Conditions).To(Equal([]*bigipResources.Condition{
+					{EndsWith: true, Host: true, HTTPHost: true, Name: "0", Index: 0, Request: true,
+						Values: []string{".foo.com"}},
+					{Equals: true, HTTPURI: true, PathSegment: true, CaseSensitive: true, Name: "1", Index: 1,
+						Request: true, Values: []string{"admin"}},
+				}))
+				Expect(rules[1].Name).To(Equal(up.Name()))
+				Expect(rules[1].Conditions).To(HaveLen(1))
+
+				Expect(findPool(mw, exception.Name()).Members).To(Equal([]bigipResources.Member{
+					{Address: "127.0.0.2", Port: 80, Session: "user-enabled"},
+				}))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("strict transport security", func() {
+			It("should insert the HSTS header on HTTPS responses", func() {
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				c.BigIP.HSTS = true
+				c.BigIP.HSTSMaxAge = 600
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+
+				hstsRef := &bigipResources.NameRef{Name: CFHSTSPolicyName, Partition: "cf"}
+				Expect(router.virtualResources[HTTPSRouterName].Policies).To(ContainElement(hstsRef))
+				Expect(router.virtualResources[HTTPRouterName].Policies).NotTo(ContainElement(hstsRef))
+
+				sigs, done := runRouter(router)
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				var hsts *bigipResources.Policy
+				Eventually(func() *bigipResources.Policy {
+					if _, ok := mw.getInput().Resources["cf"]; !ok {
+						return nil
+					}
+					for _, p := range mw.getInput().Resources["cf"].Policies {
+						if p.Name == CFHSTSPolicyName {
+							hsts = p
+						}
+					}
+					return hsts
+				}).ShouldNot(BeNil())
+				Expect(hsts.Rules).To(HaveLen(1))
+				Expect(hsts.Rules[0].Conditions).To(BeEmpty())
+				Expect(hsts.Rules[0].Actions).To(Equal([]*bigipResources.Action{{
+					Name:       "0",
+					HTTPHeader: true,
+					Insert:     true,
+					Response:   true,
+					TmName:     "Strict-Transport-Security",
+					Value:      "max-age=600",
+				}}))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should require the HTTPS virtual", func() {
+				c.BigIP.HSTS = true
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("hsts requires ssl_profiles"))
+
+				c.BigIP.SSLProfiles = []string{"/Common/clientssl"}
+				c.BigIP.HSTSMaxAge = 0
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("hsts_max_age must be positive: 0"))
+			})
+		})
+
+		Context("header and cookie routes", func() {
+			// splitHost registers two apps on a host restricted to the values a
+			// and b of their tags and one app taking the other requests
+			splitHost := func(nameTag, valueTag string, matched func(*bigipResources.Condition) bool) {
+				sigs, done := runRouter(router)
+
+				update := func(op routeUpdate.Operation, addr, value string) {
+					ep := makeEndpoint(addr)
+					if 0 != len(value) {
+						ep.Tags = map[string]string{nameTag: "variant", valueTag: value}
+					}
+					up, err := NewUpdate(logger, op, "foo.cf.com", ep, "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				// the value each rule matches and the member of the pool it
+				// forwards to, in policy order
+				routes := func() []string {
+					var found []string
+					resources, ok := mw.getInput().Resources["cf"]
+					if !ok || 0 == len(resources.Policies) {
+						return nil
+					}
+					for _, rule := range resources.Policies[0].Rules {
+						value := "*"
+						for _, c := range rule.Conditions {
+							if matched(c) {
+								value = c.Values[0]
+							}
+						}
+						member := ""
+						if pool := findPool(mw, rule.Name); nil != pool && 1 == len(pool.Members) {
+							member = pool.Members[0].Address
+						}
+						found = append(found, value+" "+member)
+					}
+					return found
+				}
+				update(routeUpdate.Add, "127.0.0.1", "a")
+				update(routeUpdate.Add, "127.0.0.2", "b")
+				update(routeUpdate.Add, "127.0.0.3", "")
+				Eventually(routes).Should(ConsistOf("a 127.0.0.1", "b 127.0.0.2", "* 127.0.0.3"))
+				// the app taking the other requests goes last
+				Expect(routes()[2]).To(Equal("* 127.0.0.3"))
+				Expect(mw.getInput().Resources["cf"].Pools).To(HaveLen(3))
+
+				update(routeUpdate.Remove, "127.0.0.1", "a")
+				Eventually(routes).Should(Equal([]string{"b 127.0.0.2", "* 127.0.0.3"}))
+				Expect(mw.getInput().Resources["cf"].Pools).To(HaveLen(2))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			}
+
+			It("should give each header value of a host its own rule and pool", func() {
+				splitHost(HeaderNameTag, HeaderValueTag, func(c *bigipResources.Condition) bool {
+					return c.HTTPHeader
+				})
+			})
+
+			It("should give each cookie value of a host its own rule and pool", func() {
+				splitHost(CookieNameTag, CookieValueTag, func(c *bigipResources.Condition) bool {
+					return c.HTTPCookie
+				})
+			})
+		})
+
+		Context("passthrough", func() {
+			It("should route passthrough routes by SNI on their own virtual", func() {
+				c.BigIP.PassthroughPort = 8443
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+
+				vs := router.virtualResources[PassthroughRouterName]
+				Expect(vs).NotTo(BeNil())
+				Expect(vs.Destination).To(Equal("/cf/127.0.0.1:8443"))
+				Expect(vs.Profiles).To(Equal([]*bigipResources.ProfileRef{
+					{Name: "tcp", Partition: "Common", Context: "all"},
+				}))
+				Expect(vs.Policies).To(Equal([]*bigipResources.NameRef{
+					{Name: CFPassthroughPolicyName, Partition: "cf"},
+				}))
+
+				sigs, done := runRouter(router)
+				ep := makeEndpoint("127.0.0.1")
+				ep.Tags = map[string]string{PassthroughTag: "true"}
+				tls, err := NewUpdate(logger, routeUpdate.Add, "tls.cf.com", ep, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(tls)
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.2"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				policies := func() map[string]*bigipResources.Policy {
+					found := make(map[string]*bigipResources.Policy)
+					if _, ok := mw.getInput().Resources["cf"]; ok {
+						for _, p := range mw.getInput().Resources["cf"].Policies {
+							found[p.Name] = p
+						}
+					}
+					return found
+				}
+				Eventually(func() int {
+					return len(policies())
+				}).Should(Equal(2))
+				passthrough := policies()[CFPassthroughPolicyName]
+				Expect(passthrough.Requires).To(Equal([]string{"ssl-persistence"}))
+				Expect(passthrough.Controls).To(Equal([]string{"forwarding"}))
+				Expect(passthrough.Rules).To(HaveLen(1))
+				Expect(passthrough.Rules[0].Name).To(Equal(tls.Name()))
+				Expect(passthrough.Rules[0].Conditions[0].ServerName).To(BeTrue())
+
+				// the HTTP virtuals don't see the passthrough route
+				routing := policies()[CFRoutingPolicyName]
+				Expect(routing.Rules).To(HaveLen(1))
+				Expect(routing.Rules[0].Name).To(Equal(up.Name()))
+				Expect(findPool(mw, tls.Name())).NotTo(BeNil())
+
+				router.ForceRemovePool(PassthroughRouterName)
+				Eventually(logger).Should(Say("f5router-force-remove-routing-virtual"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should validate the port", func() {
+				c.BigIP.PassthroughPort = 65536
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("invalid passthrough_port: 65536"))
+			})
+		})
+
+		Context("path depth", func() {
+			It("should validate the limit and the action", func() {
+				c.BigIP.MaxPathDepth = -1
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("max_path_depth must not be negative: -1"))
+
+				c.BigIP.MaxPathDepth = 0
+				c.BigIP.MaxItemRetries = -1
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("max_item_retries must not be negative: -1"))
+				c.BigIP.MaxItemRetries = 0
+
+				c.BigIP.MaxPathDepth = 4
+				c.BigIP.DeepPathAction = "drop"
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("deep_path_action must be reject or truncate, got: drop"))
+
+				c.BigIP.DeepPathAction = ""
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.c.BigIP.DeepPathAction).To(Equal(config.RejectDeepPath))
+			})
+		})
+
+		Context("path matching", func() {
+			It("should validate the mode", func() {
+				c.BigIP.PathMatch = "regex"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("path_match must be segment, prefix or exact, got: regex"))
+
+				c.BigIP.PathMatch = ""
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.c.BigIP.PathMatch).To(Equal(config.SegmentPathMatch))
+			})
+		})
+
+		Context("path-only routes", func() {
+			It("should validate the action", func() {
+				c.BigIP.PathOnlyRoutes = "drop"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("path_only_routes must be reject or catch-all, got: drop"))
+
+				c.BigIP.PathOnlyRoutes = ""
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.c.BigIP.PathOnlyRoutes).To(Equal(config.RejectPathOnly))
+			})
+		})
+
+		Context("force removing pools", func() {
+			It("should remove a pool that still has members", func() {
+				sigs, done := runRouter(router)
+
+				for _, addr := range []string{"127.0.0.1", "127.0.0.2"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint(addr), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				keep, err := NewUpdate(logger, routeUpdate.Add, "bar.cf.com", makeEndpoint("127.0.0.3"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(keep)
+				Eventually(func() int {
+					if p := findPool(mw, up.Name()); nil != p {
+						return len(p.Members)
+					}
+					return 0
+				}).Should(Equal(2))
+
+				router.ForceRemovePool(up.Name())
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).Should(BeNil())
+				Expect(logger).To(Say("f5router-pool-force-removed"))
+
+				resources := mw.getInput().Resources["cf"]
+				Expect(resources.Policies[0].Rules).To(HaveLen(1))
+				Expect(resources.Policies[0].Rules[0].Name).To(Equal(keep.Name()))
+				for _, vs := range resources.Virtuals {
+					Expect(vs.VirtualServerName).NotTo(Equal(up.Name()))
+				}
+				Expect(findPool(mw, keep.Name())).NotTo(BeNil())
+
+				router.ForceRemovePool("missing")
+				Eventually(logger).Should(Say("f5router-force-remove-unknown-pool"))
+				router.ForceRemovePool(HTTPRouterName)
+				Eventually(logger).Should(Say("f5router-force-remove-routing-virtual"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("removing endpoints by pool name", func() {
+			It("should remove the member and clean up an emptied pool", func() {
+				sigs, done := runRouter(router)
+
+				for _, addr := range []string{"127.0.0.1", "127.0.0.2"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint(addr), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				keep, err := NewUpdate(logger, routeUpdate.Add, "bar.cf.com", makeEndpoint("127.0.0.3"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(keep)
+				members := func() []bigipResources.Member {
+					if p := findPool(mw, up.Name()); nil != p {
+						return p.Members
+					}
+					return nil
+				}
+				Eventually(members).Should(HaveLen(2))
+
+				router.RemovePoolEndpointByName(up.Name(), "127.0.0.1:80")
+				Eventually(members).Should(Equal([]bigipResources.Member{
+					{Address: "127.0.0.2", Port: 80, Session: "user-enabled"},
+				}))
+				Expect(mw.getInput().Resources["cf"].Policies[0].Rules).To(HaveLen(2))
+
+				router.RemovePoolEndpointByName(up.Name(), "127.0.0.1:80")
+				Eventually(logger).Should(Say("f5router-remove-unknown-pool-endpoint"))
+				router.RemovePoolEndpointByName(up.Name(), "127.0.0.2")
+				Eventually(logger).Should(Say("f5router-invalid-endpoint-address"))
+
+				router.RemovePoolEndpointByName(up.Name(), "127.0.0.2:80")
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).Should(BeNil())
+				Expect(logger).To(Say(`f5router-pool-endpoint-removed.*"rules":\["foo.cf.com"\]`))
+				resources := mw.getInput().Resources["cf"]
+				Expect(resources.Policies[0].Rules).To(HaveLen(1))
+				Expect(resources.Policies[0].Rules[0].Name).To(Equal(keep.Name()))
+				for _, vs := range resources.Virtuals {
+					Expect(vs.VirtualServerName).NotTo(Equal(up.Name()))
+				}
+				Expect(findPool(mw, keep.Name())).NotTo(BeNil())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("removing virtuals", func() {
+			var foo, bar updateHTTP
+
+			addRoutes := func() {
+				foo, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(foo)
+				bar, err = NewUpdate(logger, routeUpdate.Add, "bar.cf.com", makeEndpoint("127.0.0.2"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(bar)
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, bar.Name())
+				}).ShouldNot(BeNil())
+			}
+			virtualNames := func() (names []string) {
+				for _, vs := range mw.getInput().Resources["cf"].Virtuals {
+					names = append(names, vs.VirtualServerName)
+				}
+				return names
+			}
+
+			It("should warn about the pool and rules left behind", func() {
+				sigs, done := runRouter(router)
+				addRoutes()
+				Expect(virtualNames()).To(ContainElement(foo.Name()))
+
+				router.RemoveVirtualServer("foo.cf.com")
+				Eventually(virtualNames).ShouldNot(ContainElement(foo.Name()))
+				Expect(logger).To(Say(
+					`f5router-virtual-removed-orphans-remain.*%s.*"pool":true.*"rules":\["foo.cf.com"\]`,
+					foo.Name()))
+				Expect(findPool(mw, foo.Name())).NotTo(BeNil())
+				Expect(mw.getInput().Resources["cf"].Policies[0].Rules).To(HaveLen(2))
+
+				router.RemoveVirtualServer("foo.cf.com")
+				Eventually(logger).Should(Say("f5router-remove-unknown-virtual"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should remove the pool and rules when cascading", func() {
+				c.BigIP.VirtualRemoval = config.CascadeVirtualRemoval
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+				addRoutes()
+
+				router.RemoveVirtualServer("foo.cf.com")
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, foo.Name())
+				}).Should(BeNil())
+				Expect(virtualNames()).NotTo(ContainElement(foo.Name()))
+				Expect(virtualNames()).To(ContainElement(bar.Name()))
+				rules := mw.getInput().Resources["cf"].Policies[0].Rules
+				Expect(rules).To(HaveLen(1))
+				Expect(rules[0].Name).To(Equal(bar.Name()))
+				Expect(logger).To(Say("f5router-pool-force-removed"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should validate the removal behavior", func() {
+				c.BigIP.VirtualRemoval = "ignore"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("virtual_removal must be warn or cascade, got: ignore"))
+
+				c.BigIP.VirtualRemoval = ""
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.c.BigIP.VirtualRemoval).To(Equal(config.WarnVirtualRemoval))
+			})
+		})
+
+		Context("clearing wildcards", func() {
+			It("should remove the wildcard routes and their pools", func() {
+				sigs, done := runRouter(router)
+
+				var wildcard updateHTTP
+				for _, uri := range []string{"*.cf.com", "*.foo.cf.com", "foo.cf.com"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, route.Uri(uri), makeEndpoint("127.0.0.1"), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+					if "*.cf.com" == uri {
+						wildcard = up
+					}
+				}
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).ShouldNot(BeNil())
+				Expect(findPool(mw, wildcard.Name())).NotTo(BeNil())
+
+				router.ClearWildcards()
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, wildcard.Name())
+				}).Should(BeNil())
+				Expect(logger).To(Say("f5router-wildcards-cleared"))
+
+				resources := mw.getInput().Resources["cf"]
+				Expect(resources.Pools).To(HaveLen(1))
+				Expect(resources.Pools[0].Name).To(Equal(up.Name()))
+				Expect(resources.Policies).To(HaveLen(1))
+				Expect(resources.Policies[0].Rules).To(HaveLen(1))
+				Expect(resources.Policies[0].Rules[0].Name).To(Equal(up.Name()))
+
+				// clearing again is harmless
+				router.ClearWildcards()
+				Eventually(logger).Should(Say("f5router-no-wildcards-to-clear"))
+				Expect(findPool(mw, up.Name())).NotTo(BeNil())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("disabled wildcards", func() {
+			It("should drop wildcard routes", func() {
+				c.BigIP.DisableWildcards = true
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
 
-			// config2
-			matchConfig(mw, expectedConfigs[update], false)
+				for _, uri := range []string{"*.cf.com", "ser*.cf.com", "foo.cf.com"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, route.Uri(uri), makeEndpoint("127.0.0.1"), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				router.SetPoolMembers("*.foo.cf.com", []*route.Endpoint{makeEndpoint("127.0.0.2")})
 
-			os <- MockSignal(123)
-			Eventually(done).Should(BeClosed(), "timed out waiting for Run to complete")
+				Eventually(func() int {
+					if _, ok := mw.getInput().Resources["cf"]; !ok {
+						return 0
+					}
+					return len(mw.getInput().Resources["cf"].Pools)
+				}).Should(Equal(1))
+				Expect(findPool(mw, up.Name())).NotTo(BeNil())
+				rules := mw.getInput().Resources["cf"].Policies[0].Rules
+				Expect(rules).To(HaveLen(1))
+				Expect(rules[0].Name).To(Equal(up.Name()))
+				Expect(router.wildcards).To(BeEmpty())
+				Expect(logger).To(Say("f5router-wildcard-route-rejected"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
 		})
 
-		It("should handle policies, profiles, session persistence, and health monitors", func() {
-			done := make(chan struct{})
-			os := make(chan os.Signal)
-			ready := make(chan struct{})
-
-			c.BigIP.HealthMonitors = []string{"Common/potato"}
-			c.BigIP.SSLProfiles = []string{"Common/clientssl"}
-			c.BigIP.Profiles = []string{"Common/http", "/Common/fakeprofile"}
-			c.BigIP.Policies = []string{"Common/fakepolicy", "/cf/anotherpolicy"}
-			c.BigIP.LoadBalancingMode = "least-connections-member"
-			c.SessionPersistence = false
+		Context("setting pool members", func() {
+			It("should replace the members as the set shrinks and grows", func() {
+				sigs, done := runRouter(router)
 
-			router, err = NewF5Router(logger, c, mw, client)
+				addresses := func() []string {
+					var addrs []string
+					if p := findPool(mw, up.Name()); nil != p {
+						for _, m := range p.Members {
+							addrs = append(addrs, m.Address)
+						}
+					}
+					return addrs
+				}
 
-			go func() {
-				defer GinkgoRecover()
-				Expect(func() {
-					err = router.Run(os, ready)
+				for _, addr := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint(addr), "")
 					Expect(err).NotTo(HaveOccurred())
-					close(done)
-				}).NotTo(Panic())
-			}()
-			Eventually(ready).Should(BeClosed())
+					router.UpdateRoute(up)
+				}
+				Eventually(addresses).Should(HaveLen(3))
+
+				// an instance moved from 127.0.0.1 to 127.0.0.4 without a removal
+				router.SetPoolMembers("foo.cf.com", []*route.Endpoint{
+					makeEndpoint("127.0.0.4"),
+					makeEndpoint("127.0.0.2"),
+				})
+				Eventually(addresses).Should(ConsistOf("127.0.0.4", "127.0.0.2"))
+
+				router.SetPoolMembers("foo.cf.com", []*route.Endpoint{
+					makeEndpoint("127.0.0.2"),
+					makeEndpoint("127.0.0.4"),
+					makeEndpoint("127.0.0.5"),
+					makeEndpoint("127.0.0.5"),
+					makeEndpoint(""),
+				})
+				Eventually(addresses).Should(ConsistOf("127.0.0.2", "127.0.0.4", "127.0.0.5"))
+				Expect(logger).To(Say("f5router-invalid-member-address"))
+
+				router.SetPoolMembers("foo.cf.com", nil)
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).Should(BeNil())
+				for _, plcy := range mw.getInput().Resources["cf"].Policies {
+					for _, rule := range plcy.Rules {
+						Expect(rule.Name).NotTo(Equal(up.Name()))
+					}
+				}
 
-			registerRoutes()
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
 
-			//config3
-			matchConfig(mw, expectedConfigs[3], false)
-		})
-		Context("service broker route updates", func() {
-			var (
-				regularEndpoint1,
-				regularEndpoint2,
-				brokerEndpoint1,
-				brokerEndpoint2,
-				brokerEndpoint3,
-				brokerEndpoint4,
-				brokerEndpoint5 *route.Endpoint
-			)
+			It("should create the route when it is not known", func() {
+				sigs, done := runRouter(router)
 
-			BeforeEach(func() {
-				regularEndpoint1 = makeEndpoint("127.0.0.1")
-				regularEndpoint2 = makeEndpoint("127.0.0.2")
-				brokerEndpoint1 = makeEndpoint("127.0.1.1")
-				brokerEndpoint2 = makeEndpoint("127.0.1.2")
-				brokerEndpoint3 = makeEndpoint("127.0.1.3")
-				brokerEndpoint4 = makeEndpoint("127.0.1.4")
-				brokerEndpoint5 = makeEndpoint("127.0.1.5")
+				router.SetPoolMembers("bar.cf.com", []*route.Endpoint{
+					makeEndpoint("127.0.0.1"),
+					makeEndpoint("127.0.0.2"),
+				})
+				name := makeObjectName("bar.cf.com")
+				Eventually(func() int {
+					if p := findPool(mw, name); nil != p {
+						return len(p.Members)
+					}
+					return 0
+				}).Should(Equal(2))
+				rules := mw.getInput().Resources["cf"].Policies[0].Rules
+				Expect(rules).To(HaveLen(1))
+				Expect(rules[0].Name).To(Equal(name))
 
-				// Add broker plans to router
-				plans := make(map[string]planResources.Plan)
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
 
-				// Updates to virtual and pool but no health monitors
-				plans["plan1"] = planResources.Plan{
-					ID: "plan1",
-					Pool: planResources.PoolType{
-						Balance: "ratio-member",
-						HealthMonitors: []bigipResources.Monitor{
-							bigipResources.Monitor{
-								Name: "/Common/existing-bigip-monitor",
-							},
-							bigipResources.Monitor{
-								Name: "plan1-monitor1",
-								Type: "http",
-							},
-						},
-					},
-					VirtualServer: planResources.VirtualType{
-						Policies:    []string{"/test/plan1-policy"},
-						Profiles:    []string{"/test/plan1-profile"},
-						SslProfiles: []string{"/test/plan1-ssl-profile"},
-					},
+		Context("dedicated virtuals", func() {
+			findVirtual := func(mw *MockWriter, name string) *bigipResources.Virtual {
+				resources, ok := mw.getInput().Resources["cf"]
+				if !ok {
+					return nil
 				}
-
-				// Updates to pool health monitors only
-				plans["plan2"] = planResources.Plan{
-					ID: "plan2",
-					Pool: planResources.PoolType{
-						HealthMonitors: []bigipResources.Monitor{
-							bigipResources.Monitor{
-								Name: "plan2-monitor1",
-								Type: "http",
-							},
-							bigipResources.Monitor{
-								Name: "plan2-monitor2",
-								Type: "tcp",
-							},
-						},
-					},
+				for _, vs := range resources.Virtuals {
+					if vs.VirtualServerName == name {
+						return vs
+					}
 				}
+				return nil
+			}
 
-				router.AddPlans(plans)
-
-				err = router.VerifyPlanExists("plan1")
-				Expect(err).NotTo(HaveOccurred())
-				err = router.VerifyPlanExists("plan2")
-				Expect(err).NotTo(HaveOccurred())
+			It("should reject addresses it cannot use", func() {
+				Expect(router.SetDedicatedVirtual("foo.cf.com", "bad", 80)).To(
+					MatchError("invalid address: bad"))
+				Expect(router.SetDedicatedVirtual("foo.cf.com", "10.0.0.1", 0)).To(
+					MatchError("invalid port: 0"))
+				Expect(router.SetDedicatedVirtual("foo.cf.com", c.BigIP.ExternalAddr, 443)).To(
+					MatchError(c.BigIP.ExternalAddr + ":443 is used by the routing virtuals"))
 			})
 
-			It("should handle service broker updates", func() {
-				done := make(chan struct{})
-				os := make(chan os.Signal)
-				ready := make(chan struct{})
+			It("should forward to the route's pool while the route exists", func() {
+				failures := make(chan error, 1)
+				router.OnError(func(item interface{}, err error) {
+					failures <- err
+				})
+				sigs, done := runRouter(router)
 
-				go func() {
-					defer GinkgoRecover()
-					Expect(func() {
-						err = router.Run(os, ready)
-						Expect(err).NotTo(HaveOccurred())
-						close(done)
-					}).NotTo(Panic())
-				}()
+				Expect(router.SetDedicatedVirtual("foo.cf.com", "10.0.0.1", 8080)).To(Succeed())
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
 
-				// Add regular route to router
-				up, err := NewUpdate(logger, routeUpdate.Add, "regular.cf.com/1", regularEndpoint1, "")
+				name := up.Name() + dedicatedSuffix
+				Eventually(func() *bigipResources.Virtual {
+					return findVirtual(mw, name)
+				}).ShouldNot(BeNil())
+				vs := findVirtual(mw, name)
+				Expect(vs.Destination).To(Equal("/cf/10.0.0.1:8080"))
+				Expect(vs.PoolName).To(Equal("/cf/" + up.Name()))
+				Expect(vs.Policies).To(BeEmpty())
+				// the route is still reachable through the shared virtual
+				Expect(findVirtual(mw, HTTPRouterName)).NotTo(BeNil())
+				Expect(findVirtual(mw, up.Name())).NotTo(BeNil())
+
+				// another route cannot take the same address
+				Expect(router.SetDedicatedVirtual("bar.cf.com", "10.0.0.1", 8080)).To(Succeed())
+				var failed error
+				Eventually(failures).Should(Receive(&failed))
+				Expect(failed).To(MatchError("10.0.0.1:8080 is already dedicated to " + up.Name()))
+
+				remove, err := NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
 				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(remove)
+				Eventually(func() *bigipResources.Virtual {
+					return findVirtual(mw, name)
+				}).Should(BeNil())
+
+				// the dedicated virtual comes back with the route
 				router.UpdateRoute(up)
+				Eventually(func() *bigipResources.Virtual {
+					return findVirtual(mw, name)
+				}).ShouldNot(BeNil())
+
+				router.RemoveDedicatedVirtual("foo.cf.com")
+				Eventually(func() *bigipResources.Virtual {
+					return findVirtual(mw, name)
+				}).Should(BeNil())
+				Expect(findPool(mw, up.Name())).NotTo(BeNil())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
 
-				matchConfig(mw, expectedConfigs[7], false)
+		Context("namespace", func() {
+			It("should prefix the policy and rule names", func() {
+				c.BigIP.Namespace = "team-a"
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
 
-				// Add a regular route that will have broker updates bound to it
-				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/1", brokerEndpoint1, "")
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
 
-				// Remove a regular route that was added before the test
-				up, err = NewUpdate(logger, routeUpdate.Remove, "regular.cf.com/1", regularEndpoint1, "")
+				var policies []*bigipResources.Policy
+				Eventually(func() int {
+					if _, ok := mw.getInput().Resources["cf"]; !ok {
+						return 0
+					}
+					policies = mw.getInput().Resources["cf"].Policies
+					return len(policies)
+				}).Should(Equal(1))
+				Expect(policies[0].Name).To(Equal("team-a-" + CFRoutingPolicyName))
+				Expect(policies[0].Rules[0].Name).To(Equal("team-a-" + up.Name()))
+				// the rule still forwards to the route's own virtual
+				Expect(policies[0].Rules[0].Actions[0].Expression).To(Equal(up.Name()))
+				Expect(router.virtualResources[HTTPRouterName].Policies).To(ContainElement(
+					&bigipResources.NameRef{Name: "team-a-" + CFRoutingPolicyName, Partition: "cf"}))
+
+				pm := router.PoolMembers()[up.Name()]
+				Expect(pm.Rule).To(Equal("team-a-" + up.Name()))
+				Expect(pm.URI).To(Equal("foo.cf.com"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should skip rules whose names get too long", func() {
+				c.BigIP.Namespace = "a" + strings.Repeat("b", 227)
+				router, err = NewF5Router(logger, c, mw, client)
 				Expect(err).NotTo(HaveOccurred())
-				router.UpdateRoute(up)
 
-				// Add broker defined updates to a route without endpoint this should not yet create bigip objects
-				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/2", nil, "plan1")
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
 				Expect(err).NotTo(HaveOccurred())
-				router.UpdateRoute(up)
+				router.addRule(up)
+				Expect(router.r).To(BeEmpty())
+				Expect(logger).To(Say("f5router-rule-error"))
+			})
 
-				// Same as above except this route will never get an endpoint so these bigip objects will never be created
-				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/3", nil, "plan1")
+			It("should reject invalid namespaces", func() {
+				c.BigIP.Namespace = "team a"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(ContainSubstring("namespace must start with a letter")))
+
+				c.BigIP.Namespace = "a" + strings.Repeat("b", 228)
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError(ContainSubstring("makes policy names longer than 255 characters")))
+			})
+		})
+
+		Context("write log", func() {
+			It("should log the resource counts on each write", func() {
+				sigs, done := runRouter(router)
+
+				for _, uri := range []route.Uri{"foo.cf.com", "*.cf.com"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, uri, makeEndpoint("127.0.0.1"), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.2"), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
 
-				// Add a regular route that will have broker updates bound to it
-				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/4", brokerEndpoint1, "")
+				// the HTTP virtual plus a tier2 virtual per route
+				Eventually(logger).Should(Say(`f5router-config-written.*` +
+					`"number-services":3,"number-pools":2,"number-pool-members":3,` +
+					`"number-exact-rules":1,"number-wildcard-rules":1`))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Context("max staleness", func() {
+			BeforeEach(func() {
+				// process is driven directly, Run normally loads the data group
+				router.internalDataGroup = make(map[string]*bigipResources.InternalDataGroupRecord)
+			})
+
+			queueTwo := func() {
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.0.1"), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
-
-				// Add a regular route that will have broker updates bound to it
-				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/5", brokerEndpoint1, "")
+				up, err = NewUpdate(logger, routeUpdate.Add, "bar.cf.com", makeEndpoint("127.0.0.1"), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+			}
 
-				// Add a regular route that will have broker updates bound to it
-				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/6", brokerEndpoint1, "")
+			It("should wait for the queue to drain by default", func() {
+				queueTwo()
+				router.pendingSince = time.Now().Add(-time.Hour)
+				Expect(router.process()).To(BeTrue())
+				Expect(findPool(mw, makeObjectName("foo.cf.com"))).To(BeNil())
+			})
+
+			It("should force a write once changes are too stale", func() {
+				c.BigIP.MaxStaleness = 1
+				queueTwo()
+				Expect(router.process()).To(BeTrue())
+				Expect(findPool(mw, makeObjectName("foo.cf.com"))).To(BeNil())
+				Expect(router.pendingSince).NotTo(BeZero())
+
+				queueTwo()
+				router.pendingSince = time.Now().Add(-2 * time.Second)
+				Expect(router.process()).To(BeTrue())
+				Expect(findPool(mw, makeObjectName("bar.cf.com"))).NotTo(BeNil())
+				Expect(router.pendingSince).To(BeZero())
+				Expect(router.queue.Len()).NotTo(BeZero())
+				Expect(logger).To(Say("f5router-forcing-stale-write"))
+			})
+
+			It("should reject a negative max staleness", func() {
+				c.BigIP.MaxStaleness = -1
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("max_staleness must not be negative: -1"))
+			})
+		})
+
+		Context("slow item warning", func() {
+			It("should report items that take longer than the warning", func() {
+				c.BigIP.SlowItemWarning = 1
+				router, err = NewF5Router(logger, c, mw, client)
 				Expect(err).NotTo(HaveOccurred())
-				router.UpdateRoute(up)
+				router.SetNameGenerator(slowNameGenerator{delay: 1500 * time.Millisecond})
+				sigs, done := runRouter(router)
+
+				router.SetPoolMembers("foo.cf.com", []*route.Endpoint{makeEndpoint("127.0.0.1")})
+				Eventually(logger, 2*time.Second).Should(Say(
+					"f5router-slow-work-item.*f5router.poolMembersSet"))
+				Eventually(logger, 2*time.Second).Should(Say("f5router-slow-work-item-done"))
+				// the item still completes
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, "foo.cf.com")
+				}).ShouldNot(BeNil())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
 
-				matchConfig(mw, expectedConfigs[8], false)
+			It("should reject a negative warning", func() {
+				c.BigIP.SlowItemWarning = -1
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("slow_item_warning must not be negative: -1"))
+			})
+		})
 
-				// Add a regular route
-				up, err = NewUpdate(logger, routeUpdate.Add, "regular.cf.com/2", regularEndpoint2, "")
+		Context("member addresses", func() {
+			It("should drop updates without a usable member address", func() {
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint(""), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Expect(logger).To(Say("f5router-invalid-member-address.*empty member address"))
 
-				// Add broker update to route with existing endpoint
-				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/1", nil, "plan2")
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("not-an-ip"), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Expect(logger).To(Say("f5router-invalid-member-address.*malformed member address: not-an-ip"))
 
-				// Add broker update to route with existing endpoint
-				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/4", nil, "plan1")
+				tcp, err := NewTCPUpdate(c, logger, routeUpdate.Add, 6020, bigipResources.Member{Port: 80})
 				Expect(err).NotTo(HaveOccurred())
-				router.UpdateRoute(up)
+				router.UpdateRoute(tcp)
+				Expect(logger).To(Say("f5router-invalid-member-address.*empty member address"))
 
-				// Add broker update to route with existing endpoint
-				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/5", nil, "plan2")
+				Expect(router.queue.Len()).To(Equal(0))
+			})
+
+			It("should let the BIG-IP resolve named members when enabled", func() {
+				c.BigIP.FQDNMembers = true
+				c.BigIP.FQDNInterval = 60
+				router, err = NewF5Router(logger, c, mw, client)
 				Expect(err).NotTo(HaveOccurred())
-				router.UpdateRoute(up)
+				sigs, done := runRouter(router)
 
-				// Add broker update to route with existing endpoint
-				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/6", nil, "plan2")
+				for _, addr := range []string{"bad_name.internal", "backend.service.internal", "127.0.0.1"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint(addr), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				Expect(logger).To(Say("malformed member address: bad_name.internal"))
+				Eventually(func() []bigipResources.Member {
+					if p := findPool(mw, up.Name()); nil != p {
+						return p.Members
+					}
+					return nil
+				}).Should(Equal([]bigipResources.Member{
+					{Address: "127.0.0.1", Port: 80, Session: "user-enabled"},
+					{Address: "backend.service.internal", Port: 80, Session: "user-enabled",
+						FQDN: &bigipResources.FQDN{
+							Name:         "backend.service.internal",
+							AutoPopulate: "enabled",
+							Interval:     "60",
+						}},
+				}))
+
+				// the named member is removed like any other
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com",
+					makeEndpoint("backend.service.internal"), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Eventually(func() []bigipResources.Member {
+					if p := findPool(mw, up.Name()); nil != p {
+						return p.Members
+					}
+					return nil
+				}).Should(HaveLen(1))
 
-				// Double bind update to route with existing endpoint make sure objects are not duplicated
-				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/4", nil, "plan1")
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+
+				c.BigIP.FQDNInterval = -1
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("fqdn_interval must not be negative: -1"))
+			})
+
+			It("should let members override the monitors of their pool", func() {
+				withMonitor := func(addr, monitor string) *route.Endpoint {
+					ep := makeEndpoint(addr)
+					ep.Tags = map[string]string{MemberMonitorTag: monitor}
+					return ep
+				}
+				c.BigIP.HealthMonitors = []string{"/Common/http"}
+				router, err = NewF5Router(logger, c, mw, client)
 				Expect(err).NotTo(HaveOccurred())
-				router.UpdateRoute(up)
+				sigs, done := runRouter(router)
+
+				for _, ep := range []*route.Endpoint{
+					makeEndpoint("127.0.0.1"),
+					withMonitor("127.0.0.2", "/Common/tcp, Common/gateway_icmp"),
+					withMonitor("127.0.0.3", "tcp"),
+				} {
+					up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				Eventually(func() []bigipResources.Member {
+					if p := findPool(mw, up.Name()); nil != p {
+						return p.Members
+					}
+					return nil
+				}).Should(Equal([]bigipResources.Member{
+					{Address: "127.0.0.1", Port: 80, Session: "user-enabled"},
+					{Address: "127.0.0.2", Port: 80, Session: "user-enabled",
+						Monitor: "/Common/tcp and /Common/gateway_icmp"},
+					{Address: "127.0.0.3", Port: 80, Session: "user-enabled"},
+				}))
+				Expect(findPool(mw, up.Name()).MonitorNames).To(Equal([]string{"/Common/http"}))
+				Expect(logger).To(Say("f5router-ignoring-member-monitor.*skipped names: \\[tcp\\]"))
 
-				// Double bind update to route with existing endpoint make sure objects are not duplicated
-				up, err = NewUpdate(logger, routeUpdate.Bind, "broker.cf.com/5", nil, "plan2")
+				// a member registering again takes its new monitors
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", withMonitor("127.0.0.1", "/Common/tcp"), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Eventually(func() string {
+					return findPool(mw, up.Name()).Members[0].Monitor
+				}).Should(Equal("/Common/tcp"))
 
-				// Add route with endpoint to a broker updated route
-				up, err = NewUpdate(logger, routeUpdate.Add, "broker.cf.com/2", brokerEndpoint2, "")
+				// the remove finds the member whatever its monitors
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", makeEndpoint("127.0.0.2"), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Eventually(func() []bigipResources.Member {
+					return findPool(mw, up.Name()).Members
+				}).Should(HaveLen(2))
+
+				router.SetPoolMembers("bar.cf.com", []*route.Endpoint{withMonitor("127.0.0.4", "/Common/tcp")})
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, makeObjectName("bar.cf.com"))
+				}).ShouldNot(BeNil())
+				Expect(findPool(mw, makeObjectName("bar.cf.com")).Members[0].Monitor).To(Equal("/Common/tcp"))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
 
-				matchConfig(mw, expectedConfigs[9], false)
+			It("should reject routes whose host is too long", func() {
+				label := strings.Repeat("a", 62)
+				long := route.Uri(strings.Join([]string{label, label, label, label, "cf.com"}, "."))
+				Expect(len(long)).To(BeNumerically(">", 253))
 
-				// Remove a regular route
-				up, err = NewUpdate(logger, routeUpdate.Remove, "regular.cf.com/2", regularEndpoint2, "")
+				up, err = NewUpdate(logger, routeUpdate.Add, long+"/path", makeEndpoint("127.0.0.1"), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Expect(logger).To(Say(`f5router-long-hostname-rejected.*"length":258`))
+				router.SetPoolMembers(long, []*route.Endpoint{makeEndpoint("127.0.0.1")})
+				Expect(logger).To(Say("f5router-long-hostname-rejected"))
+				Expect(router.queue.Len()).To(Equal(0))
 
-				// Remove a broker updated route
-				up, err = NewUpdate(logger, routeUpdate.Remove, "broker.cf.com/2", brokerEndpoint2, "")
+				// the port is not part of the host
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com:8443", makeEndpoint("127.0.0.1"), "")
 				Expect(err).NotTo(HaveOccurred())
+				c.BigIP.MaxHostnameLength = 10
 				router.UpdateRoute(up)
+				Expect(router.queue.Len()).To(Equal(1))
 
-				// Unbind a broker updated route (reset to config defaults)
-				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/1", nil, "")
+				c.BigIP.MaxHostnameLength = 300
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("max_hostname_length must be between 1 and 253, got: 300"))
+			})
+
+			It("should use the default member port when configured", func() {
+				withPort := func(addr string, port uint16) *route.Endpoint {
+					ep := makeEndpoint(addr)
+					ep.Port = port
+					return ep
+				}
+				members := func(name string) func() []bigipResources.Member {
+					return func() []bigipResources.Member {
+						if p := findPool(mw, name); nil != p {
+							return p.Members
+						}
+						return nil
+					}
+				}
+
+				sigs, done := runRouter(router)
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", withPort("127.0.0.1", 61001), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Eventually(members(up.Name())).Should(Equal([]bigipResources.Member{
+					{Address: "127.0.0.1", Port: 61001, Session: "user-enabled"},
+				}))
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
 
-				// Unbind a broker updated route (reset to config defaults)
-				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/4", nil, "")
+				c.BigIP.DefaultMemberPort = 8080
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done = runRouter(router)
+
+				for _, port := range []uint16{61001, 61002} {
+					up, err = NewUpdate(logger, routeUpdate.Add, "bar.cf.com", withPort("127.0.0.1", port), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				Eventually(members(up.Name())).Should(Equal([]bigipResources.Member{
+					{Address: "127.0.0.1", Port: 8080, Session: "user-enabled"},
+				}))
+
+				router.SetPoolMembers("baz.cf.com", []*route.Endpoint{withPort("127.0.0.2", 61003)})
+				Eventually(members(makeObjectName("baz.cf.com"))).Should(Equal([]bigipResources.Member{
+					{Address: "127.0.0.2", Port: 8080, Session: "user-enabled"},
+				}))
+
+				// the remove finds the member under the same port as the add
+				up, err = NewUpdate(logger, routeUpdate.Remove, "bar.cf.com", withPort("127.0.0.1", 61001), "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Eventually(members(up.Name())).Should(BeEmpty())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+
+				c.BigIP.DefaultMemberPort = 70000
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("invalid default_member_port: 70000"))
+			})
+
+			It("should reject or fill in members without a port", func() {
+				members := func(name string) func() []bigipResources.Member {
+					return func() []bigipResources.Member {
+						if p := findPool(mw, name); nil != p {
+							return p.Members
+						}
+						return nil
+					}
+				}
+				portless := makeEndpoint("127.0.0.1")
+				portless.Port = 0
+				Expect(portless.CanonicalAddr()).To(Equal("127.0.0.1:0"))
+
+				router.UpdateRoute(updateHTTP{
+					op:       routeUpdate.Add,
+					uri:      "foo.cf.com",
+					endpoint: portless,
+				})
+				Expect(router.queue.Len()).To(BeZero())
+				Expect(logger).To(Say(`f5router-portless-member-rejected.*member 127.0.0.1 has no port`))
+				router.SetPoolMembers("bar.cf.com", []*route.Endpoint{portless, makeEndpoint("127.0.0.2")})
+
+				sigs, done := runRouter(router)
+				Eventually(members(makeObjectName("bar.cf.com"))).Should(Equal([]bigipResources.Member{
+					{Address: "127.0.0.2", Port: 80, Session: "user-enabled"},
+				}))
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
 
-				// Unbind a broker updated route (reset to config defaults)
-				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/5", nil, "")
+				c.BigIP.PortlessMembers = config.DefaultPortPortless
+				c.BigIP.PortlessMemberPort = 8080
+				router, err = NewF5Router(logger, c, mw, client)
 				Expect(err).NotTo(HaveOccurred())
-				router.UpdateRoute(up)
+				sigs, done = runRouter(router)
 
-				// Double unbind update to route with existing endpoint make sure objects are not duplicated
-				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/4", nil, "plan1")
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", portless, "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Eventually(members(up.Name())).Should(Equal([]bigipResources.Member{
+					{Address: "127.0.0.1", Port: 8080, Session: "user-enabled"},
+				}))
 
-				// Double unbind update to route with existing endpoint make sure objects are not duplicated
-				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/5", nil, "plan2")
+				// the remove finds the member under the same port as the add
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", portless, "")
 				Expect(err).NotTo(HaveOccurred())
 				router.UpdateRoute(up)
+				Eventually(members(up.Name())).Should(BeEmpty())
 
-				// Unbind a broker updated route without an endpoint (noop since its bigip objects are never created)
-				up, err = NewUpdate(logger, routeUpdate.Unbind, "broker.cf.com/3", nil, "")
-				Expect(err).NotTo(HaveOccurred())
-				router.UpdateRoute(up)
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
 
-				matchConfig(mw, expectedConfigs[10], false)
+				c.BigIP.PortlessMemberPort = 0
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("invalid portless_member_port: 0"))
 
-				os <- MockSignal(123)
-				Eventually(done).Should(BeClosed(), "timed out waiting for Run to complete")
+				c.BigIP.PortlessMembers = "ignore"
+				r, err = NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("portless_members must be reject or default-port, got: ignore"))
 			})
-		})
 
-		Context("retry backoff", func() {
-			var fakeBigIPClient *fakeClient.FakeClient
+			It("should filter members to the member address family", func() {
+				members := func(name string) func() []bigipResources.Member {
+					return func() []bigipResources.Member {
+						if p := findPool(mw, name); nil != p {
+							return p.Members
+						}
+						return nil
+					}
+				}
+				endpoints := []*route.Endpoint{
+					makeEndpoint("127.0.0.1"),
+					makeEndpoint("2001:db8::1"),
+					makeEndpoint("::ffff:10.0.0.1"),
+				}
+				run := func(family string) []bigipResources.Member {
+					c.BigIP.MemberAddressFamily = family
+					router, err = NewF5Router(logger, c, mw, client)
+					Expect(err).NotTo(HaveOccurred())
+					sigs, done := runRouter(router)
+					defer func() {
+						sigs <- MockSignal(123)
+						Eventually(done).Should(BeClosed())
+					}()
+
+					for _, ep := range endpoints {
+						up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", ep, "")
+						Expect(err).NotTo(HaveOccurred())
+						router.UpdateRoute(up)
+					}
+					router.SetPoolMembers("bar.cf.com", endpoints)
+					Eventually(members(makeObjectName("bar.cf.com"))).ShouldNot(BeEmpty())
+					Eventually(members(up.Name())).Should(Equal(members(makeObjectName("bar.cf.com"))()))
+					return members(up.Name())()
+				}
+				addresses := func(members []bigipResources.Member) (addrs []string) {
+					for _, m := range members {
+						addrs = append(addrs, m.Address)
+					}
+					return addrs
+				}
 
-			BeforeEach(func() {
-				fakeBigIPClient = &fakeClient.FakeClient{}
+				Expect(addresses(run(config.AnyAddressFamily))).To(
+					ConsistOf("127.0.0.1", "2001:db8::1", "::ffff:10.0.0.1"))
+				// an IPv4-mapped IPv6 address is IPv4
+				Expect(addresses(run(config.IPv4AddressFamily))).To(
+					ConsistOf("127.0.0.1", "::ffff:10.0.0.1"))
+				Expect(logger).To(Say(
+					`f5router-member-address-family-filtered.*member 2001:db8::1 is not an IPv4 address`))
+				Expect(addresses(run(config.IPv6AddressFamily))).To(ConsistOf("2001:db8::1"))
+				Expect(logger).To(Say(
+					`f5router-member-address-family-filtered.*member 127.0.0.1 is not an IPv6 address`))
+
+				c.BigIP.MemberAddressFamily = "dual"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("member_address_family must be any, ipv4 or ipv6, got: dual"))
 			})
 
-			It("handles retry backoff recovery", func() {
-				networkError1 := mockNetworkError{
-					error:   errors.New("mock network error 1"),
-					retTime: false,
-					retTemp: true,
+			It("should write the monitors referenced or inline", func() {
+				http := &bigipResources.Monitor{Name: "plan-http", Type: "http", Interval: 5}
+				tcp := &bigipResources.Monitor{Name: "plan-tcp", Type: "tcp"}
+				pools := func() map[string]*bigipResources.Pool {
+					return map[string]*bigipResources.Pool{
+						"a": {Name: "a", MonitorNames: []string{"/cf/plan-tcp", "/cf/plan-http", "/Common/http"}},
+						"b": {Name: "b", MonitorNames: []string{"/cf/plan-http"}},
+						"c": {Name: "c", MonitorNames: []string{"/Common/tcp"}},
+					}
 				}
-				fakeBigIPClient.GetReturnsOnCall(0, nil, networkError1)
-
-				networkError2 := mockNetworkError{
-					error:   errors.New("mock network error 2"),
-					retTime: true,
-					retTemp: false,
+				router.monitorResources = map[string][]*bigipResources.Monitor{
+					"a": {tcp, http},
+					"b": {{Name: "plan-http", Type: "http", Interval: 10}},
 				}
-				fakeBigIPClient.GetReturnsOnCall(1, nil, networkError2)
-
-				fakeBigIPClient.GetReturnsOnCall(2, []byte("was not found"), nil)
-
-				done := make(chan struct{})
-				os := make(chan os.Signal)
-				ready := make(chan struct{})
-
-				router, err = NewF5Router(logger, c, mw, fakeBigIPClient)
 
-				go func() {
-					defer GinkgoRecover()
-					Expect(func() {
-						err = router.Run(os, ready)
-						Expect(err).NotTo(HaveOccurred())
-						close(done)
-					}).NotTo(Panic())
-				}()
+				router.poolResources = pools()
+				pm, err := router.createResources()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pm["cf"].Monitors).To(Equal([]*bigipResources.Monitor{http, tcp}))
+				for _, pool := range pm["cf"].Pools {
+					Expect(pool.HealthMonitors).To(BeEmpty())
+					Expect(pool.MonitorNames).To(Equal(pools()[pool.Name].MonitorNames))
+				}
+				Expect(logger).To(Say(`f5router-conflicting-monitor-definitions.*"monitor":"plan-http","pool":"b"`))
 
-				Eventually(logger).Should(Say(`"bigip-client-get-recoverable-error","source":"router-test","data":{"error":"mock network error 1"`))
-				Eventually(logger).Should(Say("Retrying in 1 seconds"))
-				Eventually(logger).Should(Say(`"retry-backoff-encountered-error-retrying","source":"router-test","data":{"error":"mock network error 2"`))
-				Eventually(logger).Should(Say("Retrying in 2 seconds"))
-				Eventually(logger).Should(Say("data group cf-ctlr-data-group not found on the BIG-IP"))
-				Eventually(ready).Should(BeClosed())
+				c.BigIP.MonitorMode = config.InlineMonitors
+				router.poolResources = pools()
+				pm, err = router.createResources()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pm["cf"].Monitors).To(BeEmpty())
+				Expect(pm["cf"].Pools[0].HealthMonitors).To(Equal([]*bigipResources.Monitor{tcp, http}))
+				Expect(pm["cf"].Pools[0].MonitorNames).To(Equal([]string{"/Common/http"}))
+				Expect(pm["cf"].Pools[1].HealthMonitors).To(HaveLen(1))
+				Expect(pm["cf"].Pools[1].MonitorNames).To(BeEmpty())
+				Expect(pm["cf"].Pools[2].HealthMonitors).To(BeEmpty())
+				Expect(pm["cf"].Pools[2].MonitorNames).To(Equal([]string{"/Common/tcp"}))
+				// the tracked pools keep their references
+				Expect(router.poolResources["a"].MonitorNames).To(HaveLen(3))
+
+				c.BigIP.MonitorMode = "embedded"
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("monitor_mode must be referenced or inline, got: embedded"))
 			})
 
-			It("handles retry backoff fatal error", func() {
-				networkError1 := mockNetworkError{
-					error:   errors.New("mock network error 1"),
-					retTime: true,
-					retTemp: true,
+			It("should write the members in the same order whatever the add order", func() {
+				addrs := []string{"10.0.0.10", "fd00::2", "10.0.0.9", "fd00::10", "10.0.0.9"}
+				ports := []uint16{80, 80, 8080, 80, 80}
+				written := func(order []int) []bigipResources.Member {
+					var members []bigipResources.Member
+					for _, i := range order {
+						members = append(members, bigipResources.Member{Address: addrs[i], Port: ports[i]})
+					}
+					router.poolResources = map[string]*bigipResources.Pool{
+						"sorted": {Name: "sorted", Members: members},
+					}
+					pm, err := router.createResources()
+					Expect(err).NotTo(HaveOccurred())
+					// the tracked members keep their order
+					Expect(router.poolResources["sorted"].Members).To(Equal(members))
+					return pm["cf"].Pools[0].Members
 				}
-				fakeBigIPClient.GetReturnsOnCall(0, nil, networkError1)
 
-				networkError2 := mockNetworkError{
-					error:   errors.New("mock network error 2"),
-					retTime: false,
-					retTemp: false,
+				expected := []bigipResources.Member{
+					{Address: "10.0.0.9", Port: 80},
+					{Address: "10.0.0.9", Port: 8080},
+					{Address: "10.0.0.10", Port: 80},
+					{Address: "fd00::2", Port: 80},
+					{Address: "fd00::10", Port: 80},
 				}
-				fakeBigIPClient.GetReturnsOnCall(1, nil, networkError2)
-
-				done := make(chan struct{})
-				os := make(chan os.Signal)
-				ready := make(chan struct{})
-
-				router, err = NewF5Router(logger, c, mw, fakeBigIPClient)
+				Expect(written([]int{0, 1, 2, 3, 4})).To(Equal(expected))
+				Expect(written([]int{4, 3, 2, 1, 0})).To(Equal(expected))
+				Expect(written([]int{1, 4, 0, 3, 2})).To(Equal(expected))
+			})
 
-				go func() {
-					defer GinkgoRecover()
-					Expect(func() {
-						err = router.Run(os, ready)
-						Expect(err).NotTo(HaveOccurred())
-						close(done)
-					}).NotTo(Panic())
-				}()
+			It("should require the minimum active members the pools have", func() {
+				c.BigIP.MinActiveMembers = 2
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				router.poolResources = map[string]*bigipResources.Pool{
+					"one": {Name: "one", Members: []bigipResources.Member{
+						{Address: "10.0.0.1", Port: 80},
+					}},
+					"three": {Name: "three", Members: []bigipResources.Member{
+						{Address: "10.0.0.1", Port: 80},
+						{Address: "10.0.0.2", Port: 80},
+						{Address: "10.0.0.3", Port: 80},
+					}},
+				}
+				pm, err := router.createResources()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pm["cf"].Pools[0].Name).To(Equal("one"))
+				Expect(pm["cf"].Pools[0].MinActiveMembers).To(Equal(1))
+				Expect(pm["cf"].Pools[1].MinActiveMembers).To(Equal(2))
+
+				c.BigIP.MinActiveMembers = -1
+				r, err := NewF5Router(logger, c, mw, client)
+				Expect(r).To(BeNil())
+				Expect(err).To(MatchError("min_active_members must not be negative: -1"))
+			})
 
-				Eventually(logger).Should(Say(`"bigip-client-get-recoverable-error","source":"router-test","data":{"error":"mock network error 1"`))
-				Eventually(logger).Should(Say("Retrying in 1 seconds"))
-				Eventually(logger).Should(Say("failed-to-fetch-existing-controller-data-group"))
-				Eventually(ready).Should(BeClosed())
+			It("should skip empty members added to a pool", func() {
+				router.addPool(&bigipResources.Pool{
+					Name:    "empty",
+					Members: []bigipResources.Member{{Port: 80}},
+				})
+				Expect(router.poolResources).NotTo(HaveKey("empty"))
+				Expect(logger).To(Say("f5router-skipping-empty-member"))
+
+				router.addPool(&bigipResources.Pool{
+					Name:    "mixed",
+					Members: []bigipResources.Member{{Port: 80}, {Address: "127.0.0.1", Port: 80}},
+				})
+				Expect(router.poolResources["mixed"].Members).To(Equal(
+					[]bigipResources.Member{{Address: "127.0.0.1", Port: 80}}))
 			})
 		})
 
-		Context("fake BIG-IP provides a response", func() {
-			var server *ghttp.Server
-			var fakeDataGroup *bigipResources.InternalDataGroup
+		Context("wildcards with a port", func() {
+			It("should keep the port and bare wildcards apart", func() {
+				sigs, done := runRouter(router)
 
-			BeforeEach(func() {
-				server = ghttp.NewServer()
-			})
+				up, err = NewUpdate(logger, routeUpdate.Add, "*.foo.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				withPort, err := NewUpdate(logger, routeUpdate.Add, "*.foo.com:8443", makeEndpoint("127.0.0.2"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(withPort)
 
-			AfterEach(func() {
-				//shut down the server between tests
-				server.Close()
-			})
-			It("should be able to use a pre-existing datagroup", func() {
-				fakeDataGroup = createFakeDataGroup()
-				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, fakeDataGroup))
+				var rules []*bigipResources.Rule
+				Eventually(func() int {
+					if _, ok := mw.getInput().Resources["cf"]; !ok {
+						return 0
+					}
+					if 1 != len(mw.getInput().Resources["cf"].Policies) {
+						return 0
+					}
+					rules = mw.getInput().Resources["cf"].Policies[0].Rules
+					return len(rules)
+				}).Should(Equal(2))
+
+				Expect(withPort.Name()).To(Equal("cf-foo.com-8443"))
+				Expect(up.Name()).To(Equal("cf-foo.com"))
+				Expect(rules[0].Name).To(Equal(withPort.Name()))
+				Expect(rules[0].Conditions).To(Equal([]*bigipResources.Condition{
+					{EndsWith: true, Host: true, HTTPHost: true, Name: "0", Index: 0, Request: true,
+						Values: []string{".foo.com"}},
+					{Equals: true, HTTPHost: true, Port: true, Name: "1", Index: 0, Request: true,
+						Values: []string{"8443"}},
+				}))
 
-				done := make(chan struct{})
-				os := make(chan os.Signal)
-				ready := make(chan struct{})
+				Expect(firstMatch(rules, "bar.foo.com:8443", "/").Name).To(Equal(withPort.Name()))
+				Expect(firstMatch(rules, "bar.foo.com", "/").Name).To(Equal(up.Name()))
+				Expect(findPool(mw, withPort.Name()).Members).To(Equal([]bigipResources.Member{
+					{Address: "127.0.0.2", Port: 80, Session: "user-enabled"},
+				}))
 
-				// Update the config
-				c.BigIP.URL = server.URL()
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+		})
 
+		Context("split routing policies", func() {
+			It("should emit separate exact and wildcard policies", func() {
+				c.BigIP.SplitRoutingPolicies = true
 				router, err = NewF5Router(logger, c, mw, client)
-
-				go func() {
-					defer GinkgoRecover()
-					Expect(func() {
-						err = router.Run(os, ready)
-						Expect(err).NotTo(HaveOccurred())
-						close(done)
-					}).NotTo(Panic())
-				}()
-				// Verify we got the data back from the "BIG-IP"
-				Eventually(logger).Should(Say("add-ports-to-used-ports.*60000"))
-				Eventually(ready).Should(BeClosed())
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
 
 				registerRoutes()
 
-				var virtuals []*bigipResources.Virtual
-
-				// Wait for all routes to be registered
+				var policies []*bigipResources.Policy
 				Eventually(func() int {
-					if _, ok := mw.getInput().Resources["cf"]; ok {
-						virtuals = mw.getInput().Resources["cf"].Virtuals
-						return len(virtuals)
+					if _, ok := mw.getInput().Resources["cf"]; !ok {
+						return 0
 					}
-					return 0
-				}).Should(Equal(11))
-
-				// Dests we know should exist on two virtuals
-				idDests := []string{"/cf/10.0.0.1:50000", "/cf/10.0.0.1:60000"}
-				var dests []string
-				for _, virtual := range virtuals {
-					if virtual.Destination == idDests[0] || virtual.Destination == idDests[1] {
-						dests = append(dests, virtual.Destination)
+					policies = mw.getInput().Resources["cf"].Policies
+					if 2 != len(policies) {
+						return 0
 					}
+					return len(policies[0].Rules) + len(policies[1].Rules)
+				}).Should(Equal(10))
+
+				Expect(policies[0].Name).To(Equal(CFRoutingPolicyName))
+				Expect(policies[0].Rules).To(HaveLen(5))
+				Expect(policies[0].Rules[0].Ordinal).To(Equal(0))
+				Expect(policies[1].Name).To(Equal(CFWildcardRoutingPolicyName))
+				Expect(policies[1].Rules).To(HaveLen(5))
+				Expect(policies[1].Rules[0].Ordinal).To(Equal(0))
+				for _, rl := range policies[1].Rules {
+					Expect(rl.Conditions[0].EndsWith || rl.Conditions[0].StartsWith).To(BeTrue())
 				}
-				// Marshall the virtuals for ease of printing in the error
-				data, _ := json.Marshal(virtuals)
-				Expect(dests).To(ConsistOf(idDests), "Not all datagroup destinations were assigned, virtuals: %s", data)
 
-				// Verify none of the virtuals ended up with the bunk dest addrs put in the data group
-				badDests := []string{"/cf/10.0.0.1:70000", "/cf/10.1.1.1:10019"}
-				for _, virtual := range virtuals {
-					Expect(virtual.Destination).NotTo(SatisfyAny(
-						Equal(badDests[0]),
-						Equal(badDests[1]),
-					))
+				var httpVS *bigipResources.Virtual
+				for _, vs := range mw.getInput().Resources["cf"].Virtuals {
+					if vs.VirtualServerName == HTTPRouterName {
+						httpVS = vs
+					}
 				}
+				Expect(httpVS).NotTo(BeNil())
+				Expect(httpVS.Policies).To(Equal([]*bigipResources.NameRef{
+					{Name: CFRoutingPolicyName, Partition: "cf"},
+					{Name: CFWildcardRoutingPolicyName, Partition: "cf"},
+				}))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
 			})
-			It("should be able to use a pre-existing broker data group", func() {
-				fakeDataGroup = createFakeBrokerDataGroup()
-				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusNotFound, "was not found"))
-				server.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, fakeDataGroup))
+		})
 
-				registerTestRoutes := func() {
-					noPlanEndpoint := makeEndpoint("127.0.0.1")
-					plan1Endpoint := makeEndpoint("127.0.1.1")
-					plan2Endpoint := makeEndpoint("127.0.1.2")
-					bunkPlanEndpoint := makeEndpoint("127.0.1.3")
+		Context("routing policies", func() {
+			written := func() (policies []*bigipResources.Policy, refs []string) {
+				res, ok := mw.getInput().Resources["cf"]
+				if !ok {
+					return nil, nil
+				}
+				for _, vs := range res.Virtuals {
+					if vs.VirtualServerName == HTTPRouterName {
+						for _, ref := range vs.Policies {
+							refs = append(refs, ref.Name)
+						}
+					}
+				}
+				return res.Policies, refs
+			}
+			shardNames := func() []string {
+				policies, _ := written()
+				var names []string
+				for _, plcy := range policies {
+					names = append(names, plcy.Name)
+				}
+				return names
+			}
 
-					pairs := []routePair{
-						routePair{"noPlan.cf.com", noPlanEndpoint},
-						routePair{"plan1.cf.com", plan1Endpoint},
-						routePair{"plan2.cf.com", plan2Endpoint},
-						routePair{"bunkPlan.cf.com", bunkPlanEndpoint},
+			It("should shard a policy with more rules than max_policy_rules", func() {
+				c.BigIP.MaxPolicyRules = 4
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				registerRoutes()
+				Eventually(func() int {
+					policies, _ := written()
+					rules := 0
+					for _, plcy := range policies {
+						rules += len(plcy.Rules)
 					}
-					for _, pair := range pairs {
-						up, _ = NewUpdate(logger, routeUpdate.Add, pair.url, pair.ep, "")
-						router.UpdateRoute(up)
+					return rules
+				}).Should(Equal(10))
+
+				policies, refs := written()
+				Expect(shardNames()).To(Equal([]string{
+					CFRoutingPolicyName + "-1", CFRoutingPolicyName + "-2", CFRoutingPolicyName + "-3",
+				}))
+				Expect(refs).To(Equal(shardNames()))
+				var uris []string
+				for _, plcy := range policies {
+					Expect(len(plcy.Rules)).To(BeNumerically("<=", 4))
+					for i, rl := range plcy.Rules {
+						Expect(rl.Ordinal).To(Equal(i))
+						uris = append(uris, rl.Description)
 					}
 				}
 
-				done := make(chan struct{})
-				os := make(chan os.Signal)
-				ready := make(chan struct{})
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
 
-				// Update the config
-				c.BigIP.URL = server.URL()
-				c.BrokerMode = true
+				// the shards keep the order of the unsharded policy
+				var unsharded []string
+				for _, rl := range router.makeRoutePolicy(CFRoutingPolicyName,
+					router.redirects, router.r, router.wildcards).Rules {
+					unsharded = append(unsharded, rl.Description)
+				}
+				Expect(uris).To(Equal(unsharded))
+			})
 
+			It("should shard only the policies crossing the limit", func() {
+				c.BigIP.SplitRoutingPolicies = true
+				c.BigIP.MaxPolicyRules = 5
 				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
 
-				// Add broker plans to router
-				plans := make(map[string]planResources.Plan)
-				plans["plan1-GUID"] = planResources.Plan{
-					ID:   "plan1-GUID",
-					Name: "plan1",
-					VirtualServer: planResources.VirtualType{
-						Policies: []string{"/Common/Policy1", "/Common/Policy2"},
-					},
-					Pool: planResources.PoolType{
-						HealthMonitors: []bigipResources.Monitor{
-							bigipResources.Monitor{
-								Name:     "Monitor1",
-								Type:     "http",
-								Interval: 16,
-								Timeout:  5,
-								Send:     "Hello",
-							},
-						},
-					},
-				}
-				plans["plan2-GUID"] = planResources.Plan{
-					ID:   "plan2-GUID",
-					Name: "plan2",
-					VirtualServer: planResources.VirtualType{
-						Profiles:    []string{"/Common/Profile1", "/Common/Profile2"},
-						SslProfiles: []string{"/Common/SSLProfile1", "/Common/SSLProfile2"},
-					},
-					Pool: planResources.PoolType{
-						Balance: "ratio-node",
-					},
+				registerRoutes()
+				Eventually(shardNames).Should(Equal([]string{
+					CFRoutingPolicyName, CFWildcardRoutingPolicyName,
+				}))
+				_, refs := written()
+				Expect(refs).To(Equal([]string{CFRoutingPolicyName, CFWildcardRoutingPolicyName}))
+
+				up, err = NewUpdate(logger, routeUpdate.Add, "qux.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(shardNames).Should(Equal([]string{
+					CFRoutingPolicyName + "-1", CFRoutingPolicyName + "-2", CFWildcardRoutingPolicyName,
+				}))
+				policies, refs := written()
+				Expect(policies[0].Rules).To(HaveLen(5))
+				Expect(policies[1].Rules).To(HaveLen(1))
+				Expect(refs).To(Equal(shardNames()))
+
+				// back within the limit the policy keeps its name again
+				up, err = NewUpdate(logger, routeUpdate.Remove, "qux.cf.com", makeEndpoint("127.0.0.1"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(shardNames).Should(Equal([]string{
+					CFRoutingPolicyName, CFWildcardRoutingPolicyName,
+				}))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should declare the configured strategy, controls and requires", func() {
+				c.BigIP.MaxPolicyRules = 4
+				c.BigIP.PolicyStrategy = "/Common/best-match"
+				c.BigIP.PolicyControls = []string{"forwarding", "caching"}
+				c.BigIP.PolicyRequires = []string{"http", "client-ssl"}
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done := runRouter(router)
+
+				registerRoutes()
+				Eventually(shardNames).Should(HaveLen(3))
+				policies, _ := written()
+				for _, plcy := range policies {
+					Expect(plcy.Strategy).To(Equal("/Common/best-match"))
+					Expect(plcy.Controls).To(Equal([]string{"forwarding", "caching"}))
+					Expect(plcy.Requires).To(Equal([]string{"http", "client-ssl"}))
 				}
-				router.AddPlans(plans)
 
-				go func() {
-					defer GinkgoRecover()
-					Expect(func() {
-						err = router.Run(os, ready)
-						Expect(err).NotTo(HaveOccurred())
-						close(done)
-					}).NotTo(Panic())
-				}()
-				Eventually(logger).Should(Say("process-broker-data-group-processed-data-group"))
-				Eventually(ready).Should(BeClosed())
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
 
-				// Rebuild routes with data group info
-				registerTestRoutes()
+			It("should default the strategy, controls and requires", func() {
+				plcy := router.makeRoutePolicy("test")
+				Expect(plcy.Strategy).To(Equal("/Common/first-match"))
+				Expect(plcy.Controls).To(Equal([]string{"forwarding"}))
+				Expect(plcy.Requires).To(Equal([]string{"http"}))
+			})
 
-				// Skip bigip validation since its URL is determined by the ghttp
-				// server mocking it so it will change
-				matchConfig(mw, expectedConfigs[11], true)
+			It("should reject settings the routing rules cannot work with", func() {
+				for _, tc := range []struct {
+					strategy string
+					controls []string
+					requires []string
+					err      string
+				}{
+					{strategy: "first-match", err: "policy_strategy must be a /partition/name path, got: first-match"},
+					{controls: []string{"caching"}, err: "policy_controls must include forwarding, got: [caching]"},
+					{controls: []string{"forwarding", "Bad Control"}, err: `invalid policy_controls entry: "Bad Control"`},
+					{requires: []string{"tcp"}, err: "policy_requires must include http, got: [tcp]"},
+					{requires: []string{"http", ""}, err: `invalid policy_requires entry: ""`},
+				} {
+					c := makeConfig()
+					c.BigIP.PolicyStrategy = tc.strategy
+					c.BigIP.PolicyControls = tc.controls
+					c.BigIP.PolicyRequires = tc.requires
+					router, err = NewF5Router(logger, c, mw, client)
+					Expect(router).To(BeNil())
+					Expect(err).To(MatchError(tc.err))
+				}
+			})
+
+			It("should reject a negative limit", func() {
+				c.BigIP.MaxPolicyRules = -1
+				router, err = NewF5Router(logger, c, mw, client)
+				Expect(router).To(BeNil())
+				Expect(err).To(MatchError("max_policy_rules must not be negative: -1"))
 			})
 		})
 
-		Context("fail cases", func() {
-			It("should error when not passing a URI for route update", func() {
-				_, updateErr := NewUpdate(logger, routeUpdate.Add, "", fooEndpoint, "")
-				Expect(updateErr).To(MatchError("uri length of zero is not allowed"))
+		Context("pool members", func() {
+			It("should report pool members with their URIs and rules", func() {
+				sigs, done := runRouter(router)
+
+				registerRoutes()
+				matchConfig(mw, expectedConfigs[0], false)
+
+				pools := router.PoolMembers()
+				Expect(pools).To(HaveLen(10))
+
+				bar := pools[makeObjectName("bar.cf.com")]
+				Expect(bar.URI).To(Equal("bar.cf.com"))
+				Expect(bar.Rule).To(Equal(makeObjectName("bar.cf.com")))
+				Expect(bar.Members).To(ConsistOf("127.0.1.1:80", "127.0.1.2:80"))
+
+				wild := pools[makeObjectName("*.foo.cf.com")]
+				Expect(wild.URI).To(Equal("*.foo.cf.com"))
+				Expect(wild.Members).To(Equal([]string{"127.0.6.1:80"}))
+
+				data, err := json.Marshal(router)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(ContainSubstring(`"uri":"*.foo.cf.com"`))
+				Expect(string(data)).To(ContainSubstring(`"write":{"lastWrite":`))
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
 			})
+		})
 
-			It("should error when a policy name is not formatted correctly", func() {
-				done := make(chan struct{})
-				os := make(chan os.Signal)
-				ready := make(chan struct{})
+		Context("pool state", func() {
+			It("should disable and enable all members of a pool", func() {
+				sigs, done := runRouter(router)
 
-				c.BigIP.Policies = []string{"fakepolicy", "/cf/anotherpolicy"}
+				register := func(addr string) {
+					up, err := NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint(addr), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				sessions := func() []string {
+					var states []string
+					if pool := findPool(mw, makeObjectName("foo.cf.com")); nil != pool {
+						for _, m := range pool.Members {
+							states = append(states, m.Session)
+						}
+					}
+					return states
+				}
+				register("127.0.0.1")
+				register("127.0.0.2")
+				Eventually(sessions).Should(Equal([]string{"user-enabled", "user-enabled"}))
+
+				router.DisablePool("foo.cf.com")
+				Eventually(sessions).Should(Equal([]string{"user-disabled", "user-disabled"}))
+				Expect(router.PoolMembers()[makeObjectName("foo.cf.com")].Disabled).To(BeTrue())
+
+				// the members stay in the pool and new ones join disabled
+				register("127.0.0.3")
+				Eventually(sessions).Should(Equal([]string{"user-disabled", "user-disabled", "user-disabled"}))
+
+				router.EnablePool("foo.cf.com")
+				Eventually(sessions).Should(Equal([]string{"user-enabled", "user-enabled", "user-enabled"}))
+				Expect(router.PoolMembers()[makeObjectName("foo.cf.com")].Disabled).To(BeFalse())
+
+				router.DisablePool("bar.cf.com")
+				Eventually(logger).Should(Say("f5router-disable-unknown-pool"))
+				router.lock.Lock()
+				Expect(router.disabledPools).To(BeEmpty())
+				router.lock.Unlock()
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
 
-				router, err = NewF5Router(logger, c, mw, client)
+			It("should forget the state of a deleted pool", func() {
+				sigs, done := runRouter(router)
 
-				go func() {
-					defer GinkgoRecover()
-					Expect(func() {
-						err = router.Run(os, ready)
-						Expect(err).NotTo(HaveOccurred())
-						close(done)
-					}).NotTo(Panic())
-				}()
-				Eventually(ready).Should(BeClosed())
+				update := func(op routeUpdate.Operation, addr string) {
+					up, err := NewUpdate(logger, op, "foo.cf.com", makeEndpoint(addr), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				disabled := func() bool {
+					router.lock.Lock()
+					defer router.lock.Unlock()
+					return router.disabledPools[makeObjectName("foo.cf.com")]
+				}
+				update(routeUpdate.Add, "127.0.0.1")
+				router.DisablePool("foo.cf.com")
+				Eventually(disabled).Should(BeTrue())
+
+				update(routeUpdate.Remove, "127.0.0.1")
+				Eventually(disabled).Should(BeFalse())
+
+				// a pool created again for the route starts enabled
+				update(routeUpdate.Add, "127.0.0.2")
+				Eventually(func() []string {
+					var states []string
+					if pool := findPool(mw, makeObjectName("foo.cf.com")); nil != pool {
+						for _, m := range pool.Members {
+							states = append(states, m.Address+" "+m.Session)
+						}
+					}
+					return states
+				}).Should(Equal([]string{"127.0.0.2 user-enabled"}))
 
-				Eventually(logger).Should(Say("skipping-policy-names"))
+				router.DisablePool("foo.cf.com")
+				Eventually(disabled).Should(BeTrue())
+				router.ForceRemovePool(makeObjectName("foo.cf.com"))
+				Eventually(disabled).Should(BeFalse())
+
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
 			})
+		})
 
-			It("should error when exceeding the ip range", func() {
-				done := make(chan struct{})
-				os := make(chan os.Signal)
-				ready := make(chan struct{})
+		Context("pool grace period", func() {
+			var done chan struct{}
+			var sigs chan os.Signal
 
+			BeforeEach(func() {
+				c.BigIP.PoolGracePeriod = 1
 				router, err = NewF5Router(logger, c, mw, client)
-				// Set the current port to the max
-				router.tier2VSInfo.holderPort = 65535
+				Expect(err).NotTo(HaveOccurred())
+
+				done = make(chan struct{})
+				sigs = make(chan os.Signal)
+				ready := make(chan struct{})
 
 				go func() {
 					defer GinkgoRecover()
 					Expect(func() {
-						err = router.Run(os, ready)
+						err = router.Run(sigs, ready)
 						Expect(err).NotTo(HaveOccurred())
 						close(done)
 					}).NotTo(Panic())
 				}()
 				Eventually(ready).Should(BeClosed())
+			})
 
-				registerRoutes()
+			AfterEach(func() {
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
+			})
 
-				Eventually(logger).Should(Say("Ran out of available IP addresses."))
-				// Verify the config, we should only see one 2nd tier vip, pool and rule
-				matchConfig(mw, expectedConfigs[6], false)
+			It("should retain an empty pool until the grace period expires", func() {
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", fooEndpoint, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).ShouldNot(BeNil())
+
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", fooEndpoint, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				Eventually(func() int {
+					p := findPool(mw, up.Name())
+					if nil == p {
+						return -1
+					}
+					return len(p.Members)
+				}).Should(Equal(0))
+				Expect(mw.getInput().Resources["cf"].Policies).To(HaveLen(1))
+
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}).Should(BeNil())
+				Expect(mw.getInput().Resources["cf"].Policies).To(BeEmpty())
+			})
+
+			It("should unbind a route whose pool is retained for the grace period", func() {
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", fooEndpoint, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", fooEndpoint, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(logger).Should(Say("f5router-pool-retained"))
 
+				up, err = NewUpdate(logger, routeUpdate.Unbind, "foo.cf.com", nil, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() *bigipResources.Pool {
+					return findPool(mw, up.Name())
+				}, 3*time.Second).Should(BeNil())
 			})
 
+			It("should reuse the pool when a member returns during the grace period", func() {
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", fooEndpoint, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", fooEndpoint, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", barEndpoint, "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+
+				Eventually(logger).Should(Say("f5router-pool-retained"))
+				Consistently(func() []bigipResources.Member {
+					p := findPool(mw, up.Name())
+					if nil == p {
+						return nil
+					}
+					return p.Members
+				}, 2).Should(Equal([]bigipResources.Member{
+					{Address: "127.0.1.1", Port: 80, Session: "user-enabled"},
+				}))
+			})
 		})
-		Context("tcp routing", func() {
-			registerTCP := func() {
-				ups := []tcpPair{
-					{port: 6010, member: bigipResources.Member{Address: "10.0.0.1", Port: 5000, Session: "user-enabled"}},
-					{port: 6010, member: bigipResources.Member{Address: "10.0.0.1", Port: 5001, Session: "user-enabled"}},
-					{port: 6010, member: bigipResources.Member{Address: "10.0.0.1", Port: 5002, Session: "user-enabled"}},
-					{port: 6020, member: bigipResources.Member{Address: "10.0.0.1", Port: 6000, Session: "user-enabled"}},
-					{port: 6030, member: bigipResources.Member{Address: "10.0.0.1", Port: 7000, Session: "user-enabled"}},
-					{port: 6040, member: bigipResources.Member{Address: "10.0.0.1", Port: 8000, Session: "user-enabled"}},
-					{port: 6050, member: bigipResources.Member{Address: "10.0.0.1", Port: 9000, Session: "user-enabled"}},
+
+		Context("member drain", func() {
+			var done chan struct{}
+			var sigs chan os.Signal
+
+			memberRatio := func(name, addr string) int {
+				p := findPool(mw, name)
+				if nil == p {
+					return -1
 				}
-				for _, pair := range ups {
-					up, _ := NewTCPUpdate(c, logger, routeUpdate.Add, pair.port, pair.member)
-					router.UpdateRoute(up)
+				for _, m := range p.Members {
+					if m.Address == addr {
+						return m.Ratio
+					}
 				}
+				return 0
 			}
+
 			BeforeEach(func() {
-				c.RoutingMode = config.TCP
+				c.BigIP.DrainPeriod = 1
+				c.BigIP.LoadBalancingMode = "ratio-member"
 				router, err = NewF5Router(logger, c, mw, client)
+				Expect(err).NotTo(HaveOccurred())
+				sigs, done = runRouter(router)
 
-				done := make(chan struct{})
-				os := make(chan os.Signal)
-				ready := make(chan struct{})
-
-				go func() {
-					defer GinkgoRecover()
-					Expect(func() {
-						err = router.Run(os, ready)
-						Expect(err).NotTo(HaveOccurred())
-						close(done)
-					}).NotTo(Panic())
-				}()
-
+				for _, addr := range []string{"127.0.1.1", "127.0.1.2"} {
+					up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint(addr), "")
+					Expect(err).NotTo(HaveOccurred())
+					router.UpdateRoute(up)
+				}
+				Eventually(func() int {
+					return memberRatio(up.Name(), "127.0.1.2")
+				}).Should(Equal(drainRatio))
 			})
 
-			It("should register tcp routes", func() {
-				registerTCP()
-				matchConfig(mw, expectedConfigs[4], false)
+			AfterEach(func() {
+				sigs <- MockSignal(123)
+				Eventually(done).Should(BeClosed())
 			})
 
-			It("should update tcp routes", func() {
-				registerTCP()
-				matchConfig(mw, expectedConfigs[4], false)
-				// add a pool member to existing pool
-				member := bigipResources.Member{Address: "10.0.0.1", Port: 6001, Session: "user-enabled"}
-				ad, _ := NewTCPUpdate(c, logger, routeUpdate.Add, 6020, member)
-				router.UpdateRoute(ad)
-				// add a new pool - new pool and vs created
-				member = bigipResources.Member{Address: "10.0.0.1", Port: 6000, Session: "user-enabled"}
-				ad2, _ := NewTCPUpdate(c, logger, routeUpdate.Add, 6060, member)
-				router.UpdateRoute(ad2)
-				// remove a pool member with other members left
-				member = bigipResources.Member{Address: "10.0.0.1", Port: 5000, Session: "user-enabled"}
-				rmEP, _ := NewTCPUpdate(c, logger, routeUpdate.Remove, 6010, member)
-				router.UpdateRoute(rmEP)
-				// remove a pool member and none are left - pool and vs is deleted
-				member = bigipResources.Member{Address: "10.0.0.1", Port: 9000, Session: "user-enabled"}
-				rmEP2, _ := NewTCPUpdate(c, logger, routeUpdate.Remove, 6050, member)
-				router.UpdateRoute(rmEP2)
-
-				matchConfig(mw, expectedConfigs[5], false)
+			It("should add a pool without members as it is", func() {
+				// a bind rebuilds a pool retained for its grace period without
+				// members
+				router.lock.Lock()
+				defer router.lock.Unlock()
+				Expect(func() {
+					router.addPool(&bigipResources.Pool{Name: up.Name()})
+					router.addPool(&bigipResources.Pool{Name: "cf-empty"})
+				}).NotTo(Panic())
+				Expect(router.poolResources[up.Name()].Members).To(HaveLen(2))
+				Expect(router.poolResources["cf-empty"].Members).To(BeEmpty())
 			})
 
-			It("should not add the same pool member more than once", func() {
-				registerTCP()
-				matchConfig(mw, expectedConfigs[4], false)
+			It("should lower the ratio of a removed member before deleting it", func() {
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", makeEndpoint("127.0.1.2"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
 
-				member := bigipResources.Member{Address: "10.0.0.1", Port: 5000, Session: "user-enabled"}
-				ad, _ := NewTCPUpdate(c, logger, routeUpdate.Add, 6010, member)
-				router.UpdateRoute(ad)
-				router.UpdateRoute(ad)
-				router.UpdateRoute(ad)
+				Eventually(func() int {
+					return memberRatio(up.Name(), "127.0.1.2")
+				}).Should(BeNumerically("<", drainRatio))
+				Eventually(func() int {
+					return memberRatio(up.Name(), "127.0.1.2")
+				}).Should(Equal(0))
+				Expect(memberRatio(up.Name(), "127.0.1.1")).To(Equal(drainRatio))
+			})
 
-				matchConfig(mw, expectedConfigs[4], false)
+			It("should restore the ratio when a draining member is re-added", func() {
+				up, err = NewUpdate(logger, routeUpdate.Remove, "foo.cf.com", makeEndpoint("127.0.1.2"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(logger).Should(Say("f5router-member-draining"))
 
+				up, err = NewUpdate(logger, routeUpdate.Add, "foo.cf.com", makeEndpoint("127.0.1.2"), "")
+				Expect(err).NotTo(HaveOccurred())
+				router.UpdateRoute(up)
+				Eventually(func() int {
+					return memberRatio(up.Name(), "127.0.1.2")
+				}).Should(Equal(drainRatio))
+				Consistently(func() int {
+					return memberRatio(up.Name(), "127.0.1.2")
+				}, 2).Should(Equal(drainRatio))
 			})
-
 		})
-
 	})
 })
 
@@ -1295,6 +5796,92 @@ func (mw *MockWriter) Write(input []byte) (n int, err error) {
 	return len(input), nil
 }
 
+type unhealthyWriter struct {
+	MockWriter
+}
+
+func (uw *unhealthyWriter) Healthy() error {
+	return errors.New("mock writer unhealthy")
+}
+
+// yamlToJSON converts the maps decoded from YAML to the string keyed maps
+// the JSON encoder expects
+func yamlToJSON(in interface{}) interface{} {
+	switch v := in.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{})
+		for key, value := range v {
+			out[fmt.Sprint(key)] = yamlToJSON(value)
+		}
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = yamlToJSON(v[i])
+		}
+	}
+	return in
+}
+
+type fakeLeader struct {
+	sync.Mutex
+	leader bool
+}
+
+func (fl *fakeLeader) setLeader(leader bool) {
+	fl.Lock()
+	defer fl.Unlock()
+	fl.leader = leader
+}
+
+func (fl *fakeLeader) IsLeader() bool {
+	fl.Lock()
+	defer fl.Unlock()
+	return fl.leader
+}
+
+type failingWriter struct {
+	MockWriter
+	failing bool
+}
+
+func (fw *failingWriter) setFailing(failing bool) {
+	fw.Lock()
+	defer fw.Unlock()
+	fw.failing = failing
+}
+
+func (fw *failingWriter) Write(input []byte) (n int, err error) {
+	fw.Lock()
+	failing := fw.failing
+	fw.Unlock()
+	if failing {
+		return 0, errors.New("mock write failure")
+	}
+	return fw.MockWriter.Write(input)
+}
+
+// overlapWriter records whether two writes were ever in progress at once,
+// writes is unguarded so the race detector also catches unserialized writes
+type overlapWriter struct {
+	active     int32
+	overlapped int32
+	writes     int
+}
+
+func (ow *overlapWriter) GetOutputFilename() string {
+	return "mock-file"
+}
+
+func (ow *overlapWriter) Write(input []byte) (n int, err error) {
+	if atomic.AddInt32(&ow.active, 1) > 1 {
+		atomic.StoreInt32(&ow.overlapped, 1)
+	}
+	time.Sleep(time.Millisecond)
+	ow.writes++
+	atomic.AddInt32(&ow.active, -1)
+	return len(input), nil
+}
+
 func (mw *MockWriter) getInput() *configMatcher {
 	mw.Lock()
 	defer mw.Unlock()
@@ -1322,6 +5909,7 @@ func makeConfig() *config.Config {
 	c.BigIP.Partitions = []string{"cf"}
 	c.BigIP.ExternalAddr = "127.0.0.1"
 	c.BigIP.Tier2IPRange = "10.0.0.1/32"
+	c.BigIP.InstanceID = "test-instance"
 
 	return c
 }
@@ -1493,6 +6081,83 @@ func matchIRules(mw *MockWriter, matcher configMatcher) {
 	)
 }
 
+// runRouter starts the router and waits for it to be ready, send a signal on
+// the returned channel to stop it and wait for done to close
+func runRouter(router *F5Router) (chan os.Signal, chan struct{}) {
+	done := make(chan struct{})
+	sigs := make(chan os.Signal)
+	ready := make(chan struct{})
+
+	go func() {
+		defer GinkgoRecover()
+		Expect(func() {
+			err := router.Run(sigs, ready)
+			Expect(err).NotTo(HaveOccurred())
+			close(done)
+		}).NotTo(Panic())
+	}()
+	EventuallyWithOffset(1, ready).Should(BeClosed())
+	return sigs, done
+}
+
+// firstMatch evaluates the rules in ordinal order the way the BIG-IP policy
+// would for the conditions the router generates
+func firstMatch(rules []*bigipResources.Rule, host, path string) *bigipResources.Rule {
+	sorted := append([]*bigipResources.Rule{}, rules...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Ordinal < sorted[j].Ordinal })
+	segments := strings.Split(path, "/")
+	hostname, port := host, ""
+	if i := strings.LastIndex(host, ":"); -1 != i {
+		hostname, port = host[:i], host[i+1:]
+	}
+
+	for _, rl := range sorted {
+		matched := true
+		for _, c := range rl.Conditions {
+			var subject string
+			switch {
+			case c.HTTPHost && c.Port:
+				subject = port
+			case c.HTTPHost:
+				subject = hostname
+			case c.Path:
+				subject = path
+			case c.PathSegment:
+				if c.Index < len(segments) {
+					subject = segments[c.Index]
+				}
+			}
+			switch {
+			case c.Equals:
+				matched = subject == c.Values[0]
+			case c.StartsWith:
+				matched = strings.HasPrefix(subject, c.Values[0])
+			case c.EndsWith:
+				matched = strings.HasSuffix(subject, c.Values[0])
+			}
+			if !matched {
+				break
+			}
+		}
+		if matched {
+			return rl
+		}
+	}
+	return nil
+}
+
+func findPool(mw *MockWriter, name string) *bigipResources.Pool {
+	if _, ok := mw.getInput().Resources["cf"]; !ok {
+		return nil
+	}
+	for _, pool := range mw.getInput().Resources["cf"].Pools {
+		if pool.Name == name {
+			return pool
+		}
+	}
+	return nil
+}
+
 func createFakeDataGroup() *bigipResources.InternalDataGroup {
 	fake := &bigipResources.InternalDataGroup{
 		Name: "Fake Data",
@@ -1520,3 +6185,20 @@ func createFakeBrokerDataGroup() *bigipResources.InternalDataGroup {
 		},
 	}
 }
+
+type testNameGenerator struct{}
+
+func (testNameGenerator) ObjectName(uri, partition string) string {
+	return "cf-" + partition + "-" + uri
+}
+
+// slowNameGenerator names objects by their URI after a delay, it stalls the
+// worker on the items that name routes
+type slowNameGenerator struct {
+	delay time.Duration
+}
+
+func (g slowNameGenerator) ObjectName(uri, partition string) string {
+	time.Sleep(g.delay)
+	return uri
+}
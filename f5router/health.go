@@ -0,0 +1,94 @@
+/*-
+ * Copyright (c) 2017,2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package f5router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/uber-go/zap"
+)
+
+// Ready returns nil once the router can keep the BIG-IP up to date, the
+// worker must be running and the leader must have written its config
+func (r *F5Router) Ready() error {
+	r.lock.Lock()
+	workerRunning := r.workerRunning
+	leading := nil == r.leader || r.leading
+	written := r.initialConfigWritten || !r.writeStatus.LastWrite.IsZero()
+	lastError := r.writeStatus.LastError
+	r.lock.Unlock()
+
+	if !workerRunning {
+		return errors.New("worker is not running")
+	}
+	// a follower has nothing to write until it becomes the leader
+	if leading && !written {
+		return errors.New("config has not been written")
+	}
+	if 0 != len(lastError) {
+		return fmt.Errorf("last config write failed: %s", lastError)
+	}
+	if r.c.BigIP.ReadyOnHealthyWriter {
+		if err := r.Healthy(); nil != err {
+			return fmt.Errorf("config writer is unhealthy: %v", err)
+		}
+	}
+	return nil
+}
+
+// healthHandler serves the liveness and readiness probes of the controller
+// process, these say nothing about the health of the BIG-IP
+func (r *F5Router) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if err := r.Ready(); nil != err {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// startHealthServer listens on the health port before returning so a port
+// already in use stops Run
+func (r *F5Router) startHealthServer() (*http.Server, error) {
+	addr := net.JoinHostPort("", strconv.Itoa(r.c.BigIP.HealthPort))
+	listener, err := net.Listen("tcp", addr)
+	if nil != err {
+		return nil, fmt.Errorf("failed starting health server: %v", err)
+	}
+	server := &http.Server{Handler: r.healthHandler()}
+	go func() {
+		err := server.Serve(listener)
+		if nil != err && http.ErrServerClosed != err {
+			r.logger.Warn("f5router-health-server-error", zap.Error(err))
+		}
+	}()
+	r.logger.Info("f5router-health-server-started", zap.String("address", addr))
+	return server, nil
+}
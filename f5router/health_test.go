@@ -0,0 +1,136 @@
+/*-
+ * Copyright (c) 2017,2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package f5router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/F5Networks/cf-bigip-ctlr/bigipclient"
+	"github.com/F5Networks/cf-bigip-ctlr/config"
+	"github.com/F5Networks/cf-bigip-ctlr/test_util"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health endpoints", func() {
+	var logger *test_util.TestZapLogger
+	var c *config.Config
+
+	probe := func(r *F5Router, path string) int {
+		rec := httptest.NewRecorder()
+		r.healthHandler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	BeforeEach(func() {
+		logger = test_util.NewTestZapLogger("health-test")
+		c = makeConfig()
+	})
+
+	AfterEach(func() {
+		logger.Close()
+	})
+
+	It("should only be ready while the worker runs", func() {
+		router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(probe(router, "/healthz")).To(Equal(http.StatusOK))
+		Expect(probe(router, "/readyz")).To(Equal(http.StatusServiceUnavailable))
+		Expect(router.Ready()).To(MatchError("worker is not running"))
+
+		sigs, done := runRouter(router)
+		Eventually(router.Ready).Should(Succeed())
+		Expect(probe(router, "/readyz")).To(Equal(http.StatusOK))
+
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+		Expect(router.Ready()).To(MatchError("worker is not running"))
+	})
+
+	It("should not be ready after a failed write", func() {
+		fw := &failingWriter{}
+		router, err := NewF5Router(logger, c, fw, bigipclient.DefaultClient())
+		Expect(err).NotTo(HaveOccurred())
+		sigs, done := runRouter(router)
+		Eventually(router.Ready).Should(Succeed())
+
+		fw.setFailing(true)
+		router.queue.Add(configRetry{})
+		Eventually(router.Ready).Should(MatchError(
+			"last config write failed: failed writing config: mock write failure"))
+		Expect(probe(router, "/readyz")).To(Equal(http.StatusServiceUnavailable))
+
+		fw.setFailing(false)
+		router.queue.Add(configRetry{})
+		Eventually(router.Ready).Should(Succeed())
+
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("should optionally require a healthy writer", func() {
+		router, err := NewF5Router(logger, c, &unhealthyWriter{}, bigipclient.DefaultClient())
+		Expect(err).NotTo(HaveOccurred())
+		sigs, done := runRouter(router)
+		Eventually(router.Ready).Should(Succeed())
+
+		c.BigIP.ReadyOnHealthyWriter = true
+		Expect(router.Ready()).To(MatchError(
+			"config writer is unhealthy: mock writer unhealthy"))
+
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("should serve the probes on the health port", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		c.BigIP.HealthPort = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+		Expect(err).NotTo(HaveOccurred())
+		sigs, done := runRouter(router)
+
+		url := fmt.Sprintf("http://127.0.0.1:%d", c.BigIP.HealthPort)
+		Eventually(func() int {
+			resp, err := http.Get(url + "/readyz")
+			if nil != err {
+				return 0
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}).Should(Equal(http.StatusOK))
+
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+		_, err = http.Get(url + "/healthz")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject an invalid health port", func() {
+		c.BigIP.HealthPort = 70000
+		router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+		Expect(router).To(BeNil())
+		Expect(err).To(MatchError("invalid health_port: 70000"))
+	})
+})
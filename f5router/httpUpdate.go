@@ -19,6 +19,10 @@ package f5router
 import (
 	"errors"
 	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/F5Networks/cf-bigip-ctlr/config"
 	"github.com/F5Networks/cf-bigip-ctlr/f5router/bigipResources"
@@ -30,6 +34,113 @@ import (
 	"github.com/uber-go/zap"
 )
 
+// OneConnectTag is the route tag selecting the OneConnect profile of a route,
+// NoOneConnect turns connection reuse off for the route
+const (
+	OneConnectTag = "f5-oneconnect-profile"
+	NoOneConnect  = "none"
+)
+
+// RequestTimeoutTag and ResponseTimeoutTag replace the request_timeout and
+// response_timeout of a route, in seconds with 0 turning the timeout off
+const (
+	RequestTimeoutTag  = "f5-request-timeout"
+	ResponseTimeoutTag = "f5-response-timeout"
+)
+
+// HeaderNameTag and HeaderValueTag restrict a route to requests carrying the
+// header with the value, so one host can be split between apps by header. The
+// restricted route has its own pool and rule beside the route taking the
+// other requests for the URI
+const (
+	HeaderNameTag  = "f5-header-name"
+	HeaderValueTag = "f5-header-value"
+)
+
+// CookieNameTag and CookieValueTag restrict a route to requests carrying the
+// cookie with the value, so one host can be split between apps by cookie. Like
+// a header restricted route, the route has its own pool and rule
+const (
+	CookieNameTag  = "f5-cookie-name"
+	CookieValueTag = "f5-cookie-value"
+)
+
+// PassthroughTag puts a route on the passthrough virtual, its TLS connections
+// are forwarded to the pool by the SNI server name without being decrypted
+const PassthroughTag = "f5-passthrough"
+
+// PriorityTag is the route tag moving a route's rule ahead of the rules it
+// would otherwise sort behind, rules with a higher priority match first
+const PriorityTag = "f5-route-priority"
+
+// XFFTag is the route tag turning the X-Forwarded-For header of a route on
+// or off, overriding insert_xff
+const XFFTag = "f5-insert-xff"
+
+// SkipPolicyTag is the route tag leaving a route out of the CF routing policy,
+// for routes a custom policy forwards to the route's pool
+const SkipPolicyTag = "f5-skip-routing-policy"
+
+// WildcardWeightsTag splits the requests a wildcard route matches between its
+// own pool and the pools of other routes, e.g. "catchall.cf.com=20" sends 20
+// percent to the catchall.cf.com route and the rest to the wildcard's pool
+const WildcardWeightsTag = "f5-wildcard-weights"
+
+// weightedTarget is a route taking a percentage of a wildcard's requests
+type weightedTarget struct {
+	uri    route.Uri
+	weight int
+}
+
+// AllDownPoolTag and AllDownStatusTag override the all_down_pool and
+// all_down_status fallback of a route, NoAllDownFallback turns it off
+const (
+	AllDownPoolTag    = "f5-all-down-pool"
+	AllDownStatusTag  = "f5-all-down-status"
+	NoAllDownFallback = "none"
+)
+
+// MemberMonitorTag gives the endpoint's pool member its own monitors, a comma
+// separated list of /partition/name, instead of inheriting the pool's
+const MemberMonitorTag = "f5-member-monitor"
+
+// SourceAddressTag restricts a route to clients from a comma separated list of
+// networks in CIDR notation, e.g. "10.0.0.0/8,192.168.1.0/24"
+const SourceAddressTag = "f5-source-address"
+
+// HostMatchTag changes how the host of a route without a wildcard is matched,
+// HostPatternTag replaces the host as the value it is matched against, e.g. a
+// regular expression for the regex match
+const (
+	HostMatchTag   = "f5-host-match"
+	HostPatternTag = "f5-host-pattern"
+)
+
+// PathRegexTag matches the whole request path against a regular expression
+// instead of the route's path
+const PathRegexTag = "f5-path-regex"
+
+// NegateTag inverts conditions of a route's rule, it is a comma separated list
+// of the conditions to negate out of the NegateHost, NegateHeader and
+// NegateSource conditions
+const NegateTag = "f5-negate"
+
+// The conditions NegateTag can negate
+const (
+	NegateHost   = "host"
+	NegateHeader = "header"
+	NegateSource = "source"
+)
+
+// The host matches HostMatchTag accepts, EqualsHostMatch is the default
+const (
+	EqualsHostMatch     = "equals"
+	StartsWithHostMatch = "starts-with"
+	EndsWithHostMatch   = "ends-with"
+	ContainsHostMatch   = "contains"
+	RegexHostMatch      = "regex"
+)
+
 type updateHTTP struct {
 	logger   logger.Logger
 	op       routeUpdate.Operation
@@ -63,34 +174,65 @@ func createResources(
 			Context:   "all",
 		}}
 
+	partition, err := resolvePartition(c, 0)
+	if nil != err {
+		return rs, err
+	}
+
 	if c.SessionPersistence {
-		jsessionPath, err := joinBigipPath(c.BigIP.Partitions[0], bigipResources.JsessionidIRuleName)
+		jsessionPath, err := joinBigipPath(partition, bigipResources.JsessionidIRuleName)
 		if nil != err {
 			return rs, err
 		}
 		iRule = append(iRule, jsessionPath)
 	}
 
-	poolPath, err := joinBigipPath(c.BigIP.Partitions[0], hu.name)
+	request, response, err := hu.timeouts(c)
 	if nil != err {
-		return rs, err
+		hu.logger.Warn("f5router-ignoring-route-timeout", zap.Error(err))
+	}
+	if 0 != request || 0 != response {
+		timeoutsPath, err := joinBigipPath(partition,
+			bigipResources.RouteTimeoutsiRuleName(request, response))
+		if nil != err {
+			return rs, err
+		}
+		iRule = append(iRule, timeoutsPath)
+	}
+
+	poolRef := poolPath(partition, hu.name)
+	if "" == poolRef {
+		return rs, fmt.Errorf("invalid pool path for %s", hu.name)
 	}
 
 	if hu.endpoint != nil {
 		address = hu.endpoint.Address
-		port = hu.endpoint.Port
+		port = memberPort(hu.endpoint.Port, c)
 		description = makeDescription(hu.uri.String(), hu.endpoint.ApplicationId)
 	}
 
 	if address == "" || description == "" {
-		err = errors.New("createResources error: missing endpoint address or description")
-		return rs, err
+		return rs, errors.New("createResources error: missing endpoint address or description")
+	}
+
+	oneConnect := c.BigIP.OneConnectProfile
+	if hu.endpoint != nil {
+		if tag, ok := hu.endpoint.Tags[OneConnectTag]; ok {
+			oneConnect = tag
+		}
+	}
+	if 0 != len(oneConnect) && NoOneConnect != oneConnect {
+		refs, err := generateProfileList([]string{oneConnect}, "all")
+		if nil != err {
+			hu.logger.Warn("skipping-oneconnect-profile-name", zap.Error(err))
+		}
+		profile = append(profile, refs...)
 	}
 
 	vs := &bigipResources.Virtual{
 		VirtualServerName:     hu.name,
-		PoolName:              poolPath,
-		Mode:                  "tcp",
+		PoolName:              poolRef,
+		Mode:                  virtualMode(c, tier2VirtualType),
 		Enabled:               true,
 		Destination:           destination,
 		SourceAddress:         c.BigIP.Tier2IPRange,
@@ -106,6 +248,11 @@ func createResources(
 		Port:    port,
 		Session: "user-enabled",
 	}
+	makeFQDNMember(&member, c)
+	member.Monitor, err = hu.memberMonitor()
+	if nil != err {
+		hu.logger.Warn("f5router-ignoring-member-monitor", zap.Error(err))
+	}
 	pool := makePool(
 		hu.name,
 		description,
@@ -224,7 +371,12 @@ func (hu updateHTTP) CreatePlanResources(c *config.Config, plan planResources.Pl
 
 			// Create custom monitor and attach to pool
 			if plan.Pool.HealthMonitors[i].Type != "" {
-				hmName, err := joinBigipPath(c.BigIP.Partitions[0], name)
+				partition, err := resolvePartition(c, 0)
+				if nil != err {
+					hu.logger.Warn("plan-pool-name-error", zap.Error(err))
+					continue
+				}
+				hmName, err := joinBigipPath(partition, name)
 				if err != nil {
 					hu.logger.Warn("plan-pool-name-error", zap.Error(err))
 				} else {
@@ -233,7 +385,12 @@ func (hu updateHTTP) CreatePlanResources(c *config.Config, plan planResources.Pl
 				}
 			} else {
 				// Monitor already exists on bigip attach name to pool
-				hmNames = append(hmNames, name)
+				refs, err := generateNameList([]string{name})
+				if err != nil {
+					hu.logger.Warn("plan-pool-monitor-name-error", zap.Error(err))
+				} else {
+					hmNames = append(hmNames, fmt.Sprintf("/%s/%s", refs[0].Partition, refs[0].Name))
+				}
 			}
 		}
 		pool.MonitorNames = hmNames
@@ -301,6 +458,352 @@ func (hu updateHTTP) Route() string {
 	return hu.uri.String()
 }
 
+// priority returns the positive priority from the route's tags, 0 when it has
+// none
+func (hu updateHTTP) priority() (int, error) {
+	if nil == hu.endpoint {
+		return 0, nil
+	}
+	tag, ok := hu.endpoint.Tags[PriorityTag]
+	if !ok {
+		return 0, nil
+	}
+	p, err := strconv.Atoi(tag)
+	if nil != err || p <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer, got: %s", PriorityTag, tag)
+	}
+	return p, nil
+}
+
+// insertXFF returns if the route's requests get the X-Forwarded-For header, a
+// tag that does not parse leaves insert_xff in place
+func (hu updateHTTP) insertXFF(c *config.Config) (bool, error) {
+	if nil == hu.endpoint {
+		return c.BigIP.InsertXFF, nil
+	}
+	tag, ok := hu.endpoint.Tags[XFFTag]
+	if !ok {
+		return c.BigIP.InsertXFF, nil
+	}
+	insert, err := strconv.ParseBool(tag)
+	if nil != err {
+		return c.BigIP.InsertXFF, fmt.Errorf("%s must be true or false, got: %s", XFFTag, tag)
+	}
+	return insert, nil
+}
+
+// skipRoutingPolicy is true when the route's rule is left out of the CF
+// routing policy
+func (hu updateHTTP) skipRoutingPolicy() (bool, error) {
+	if nil == hu.endpoint {
+		return false, nil
+	}
+	tag, ok := hu.endpoint.Tags[SkipPolicyTag]
+	if !ok {
+		return false, nil
+	}
+	skip, err := strconv.ParseBool(tag)
+	if nil != err {
+		return false, fmt.Errorf("%s must be true or false, got: %s", SkipPolicyTag, tag)
+	}
+	return skip, nil
+}
+
+// passthrough is true when the route is served by the passthrough virtual
+func (hu updateHTTP) passthrough() (bool, error) {
+	if nil == hu.endpoint {
+		return false, nil
+	}
+	tag, ok := hu.endpoint.Tags[PassthroughTag]
+	if !ok {
+		return false, nil
+	}
+	passthrough, err := strconv.ParseBool(tag)
+	if nil != err {
+		return false, fmt.Errorf("%s must be true or false, got: %s", PassthroughTag, tag)
+	}
+	return passthrough, nil
+}
+
+// memberMonitor returns the monitor rule of the endpoint's member, empty for a
+// member inheriting the monitors of its pool
+func (hu updateHTTP) memberMonitor() (string, error) {
+	if nil == hu.endpoint {
+		return "", nil
+	}
+	tag, ok := hu.endpoint.Tags[MemberMonitorTag]
+	if !ok {
+		return "", nil
+	}
+	var names []string
+	for _, name := range strings.Split(tag, ",") {
+		if name = strings.TrimSpace(name); "" != name {
+			names = append(names, name)
+		}
+	}
+	if 0 == len(names) {
+		return "", fmt.Errorf("%s has no monitors", MemberMonitorTag)
+	}
+	if _, err := generateNameList(names); nil != err {
+		return "", fmt.Errorf("invalid %s: %v", MemberMonitorTag, err)
+	}
+	// the member is only up while all of its monitors are
+	return strings.Join(fixupNames(names), " and "), nil
+}
+
+// sourceAddresses returns the client networks the route is restricted to,
+// nil for a route open to every client
+func (hu updateHTTP) sourceAddresses() ([]string, error) {
+	if nil == hu.endpoint {
+		return nil, nil
+	}
+	tag, ok := hu.endpoint.Tags[SourceAddressTag]
+	if !ok {
+		return nil, nil
+	}
+	var networks []string
+	for _, cidr := range strings.Split(tag, ",") {
+		if cidr = strings.TrimSpace(cidr); "" == cidr {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if nil != err {
+			return nil, fmt.Errorf("invalid %s: %v", SourceAddressTag, err)
+		}
+		networks = append(networks, network.String())
+	}
+	if 0 == len(networks) {
+		return nil, fmt.Errorf("%s has no networks", SourceAddressTag)
+	}
+	return networks, nil
+}
+
+// hostMatch returns how the route's host condition matches and the value it
+// matches against, a tag that does not parse leaves the equals match of host
+func (hu updateHTTP) hostMatch(host string) (string, string, error) {
+	if nil == hu.endpoint {
+		return EqualsHostMatch, host, nil
+	}
+	match, ok := hu.endpoint.Tags[HostMatchTag]
+	if !ok {
+		return EqualsHostMatch, host, nil
+	}
+	value := host
+	if pattern, ok := hu.endpoint.Tags[HostPatternTag]; ok && "" != pattern {
+		value = pattern
+	}
+	switch match {
+	case EqualsHostMatch, StartsWithHostMatch, EndsWithHostMatch, ContainsHostMatch:
+	case RegexHostMatch:
+		if _, err := regexp.Compile(value); nil != err {
+			return EqualsHostMatch, host, fmt.Errorf("invalid %s: %v", HostPatternTag, err)
+		}
+	default:
+		return EqualsHostMatch, host, fmt.Errorf("%s must be %s, %s, %s, %s or %s, got: %s",
+			HostMatchTag, EqualsHostMatch, StartsWithHostMatch, EndsWithHostMatch,
+			ContainsHostMatch, RegexHostMatch, match)
+	}
+	return match, value, nil
+}
+
+// pathRegex returns the regular expression the route's path is matched
+// against, empty for a route matching its own path
+func (hu updateHTTP) pathRegex() (string, error) {
+	if nil == hu.endpoint {
+		return "", nil
+	}
+	regex, ok := hu.endpoint.Tags[PathRegexTag]
+	if !ok {
+		return "", nil
+	}
+	if 0 == len(regex) {
+		return "", fmt.Errorf("%s is empty", PathRegexTag)
+	}
+	if _, err := regexp.Compile(regex); nil != err {
+		return "", fmt.Errorf("invalid %s: %v", PathRegexTag, err)
+	}
+	return regex, nil
+}
+
+// negatedConditions returns the conditions the route's rule negates
+func (hu updateHTTP) negatedConditions() (map[string]bool, error) {
+	if nil == hu.endpoint {
+		return nil, nil
+	}
+	tag, ok := hu.endpoint.Tags[NegateTag]
+	if !ok {
+		return nil, nil
+	}
+	negated := make(map[string]bool)
+	for _, name := range strings.Split(tag, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case NegateHost, NegateHeader, NegateSource:
+			negated[name] = true
+		default:
+			return nil, fmt.Errorf("%s must list %s, %s or %s, got: %s",
+				NegateTag, NegateHost, NegateHeader, NegateSource, name)
+		}
+	}
+	if negated[NegateHost] && strings.Contains(hu.uri.String(), "*") {
+		return nil, fmt.Errorf("%s cannot negate the host of wildcard route %s", NegateTag, hu.uri)
+	}
+	return negated, nil
+}
+
+// allDownFallback returns the pool or status serving the route's requests
+// while its pool has no active members, a tag that does not parse leaves the
+// configured fallback in place
+func (hu updateHTTP) allDownFallback(c *config.Config) (string, int, error) {
+	pool := c.BigIP.AllDownPool
+	status := c.BigIP.AllDownStatus
+	if nil == hu.endpoint {
+		return pool, status, nil
+	}
+	if tag, ok := hu.endpoint.Tags[AllDownPoolTag]; ok {
+		if NoAllDownFallback == tag {
+			return "", 0, nil
+		}
+		if _, err := generateNameList([]string{tag}); nil != err {
+			return pool, status, fmt.Errorf("invalid %s: %v", AllDownPoolTag, err)
+		}
+		return tag, 0, nil
+	}
+	if tag, ok := hu.endpoint.Tags[AllDownStatusTag]; ok {
+		if NoAllDownFallback == tag {
+			return "", 0, nil
+		}
+		s, err := strconv.Atoi(tag)
+		if nil != err || !validStatus(s) {
+			return pool, status, fmt.Errorf("%s must be an HTTP status, got: %s", AllDownStatusTag, tag)
+		}
+		return "", s, nil
+	}
+	return pool, status, nil
+}
+
+// timeouts returns the request and response timeouts of the route, a tag that
+// is not a number of seconds leaves the configured timeout in place
+func (hu updateHTTP) timeouts(c *config.Config) (int, int, error) {
+	request := c.BigIP.RequestTimeout
+	response := c.BigIP.ResponseTimeout
+	if nil == hu.endpoint {
+		return request, response, nil
+	}
+	var errs []string
+	for _, t := range []struct {
+		tag     string
+		timeout *int
+	}{
+		{RequestTimeoutTag, &request},
+		{ResponseTimeoutTag, &response},
+	} {
+		tag, ok := hu.endpoint.Tags[t.tag]
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.Atoi(tag)
+		if nil != err || seconds < 0 {
+			errs = append(errs, fmt.Sprintf("%s must be a number of seconds, got: %s", t.tag, tag))
+			continue
+		}
+		*t.timeout = seconds
+	}
+	if 0 != len(errs) {
+		return request, response, errors.New(strings.Join(errs, ", "))
+	}
+	return request, response, nil
+}
+
+// wildcardWeights returns the routes sharing the requests of a wildcard route
+// in the order of its tag, nil when the route has no weights
+func (hu updateHTTP) wildcardWeights() ([]weightedTarget, error) {
+	if nil == hu.endpoint {
+		return nil, nil
+	}
+	tag, ok := hu.endpoint.Tags[WildcardWeightsTag]
+	if !ok {
+		return nil, nil
+	}
+	if !strings.Contains(hu.uri.String(), "*") {
+		return nil, fmt.Errorf("%s only applies to wildcard routes", WildcardWeightsTag)
+	}
+
+	var targets []weightedTarget
+	total := 0
+	for _, entry := range strings.Split(tag, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), "=")
+		if 2 != len(parts) || 0 == len(parts[0]) {
+			return nil, fmt.Errorf("%s entries must be route=percent, got: %s", WildcardWeightsTag, entry)
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if nil != err || weight <= 0 {
+			return nil, fmt.Errorf("%s percent must be positive, got: %s", WildcardWeightsTag, entry)
+		}
+		target := route.Uri(parts[0]).RouteKey()
+		if target == hu.uri.RouteKey() {
+			return nil, fmt.Errorf("%s must not name the route itself", WildcardWeightsTag)
+		}
+		total += weight
+		targets = append(targets, weightedTarget{uri: target, weight: weight})
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("%s percents add up to more than 100: %d", WildcardWeightsTag, total)
+	}
+	return targets, nil
+}
+
+// headerMatch returns the request header and value the route's tags restrict
+// it to, the name is empty when the route takes any request for its URI
+func (hu updateHTTP) headerMatch() (string, string) {
+	if nil == hu.endpoint {
+		return "", ""
+	}
+	name := hu.endpoint.Tags[HeaderNameTag]
+	value := hu.endpoint.Tags[HeaderValueTag]
+	if 0 == len(name) || 0 == len(value) {
+		return "", ""
+	}
+	return name, value
+}
+
+// variant tells apart the routes of a URI restricted to different requests,
+// it is empty for the route taking every request for its URI
+func (hu updateHTTP) variant() string {
+	var matches []string
+	if name, value := hu.headerMatch(); 0 != len(name) {
+		matches = append(matches, "header:"+name+"="+value)
+	}
+	if name, value := hu.cookieMatch(); 0 != len(name) {
+		matches = append(matches, "cookie:"+name+"="+value)
+	}
+	return strings.Join(matches, "&")
+}
+
+// ruleKey is the key of the route's rule, routes of a URI restricted to
+// different requests each have a rule
+func (hu updateHTTP) ruleKey() route.Uri {
+	if v := hu.variant(); 0 != len(v) {
+		return route.Uri(hu.uri.String() + "#" + v)
+	}
+	return hu.uri
+}
+
+// cookieMatch returns the cookie and value the route is restricted to, both
+// are empty unless the route has both tags
+func (hu updateHTTP) cookieMatch() (string, string) {
+	if nil == hu.endpoint {
+		return "", ""
+	}
+	name := hu.endpoint.Tags[CookieNameTag]
+	value := hu.endpoint.Tags[CookieValueTag]
+	if 0 == len(name) || 0 == len(value) {
+		return "", ""
+	}
+	return name, value
+}
+
 func (hu updateHTTP) PlanID() string {
 	return hu.planID
 }
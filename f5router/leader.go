@@ -0,0 +1,83 @@
+/*-
+ * Copyright (c) 2017,2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package f5router
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Leader decides if this controller instance writes the config, followers
+// keep tracking routes but leave the BIG-IP to the leader
+type Leader interface {
+	IsLeader() bool
+}
+
+// LeaderReleaser is implemented by leaders which can give up leadership, the
+// router releases them when it stops so another instance takes over at once
+type LeaderReleaser interface {
+	Release() error
+}
+
+// FileLeader holds leadership for as long as it holds an exclusive lock on a
+// file shared by the controller instances
+type FileLeader struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+// NewFileLeader creates a FileLeader competing for the lock on path
+func NewFileLeader(path string) *FileLeader {
+	return &FileLeader{path: path}
+}
+
+// IsLeader tries to take the lock if it is not already held
+func (l *FileLeader) IsLeader() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if nil != l.file {
+		return true
+	}
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if nil != err {
+		return false
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if nil != err {
+		f.Close()
+		return false
+	}
+	l.file = f
+	return true
+}
+
+// Release gives up leadership so another instance can take the lock
+func (l *FileLeader) Release() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if nil == l.file {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,82 @@
+/*-
+ * Copyright (c) 2017,2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package f5router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/F5Networks/cf-bigip-ctlr/bigipclient"
+	"github.com/F5Networks/cf-bigip-ctlr/test_util"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileLeader", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "leader")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should only let one instance hold the lock", func() {
+		path := filepath.Join(dir, "leader.lock")
+		first := NewFileLeader(path)
+		second := NewFileLeader(path)
+
+		Expect(first.IsLeader()).To(BeTrue())
+		Expect(first.IsLeader()).To(BeTrue())
+		Expect(second.IsLeader()).To(BeFalse())
+
+		Expect(first.Release()).To(Succeed())
+		Expect(second.IsLeader()).To(BeTrue())
+		Expect(first.IsLeader()).To(BeFalse())
+		Expect(second.Release()).To(Succeed())
+	})
+
+	It("should be released when the router stops", func() {
+		c := makeConfig()
+		c.BigIP.LeaderElection = true
+		c.BigIP.LeaderLockFile = filepath.Join(dir, "leader.lock")
+		logger := test_util.NewTestZapLogger("leader-test")
+		router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+		Expect(err).NotTo(HaveOccurred())
+		sigs, done := runRouter(router)
+
+		other := NewFileLeader(c.BigIP.LeaderLockFile)
+		Expect(other.IsLeader()).To(BeFalse())
+
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+		Expect(other.IsLeader()).To(BeTrue())
+		Expect(other.Release()).To(Succeed())
+	})
+
+	It("should not lead without a lock file", func() {
+		l := NewFileLeader(filepath.Join(dir, "missing", "leader.lock"))
+		Expect(l.IsLeader()).To(BeFalse())
+		Expect(l.Release()).To(Succeed())
+	})
+})
@@ -0,0 +1,254 @@
+/*-
+ * Copyright (c) 2017,2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package f5router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/F5Networks/cf-bigip-ctlr/f5router/bigipResources"
+	"github.com/F5Networks/cf-bigip-ctlr/route"
+
+	"github.com/uber-go/zap"
+)
+
+// snapshotVersion changes whenever the snapshot format does, a snapshot of
+// another version is ignored
+const snapshotVersion = 1
+
+// defaultSnapshotGracePeriod is how long, in seconds, the members loaded from a
+// snapshot have to register again before they are removed
+const defaultSnapshotGracePeriod = 120
+
+// The rule maps a snapshot rule is loaded into
+const (
+	exactSnapshotRules    = "exact"
+	wildcardSnapshotRules = "wildcard"
+	redirectSnapshotRules = "redirect"
+)
+
+// snapshot is the state the router writes its config from. It is saved after
+// every successful write so a restarted router can write the same config
+// before the routes register again
+type snapshot struct {
+	Version  int                                  `json:"version"`
+	Pools    map[string]*bigipResources.Pool      `json:"pools"`
+	Virtuals map[string]*bigipResources.Virtual   `json:"virtuals"`
+	Monitors map[string][]*bigipResources.Monitor `json:"monitors"`
+	Rules    []snapshotRule                       `json:"rules"`
+	// Tier2Addresses are the records of the internal data group, the
+	// addresses of the tier2 virtuals
+	Tier2Addresses    map[string]*bigipResources.InternalDataGroupRecord `json:"tier2Addresses"`
+	DedicatedVirtuals map[string]bigipResources.VirtualAddress           `json:"dedicatedVirtuals"`
+}
+
+// snapshotRule is a policy rule with the map it is kept in and the fields the
+// config leaves out
+type snapshotRule struct {
+	Map      string               `json:"map"`
+	URI      route.Uri            `json:"uri"`
+	FullURI  string               `json:"fullUri"`
+	Priority int                  `json:"priority"`
+	Pool     string               `json:"pool"`
+	Rule     *bigipResources.Rule `json:"rule"`
+}
+
+// primedMember is a pool member loaded from a snapshot which has not
+// registered since
+type primedMember struct {
+	pool   string
+	member bigipResources.Member
+}
+
+// snapshotExpiry is queued when a snapshot is loaded, it removes the members
+// which did not register again within the grace period
+type snapshotExpiry struct{}
+
+func (r *F5Router) snapshotGracePeriod() time.Duration {
+	return time.Duration(r.c.BigIP.SnapshotGracePeriod) * time.Second
+}
+
+// saveSnapshot writes the state to snapshot_file, it is written next to the
+// file and renamed over it so a crash never leaves half a snapshot
+func (r *F5Router) saveSnapshot() error {
+	path := r.c.BigIP.SnapshotFile
+	if 0 == len(path) {
+		return nil
+	}
+
+	s := snapshot{
+		Version:           snapshotVersion,
+		Pools:             r.poolResources,
+		Virtuals:          r.virtualResources,
+		Monitors:          r.monitorResources,
+		Tier2Addresses:    r.internalDataGroup,
+		DedicatedVirtuals: r.dedicatedVirtuals,
+	}
+	for _, rules := range []struct {
+		name  string
+		rules bigipResources.RuleMap
+	}{
+		{exactSnapshotRules, r.r},
+		{wildcardSnapshotRules, r.wildcards},
+		{redirectSnapshotRules, r.redirects},
+	} {
+		for uri, rule := range rules.rules {
+			s.Rules = append(s.Rules, snapshotRule{
+				Map:      rules.name,
+				URI:      uri,
+				FullURI:  rule.FullURI,
+				Priority: rule.Priority,
+				Pool:     rule.Pool,
+				Rule:     rule,
+			})
+		}
+	}
+	sort.Slice(s.Rules, func(i, j int) bool {
+		if s.Rules[i].Map != s.Rules[j].Map {
+			return s.Rules[i].Map < s.Rules[j].Map
+		}
+		return s.Rules[i].URI < s.Rules[j].URI
+	})
+
+	data, err := json.Marshal(s)
+	if nil != err {
+		return fmt.Errorf("failed marshaling snapshot: %v", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if nil != err {
+		return fmt.Errorf("failed creating snapshot: %v", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(f.Name(), path)
+	}
+	if nil != err {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed writing snapshot: %v", err)
+	}
+	return nil
+}
+
+// loadSnapshot primes the state from snapshot_file, a missing file is not an
+// error. Tier2 addresses read from the BIG-IP win over the snapshot's
+func (r *F5Router) loadSnapshot() error {
+	path := r.c.BigIP.SnapshotFile
+	if 0 == len(path) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if nil != err {
+		return fmt.Errorf("failed reading snapshot: %v", err)
+	}
+	var s snapshot
+	if err = json.Unmarshal(data, &s); nil != err {
+		return fmt.Errorf("failed parsing snapshot %s: %v", path, err)
+	}
+	if snapshotVersion != s.Version {
+		return fmt.Errorf("snapshot %s has version %d, expected %d", path, s.Version, snapshotVersion)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for name, record := range s.Tier2Addresses {
+		if _, ok := r.internalDataGroup[name]; ok {
+			continue
+		}
+		va, err := record.ReturnTier2VirtualAddress()
+		if nil != err {
+			continue
+		}
+		if _, used := r.tier2VSInfo.usedPorts[va.String()]; used {
+			continue
+		}
+		r.tier2VSInfo.usedPorts[va.String()] = va
+		r.internalDataGroup[name] = record
+	}
+	// the routing virtuals are already built from the config
+	for name, vs := range s.Virtuals {
+		if _, ok := r.virtualResources[name]; !ok {
+			r.virtualResources[name] = vs
+		}
+	}
+	for name, pool := range s.Pools {
+		r.poolResources[name] = pool
+		for _, m := range pool.Members {
+			r.primedMembers[memberKey(name, m)] = primedMember{pool: name, member: m}
+		}
+	}
+	for name, monitors := range s.Monitors {
+		r.monitorResources[name] = monitors
+	}
+	for name, va := range s.DedicatedVirtuals {
+		r.dedicatedVirtuals[name] = va
+	}
+	for _, sr := range s.Rules {
+		if nil == sr.Rule {
+			continue
+		}
+		rule := sr.Rule
+		rule.FullURI = sr.FullURI
+		rule.Priority = sr.Priority
+		rule.Pool = sr.Pool
+		switch sr.Map {
+		case exactSnapshotRules:
+			r.r[sr.URI] = rule
+		case wildcardSnapshotRules:
+			r.wildcards[sr.URI] = rule
+		case redirectSnapshotRules:
+			r.redirects[sr.URI] = rule
+		}
+	}
+	r.reportRuleStats()
+
+	r.logger.Info("f5router-snapshot-loaded",
+		zap.String("path", path),
+		zap.Int("number-pools", len(s.Pools)),
+		zap.Int("number-rules", len(s.Rules)),
+	)
+	return nil
+}
+
+// processSnapshotExpiry removes the members of the snapshot which have not
+// registered again, a pool left empty goes with its rules and virtual
+func (r *F5Router) processSnapshotExpiry() {
+	expired := 0
+	for key, p := range r.primedMembers {
+		delete(r.primedMembers, key)
+		if nil == r.findMember(p.pool, p.member) {
+			continue
+		}
+		r.processPoolEndpointRemove(poolEndpointRemove{
+			name:    p.pool,
+			address: p.member.Address,
+			port:    p.member.Port,
+		})
+		expired++
+	}
+	r.logger.Info("f5router-snapshot-members-expired", zap.Int("members", expired))
+}
@@ -0,0 +1,205 @@
+/*-
+ * Copyright (c) 2017,2018, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package f5router
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/F5Networks/cf-bigip-ctlr/bigipclient"
+	"github.com/F5Networks/cf-bigip-ctlr/config"
+	"github.com/F5Networks/cf-bigip-ctlr/f5router/bigipResources"
+	"github.com/F5Networks/cf-bigip-ctlr/f5router/routeUpdate"
+	fakeMetrics "github.com/F5Networks/cf-bigip-ctlr/metrics/fakes"
+	"github.com/F5Networks/cf-bigip-ctlr/route"
+	"github.com/F5Networks/cf-bigip-ctlr/test_util"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Snapshot", func() {
+	var dir string
+	var c *config.Config
+	var logger *test_util.TestZapLogger
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "snapshot")
+		Expect(err).NotTo(HaveOccurred())
+		logger = test_util.NewTestZapLogger("snapshot-test")
+		c = makeConfig()
+		c.BigIP.SnapshotFile = filepath.Join(dir, "snapshot.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newRouter := func(mw *MockWriter) *F5Router {
+		router, err := NewF5Router(logger, c, mw, bigipclient.DefaultClient())
+		Expect(err).NotTo(HaveOccurred())
+		return router
+	}
+	addRoute := func(router *F5Router, uri, addr string) updateHTTP {
+		ep := makeEndpoint(addr)
+		ep.Tags = map[string]string{SourceAddressTag: "10.0.0.0/8"}
+		up, err := NewUpdate(logger, routeUpdate.Add, route.Uri(uri), ep, "")
+		Expect(err).NotTo(HaveOccurred())
+		router.UpdateRoute(up)
+		return up
+	}
+	members := func(mw *MockWriter, name string) func() []bigipResources.Member {
+		return func() []bigipResources.Member {
+			if pool := findPool(mw, name); nil != pool {
+				return pool.Members
+			}
+			return nil
+		}
+	}
+
+	It("should write the last config again after a restart", func() {
+		mw := &MockWriter{}
+		router := newRouter(mw)
+		sigs, done := runRouter(router)
+		foo := addRoute(router, "foo.cf.com/app", "127.0.0.1")
+		addRoute(router, "foo.cf.com/app", "127.0.0.2")
+		bar := addRoute(router, "*.bar.cf.com", "127.0.0.3")
+		Eventually(members(mw, foo.Name())).Should(HaveLen(2))
+		Eventually(members(mw, bar.Name())).Should(HaveLen(1))
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+		written := mw.getInput().Resources["cf"]
+
+		data, err := ioutil.ReadFile(c.BigIP.SnapshotFile)
+		Expect(err).NotTo(HaveOccurred())
+		var s snapshot
+		Expect(json.Unmarshal(data, &s)).To(Succeed())
+		Expect(s.Version).To(Equal(snapshotVersion))
+		Expect(s.Pools).To(HaveKey(foo.Name()))
+		// the rules keep the fields their JSON leaves out beside them
+		Expect(s.Rules).To(HaveLen(2))
+		wildcard := s.Rules[1]
+		Expect(wildcard.Map).To(Equal(wildcardSnapshotRules))
+		Expect(wildcard.URI).To(Equal(route.Uri("*.bar.cf.com")))
+		Expect(wildcard.FullURI).To(Equal("*.bar.cf.com"))
+		Expect(wildcard.Pool).To(Equal(bar.Name()))
+		Expect(wildcard.Rule.Conditions).To(Equal(router.wildcards["*.bar.cf.com"].Conditions))
+
+		// the restarted router writes the same resources before any route
+		// registers again
+		c.BigIP.SnapshotGracePeriod = 1
+		mw = &MockWriter{}
+		router = newRouter(mw)
+		reporter := &fakeMetrics.FakeRouterReporter{}
+		router.SetReporter(reporter)
+		sigs, done = runRouter(router)
+		Eventually(members(mw, bar.Name())).Should(HaveLen(1))
+		Expect(reporter.CaptureRuleStatsCallCount()).NotTo(BeZero())
+		// the restored rules are counted before any route registers again
+		exact, wildcards := reporter.CaptureRuleStatsArgsForCall(0)
+		Expect(exact).To(Equal(1))
+		Expect(wildcards).To(Equal(1))
+		restored := mw.getInput().Resources["cf"]
+		Expect(restored.Pools).To(ConsistOf(written.Pools))
+		Expect(restored.Virtuals).To(ConsistOf(written.Virtuals))
+		Expect(restored.Policies).To(Equal(written.Policies))
+
+		// members which do not register again within the grace period are
+		// removed, with the routes left without members
+		addRoute(router, "foo.cf.com/app", "127.0.0.2")
+		Eventually(members(mw, foo.Name()), "5s").Should(Equal([]bigipResources.Member{
+			{Address: "127.0.0.2", Port: 80, Session: "user-enabled"},
+		}))
+		Expect(findPool(mw, bar.Name())).To(BeNil())
+		Expect(logger).To(Say(`f5router-snapshot-members-expired.*"members":2`))
+		router.lock.Lock()
+		Expect(router.wildcards).To(BeEmpty())
+		Expect(router.r).To(HaveLen(1))
+		router.lock.Unlock()
+
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("should start empty from a snapshot it cannot use", func() {
+		Expect(ioutil.WriteFile(c.BigIP.SnapshotFile, []byte(`{"version": 0}`), 0644)).To(Succeed())
+		router := newRouter(&MockWriter{})
+		sigs, done := runRouter(router)
+		Eventually(logger).Should(Say("f5router-ignoring-snapshot.*has version 0, expected 1"))
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+
+		Expect(ioutil.WriteFile(c.BigIP.SnapshotFile, []byte(`{`), 0644)).To(Succeed())
+		router = newRouter(&MockWriter{})
+		Expect(router.loadSnapshot()).To(MatchError(ContainSubstring("failed parsing snapshot")))
+		Expect(router.poolResources).To(BeEmpty())
+
+		// no snapshot yet is not an error
+		Expect(os.Remove(c.BigIP.SnapshotFile)).To(Succeed())
+		Expect(router.loadSnapshot()).To(Succeed())
+	})
+
+	It("should remove the controller's objects on shutdown", func() {
+		c.BigIP.CleanupOnShutdown = true
+		c.BigIP.CleanupWait = 0
+		mw := &MockWriter{}
+		router := newRouter(mw)
+		sigs, done := runRouter(router)
+		foo := addRoute(router, "foo.cf.com/app", "127.0.0.1")
+		Eventually(members(mw, foo.Name())).Should(HaveLen(1))
+		Eventually(func() string { return c.BigIP.SnapshotFile }).Should(BeAnExistingFile())
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+
+		Expect(logger).To(Say("f5router-cleanup-written"))
+		cleanup := mw.getInput()
+		Expect(cleanup.Resources).To(HaveKey("cf"))
+		Expect(cleanup.Resources["cf"].Pools).To(BeEmpty())
+		Expect(cleanup.Resources["cf"].Virtuals).To(BeEmpty())
+		Expect(cleanup.Resources["cf"].Policies).To(BeEmpty())
+		Expect(c.BigIP.SnapshotFile).NotTo(BeAnExistingFile())
+
+		// a follower leaves the objects to the leader
+		fl := &fakeLeader{}
+		mw = &MockWriter{}
+		router = newRouter(mw)
+		router.SetLeader(fl)
+		sigs, done = runRouter(router)
+		sigs <- MockSignal(123)
+		Eventually(done).Should(BeClosed())
+		Expect(logger).To(Say("f5router-follower-skipping-cleanup"))
+		Expect(mw.getInput().Resources).To(BeEmpty())
+	})
+
+	It("should reject a negative cleanup wait", func() {
+		c.BigIP.CleanupWait = -1
+		router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+		Expect(router).To(BeNil())
+		Expect(err).To(MatchError("cleanup_wait must not be negative: -1"))
+	})
+
+	It("should reject a negative grace period", func() {
+		c.BigIP.SnapshotGracePeriod = -1
+		router, err := NewF5Router(logger, c, &MockWriter{}, bigipclient.DefaultClient())
+		Expect(router).To(BeNil())
+		Expect(err).To(MatchError("snapshot_grace_period must not be negative: -1"))
+	})
+})
@@ -63,14 +63,20 @@ func (tu updateTCP) CreateResources(c *config.Config) (bigipResources.Resources,
 		Port:     int32(tu.routePort),
 	}
 
-	dest, err := verifyDestAddress(va, tu.c.BigIP.Partitions[0])
+	partition, err := resolvePartition(c, 0)
+	if nil != err {
+		return rs, err
+	}
+	dest, err := verifyDestAddress(va, partition)
 	if err != nil {
 		return rs, err
 	}
 
 	// FIXME need to handle multiple tcp router groups
 	poolDescrip := fmt.Sprintf("route-port: %d, router-group: %s", tu.routePort, c.TCPRouterGroupName)
-	pool := makePool(tu.name, poolDescrip, []bigipResources.Member{tu.member}, c.BigIP.LoadBalancingMode,
+	member := tu.member
+	makeFQDNMember(&member, c)
+	pool := makePool(tu.name, poolDescrip, []bigipResources.Member{member}, c.BigIP.LoadBalancingMode,
 		fixupNames(c.BigIP.HealthMonitors))
 	rs.Pools = append(rs.Pools, pool)
 
@@ -81,20 +87,30 @@ func (tu updateTCP) CreateResources(c *config.Config) (bigipResources.Resources,
 			Context:   "all",
 		}}
 
-	poolPath, err := joinBigipPath(c.BigIP.Partitions[0], tu.name)
-	if nil != err {
-		return bigipResources.Resources{}, err
+	poolRef := poolPath(partition, tu.name)
+	if "" == poolRef {
+		return bigipResources.Resources{}, fmt.Errorf("invalid pool path for %s", tu.name)
 	}
 
 	vs := &bigipResources.Virtual{
 		VirtualServerName:     tu.name,
-		PoolName:              poolPath,
-		Mode:                  "tcp",
+		PoolName:              poolRef,
+		Mode:                  virtualMode(c, tcpVirtualType),
 		Enabled:               true,
 		Destination:           dest,
 		Profiles:              profile,
 		SourceAddrTranslation: bigipResources.SourceAddrTranslation{Type: "automap"},
 	}
+	// mirroring keeps the TCP connections through a failover
+	if c.BigIP.ConnectionMirroring {
+		vs.Mirror = "enabled"
+	}
+	setAutoLastHop(vs, c)
+	// the names were validated with the config
+	err = restrictVLANs(vs, c.BigIP.VLANs)
+	if nil != err {
+		return rs, err
+	}
 
 	if nil != vs {
 		rs.Virtuals = append(rs.Virtuals, vs)
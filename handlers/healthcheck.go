@@ -9,10 +9,13 @@ import (
 	"sync/atomic"
 
 	"github.com/F5Networks/cf-bigip-ctlr/logger"
+
+	"github.com/uber-go/zap"
 )
 
 type healthcheck struct {
 	heartbeatOK *int32
+	check       func() error
 	logger      logger.Logger
 }
 
@@ -23,6 +26,16 @@ func NewHealthcheck(heartbeatOK *int32, logger logger.Logger) http.Handler {
 	}
 }
 
+// NewCheckedHealthcheck reports unhealthy when the check fails as well as
+// while draining
+func NewCheckedHealthcheck(heartbeatOK *int32, check func() error, logger logger.Logger) http.Handler {
+	return &healthcheck{
+		heartbeatOK: heartbeatOK,
+		check:       check,
+		logger:      logger,
+	}
+}
+
 func (h *healthcheck) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	rw.Header().Set("Cache-Control", "private, max-age=0")
@@ -35,6 +48,15 @@ func (h *healthcheck) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if nil != h.check {
+		if err := h.check(); nil != err {
+			h.logger.Warn("healthcheck-failed", zap.Error(err))
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			r.Close = true
+			return
+		}
+	}
+
 	rw.WriteHeader(http.StatusOK)
 	rw.Write([]byte("ok\n"))
 	r.Close = true
@@ -5,6 +5,7 @@
 package handlers_test
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -70,4 +71,27 @@ var _ = Describe("Healthcheck", func() {
 			Expect(resp.Header().Get("Expires")).To(Equal("0"))
 		})
 	})
+
+	Context("when a health check is provided", func() {
+		var checkErr error
+
+		BeforeEach(func() {
+			checkErr = nil
+			handler = handlers.NewCheckedHealthcheck(&heartbeatOK, func() error {
+				return checkErr
+			}, logger)
+		})
+
+		It("responds with 200 OK while the check passes", func() {
+			handler.ServeHTTP(resp, req)
+			Expect(resp.Code).To(Equal(200))
+		})
+
+		It("responds with a 503 Service Unavailable when the check fails", func() {
+			checkErr = errors.New("config writer target not writable")
+			handler.ServeHTTP(resp, req)
+			Expect(resp.Code).To(Equal(503))
+			Expect(req.Close).To(BeTrue())
+		})
+	})
 })
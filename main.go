@@ -141,12 +141,23 @@ func main() {
 		writer.Close()
 	}()
 
+	// the driver reads the temporary file, the copies are for auditing
+	var routerWriter f5router.Writer = writer
+	if 0 != len(c.BigIP.ConfigCopies) {
+		var copies []f5router.Writer
+		for _, path := range c.BigIP.ConfigCopies {
+			copies = append(copies, f5router.NewFileConfigWriter(logger.Session("f5writer"), path))
+		}
+		routerWriter = f5router.NewMultiWriter(logger.Session("f5writer"), writer, copies...)
+	}
+
 	bigIPClient := bigipclient.DefaultClient()
 
-	f5Router, err := f5router.NewF5Router(logger.Session("f5router"), c, writer, bigIPClient)
+	f5Router, err := f5router.NewF5Router(logger.Session("f5router"), c, routerWriter, bigIPClient)
 	if nil != err {
 		logger.Fatal("f5router-failed-initialization", zap.Error(err))
 	}
+	f5Router.SetReporter(metricsReporter)
 
 	var dp string
 	if 0 != len(c.BigIP.DriverCmd) {
@@ -228,6 +239,7 @@ func main() {
 		registry,
 		routingTable,
 		varz,
+		f5Router,
 		brokerHandler,
 	)
 	if nil != err {
@@ -236,8 +248,15 @@ func main() {
 
 	// controller handles StartResponseDelayInterval - start it before configuration ops
 	members = append(members, grouper.Member{Name: "controller", Runner: controller})
-	members = append(members, grouper.Member{Name: "f5router", Runner: f5Router})
-	members = append(members, grouper.Member{Name: "f5driver", Runner: driver})
+	// members stop in reverse order, the driver has to outlive the router to
+	// apply the cleanup config
+	if c.BigIP.CleanupOnShutdown {
+		members = append(members, grouper.Member{Name: "f5driver", Runner: driver})
+		members = append(members, grouper.Member{Name: "f5router", Runner: f5Router})
+	} else {
+		members = append(members, grouper.Member{Name: "f5router", Runner: f5Router})
+		members = append(members, grouper.Member{Name: "f5driver", Runner: driver})
+	}
 
 	group := grouper.NewOrdered(os.Interrupt, members)
 
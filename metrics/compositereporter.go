@@ -45,6 +45,12 @@ type RouteRegistryReporter interface {
 	CaptureUnregistryMessage(msg ComponentTagged)
 }
 
+//go:generate counterfeiter -o fakes/fake_router_reporter.go . RouterReporter
+type RouterReporter interface {
+	CaptureRuleStats(exactRules, wildcardRules int)
+	CaptureUnsupportedWorkItem()
+}
+
 //go:generate counterfeiter -o fakes/fake_combinedreporter.go . CombinedReporter
 type CombinedReporter interface {
 	CaptureBadRequest()
@@ -0,0 +1,61 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+
+	"github.com/F5Networks/cf-bigip-ctlr/metrics"
+)
+
+type FakeRouterReporter struct {
+	CaptureRuleStatsStub        func(exactRules, wildcardRules int)
+	captureRuleStatsMutex       sync.RWMutex
+	captureRuleStatsArgsForCall []struct {
+		exactRules    int
+		wildcardRules int
+	}
+	CaptureUnsupportedWorkItemStub        func()
+	captureUnsupportedWorkItemMutex       sync.RWMutex
+	captureUnsupportedWorkItemArgsForCall []struct{}
+}
+
+func (fake *FakeRouterReporter) CaptureRuleStats(exactRules int, wildcardRules int) {
+	fake.captureRuleStatsMutex.Lock()
+	fake.captureRuleStatsArgsForCall = append(fake.captureRuleStatsArgsForCall, struct {
+		exactRules    int
+		wildcardRules int
+	}{exactRules, wildcardRules})
+	fake.captureRuleStatsMutex.Unlock()
+	if fake.CaptureRuleStatsStub != nil {
+		fake.CaptureRuleStatsStub(exactRules, wildcardRules)
+	}
+}
+
+func (fake *FakeRouterReporter) CaptureRuleStatsCallCount() int {
+	fake.captureRuleStatsMutex.RLock()
+	defer fake.captureRuleStatsMutex.RUnlock()
+	return len(fake.captureRuleStatsArgsForCall)
+}
+
+func (fake *FakeRouterReporter) CaptureRuleStatsArgsForCall(i int) (int, int) {
+	fake.captureRuleStatsMutex.RLock()
+	defer fake.captureRuleStatsMutex.RUnlock()
+	return fake.captureRuleStatsArgsForCall[i].exactRules, fake.captureRuleStatsArgsForCall[i].wildcardRules
+}
+
+func (fake *FakeRouterReporter) CaptureUnsupportedWorkItem() {
+	fake.captureUnsupportedWorkItemMutex.Lock()
+	fake.captureUnsupportedWorkItemArgsForCall = append(fake.captureUnsupportedWorkItemArgsForCall, struct{}{})
+	fake.captureUnsupportedWorkItemMutex.Unlock()
+	if fake.CaptureUnsupportedWorkItemStub != nil {
+		fake.CaptureUnsupportedWorkItemStub()
+	}
+}
+
+func (fake *FakeRouterReporter) CaptureUnsupportedWorkItemCallCount() int {
+	fake.captureUnsupportedWorkItemMutex.RLock()
+	defer fake.captureUnsupportedWorkItemMutex.RUnlock()
+	return len(fake.captureUnsupportedWorkItemArgsForCall)
+}
+
+var _ metrics.RouterReporter = new(FakeRouterReporter)
@@ -82,6 +82,15 @@ func (m *MetricsReporter) CaptureRouteStats(totalRoutes int, msSinceLastUpdate u
 	m.sender.SendValue("ms_since_last_registry_update", float64(msSinceLastUpdate), "ms")
 }
 
+func (m *MetricsReporter) CaptureRuleStats(exactRules, wildcardRules int) {
+	m.sender.SendValue("f5router_exact_rules", float64(exactRules), "")
+	m.sender.SendValue("f5router_wildcard_rules", float64(wildcardRules), "")
+}
+
+func (m *MetricsReporter) CaptureUnsupportedWorkItem() {
+	m.sender.IncrementCounter("f5router_unsupported_work_items")
+}
+
 func (m *MetricsReporter) CaptureRegistryMessage(msg ComponentTagged) {
 	var componentName string
 	if msg.Component() == "" {
@@ -353,6 +353,27 @@ var _ = Describe("MetricsReporter", func() {
 			Expect(unit).To(Equal("ms"))
 		})
 
+		It("sends the exact and wildcard rule counts", func() {
+			metricReporter.CaptureRuleStats(7, 3)
+
+			Expect(sender.SendValueCallCount()).To(Equal(2))
+			name, value, unit := sender.SendValueArgsForCall(0)
+			Expect(name).To(Equal("f5router_exact_rules"))
+			Expect(value).To(BeEquivalentTo(7))
+			Expect(unit).To(Equal(""))
+			name, value, unit = sender.SendValueArgsForCall(1)
+			Expect(name).To(Equal("f5router_wildcard_rules"))
+			Expect(value).To(BeEquivalentTo(3))
+			Expect(unit).To(Equal(""))
+		})
+
+		It("increments the unsupported work item counter", func() {
+			metricReporter.CaptureUnsupportedWorkItem()
+
+			Expect(sender.IncrementCounterCallCount()).To(Equal(1))
+			Expect(sender.IncrementCounterArgsForCall(0)).To(Equal("f5router_unsupported_work_items"))
+		})
+
 		It("sends the lookup time for routing table", func() {
 			metricReporter.CaptureLookupTime(time.Duration(9) * time.Second)
 